@@ -1,2 +1,2 @@
 #!/bin/sh
-CC=x86_64-linux-musl-gcc CXX=x86_64-linux-musl-g++ GOARCH=amd64 GOOS=linux CGO_ENABLED=1 go build -ldflags "-linkmode external -extldflags -static"
\ No newline at end of file
+CC=x86_64-linux-musl-gcc CXX=x86_64-linux-musl-g++ GOARCH=amd64 GOOS=linux CGO_ENABLED=1 go build -ldflags "-linkmode external -extldflags -static -X github.com/critizr/gaia-responses-importer/pkg/importer.Version=$(git describe --tags --always --dirty)"
\ No newline at end of file
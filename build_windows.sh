@@ -0,0 +1,2 @@
+#!/bin/sh
+CC=x86_64-w64-mingw32-gcc CXX=x86_64-w64-mingw32-g++ GOARCH=amd64 GOOS=windows CGO_ENABLED=1 go build -ldflags "-extldflags -static -X github.com/critizr/gaia-responses-importer/pkg/importer.Version=$(git describe --tags --always --dirty)" -o gaia-responses-importer.exe
@@ -2,4 +2,12 @@ module github.com/critizr/gaia-responses-importer
 
 go 1.14
 
-require github.com/mattn/go-sqlite3 v2.0.3+incompatible
+require (
+	github.com/go-sql-driver/mysql v1.7.1
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v2.0.3+incompatible
+	github.com/segmentio/kafka-go v0.4.47
+	golang.org/x/term v0.13.0
+	golang.org/x/text v0.13.0
+	gopkg.in/yaml.v2 v2.4.0
+)
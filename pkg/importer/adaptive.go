@@ -0,0 +1,132 @@
+package importer
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	argAdaptive         = Flags.Bool("adaptive", false, "tune concurrency between -adaptive-min and -j from API latency and errors")
+	argAdaptiveMin      = Flags.Int("adaptive-min", 1, "minimum concurrency in adaptive mode")
+	argAdaptiveInterval = Flags.Duration("adaptive-interval", 5*time.Second, "interval between two concurrency adjustments in adaptive mode")
+)
+
+// tuner adjusts the number of tokens available in the semaphore of the
+// workers, AIMD-style: one more worker after each healthy interval, half of
+// them after an interval with throttling, server or network errors, or with
+// a latency twice as high as the best one seen. Tokens taken off are parked
+// by the tuner until given back.
+type tuner struct {
+	sem      chan bool
+	min, max int
+	parked   int
+
+	mu       sync.Mutex
+	requests int
+	failures int
+	latency  time.Duration
+	best     time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var concurrencyTuner *tuner
+
+func newTuner(sem chan bool, min, max int) *tuner {
+	if min < 1 {
+		min = 1
+	}
+	if min > max {
+		min = max
+	}
+	t := &tuner{sem: sem, min: min, max: max, stop: make(chan struct{}), done: make(chan struct{})}
+	for t.limit() > min {
+		<-sem
+		t.parked++
+	}
+	return t
+}
+
+func (t *tuner) limit() int {
+	return t.max - t.parked
+}
+
+// observe records the outcome of a request. It is a no-op on a nil tuner.
+func (t *tuner) observe(status int, failed bool, latency time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests++
+	if failed || status == 429 || status >= 500 {
+		t.failures++
+	}
+	t.latency += latency
+}
+
+func (t *tuner) run(interval time.Duration) {
+	logInfo(Fields{"concurrency": t.limit()}, "adaptive concurrency starting at %d", t.limit())
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-ticker.C:
+			}
+			t.adjust()
+		}
+	}()
+}
+
+func (t *tuner) adjust() {
+	t.mu.Lock()
+	requests, failures, latency := t.requests, t.failures, t.latency
+	t.requests, t.failures, t.latency = 0, 0, 0
+	var average time.Duration
+	if requests > 0 {
+		average = latency / time.Duration(requests)
+		if t.best == 0 || average < t.best {
+			t.best = average
+		}
+	}
+	best := t.best
+	t.mu.Unlock()
+	if requests == 0 {
+		return
+	}
+
+	previous := t.limit()
+	switch {
+	case failures > 0 || average > 2*best:
+		target := previous / 2
+		if target < t.min {
+			target = t.min
+		}
+		for t.limit() > target {
+			select {
+			case <-t.sem:
+				t.parked++
+			case <-t.stop:
+				return
+			}
+		}
+	case t.parked > 0:
+		t.sem <- true
+		t.parked--
+	}
+	if t.limit() != previous {
+		logInfo(Fields{"concurrency": t.limit(), "failures": failures, "latency_ms": average.Milliseconds()},
+			"adaptive concurrency set to %d (%d failures, %s average latency)", t.limit(), failures, average)
+	}
+}
+
+// Stop ends the adjustments. Parked tokens are not given back.
+func (t *tuner) Stop() {
+	close(t.stop)
+	<-t.done
+}
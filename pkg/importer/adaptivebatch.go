@@ -0,0 +1,132 @@
+package importer
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	argAdaptiveBatch    = Flags.Bool("adaptive-batch", false, "tune the batch size between -adaptive-batch-min and -batch-size from API latency and errors, every -adaptive-interval")
+	argAdaptiveBatchMin = Flags.Int("adaptive-batch-min", 1, "minimum batch size with -adaptive-batch")
+)
+
+// batchSizer adjusts the number of entries sent per batch request, starting
+// at a quarter of the maximum: a quarter more after an interval of clean
+// batches, half as many after an interval with failed requests, more than 1%
+// of items failing with a retryable status, or a latency per entry twice as
+// high as the best one seen.
+type batchSizer struct {
+	min, max int
+
+	mu       sync.Mutex
+	current  int
+	batches  int
+	failures int
+	entries  int
+	retried  int
+	latency  time.Duration
+	best     time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var batchTuner *batchSizer
+
+func newBatchSizer(min, max int) *batchSizer {
+	if min < 1 {
+		min = 1
+	}
+	if min > max {
+		min = max
+	}
+	current := max / 4
+	if current < min {
+		current = min
+	}
+	return &batchSizer{min: min, max: max, current: current, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// batchSize returns the number of entries to send per request, -batch-size
+// without -adaptive-batch.
+func batchSize() int {
+	if batchTuner == nil {
+		return *argBatchSize
+	}
+	batchTuner.mu.Lock()
+	defer batchTuner.mu.Unlock()
+	return batchTuner.current
+}
+
+// observe records the outcome of a batch of n entries, of which retried
+// failed with a retryable status. It is a no-op on a nil batchSizer.
+func (b *batchSizer) observe(n, retried int, failed bool, latency time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batches++
+	b.entries += n
+	b.retried += retried
+	if failed {
+		b.failures++
+	}
+	b.latency += latency
+}
+
+func (b *batchSizer) run(interval time.Duration) {
+	logInfo(Fields{"batch_size": b.current}, "adaptive batch size starting at %d", b.current)
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.stop:
+				return
+			case <-ticker.C:
+			}
+			b.adjust()
+		}
+	}()
+}
+
+func (b *batchSizer) adjust() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	batches, failures, entries, retried, latency := b.batches, b.failures, b.entries, b.retried, b.latency
+	b.batches, b.failures, b.entries, b.retried, b.latency = 0, 0, 0, 0, 0
+	if batches == 0 || entries == 0 {
+		return
+	}
+	perEntry := latency / time.Duration(entries)
+	if b.best == 0 || perEntry < b.best {
+		b.best = perEntry
+	}
+
+	previous := b.current
+	switch {
+	case failures > 0 || retried*100 > entries || perEntry > 2*b.best:
+		b.current /= 2
+		if b.current < b.min {
+			b.current = b.min
+		}
+	default:
+		b.current += b.current/4 + 1
+		if b.current > b.max {
+			b.current = b.max
+		}
+	}
+	if b.current != previous {
+		average := latency / time.Duration(batches)
+		logInfo(Fields{"batch_size": b.current, "failures": failures, "retried": retried, "latency_ms": average.Milliseconds()},
+			"adaptive batch size set to %d (%d failed batches, %d of %d items retried, %s average latency)", b.current, failures, retried, entries, average)
+	}
+}
+
+// Stop ends the adjustments.
+func (b *batchSizer) Stop() {
+	close(b.stop)
+	<-b.done
+}
@@ -0,0 +1,253 @@
+package importer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// payloadAnalysis sums up the pending payloads scanned by analyze.
+type payloadAnalysis struct {
+	entries   int
+	invalid   int
+	notObject int
+	sizes     []int
+	total     int64
+	keys      map[string]int
+	dates     map[string]*dateRange
+	places    map[string]int
+	placePath string
+}
+
+// dateRange is the range of the dates found under a top-level key.
+type dateRange struct {
+	first, last time.Time
+	count       int
+}
+
+func newPayloadAnalysis(placePath string) *payloadAnalysis {
+	return &payloadAnalysis{
+		keys:      make(map[string]int),
+		dates:     make(map[string]*dateRange),
+		places:    make(map[string]int),
+		placePath: placePath,
+	}
+}
+
+// parseDate parses the string values looking like the dates -created-at-path
+// accepts.
+func parseDate(value string) (time.Time, bool) {
+	for _, layout := range createdAtLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (a *payloadAnalysis) add(payload string) {
+	a.entries++
+	a.sizes = append(a.sizes, len(payload))
+	a.total += int64(len(payload))
+	doc, err := decodeJSON([]byte(payload))
+	if err != nil {
+		a.invalid++
+		return
+	}
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		a.notObject++
+		return
+	}
+	for key, value := range object {
+		a.keys[key]++
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if t, ok := parseDate(s); ok {
+			r := a.dates[key]
+			if r == nil {
+				r = &dateRange{first: t, last: t}
+				a.dates[key] = r
+			}
+			if t.Before(r.first) {
+				r.first = t
+			}
+			if t.After(r.last) {
+				r.last = t
+			}
+			r.count++
+		}
+	}
+	if value, found := valueAt(doc, a.placePath); found && value != nil {
+		if id, scalar := lintString(value); scalar {
+			a.places[id]++
+		}
+	}
+}
+
+// percentile returns the size under which p percent of the payloads are.
+func (a *payloadAnalysis) percentile(p int) int {
+	if len(a.sizes) == 0 {
+		return 0
+	}
+	return a.sizes[(len(a.sizes)-1)*p/100]
+}
+
+// topPlaces returns the n place IDs referenced by the most payloads.
+func (a *payloadAnalysis) topPlaces(n int) []string {
+	ids := make([]string, 0, len(a.places))
+	for id := range a.places {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if a.places[ids[i]] != a.places[ids[j]] {
+			return a.places[ids[i]] > a.places[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+func (a *payloadAnalysis) fields(top int) Fields {
+	keys := make(map[string]interface{}, len(a.keys))
+	for key, n := range a.keys {
+		keys[key] = map[string]int{"present": n, "missing": a.entries - a.invalid - a.notObject - n}
+	}
+	dates := make(map[string]interface{}, len(a.dates))
+	for key, r := range a.dates {
+		dates[key] = map[string]interface{}{"first": r.first.Format(time.RFC3339), "last": r.last.Format(time.RFC3339), "count": r.count}
+	}
+	places := make(map[string]int)
+	for _, id := range a.topPlaces(top) {
+		places[id] = a.places[id]
+	}
+	return Fields{
+		"entries":         a.entries,
+		"invalid_json":    a.invalid,
+		"not_object":      a.notObject,
+		"total_bytes":     a.total,
+		"size_min":        a.percentile(0),
+		"size_p50":        a.percentile(50),
+		"size_p90":        a.percentile(90),
+		"size_p99":        a.percentile(99),
+		"size_max":        a.percentile(100),
+		"keys":            keys,
+		"dates":           dates,
+		"distinct_places": len(a.places),
+		"top_places":      places,
+	}
+}
+
+func (a *payloadAnalysis) print(top int) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "entries\t%d\n", a.entries)
+	if a.invalid > 0 {
+		fmt.Fprintf(w, "  invalid JSON\t%d\n", a.invalid)
+	}
+	if a.notObject > 0 {
+		fmt.Fprintf(w, "  not an object\t%d\n", a.notObject)
+	}
+	fmt.Fprintf(w, "total size\t%s\n", formatBytes(a.total))
+	fmt.Fprintf(w, "payload size\tmin %d, p50 %d, p90 %d, p99 %d, max %d bytes\n",
+		a.percentile(0), a.percentile(50), a.percentile(90), a.percentile(99), a.percentile(100))
+	fmt.Fprintln(w)
+
+	objects := a.entries - a.invalid - a.notObject
+	keys := make([]string, 0, len(a.keys))
+	for key := range a.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(w, "KEY\tPRESENT\tMISSING")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", key, a.keys[key], objects-a.keys[key])
+	}
+	fmt.Fprintln(w)
+
+	if len(a.dates) > 0 {
+		dateKeys := make([]string, 0, len(a.dates))
+		for key := range a.dates {
+			dateKeys = append(dateKeys, key)
+		}
+		sort.Strings(dateKeys)
+		fmt.Fprintln(w, "DATE KEY\tFIRST\tLAST\tDATES")
+		for _, key := range dateKeys {
+			r := a.dates[key]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", key, r.first.Format(time.RFC3339), r.last.Format(time.RFC3339), r.count)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "distinct %s\t%d\n", a.placePath, len(a.places))
+	for _, id := range a.topPlaces(top) {
+		fmt.Fprintf(w, "  %s\t%d\n", id, a.places[id])
+	}
+	return w.Flush()
+}
+
+// formatBytes formats n bytes with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func runAnalyze(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	commonFlags(fs)
+	inheritFlags(fs, "page-size", "where")
+	placePath := fs.String("place-path", "place_id", "dot-separated path of the place ID in the payloads")
+	top := fs.Int("top", 10, "number of most referenced place IDs listed")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s analyze [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+	store.SetPendingFilter(*argWhere)
+
+	a := newPayloadAnalysis(*placePath)
+	after := ""
+	for {
+		page, err := store.FetchPending(pendingScope{}, after, *argPageSize)
+		if err != nil {
+			return fmt.Errorf("failed to fetch data: %s", err)
+		}
+		for _, entry := range page {
+			a.add(entry.Payload)
+		}
+		if len(page) < *argPageSize {
+			break
+		}
+		after = page[len(page)-1].UID
+	}
+	sort.Ints(a.sizes)
+
+	if jsonLogs {
+		logInfo(a.fields(*top), "%d pending payloads analyzed", a.entries)
+		return nil
+	}
+	return a.print(*top)
+}
@@ -0,0 +1,269 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	argAPIVersion      = Flags.String("api-version", "", "Gaia API `version` the payloads are adapted to with its -api-adapters adapter, e.g. v3, or auto to ask the API with -api-version-probe at start (default: payloads sent as prepared)")
+	argAPIAdapters     = Flags.String("api-adapters", "", "YAML `file` of the payload adapter of each API version: fields renamed or removed and wrapper objects, applied last before sending")
+	argAPIVersionProbe = Flags.String("api-version-probe", "GET /version", "request asking the API its version for -api-version auto, as a method and a path, the version being read from its Gaia-Api-Version header or the version field of its JSON body")
+)
+
+// apiVersionHeader is the response header of the API holding its version.
+const apiVersionHeader = "Gaia-Api-Version"
+
+// APIAdapter is the payload adjustments of an API version, from the
+// -api-adapters file, applied in this order.
+type APIAdapter struct {
+	Remove []string          `yaml:"remove"`
+	Rename map[string]string `yaml:"rename"`
+	Wrap   string            `yaml:"wrap"`
+}
+
+// empty tells whether a leaves the payloads as they are.
+func (a *APIAdapter) empty() bool {
+	return a == nil || len(a.Remove) == 0 && len(a.Rename) == 0 && a.Wrap == ""
+}
+
+// AdapterError is a payload an API version adapter could not adjust.
+type AdapterError struct {
+	Version string
+	Err     error
+}
+
+func (e *AdapterError) Error() string {
+	return fmt.Sprintf("failed to adapt payload to API %s: %s", e.Version, e.Err)
+}
+
+var (
+	// apiVersion is the version of the API the payloads are sent to, empty if
+	// unknown.
+	apiVersion string
+	apiAdapter *APIAdapter
+	// apiAdapters are the adapters of the -api-adapters file, by version.
+	apiAdapters map[string]*APIAdapter
+)
+
+func loadAPIAdapters(path string) (map[string]*APIAdapter, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	adapters := map[string]*APIAdapter{}
+	if err := yaml.UnmarshalStrict(content, &adapters); err != nil {
+		return nil, err
+	}
+	if len(adapters) == 0 {
+		return nil, errors.New("no versions")
+	}
+	for version, a := range adapters {
+		if a == nil {
+			adapters[version] = &APIAdapter{}
+			continue
+		}
+		for from, to := range a.Rename {
+			if from == "" || to == "" {
+				return nil, fmt.Errorf("version %s renames %q to %q", version, from, to)
+			}
+		}
+	}
+	return adapters, nil
+}
+
+// setupAPIAdapters loads the -api-adapters file and selects the adapter of
+// an -api-version given explicitly.
+func setupAPIAdapters() error {
+	apiVersion, apiAdapter, apiAdapters = "", nil, nil
+	if *argAPIAdapters != "" {
+		adapters, err := loadAPIAdapters(*argAPIAdapters)
+		if err != nil {
+			return fmt.Errorf("invalid API adapters %s: %s", *argAPIAdapters, err)
+		}
+		apiAdapters = adapters
+	}
+	switch *argAPIVersion {
+	case "":
+		return nil
+	case "auto":
+		if apiAdapters == nil {
+			return errors.New("-api-version auto needs -api-adapters")
+		}
+		return nil
+	}
+	return selectAPIVersion(normalizeAPIVersion(*argAPIVersion), true)
+}
+
+// selectAPIVersion selects the adapter of version, failing if there is none
+// and required is set.
+func selectAPIVersion(version string, required bool) error {
+	apiVersion = version
+	a, ok := apiAdapters[version]
+	if !ok {
+		if required {
+			if apiAdapters == nil {
+				return fmt.Errorf("-api-version %s needs -api-adapters", version)
+			}
+			return fmt.Errorf("no adapter for API %s in %s", version, *argAPIAdapters)
+		}
+		logInfo(Fields{"api_version": version}, "no adapter for API %s, payloads sent as prepared", version)
+		return nil
+	}
+	apiAdapter = a
+	logInfo(Fields{"api_version": version}, "adapting payloads to API %s", version)
+	return nil
+}
+
+// normalizeAPIVersion returns the major version of version, e.g. v3 for
+// "3.2.1" or "V3".
+func normalizeAPIVersion(version string) string {
+	version = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "v")
+	if i := strings.Index(version, "."); i >= 0 {
+		version = version[:i]
+	}
+	return "v" + version
+}
+
+// detectAPIVersion asks the API its version with the -api-version probe
+// and selects its adapter, for -api-version auto.
+func detectAPIVersion() error {
+	if *argAPIVersion != "auto" {
+		return nil
+	}
+	method, path := "GET", *argAPIVersionProbe
+	if fields := strings.Fields(*argAPIVersionProbe); len(fields) == 2 {
+		method, path = strings.ToUpper(fields[0]), fields[1]
+	}
+	api := &endpoint{url: *argURL}
+	if _, missing := authenticator.(*missingAuth); missing {
+		names := make([]string, 0, len(tenants))
+		for name := range tenants {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		api = tenants[names[0]]
+	}
+	req, err := http.NewRequest(method, api.url+path, nil)
+	if err != nil {
+		return fmt.Errorf("invalid -api-version-probe: %s", err)
+	}
+	if err := api.authorize(req); err != nil {
+		return fmt.Errorf("failed to get credentials to detect the API version: %s", err)
+	}
+	setHeaders(req)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to detect the API version: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	version := resp.Header.Get(apiVersionHeader)
+	if version == "" && resp.StatusCode < 300 {
+		var doc struct {
+			Version interface{} `json:"version"`
+		}
+		if json.Unmarshal(body, &doc) == nil && doc.Version != nil {
+			version = fmt.Sprint(doc.Version)
+		}
+	}
+	if version == "" {
+		return fmt.Errorf("failed to detect the API version: %s %s answered HTTP %d without %s header nor version field", method, req.URL, resp.StatusCode, apiVersionHeader)
+	}
+	logInfo(Fields{"api_version": version}, "the API has version %s", version)
+	return selectAPIVersion(normalizeAPIVersion(version), false)
+}
+
+// adapt replaces the payload of e by its copy adjusted by the adapter of
+// the API version.
+func (e *Entry) adapt() error {
+	if apiAdapter.empty() {
+		return nil
+	}
+	var doc interface{}
+	decoder := json.NewDecoder(strings.NewReader(e.Payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return &AdapterError{apiVersion, fmt.Errorf("payload is not valid JSON: %s", err)}
+	}
+	for _, path := range apiAdapter.Remove {
+		removeAt(doc, strings.Split(path, "."))
+	}
+	renames := make([]string, 0, len(apiAdapter.Rename))
+	for from := range apiAdapter.Rename {
+		renames = append(renames, from)
+	}
+	sort.Strings(renames)
+	for _, from := range renames {
+		value, ok := removeAt(doc, strings.Split(from, "."))
+		if !ok {
+			continue
+		}
+		to := apiAdapter.Rename[from]
+		if err := setAt(doc, strings.Split(to, "."), value); err != nil {
+			return &AdapterError{apiVersion, fmt.Errorf("failed to rename %s to %s: %s", from, to, err)}
+		}
+	}
+	if apiAdapter.Wrap != "" {
+		keys := strings.Split(apiAdapter.Wrap, ".")
+		for i := len(keys) - 1; i >= 0; i-- {
+			doc = map[string]interface{}{keys[i]: doc}
+		}
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return &AdapterError{apiVersion, err}
+	}
+	e.Payload = strings.TrimSuffix(b.String(), "\n")
+	return nil
+}
+
+// removeAt removes the field at keys under node, returning its value.
+func removeAt(node interface{}, keys []string) (interface{}, bool) {
+	for _, key := range keys[:len(keys)-1] {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		node = object[key]
+	}
+	object, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	value, ok := object[keys[len(keys)-1]]
+	delete(object, keys[len(keys)-1])
+	return value, ok
+}
+
+// setAt sets the field at keys under node to value, creating the missing
+// objects on the way.
+func setAt(node interface{}, keys []string, value interface{}) error {
+	object, ok := node.(map[string]interface{})
+	if !ok {
+		return errors.New("not an object")
+	}
+	for i, key := range keys[:len(keys)-1] {
+		child, found := object[key]
+		if !found || child == nil {
+			child = map[string]interface{}{}
+			object[key] = child
+		}
+		if object, ok = child.(map[string]interface{}); !ok {
+			return fmt.Errorf("%s is not an object", strings.Join(keys[:i+1], "."))
+		}
+	}
+	object[keys[len(keys)-1]] = value
+	return nil
+}
@@ -0,0 +1,39 @@
+package importer
+
+import (
+	"fmt"
+	"net/http"
+)
+
+var argArchive = Flags.String("archive-responses", "errors", "store API response bodies: none, errors or all")
+
+func validateArchiveMode(mode string) error {
+	switch mode {
+	case "none", "errors", "all":
+		return nil
+	}
+	return fmt.Errorf("unknown -archive-responses mode %q", mode)
+}
+
+func (e *Entry) recordResponse(resp *http.Response, body []byte) {
+	e.RequestID = resp.Header.Get("X-Request-Id")
+	archived := string(body)
+	e.ResponseBody = &archived
+}
+
+// archivedBody returns the response body to persist for e, given the outcome
+// of its import.
+func (e *Entry) archivedBody(success bool) *string {
+	switch {
+	case *argArchive == "all", *argArchive == "errors" && !success:
+		return e.ResponseBody
+	}
+	return nil
+}
+
+func (e *Entry) archivedRequestID() *string {
+	if *argArchive == "none" || e.RequestID == "" {
+		return nil
+	}
+	return &e.RequestID
+}
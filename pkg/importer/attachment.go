@@ -0,0 +1,457 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	argAttachmentDir        = Flags.String("attachment-dir", "", "`directory` relative -attachment file paths are resolved from (default: the current directory)")
+	argAttachmentFormField  = Flags.String("attachment-form-field", "file", "name of the multipart form field holding the file of the -attachment uploads")
+	argAttachmentIDPath     = Flags.String("attachment-id-path", "", "dot-separated path of the media identifier in the answers of the -attachment uploads (default: the -response-id-path)")
+	argAttachmentRetries    = Flags.Int("attachment-retries", 3, "number of times an -attachment upload failing with a network error, 408 or 5xx is sent again")
+	argAttachmentRetryDelay = Flags.Duration("attachment-retry-delay", time.Second, "pause before sending a failed -attachment upload again, doubled on each retry")
+	argAttachmentCache      = Flags.String("attachment-cache", "", "JSON `file` keeping the media identifiers of the -attachment files uploaded across runs, by upload URL and content digest")
+)
+
+// attachmentList is a repeatable flag of "field=/api/path" attachments.
+type attachmentList []attachment
+
+// attachment is a payload field referencing files, uploaded to an API path
+// before sending the payload, with the media identifiers of the uploads
+// replacing the file references.
+type attachment struct {
+	field string
+	path  string
+}
+
+func (l *attachmentList) String() string {
+	attachments := make([]string, len(*l))
+	for i, a := range *l {
+		attachments[i] = a.field + "=" + a.path
+	}
+	return strings.Join(attachments, ", ")
+}
+
+func (l *attachmentList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || !strings.HasPrefix(parts[1], "/") {
+		return fmt.Errorf("invalid attachment %q, expected field=/api/path", value)
+	}
+	*l = append(*l, attachment{parts[0], parts[1]})
+	return nil
+}
+
+func (l *attachmentList) reset() {
+	*l = nil
+}
+
+var argAttachments attachmentList
+
+func init() {
+	Flags.Var(&argAttachments, "attachment", "`field=/api/path` payload field referencing files uploaded to this API path before sending the entry, the media identifiers replacing them, repeatable; the files are those of the attachments table rows of the entry and field, or else the field value, a path or a list of paths")
+}
+
+// attachmentColumns are the columns of the attachments table, listing the
+// files to upload for the fields of the entries, and their media identifier
+// once uploaded.
+var attachmentColumns = []column{
+	{"uid", "%s NOT NULL"},
+	{"field", "TEXT NOT NULL"},
+	{"file", "TEXT NOT NULL"},
+	{"position", "INTEGER"},
+	{"media_id", "TEXT"},
+	{"uploaded_at", "TEXT"},
+	{"error", "TEXT"},
+}
+
+// AttachmentError is a file referenced by an -attachment field that cannot be
+// read.
+type AttachmentError struct {
+	Field string
+	File  string
+	Err   error
+}
+
+func (e *AttachmentError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("invalid attachment %s: %s", e.Field, e.Err)
+	}
+	return fmt.Sprintf("invalid attachment %s %s: %s", e.Field, e.File, e.Err)
+}
+
+// uploader uploads the -attachment files, remembering their media
+// identifiers for the run and in -attachment-cache. A file being uploaded is
+// only uploaded once, the other entries referencing it waiting for the
+// answer.
+type uploader struct {
+	mu       sync.Mutex
+	store    *sqlStore
+	media    map[string]string
+	inFlight map[string]chan struct{}
+}
+
+var attachmentUploader *uploader
+
+func setupAttachments(store Store) error {
+	attachmentUploader = nil
+	if len(argAttachments) == 0 {
+		return nil
+	}
+	u := &uploader{media: make(map[string]string), inFlight: make(map[string]chan struct{})}
+	if s := schemaStore(store); s != nil && s.has("attachments", "") {
+		u.store = s
+	}
+	if *argAttachmentCache != "" {
+		content, err := ioutil.ReadFile(*argAttachmentCache)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return fmt.Errorf("failed to read attachment cache: %s", err)
+		default:
+			if err := json.Unmarshal(content, &u.media); err != nil {
+				return fmt.Errorf("invalid attachment cache %s: %s", *argAttachmentCache, err)
+			}
+			logInfo(Fields{"attachments": len(u.media)}, "%d uploaded attachments loaded from %s", len(u.media), *argAttachmentCache)
+		}
+	}
+	attachmentUploader = u
+	return nil
+}
+
+// save writes the media identifiers of the uploaded files to
+// -attachment-cache.
+func (u *uploader) save() error {
+	if u == nil || *argAttachmentCache == "" {
+		return nil
+	}
+	u.mu.Lock()
+	content, err := json.MarshalIndent(u.media, "", "  ")
+	u.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*argAttachmentCache, append(content, '\n'), 0644)
+}
+
+// attachedFile is a file to upload for a field of an entry, with its media
+// identifier if the attachments table holds it.
+type attachedFile struct {
+	file    string
+	mediaID string
+	row     bool
+}
+
+// rows returns the files of the attachments table for field of entry uid, in
+// order.
+func (u *uploader) rows(uid, field string) ([]attachedFile, error) {
+	if u.store == nil {
+		return nil, nil
+	}
+	rows, err := u.store.query("SELECT file, media_id FROM attachments WHERE uid = ? AND field = ? ORDER BY position, file", uid, field)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachments: %s", err)
+	}
+	defer rows.Close()
+	var files []attachedFile
+	for rows.Next() {
+		var f attachedFile
+		var mediaID *string
+		if err := rows.Scan(&f.file, &mediaID); err != nil {
+			return nil, fmt.Errorf("failed to read attachments: %s", err)
+		}
+		if mediaID != nil {
+			f.mediaID = *mediaID
+		}
+		f.row = true
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// record stores the outcome of the upload of a file of the attachments table.
+func (u *uploader) record(uid string, a attachment, f attachedFile, err error) {
+	if !f.row {
+		return
+	}
+	var dbErr error
+	if err != nil {
+		_, dbErr = u.store.exec("UPDATE attachments SET error = ? WHERE uid = ? AND field = ? AND file = ?", err.Error(), uid, a.field, f.file)
+	} else {
+		_, dbErr = u.store.exec("UPDATE attachments SET media_id = ?, uploaded_at = ?, error = NULL WHERE uid = ? AND field = ? AND file = ?",
+			f.mediaID, time.Now().UTC().Format(time.RFC3339), uid, a.field, f.file)
+	}
+	if dbErr != nil {
+		logError(Fields{"uid": uid, "file": f.file, "error": dbErr}, "failed to record upload of %s: %s", f.file, dbErr)
+	}
+}
+
+// attachedFiles returns the files to upload for field a of e, whose payload
+// is doc, and whether a single media identifier replaces them rather than a
+// list.
+func (e *Entry) attachedFiles(doc interface{}, a attachment) ([]attachedFile, bool, error) {
+	value, _ := valueAt(doc, a.field)
+	files, err := attachmentUploader.rows(e.UID, a.field)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(files) > 0 {
+		_, single := value.(string)
+		if single && len(files) > 1 {
+			return nil, false, &AttachmentError{Field: a.field, Err: fmt.Errorf("%d files in the attachments table for a single value", len(files))}
+		}
+		return files, single, nil
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil, false, nil
+	case string:
+		if v == "" {
+			return nil, false, nil
+		}
+		return []attachedFile{{file: v}}, true, nil
+	case []interface{}:
+		for _, item := range v {
+			file, ok := item.(string)
+			if !ok || file == "" {
+				return nil, false, &AttachmentError{Field: a.field, Err: fmt.Errorf("%s is not a file path", compactJSON(item))}
+			}
+			files = append(files, attachedFile{file: file})
+		}
+		return files, false, nil
+	}
+	return nil, false, &AttachmentError{Field: a.field, Err: fmt.Errorf("%s is not a file path nor a list of them", compactJSON(value))}
+}
+
+// attachmentPath returns the path on disk of a file reference.
+func attachmentPath(file string) string {
+	if strings.HasPrefix(file, "file://") {
+		if u, err := url.Parse(file); err == nil {
+			file = u.Host + u.Path
+		}
+	}
+	if !filepath.IsAbs(file) && *argAttachmentDir != "" {
+		file = filepath.Join(*argAttachmentDir, file)
+	}
+	return file
+}
+
+// checkAttachments checks that the files referenced by the -attachment fields
+// of e can be read, without uploading them.
+func (e *Entry) checkAttachments() error {
+	if attachmentUploader == nil {
+		return nil
+	}
+	doc, err := decodeJSON([]byte(e.Payload))
+	if err != nil {
+		return &ParseError{e.Payload}
+	}
+	for _, a := range argAttachments {
+		files, _, err := e.attachedFiles(doc, a)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.mediaID != "" {
+				continue
+			}
+			if _, err := os.Stat(attachmentPath(f.file)); err != nil {
+				return &AttachmentError{a.field, f.file, err}
+			}
+		}
+	}
+	return nil
+}
+
+// uploadAttachments uploads the files referenced by the -attachment fields of
+// e, and replaces them in its payload by their media identifiers. It is a
+// no-op without -attachment.
+func (e *Entry) uploadAttachments(ctx context.Context) error {
+	if attachmentUploader == nil {
+		return nil
+	}
+	doc, err := decodeJSON([]byte(e.Payload))
+	if err != nil {
+		return &ParseError{e.Payload}
+	}
+	api, err := e.endpoint()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, a := range argAttachments {
+		files, single, err := e.attachedFiles(doc, a)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		ids := make([]interface{}, len(files))
+		for i, f := range files {
+			if f.mediaID == "" {
+				f.mediaID, err = attachmentUploader.upload(ctx, api, e.UID, a, f.file)
+				attachmentUploader.record(e.UID, a, f, err)
+				if err != nil {
+					return err
+				}
+			}
+			ids[i] = f.mediaID
+		}
+		var value interface{} = ids
+		if single {
+			value = ids[0]
+		}
+		if err := setAt(doc, strings.Split(a.field, "."), value); err != nil {
+			return &AttachmentError{Field: a.field, Err: err}
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	e.Payload = strings.TrimSuffix(b.String(), "\n")
+	return nil
+}
+
+// upload returns the media identifier of file, referenced by entry uid,
+// uploaded to the path of a, from the cache or else the API.
+func (u *uploader) upload(ctx context.Context, api *endpoint, uid string, a attachment, file string) (string, error) {
+	path := attachmentPath(file)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", &AttachmentError{a.field, file, err}
+	}
+	sum := sha256.Sum256(content)
+	key := api.url + a.path + " " + checksumPrefix + hex.EncodeToString(sum[:])
+	for {
+		u.mu.Lock()
+		id, ok := u.media[key]
+		wait := u.inFlight[key]
+		if !ok && wait == nil {
+			u.inFlight[key] = make(chan struct{})
+		}
+		u.mu.Unlock()
+		if ok {
+			return id, nil
+		}
+		if wait == nil {
+			break
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	id, err := sendAttachment(ctx, api, a.path, filepath.Base(path), content)
+	u.mu.Lock()
+	if err == nil {
+		u.media[key] = id
+	}
+	close(u.inFlight[key])
+	delete(u.inFlight, key)
+	u.mu.Unlock()
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s %s: %w", a.field, file, err)
+	}
+	logInfo(Fields{"uid": uid, "file": file, "media_id": id}, "%s of entry %s uploaded as %s", file, uid, id)
+	return id, nil
+}
+
+// sendAttachment uploads content, the file name, to path as a multipart
+// form, sending it again after network errors, 408 and 5xx answers up to
+// -attachment-retries times, within the -retry-budget, and returns its media
+// identifier.
+func sendAttachment(ctx context.Context, api *endpoint, path, name string, content []byte) (string, error) {
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(*argAttachmentFormField), escapeQuotes(name)))
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return "", err
+	}
+	part.Write(content)
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+	idPath := *argAttachmentIDPath
+	if idPath == "" {
+		idPath = *argResponseID
+	}
+	delay := *argAttachmentRetryDelay
+	for attempt := 0; ; attempt++ {
+		id, retryable, err := postAttachment(ctx, api, path, form.FormDataContentType(), body.Bytes(), idPath)
+		if err == nil || !retryable || attempt >= *argAttachmentRetries || ctx.Err() != nil || !apiRetries.allow() {
+			return id, err
+		}
+		logInfo(Fields{"file": name, "attempt": attempt + 1, "error": err}, "upload of %s failed, sending it again in %s: %s", name, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", err
+		}
+		delay *= 2
+	}
+}
+
+// postAttachment sends an upload once, and tells whether it may be sent again
+// if it failed.
+func postAttachment(ctx context.Context, api *endpoint, path, contentType string, body []byte, idPath string) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", api.url+path, bytes.NewReader(body))
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if err := api.authorize(req); err != nil {
+		return "", false, err
+	}
+	resp, _, err := api.send(req)
+	if err != nil {
+		return "", true, err
+	}
+	defer resp.Body.Close()
+	answer, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		retryable := resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500
+		return "", retryable, &APIError{resp.StatusCode, string(answer)}
+	}
+	id, ok, err := extractID(answer, idPath)
+	if err != nil || !ok || id == "" {
+		return "", false, &ParseError{string(answer)}
+	}
+	return id, false, nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
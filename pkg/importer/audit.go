@@ -0,0 +1,144 @@
+package importer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var argAuditFile = Flags.String("audit-file", "", "append a JSON line for every state change of an entry (claimed, sent, imported, duplicate, errored, blocked, dead_lettered, rolled_back, requeued) to this `file`")
+
+// auditLog is the append-only trail of the state changes of entries, kept
+// apart from the database.
+type auditLog struct {
+	mu       sync.Mutex
+	f        *os.File
+	command  string
+	runID    string
+	instance string
+}
+
+var auditTrail *auditLog
+
+// setupAudit opens -audit-file, if set, for the state changes made by
+// command.
+func setupAudit(command string) error {
+	if *argAuditFile == "" || auditTrail != nil {
+		return nil
+	}
+	f, err := os.OpenFile(*argAuditFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %s", err)
+	}
+	auditTrail = &auditLog{f: f, command: command}
+	return nil
+}
+
+// record appends event of uid with fields. It is a no-op on a nil auditLog.
+func (a *auditLog) record(event, uid string, fields Fields) {
+	if a == nil {
+		return
+	}
+	line := Fields{"time": time.Now().UTC().Format(time.RFC3339Nano), "event": event, "uid": uid, "command": a.command}
+	if a.runID != "" {
+		line["run_id"] = a.runID
+	}
+	if a.instance != "" {
+		line["instance"] = a.instance
+	}
+	for key, value := range fields {
+		line[key] = value
+	}
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(line); err != nil {
+		logError(Fields{"uid": uid, "error": err}, "failed to write entry %s to the audit file: %s", uid, err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(data.Bytes()); err != nil {
+		logError(Fields{"uid": uid, "error": err}, "failed to write entry %s to the audit file: %s", uid, err)
+	}
+}
+
+// entry appends event of e with its outcome.
+func (a *auditLog) entry(event string, e *Entry) {
+	if a == nil {
+		return
+	}
+	fields := Fields{}
+	if e.Status != 0 {
+		fields["http_status"] = e.Status
+	}
+	if e.ResponseId != nil {
+		fields["response_id"] = *e.ResponseId
+	}
+	if e.DuplicateOf != nil {
+		fields["duplicate_of"] = *e.DuplicateOf
+	}
+	if e.Err != nil {
+		fields["error"] = e.Err.Error()
+		fields["error_class"] = classifyError(e.Err)
+	}
+	a.record(event, e.UID, fields)
+}
+
+// sent appends the sending of payload for e to url, identified by its hash.
+func (a *auditLog) sent(e *Entry, method, url, payload string) {
+	if a == nil {
+		return
+	}
+	sum := sha256.Sum256([]byte(payload))
+	a.record("sent", e.UID, Fields{
+		"method":         method,
+		"url":            url,
+		"attempt":        e.Attempts + 1,
+		"payload_sha256": hex.EncodeToString(sum[:]),
+	})
+}
+
+// requeued appends the requeueing of uids.
+func (a *auditLog) requeued(uids []string) {
+	for _, uid := range uids {
+		a.record("requeued", uid, nil)
+	}
+}
+
+// closeAudit flushes the trail to disk and closes it.
+func closeAudit() {
+	if auditTrail == nil {
+		return
+	}
+	auditTrail.f.Sync()
+	auditTrail.f.Close()
+	auditTrail = nil
+}
+
+// uidsWhere returns the uids of the entries matching condition, which are
+// about to change state, when an audit trail is kept.
+func (s *sqlStore) uidsWhere(condition string, args ...interface{}) ([]string, error) {
+	if auditTrail == nil {
+		return nil, nil
+	}
+	rows, err := s.query("SELECT uid FROM imports WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uids []string
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
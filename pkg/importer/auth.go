@@ -0,0 +1,199 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	argAuth              = Flags.String("auth", "token", "authentication scheme: token (raw token in -auth-header), bearer or oauth2")
+	argAuthHeader        = Flags.String("auth-header", "Authorization", "`header` the credentials are sent in, e.g. X-Api-Key")
+	argAuthPrefix        = Flags.String("auth-prefix", "", "scheme sent before the token in -auth-header, followed by a space, e.g. Token for \"Authorization: Token xyz\" (default: none with -auth token, Bearer with bearer and oauth2)")
+	argOAuthTokenURL     = Flags.String("oauth-token-url", "", "OAuth2 token endpoint, for -auth oauth2")
+	argOAuthClientID     = Flags.String("oauth-client-id", "", "OAuth2 client ID, for -auth oauth2")
+	argOAuthClientSecret = Flags.String("oauth-client-secret", "", "OAuth2 client secret, for -auth oauth2")
+	argOAuthScope        = Flags.String("oauth-scope", "", "space-separated OAuth2 scopes, for -auth oauth2")
+)
+
+// Authenticator adds credentials to API requests.
+type Authenticator interface {
+	Authorize(req *http.Request) error
+}
+
+type staticAuth struct {
+	header string
+	value  string
+}
+
+func (a *staticAuth) Authorize(req *http.Request) error {
+	req.Header.Set(a.header, a.value)
+	return nil
+}
+
+// missingAuth fails the requests of entries without tenant when the flags
+// give no credentials, which is only needed if all entries have a tenant.
+type missingAuth struct{}
+
+func (a *missingAuth) Authorize(req *http.Request) error {
+	return &TenantError{}
+}
+
+// oauth2Auth implements the OAuth2 client credentials grant, refreshing the
+// access token shortly before it expires.
+type oauth2Auth struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scope        string
+	header       string
+	prefix       string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+const oauth2RefreshMargin = time.Minute
+
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (a *oauth2Auth) Authorize(req *http.Request) error {
+	token, err := a.accessToken(req.Context())
+	if err != nil {
+		return fmt.Errorf("failed to get OAuth2 token: %s", err)
+	}
+	req.Header.Set(a.header, a.prefix+token)
+	return nil
+}
+
+func (a *oauth2Auth) accessToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Now().Before(a.expires.Add(-oauth2RefreshMargin)) {
+		return a.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if a.scope != "" {
+		form.Set("scope", a.scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return "", &APIError{resp.StatusCode, string(body)}
+	}
+	var token oauth2Token
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", &ParseError{string(body)}
+	}
+	a.token = token.AccessToken
+	a.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	if token.ExpiresIn == 0 {
+		a.expires = time.Now().Add(time.Hour)
+	}
+	logInfo(Fields{"expires_at": a.expires.UTC().Format(time.RFC3339)}, "OAuth2 token refreshed")
+	return a.token, nil
+}
+
+var authenticator Authenticator = &staticAuth{header: "Authorization"}
+
+// authSettings are the credentials of an account, from the flags or a
+// tenant.
+type authSettings struct {
+	scheme       string
+	header       string
+	prefix       string
+	token        string
+	tokenSource  string
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scope        string
+}
+
+func flagAuthSettings() authSettings {
+	return authSettings{
+		scheme:       *argAuth,
+		header:       *argAuthHeader,
+		prefix:       *argAuthPrefix,
+		token:        *argToken,
+		tokenSource:  *argTokenSource,
+		tokenURL:     *argOAuthTokenURL,
+		clientID:     *argOAuthClientID,
+		clientSecret: *argOAuthClientSecret,
+		scope:        *argOAuthScope,
+	}
+}
+
+func newAuthenticator() (Authenticator, error) {
+	return flagAuthSettings().authenticator()
+}
+
+// tokenPrefix returns what precedes the token in the header of s: the
+// -auth-prefix scheme, or that of -auth.
+func (s authSettings) tokenPrefix() string {
+	switch {
+	case strings.TrimSpace(s.prefix) != "":
+		return strings.TrimSpace(s.prefix) + " "
+	case s.scheme == "bearer", s.scheme == "oauth2":
+		return "Bearer "
+	}
+	return ""
+}
+
+func (s authSettings) authenticator() (Authenticator, error) {
+	header := http.CanonicalHeaderKey(strings.TrimSpace(s.header))
+	if header == "" {
+		return nil, errors.New("an authentication header is needed")
+	}
+	redactedHeaders[header] = true
+	switch s.scheme {
+	case "token", "bearer":
+		if s.tokenSource != "" {
+			source, err := parseTokenSource(s.tokenSource)
+			if err != nil {
+				return nil, err
+			}
+			return newRotatingAuth(source, header, s.tokenPrefix())
+		}
+		if s.token == "" {
+			return nil, errors.New("an API token is needed")
+		}
+		return &staticAuth{header, s.tokenPrefix() + s.token}, nil
+	case "oauth2":
+		if s.tokenURL == "" || s.clientID == "" || s.clientSecret == "" {
+			return nil, errors.New("-oauth-token-url, -oauth-client-id and -oauth-client-secret are needed with -auth oauth2")
+		}
+		return &oauth2Auth{
+			tokenURL:     s.tokenURL,
+			clientID:     s.clientID,
+			clientSecret: s.clientSecret,
+			scope:        s.scope,
+			header:       header,
+			prefix:       s.tokenPrefix(),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown authentication scheme %q", s.scheme)
+}
@@ -0,0 +1,111 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	argCreatedAtPath   = Flags.String("created-at-path", "", "dot-separated path of the original response date in the payloads, sent as their created_at so that they keep their date in Gaia")
+	argCreatedAtFormat = Flags.String("created-at-format", "", "Go time layout of the -created-at-path dates (default: RFC 3339, 2006-01-02 15:04:05, 2006-01-02 or Unix seconds)")
+	argCreatedAtField  = Flags.String("created-at-field", "created_at", "payload field receiving the -created-at-path date")
+	argCreatedAtParam  = Flags.String("created-at-param", "", "send the -created-at-path date in this query parameter instead of the -created-at-field payload field")
+)
+
+var createdAtLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// CreatedAtError is returned for entries whose original date cannot be read,
+// rather than importing them with the current date.
+type CreatedAtError struct {
+	Err error
+}
+
+func (e *CreatedAtError) Error() string {
+	return fmt.Sprintf("failed to read the response date: %s", e.Err)
+}
+
+func checkCreatedAtFlags() error {
+	if *argCreatedAtPath == "" {
+		return nil
+	}
+	if *argCreatedAtParam != "" && *argBatchSize > 1 {
+		return errors.New("-created-at-param cannot be used with -batch-size, the date of each entry has to be in its payload")
+	}
+	return nil
+}
+
+// parseCreatedAt returns the date value, in the local time zone unless it
+// has one, as RFC 3339 in UTC.
+func parseCreatedAt(value string) (string, error) {
+	if *argCreatedAtFormat != "" {
+		t, err := time.ParseInLocation(*argCreatedAtFormat, value, time.Local)
+		if err != nil {
+			return "", fmt.Errorf("%q does not match -created-at-format", value)
+		}
+		return t.UTC().Format(time.RFC3339), nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC().Format(time.RFC3339), nil
+	}
+	for _, layout := range createdAtLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.UTC().Format(time.RFC3339), nil
+		}
+	}
+	return "", fmt.Errorf("unsupported date %q, set -created-at-format", value)
+}
+
+// readCreatedAt reads the original date of e from its stored payload.
+func (e *Entry) readCreatedAt() error {
+	if *argCreatedAtPath == "" {
+		return nil
+	}
+	value, ok, err := extractID([]byte(e.Payload), *argCreatedAtPath)
+	if err != nil {
+		return &CreatedAtError{err}
+	}
+	if !ok {
+		return &CreatedAtError{fmt.Errorf("no string or number at %s", *argCreatedAtPath)}
+	}
+	if e.createdAt, err = parseCreatedAt(value); err != nil {
+		return &CreatedAtError{err}
+	}
+	return nil
+}
+
+// backdate sets the original date of e in the payload actually sent, unless
+// it goes in a query parameter.
+func (e *Entry) backdate() error {
+	if e.createdAt == "" || *argCreatedAtParam != "" {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(e.Payload)))
+	decoder.UseNumber()
+	var payload map[string]interface{}
+	if err := decoder.Decode(&payload); err != nil || payload == nil {
+		return &CreatedAtError{errors.New("the payload is not a JSON object")}
+	}
+	payload[*argCreatedAtField] = e.createdAt
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return &CreatedAtError{err}
+	}
+	e.Payload = string(b)
+	return nil
+}
+
+// setCreatedAtParam adds the original date of e to the query of req, with
+// -created-at-param.
+func (e *Entry) setCreatedAtParam(req *http.Request) {
+	if e.createdAt == "" || *argCreatedAtParam == "" {
+		return
+	}
+	query := req.URL.Query()
+	query.Set(*argCreatedAtParam, e.createdAt)
+	req.URL.RawQuery = query.Encode()
+}
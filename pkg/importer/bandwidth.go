@@ -0,0 +1,137 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var argMaxBandwidth = Flags.String("max-bandwidth", "", "cap the aggregate upload throughput to the API across workers, e.g. 5MB/s, 512KiB/s or 20Mbit/s")
+
+// bandwidthChunk is the largest write let through at once, so that large
+// payloads are spread over time instead of sent in bursts.
+const bandwidthChunk = 16 * 1024
+
+var bandwidthUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"kbit", 1000 / 8.0},
+	{"mbit", 1000 * 1000 / 8.0},
+	{"gbit", 1000 * 1000 * 1000 / 8.0},
+	{"kib", 1 << 10},
+	{"mib", 1 << 20},
+	{"gib", 1 << 30},
+	{"kb", 1000},
+	{"mb", 1000 * 1000},
+	{"gb", 1000 * 1000 * 1000},
+	{"b", 1},
+}
+
+// parseBytes parses a positive quantity such as 5MB or 512KiB into bytes.
+func parseBytes(s string) (float64, bool) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	scale := 1.0
+	for _, unit := range bandwidthUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, scale = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n * scale, true
+}
+
+// parseBandwidth parses a throughput such as 5MB/s into bytes per second.
+func parseBandwidth(s string) (float64, error) {
+	rate, ok := parseBytes(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if !ok {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected e.g. 5MB/s", s)
+	}
+	return rate, nil
+}
+
+// bandwidthLimiter spreads the bytes written by all the connections to the
+// API so that they do not exceed rate bytes per second.
+type bandwidthLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	next time.Time
+}
+
+var apiBandwidth *bandwidthLimiter
+
+func setupBandwidth() error {
+	apiBandwidth = nil
+	if *argMaxBandwidth == "" {
+		return nil
+	}
+	rate, err := parseBandwidth(*argMaxBandwidth)
+	if err != nil {
+		return fmt.Errorf("invalid -max-bandwidth: %s", err)
+	}
+	apiBandwidth = &bandwidthLimiter{rate: rate}
+	return nil
+}
+
+// reserve books n bytes and returns how long to wait before writing them.
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	return wait
+}
+
+// limitedConn is a connection whose writes go through a bandwidthLimiter.
+type limitedConn struct {
+	net.Conn
+	limiter *bandwidthLimiter
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > bandwidthChunk {
+			chunk = chunk[:bandwidthChunk]
+		}
+		if wait := c.limiter.reserve(len(chunk)); wait > 0 {
+			time.Sleep(wait)
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// limitDial makes the connections opened by dial share the bandwidth of l.
+func (l *bandwidthLimiter) limitDial(dial dialFunc) dialFunc {
+	if l == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &limitedConn{Conn: conn, limiter: l}, nil
+	}
+}
@@ -0,0 +1,268 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+var (
+	argBatchResultUID  = Flags.String("batch-result-uid", "", "field of the batch item results holding the uid of their entry, when results are not in request order")
+	argBatchRetries    = Flags.Int("batch-retries", 2, "number of times the entries of a batch failing with a 408, 429 or 5xx item status are sent again, without the others")
+	argBatchRetryDelay = Flags.Duration("batch-retry-delay", time.Second, "pause before sending failed batch entries again, doubled on each retry")
+)
+
+// BatchItemResult is the outcome of one payload of a batch request, in the
+// same position as the payload in the request.
+type BatchItemResult struct {
+	Status int
+	Error  json.RawMessage
+	Index  *int
+}
+
+// doBatchImport sends entries, which must share the same target, tenant,
+// headers, query parameters and auth token, in one request to the batch
+// endpoint of that target, and sets the outcome of each entry from the
+// matching item result. An error is returned only when the request as a
+// whole failed.
+func doBatchImport(ctx context.Context, entries []Entry) error {
+	var body bytes.Buffer
+	body.WriteByte('[')
+	for i, entry := range entries {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.WriteString(entry.Payload)
+	}
+	body.WriteByte(']')
+
+	api, err := entries[0].endpoint()
+	if err != nil {
+		return err
+	}
+	target := entries[0].target()
+	var history []RequestAttempt
+	uids := make([]string, len(entries))
+	for i := range entries {
+		uids[i] = entries[i].UID
+	}
+	req, err := http.NewRequestWithContext(withEntryUIDs(withAttemptLog(ctx, &history), uids...), target.Method, api.url+target.Path+"/batch", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := api.authorize(req); err != nil {
+		return err
+	}
+	if *argIdempotency {
+		req.Header.Set("Idempotency-Key", batchIdempotencyKey(entries))
+	}
+	if err := entries[0].setEntryHeaders(req); err != nil {
+		return err
+	}
+	if err := entries[0].setQueryParams(req); err != nil {
+		return err
+	}
+	entries[0].setAuthToken(req)
+	correlationID, err := setCorrelationID(req)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].CorrelationID = correlationID
+	}
+
+	for i := range entries {
+		auditTrail.sent(&entries[i], req.Method, req.URL.String(), entries[i].Payload)
+	}
+	resp, elapsed, err := api.send(req)
+	for i := range entries {
+		entries[i].Attempts++
+		entries[i].ImportTime = elapsed.Milliseconds()
+		for _, a := range history {
+			a.Attempt = len(entries[i].history) + 1
+			entries[i].history = append(entries[i].history, a)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	payload, _ := ioutil.ReadAll(resp.Body)
+	for i := range entries {
+		entries[i].recordResponse(resp, payload)
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 201 && resp.StatusCode != 207 {
+		apiErr := &APIError{resp.StatusCode, string(payload)}
+		for i := range entries {
+			entries[i].Status = resp.StatusCode
+			entries[i].Err = apiErr
+		}
+		return fmt.Errorf("unexpected status: %v", apiErr)
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(payload, &items); err != nil {
+		return &ParseError{string(payload)}
+	}
+	results, err := mapBatchResults(entries, items)
+	if err != nil {
+		return err
+	}
+	for i, item := range results {
+		entry := &entries[i]
+		if item == nil {
+			entry.Err = &ParseError{"no result for the entry in the batch response"}
+			continue
+		}
+		var result BatchItemResult
+		if err := json.Unmarshal(item, &result); err != nil {
+			entry.Err = &ParseError{string(item)}
+			continue
+		}
+		archived := string(item)
+		entry.ResponseBody = &archived
+		entry.Status = result.Status
+		if !successStatuses[result.Status] {
+			if existsAnswer(result.Status, result.Error) {
+				entry.Err = entry.alreadyExists(ctx, result.Status, result.Error)
+				continue
+			}
+			entry.Err = &APIError{result.Status, string(result.Error)}
+			continue
+		}
+		id, ok, err := extractResponseID(item)
+		if err != nil || !ok {
+			entry.Err = &ParseError{string(item)}
+			continue
+		}
+		entry.ResponseId = &id
+		entry.extractFields(item)
+	}
+	return nil
+}
+
+// mapBatchResults attributes the item results of a batch response to
+// entries: by the -batch-result-uid field of the items if set, by their index
+// field if they have one, and by position otherwise. The result of an entry
+// is nil when none could be attributed to it.
+func mapBatchResults(entries []Entry, items []json.RawMessage) ([]json.RawMessage, error) {
+	results := make([]json.RawMessage, len(entries))
+	if *argBatchResultUID != "" {
+		positions := make(map[string]int, len(entries))
+		for i, entry := range entries {
+			positions[entry.UID] = i
+		}
+		for _, item := range items {
+			var fields map[string]json.RawMessage
+			var uid string
+			if json.Unmarshal(item, &fields) != nil || json.Unmarshal(fields[*argBatchResultUID], &uid) != nil {
+				return nil, &ParseError{fmt.Sprintf("batch result without %q field: %s", *argBatchResultUID, item)}
+			}
+			i, ok := positions[uid]
+			if !ok || results[i] != nil {
+				return nil, &ParseError{fmt.Sprintf("batch result for unknown or repeated uid %q", uid)}
+			}
+			results[i] = item
+		}
+		return results, nil
+	}
+
+	indexed := 0
+	for _, item := range items {
+		var result BatchItemResult
+		if json.Unmarshal(item, &result) != nil || result.Index == nil {
+			continue
+		}
+		indexed++
+		i := *result.Index
+		if i < 0 || i >= len(entries) || results[i] != nil {
+			return nil, &ParseError{fmt.Sprintf("batch result for invalid or repeated index %d", i)}
+		}
+		results[i] = item
+	}
+	if indexed > 0 {
+		if indexed != len(items) {
+			return nil, &ParseError{"batch results mix indexed and unindexed items"}
+		}
+		return results, nil
+	}
+	if len(items) != len(entries) {
+		return nil, &ParseError{fmt.Sprintf("batch returned %d results for %d entries", len(items), len(entries))}
+	}
+	copy(results, items)
+	return results, nil
+}
+
+// retryableItem reports whether a batch entry failed in a way that makes
+// sending it again safe and worthwhile.
+func retryableItem(e *Entry) bool {
+	if _, ok := e.Err.(*APIError); !ok {
+		return false
+	}
+	return e.Status == http.StatusRequestTimeout || e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// importBatch sends entries as a batch, then sends again, up to
+// -batch-retries times, only those whose item failed with a retryable
+// status, so that entries already imported are never sent twice.
+func importBatch(ctx context.Context, entries []Entry) error {
+	err := doBatchImport(ctx, entries)
+	if batchTuner != nil && ctx.Err() == nil {
+		retried := 0
+		for i := range entries {
+			if retryableItem(&entries[i]) {
+				retried++
+			}
+		}
+		batchTuner.observe(len(entries), retried, err != nil, time.Duration(entries[0].ImportTime)*time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+	delay := *argBatchRetryDelay
+	for retry := 1; retry <= *argBatchRetries; retry++ {
+		var failed []int
+		for i := range entries {
+			if retryableItem(&entries[i]) {
+				failed = append(failed, i)
+			}
+		}
+		if len(failed) == 0 || !apiRetries.allow() {
+			return nil
+		}
+		logInfo(Fields{"failed": len(failed), "entries": len(entries), "retry": retry},
+			"%d of %d entries of the batch failed with a retryable status, sending them again in %s", len(failed), len(entries), delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+		delay *= 2
+
+		subset := make([]Entry, len(failed))
+		for j, i := range failed {
+			subset[j] = entries[i]
+			subset[j].Err, subset[j].Status = nil, 0
+		}
+		err := doBatchImport(ctx, subset)
+		for j, i := range failed {
+			entries[i] = subset[j]
+		}
+		if err != nil {
+			// The entries already imported are kept, the others fail with
+			// the error of the request.
+			for _, i := range failed {
+				if entries[i].Err == nil {
+					entries[i].Err = err
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
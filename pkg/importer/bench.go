@@ -0,0 +1,258 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// benchLevel is the outcome of the benchmark at one concurrency level.
+type benchLevel struct {
+	concurrency int
+	requests    int
+	errors      int
+	throttled   int
+	elapsed     time.Duration
+	latencies   []int64
+	created     []Entry
+}
+
+func (l *benchLevel) rate() float64 {
+	if l.elapsed <= 0 {
+		return 0
+	}
+	return float64(l.requests-l.errors) / l.elapsed.Seconds()
+}
+
+func (l *benchLevel) errorRatio() float64 {
+	if l.requests == 0 {
+		return 0
+	}
+	return float64(l.errors) / float64(l.requests)
+}
+
+func (l *benchLevel) fields() Fields {
+	return Fields{
+		"concurrency": l.concurrency,
+		"requests":    l.requests,
+		"errors":      l.errors,
+		"throttled":   l.throttled,
+		"rate":        l.rate(),
+		"latency_ms":  percentiles(append([]int64(nil), l.latencies...)),
+	}
+}
+
+// benchPayload returns a synthetic payload of about size bytes.
+func benchPayload(n, size int) string {
+	payload := fmt.Sprintf(`{"bench":true,"uid":"bench-%d","text":""}`, n)
+	if pad := size - len(payload); pad > 0 {
+		payload = strings.Replace(payload, `"text":""`, `"text":"`+strings.Repeat("x", pad)+`"`, 1)
+	}
+	return payload
+}
+
+// benchmark sends synthetic payloads of size bytes with concurrency workers
+// for duration, or until requests are sent if not 0.
+func benchmark(ctx context.Context, concurrency, size int, duration time.Duration, requests int) *benchLevel {
+	level := &benchLevel{concurrency: concurrency}
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	var mu sync.Mutex
+	var sent int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				n := atomic.AddInt64(&sent, 1)
+				if requests > 0 && n > int64(requests) {
+					return
+				}
+				e := Entry{UID: "bench-" + strconv.FormatInt(n, 10), Payload: benchPayload(int(n), size)}
+				key, err := newUUID()
+				if err != nil {
+					return
+				}
+				e.IdempotencyKey = key
+				err = e.doImport(ctx)
+				if err != nil && ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				level.requests++
+				level.latencies = append(level.latencies, e.ImportTime)
+				if e.Status == 429 {
+					level.throttled++
+				}
+				if err != nil {
+					level.errors++
+					if level.errors == 1 {
+						logError(Fields{"concurrency": concurrency, "error": err}, "benchmark request failed at concurrency %d: %s", concurrency, err)
+					}
+				} else {
+					level.created = append(level.created, e)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	level.elapsed = time.Since(start)
+	return level
+}
+
+// recommendedLevel returns the lowest concurrency level achieving 90% of the
+// best rate with less than 1% of errors, nil if none does.
+func recommendedLevel(levels []*benchLevel) *benchLevel {
+	best := 0.0
+	for _, l := range levels {
+		if l.errorRatio() < 0.01 && l.rate() > best {
+			best = l.rate()
+		}
+	}
+	for _, l := range levels {
+		if l.errorRatio() < 0.01 && best > 0 && l.rate() >= 0.9*best {
+			return l
+		}
+	}
+	return nil
+}
+
+// cleanUpBench deletes the responses created by the benchmark.
+func cleanUpBench(created []Entry, concurrency int) (deleted, failed int) {
+	queue := make(chan Entry)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range queue {
+				err := e.rollback()
+				mu.Lock()
+				if err != nil {
+					failed++
+					if failed == 1 {
+						logError(Fields{"response_id": *e.ResponseId, "error": err}, "failed to delete benchmark response %s: %s", *e.ResponseId, err)
+					}
+				} else {
+					deleted++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, e := range created {
+		queue <- e
+	}
+	close(queue)
+	wg.Wait()
+	return deleted, failed
+}
+
+func parseLevels(list string) ([]int, error) {
+	var levels []int
+	for _, value := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid concurrency level %q", value)
+		}
+		levels = append(levels, n)
+	}
+	return levels, nil
+}
+
+func printBench(levels []*benchLevel, recommended *benchLevel) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "J\tREQUESTS\tERRORS\tTHROTTLED\tRATE\tP50\tP95\tP99\tMAX")
+	for _, l := range levels {
+		latency := percentiles(append([]int64(nil), l.latencies...))
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%.1f/s\t%dms\t%dms\t%dms\t%dms\n", l.concurrency, l.requests, l.errors, l.throttled,
+			l.rate(), latency.P50, latency.P95, latency.P99, latency.Max)
+	}
+	fmt.Fprintln(w)
+	if recommended == nil {
+		fmt.Fprintln(w, "no level stayed under 1% of errors")
+	} else {
+		fmt.Fprintf(w, "recommended\t-j %d, about %.0f entries/min\n", recommended.concurrency, recommended.rate()*60)
+	}
+	return w.Flush()
+}
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	inheritFlags(fs, "log-format", "config", "request-timeout", "target", "method", "success-status", "response-id-path")
+	apiFlags(fs)
+	levelList := fs.String("levels", "1,2,4,8,16,32", "comma-separated concurrency levels measured, in order")
+	duration := fs.Duration("duration", 10*time.Second, "time spent at each level")
+	requests := fs.Int("requests", 0, "stop each level after this many requests, if before -duration")
+	size := fs.Int("payload-size", 1024, "size in bytes of the synthetic payloads")
+	cleanup := fs.Bool("cleanup", true, "delete the responses created once done")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench -url URL [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	levels, err := parseLevels(*levelList)
+	if err != nil {
+		return err
+	}
+	if *duration <= 0 {
+		return errors.New("-duration must be positive")
+	}
+	if successStatuses, err = parseSuccessStatuses(*argSuccessStatus); err != nil {
+		return err
+	}
+	workers := 0
+	for _, n := range levels {
+		if n > workers {
+			workers = n
+		}
+	}
+	if err := setupAPI(workers); err != nil {
+		return err
+	}
+	defer spans.Close()
+
+	var results []*benchLevel
+	var created []Entry
+	for _, n := range levels {
+		logInfo(Fields{"concurrency": n}, "benchmarking %s with %d workers for %s...", *argURL, n, *duration)
+		level := benchmark(context.Background(), n, *size, *duration, *requests)
+		results = append(results, level)
+		created = append(created, level.created...)
+		logInfo(level.fields(), "concurrency %d: %d requests, %d errors, %.1f/s", n, level.requests, level.errors, level.rate())
+	}
+	recommended := recommendedLevel(results)
+
+	if *cleanup && len(created) > 0 {
+		deleted, failed := cleanUpBench(created, workers)
+		logInfo(Fields{"deleted": deleted, "failed": failed}, "%d benchmark responses deleted, %d failed", deleted, failed)
+	}
+
+	if jsonLogs {
+		report := make([]Fields, len(results))
+		for i, l := range results {
+			report[i] = l.fields()
+		}
+		fields := Fields{"levels": report}
+		if recommended != nil {
+			fields["recommended_j"] = recommended.concurrency
+		}
+		logInfo(fields, "benchmark done")
+		return nil
+	}
+	return printBench(results, recommended)
+}
@@ -0,0 +1,133 @@
+package importer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	argBreakerThreshold   = Flags.Int("breaker-threshold", 10, "consecutive 5xx or network failures opening the circuit breaker (0 disables it)")
+	argBreakerCooldown    = Flags.Duration("breaker-cooldown", 10*time.Second, "initial pause when the circuit breaker opens, doubled on each failed probe")
+	argBreakerMaxCooldown = Flags.Duration("breaker-max-cooldown", 5*time.Minute, "maximum pause of the circuit breaker")
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is a circuit breaker shared by all workers. Once open, requests wait
+// for the cool-down to elapse, then a single probe is let through: its success
+// closes the circuit, its failure opens it again for twice as long.
+type breaker struct {
+	mu          sync.Mutex
+	threshold   int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	state       int
+	failures    int
+	cooldown    time.Duration
+	openUntil   time.Time
+	stateChange chan struct{}
+}
+
+var apiBreaker = newBreaker(0, 0, 0)
+
+func newBreaker(threshold int, cooldown, maxCooldown time.Duration) *breaker {
+	return &breaker{
+		threshold:   threshold,
+		baseDelay:   cooldown,
+		maxDelay:    maxCooldown,
+		cooldown:    cooldown,
+		stateChange: make(chan struct{}),
+	}
+}
+
+func (b *breaker) setState(state int) {
+	b.state = state
+	close(b.stateChange)
+	b.stateChange = make(chan struct{})
+}
+
+// allow blocks until a request may be sent. It reports whether that request
+// is the probe of a half-open circuit.
+func (b *breaker) allow(ctx context.Context) (bool, error) {
+	if b.threshold <= 0 {
+		return false, nil
+	}
+	for {
+		b.mu.Lock()
+		var wait <-chan time.Time
+		switch b.state {
+		case breakerClosed:
+			b.mu.Unlock()
+			return false, nil
+		case breakerOpen:
+			remaining := time.Until(b.openUntil)
+			if remaining <= 0 {
+				b.setState(breakerHalfOpen)
+				b.mu.Unlock()
+				logInfo(nil, "circuit breaker half-open, probing the API")
+				return true, nil
+			}
+			wait = time.After(remaining)
+		}
+		changed := b.stateChange
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-changed:
+		case <-wait:
+		}
+	}
+}
+
+// record feeds the outcome of a request sent after allow returned.
+func (b *breaker) record(probe, failed bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.state == breakerHalfOpen && probe:
+		if failed {
+			b.cooldown *= 2
+			if b.cooldown > b.maxDelay {
+				b.cooldown = b.maxDelay
+			}
+			b.open()
+			return
+		}
+		b.failures = 0
+		b.cooldown = b.baseDelay
+		b.setState(breakerClosed)
+		logInfo(nil, "circuit breaker closed, resuming imports")
+	case b.state == breakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open()
+		}
+	}
+}
+
+func (b *breaker) open() {
+	b.openUntil = time.Now().Add(b.cooldown)
+	b.setState(breakerOpen)
+	logError(Fields{"cooldown_ms": b.cooldown.Milliseconds()}, "API degraded, circuit breaker open for %s", b.cooldown)
+}
+
+// isOpen reports whether requests are held by an open or half-open circuit.
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
@@ -0,0 +1,230 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	argRecordAPI   = Flags.String("record-api", "", "record every API request and its response to this fixture `file`, one JSON object per line, for -replay-api")
+	argReplayAPI   = Flags.String("replay-api", "", "answer the API requests from the responses recorded in this fixture `file` by -record-api instead of sending them, e.g. to test transformations and flags without network access")
+	argReplayMatch = Flags.String("replay-match", "body", "how -replay-api finds the recorded response of a request: body (same method, path, query and body) or path (same method, path and query, in the recorded order)")
+)
+
+// Interaction is an API request and its response, as recorded in a fixture
+// file by -record-api.
+type Interaction struct {
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Body     string            `json:"body,omitempty"`
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Response string            `json:"response"`
+}
+
+func (i *Interaction) key(match string) string {
+	if match == "path" {
+		return i.Method + " " + i.Path
+	}
+	return i.Method + " " + i.Path + "\n" + i.Body
+}
+
+// requestPath returns the path and query of req, the API host being left
+// out so that fixtures replay against any -url.
+func requestPath(req *http.Request) string {
+	if req.URL.RawQuery == "" {
+		return req.URL.Path
+	}
+	return req.URL.Path + "?" + req.URL.RawQuery
+}
+
+// requestBody returns the uncompressed body of req, leaving it readable.
+func requestBody(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return "", nil
+	}
+	var body []byte
+	var err error
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		body, err = ioutil.ReadAll(r)
+		r.Close()
+	} else {
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if err != nil {
+		return "", err
+	}
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		body = gunzip(body)
+	}
+	return string(body), nil
+}
+
+// recorder sends the requests with client and writes them to a fixture file
+// along with their responses.
+type recorder struct {
+	client GaiaClient
+	mu     sync.Mutex
+	out    *os.File
+}
+
+func (r *recorder) Do(req *http.Request) (*http.Response, error) {
+	body, err := requestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	response, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(response))
+	interaction := Interaction{Method: req.Method, Path: requestPath(req), Body: body, Status: resp.StatusCode, Response: string(response)}
+	for name := range resp.Header {
+		if redactedHeaders[name] {
+			continue
+		}
+		if interaction.Headers == nil {
+			interaction.Headers = map[string]string{}
+		}
+		interaction.Headers[name] = resp.Header.Get(name)
+	}
+	line, err := json.Marshal(interaction)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.out.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to record API interaction: %s", err)
+	}
+	return resp, nil
+}
+
+// replayer answers the requests from the interactions of a fixture file,
+// those of the same key in their recorded order, the last one repeating.
+type replayer struct {
+	match        string
+	mu           sync.Mutex
+	interactions map[string][]Interaction
+}
+
+// ReplayError is a request without recorded response in the -replay-api
+// fixtures.
+type ReplayError struct {
+	Method string
+	Path   string
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("no recorded response for %s %s in the -replay-api fixtures", e.Method, e.Path)
+}
+
+func loadReplayer(path, match string) (*replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open fixtures: %s", err)
+	}
+	defer f.Close()
+	r := &replayer{match: match, interactions: map[string][]Interaction{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	n := 0
+	for scanner.Scan() {
+		n++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var i Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &i); err != nil {
+			return nil, fmt.Errorf("invalid fixture at line %d of %s: %s", n, path, err)
+		}
+		key := i.key(match)
+		r.interactions[key] = append(r.interactions[key], i)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read fixtures: %s", err)
+	}
+	return r, nil
+}
+
+func (r *replayer) Do(req *http.Request) (*http.Response, error) {
+	body, err := requestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	key := (&Interaction{Method: req.Method, Path: requestPath(req), Body: body}).key(r.match)
+	r.mu.Lock()
+	recorded := r.interactions[key]
+	if len(recorded) == 0 {
+		r.mu.Unlock()
+		return nil, &ReplayError{req.Method, requestPath(req)}
+	}
+	i := recorded[0]
+	if len(recorded) > 1 {
+		r.interactions[key] = recorded[1:]
+	}
+	r.mu.Unlock()
+	header := http.Header{}
+	for name, value := range i.Headers {
+		header.Set(name, value)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", i.Status, http.StatusText(i.Status)),
+		StatusCode:    i.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(i.Response)),
+		ContentLength: int64(len(i.Response)),
+		Request:       req,
+	}, nil
+}
+
+// setupCassette returns client recording its interactions with -record-api,
+// or the replayer of the -replay-api fixtures.
+func setupCassette(client GaiaClient) (GaiaClient, error) {
+	switch {
+	case *argRecordAPI != "" && *argReplayAPI != "":
+		return nil, errors.New("-record-api and -replay-api cannot be combined")
+	case *argReplayMatch != "body" && *argReplayMatch != "path":
+		return nil, fmt.Errorf("unknown -replay-match %q, expected body or path", *argReplayMatch)
+	case *argReplayAPI != "":
+		r, err := loadReplayer(*argReplayAPI, *argReplayMatch)
+		if err != nil {
+			return nil, err
+		}
+		logInfo(Fields{"replay_api": *argReplayAPI}, "replaying the API responses recorded in %s", *argReplayAPI)
+		return r, nil
+	case *argRecordAPI != "":
+		out, err := os.OpenFile(*argRecordAPI, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open fixtures: %s", err)
+		}
+		logInfo(Fields{"record_api": *argRecordAPI}, "recording the API interactions to %s", *argRecordAPI)
+		return &recorder{client: client, out: out}, nil
+	}
+	return client, nil
+}
@@ -0,0 +1,134 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var argCheckpoint = Flags.String("checkpoint", "", "record progress in this JSON `file` instead of the database, which is then only read")
+
+// CheckpointError describes an entry that failed to import in checkpoint
+// mode, since the database cannot keep it.
+type CheckpointError struct {
+	UID    string `json:"uid"`
+	Error  string `json:"error"`
+	Class  string `json:"class"`
+	Status int    `json:"status,omitempty"`
+}
+
+// Checkpoint is the content of the checkpoint file: every entry up to Cursor
+// has been processed, over all runs.
+type Checkpoint struct {
+	Cursor    string            `json:"cursor"`
+	Imported  int               `json:"imported"`
+	Errored   int               `json:"errored"`
+	Errors    []CheckpointError `json:"errors"`
+	UpdatedAt string            `json:"updated_at"`
+}
+
+// checkpointStore keeps the outcome of imports in a checkpoint file, so that
+// the underlying store, a read-only replica or a snapshot, is never written
+// to.
+type checkpointStore struct {
+	Store
+	path       string
+	mu         sync.Mutex
+	checkpoint Checkpoint
+	scheduled  []string
+	done       map[string]bool
+}
+
+func openCheckpoint(store Store, path string) (*checkpointStore, error) {
+	s := &checkpointStore{Store: store, path: path, done: make(map[string]bool)}
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &s.checkpoint); err != nil {
+			return nil, err
+		}
+	}
+	store.SetPendingAfter(s.checkpoint.Cursor)
+	return s, nil
+}
+
+// track registers entries about to be processed, in uid order: the cursor
+// only moves past an entry once it and all those before it are done.
+func (s *checkpointStore) track(entries []Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range entries {
+		s.scheduled = append(s.scheduled, entry.UID)
+	}
+}
+
+func (s *checkpointStore) CountPending(uids []string) (int, error) {
+	s.mu.Lock()
+	s.Store.SetPendingAfter(s.checkpoint.Cursor)
+	s.mu.Unlock()
+	return s.Store.CountPending(uids)
+}
+
+func (s *checkpointStore) WriteStatus(updates []StatusUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, update := range updates {
+		e := &update.Entry
+		s.done[e.UID] = true
+		if update.Imported {
+			s.checkpoint.Imported++
+			continue
+		}
+		s.checkpoint.Errored++
+		s.checkpoint.Errors = append(s.checkpoint.Errors, CheckpointError{
+			UID:    e.UID,
+			Error:  e.Err.Error(),
+			Class:  classifyError(e.Err),
+			Status: e.Status,
+		})
+	}
+	for len(s.scheduled) > 0 && s.done[s.scheduled[0]] {
+		s.checkpoint.Cursor = s.scheduled[0]
+		delete(s.done, s.scheduled[0])
+		s.scheduled = s.scheduled[1:]
+	}
+	return s.save()
+}
+
+// SetIdempotencyKey keeps keys for the current run only.
+func (s *checkpointStore) SetIdempotencyKey(e *Entry, key string) error {
+	return nil
+}
+
+func (s *checkpointStore) Claim(e *Entry, instance string, expiry time.Duration) (bool, error) {
+	return false, errors.New("claiming entries is not possible with a checkpoint file")
+}
+
+func (s *checkpointStore) save() error {
+	s.checkpoint.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.MarshalIndent(s.checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,239 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var argChecksum = Flags.Bool("checksum", false, "compute the checksum of the imported entries, their uids and payloads, at the end of the run and record it in the runs table, for verify-checksum")
+
+// checksumPrefix starts every checksum, naming its algorithm.
+const checksumPrefix = "sha256:"
+
+// Checksum is the checksum of the imported entries of a database: the sum,
+// modulo 2^256, of the SHA-256 of the uid and payload hash of each of them,
+// the same whatever the order the database returns them in.
+type Checksum struct {
+	Sum     string
+	Entries int
+}
+
+func (c Checksum) String() string {
+	return fmt.Sprintf("%s (%d entries)", c.Sum, c.Entries)
+}
+
+// addDigest adds digest to sum, both big-endian 256-bit numbers, dropping
+// the carry out of the last byte.
+func addDigest(sum *[sha256.Size]byte, digest []byte) {
+	carry := 0
+	for i := sha256.Size - 1; i >= 0; i-- {
+		n := int(sum[i]) + int(digest[i]) + carry
+		sum[i], carry = byte(n), n>>8
+	}
+}
+
+// entryDigest returns the hash of the uid and payload of an imported entry.
+func entryDigest(uid, payload string) []byte {
+	payloadHash := sha256.Sum256([]byte(payload))
+	h := sha256.New()
+	h.Write([]byte(uid))
+	h.Write([]byte{0})
+	h.Write(payloadHash[:])
+	return h.Sum(nil)
+}
+
+// checksumPayload returns payload as sent: decrypted, uncompressed and read
+// from its file if it references one.
+func checksumPayload(payload string) (string, error) {
+	payload, err := decodePayload(payload)
+	if err != nil {
+		return "", err
+	}
+	if path, ok := payloadPath(payload); ok {
+		return readPayloadFile(path)
+	}
+	return payload, nil
+}
+
+// Checksum computes the checksum of the imported entries, those with a
+// response_id, reading them by pages of pageSize.
+func (s *sqlStore) Checksum(pageSize int) (Checksum, error) {
+	var sum [sha256.Size]byte
+	entries := 0
+	for after := ""; ; {
+		rows, err := s.query("SELECT uid, payload FROM imports WHERE response_id IS NOT NULL AND uid > ? ORDER BY uid LIMIT ?", after, pageSize)
+		if err != nil {
+			return Checksum{}, err
+		}
+		n := 0
+		for rows.Next() {
+			var uid, payload string
+			if err := rows.Scan(&uid, &payload); err != nil {
+				rows.Close()
+				return Checksum{}, err
+			}
+			if payload, err = checksumPayload(payload); err != nil {
+				rows.Close()
+				return Checksum{}, fmt.Errorf("failed to read payload of %s: %s", uid, err)
+			}
+			addDigest(&sum, entryDigest(uid, payload))
+			after = uid
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return Checksum{}, err
+		}
+		entries += n
+		if n < pageSize {
+			break
+		}
+	}
+	return Checksum{checksumPrefix + hex.EncodeToString(sum[:]), entries}, nil
+}
+
+// recordChecksum computes the checksum of the imported entries of store
+// into r, for -checksum.
+func recordChecksum(store Store, r *Run) {
+	if k, ok := store.(*kafkaStore); ok {
+		store = k.Store
+	}
+	s, ok := store.(*sqlStore)
+	if !ok || !s.has("runs", "checksum") {
+		logError(nil, "-checksum needs a -db database with the checksum column of the runs table, run migrate first")
+		return
+	}
+	c, err := s.Checksum(*argPageSize)
+	if err != nil {
+		logError(Fields{"error": err}, "failed to compute checksum: %s", err)
+		return
+	}
+	r.Checksum = sql.NullString{String: c.Sum, Valid: true}
+	r.ChecksumEntries = c.Entries
+	logInfo(Fields{"checksum": c.Sum, "entries": c.Entries}, "checksum of the imported entries: %s", c)
+}
+
+// lastChecksum returns the checksum recorded by the latest run with one.
+func (s *sqlStore) lastChecksum() (Checksum, string, error) {
+	var c Checksum
+	var runID string
+	err := s.db.QueryRow(s.dialect.rebind("SELECT id, checksum, COALESCE(checksum_entries, 0) FROM runs WHERE checksum IS NOT NULL ORDER BY finished_at DESC LIMIT 1")).Scan(&runID, &c.Sum, &c.Entries)
+	return c, runID, err
+}
+
+// parseChecksum reads a checksum given to verify-checksum, with or without
+// its entry count, as printed by verify-checksum.
+func parseChecksum(value string) (Checksum, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], checksumPrefix) || len(fields[0]) != len(checksumPrefix)+64 {
+		return Checksum{}, fmt.Errorf("invalid checksum %q, expected %s followed by 64 hexadecimal digits", value, checksumPrefix)
+	}
+	if _, err := hex.DecodeString(strings.TrimPrefix(fields[0], checksumPrefix)); err != nil {
+		return Checksum{}, fmt.Errorf("invalid checksum %q: %s", value, err)
+	}
+	c := Checksum{Sum: fields[0], Entries: -1}
+	if len(fields) > 1 {
+		if _, err := fmt.Sscanf(strings.Join(fields[1:], " "), "(%d entries)", &c.Entries); err != nil {
+			return Checksum{}, fmt.Errorf("invalid checksum %q, expected an entry count such as (42 entries)", value)
+		}
+	}
+	return c, nil
+}
+
+// ErrChecksumMismatch is returned by verify-checksum when the checksums
+// differ.
+var ErrChecksumMismatch = errors.New("checksums differ")
+
+func runVerifyChecksum(args []string) error {
+	fs := flag.NewFlagSet("verify-checksum", flag.ExitOnError)
+	commonFlags(fs)
+	inheritFlags(fs, "page-size")
+	expect := fs.String("expect", "", "checksum to compare with, as printed by verify-checksum or recorded by -checksum in another environment")
+	db2 := fs.String("db2", "", "database whose checksum to compare with that of -db")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify-checksum [-expect CHECKSUM | -db2 other.db] [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *expect != "" && *db2 != "" {
+		return errors.New("-expect and -db2 cannot be combined")
+	}
+
+	checksumOf := func(dsn string) (*sqlStore, Checksum, error) {
+		db, d, err := openDB(dsn)
+		if err != nil {
+			return nil, Checksum{}, fmt.Errorf("failed to open database %s: %s", redactDSN(dsn), err)
+		}
+		s := &sqlStore{db: db, dialect: d}
+		if err := s.detectSchema(); err != nil {
+			db.Close()
+			return nil, Checksum{}, err
+		}
+		c, err := s.Checksum(*argPageSize)
+		if err != nil {
+			db.Close()
+			return nil, Checksum{}, fmt.Errorf("failed to compute checksum of %s: %s", redactDSN(dsn), err)
+		}
+		return s, c, nil
+	}
+	s, got, err := checksumOf(*argDb)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var want Checksum
+	var against string
+	switch {
+	case *expect != "":
+		if want, err = parseChecksum(*expect); err != nil {
+			return err
+		}
+		against = "-expect"
+	case *db2 != "":
+		other, c, err := checksumOf(*db2)
+		if err != nil {
+			return err
+		}
+		other.Close()
+		want, against = c, redactDSN(*db2)
+	default:
+		if !s.has("runs", "checksum") {
+			return errors.New("the runs table has no checksum column, run migrate first or give -expect or -db2")
+		}
+		c, runID, err := s.lastChecksum()
+		if err == sql.ErrNoRows {
+			return errors.New("no run recorded a checksum, run with -checksum or give -expect or -db2")
+		} else if err != nil {
+			return fmt.Errorf("failed to query runs: %s", err)
+		}
+		want, against = c, "run "+runID
+	}
+
+	match := got.Sum == want.Sum && (want.Entries < 0 || got.Entries == want.Entries)
+	if jsonLogs {
+		logInfo(Fields{"checksum": got.Sum, "entries": got.Entries, "expected": want.Sum, "against": against, "match": match}, "checksum of %s: %s", redactDSN(*argDb), got)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "%s\t%s\n", redactDSN(*argDb), got)
+		if want.Entries < 0 {
+			fmt.Fprintf(w, "%s\t%s\n", against, want.Sum)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\n", against, want)
+		}
+		w.Flush()
+	}
+	if !match {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package importer
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	argHTTPTimeout     = Flags.Duration("http-timeout", time.Minute, "timeout of each API request, including reading the response (0 disables it)")
+	argRequestTimeout  = Flags.Duration("request-timeout", 0, "maximum time spent sending an entry or a batch, including 429 retries and circuit breaker waits (0 disables it)")
+	argMaxConns        = Flags.Int("max-conns", 0, "maximum number of connections to the API (0 means unlimited)")
+	argMaxIdleConns    = Flags.Int("max-idle-conns", 0, "maximum number of idle connections kept for reuse (defaults to -j)")
+	argIdleConnTimeout = Flags.Duration("idle-conn-timeout", 90*time.Second, "time after which an idle connection is closed")
+	argProxy           = Flags.String("proxy", "", "HTTP or HTTPS proxy URL (defaults to the HTTP_PROXY/HTTPS_PROXY environment variables)")
+)
+
+// GaiaClient sends the HTTP requests of the importer to the API. The default
+// implementation is an *http.Client set up from the flags; WithClient injects
+// another one, e.g. a fake in tests or the client of an embedding program.
+type GaiaClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+var httpClient GaiaClient = http.DefaultClient
+
+// sendRequest sends req with the -header headers, after the pause asked by the API if it is
+// throttling, and again after the delay it asks for each time it answers
+// with 429 Too Many Requests, up to -throttle-retries times. With -gzip, the
+// body is compressed until the API refuses it.
+func sendRequest(req *http.Request) (*http.Response, time.Duration, error) {
+	setHeaders(req)
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	var uncompressed func() (io.ReadCloser, error)
+	if gzipEnabled() && req.Header.Get("Content-Encoding") == "" && req.GetBody != nil && req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if uncompressed, err = compressRequest(req); err != nil {
+			return nil, 0, err
+		}
+	}
+	apiRetries.sent()
+	for attempt := 0; ; attempt++ {
+		if err := apiThrottle.wait(req.Context()); err != nil {
+			return nil, 0, err
+		}
+		resp, elapsed, err := slowRequests.send(req)
+		logAttempt(req, resp, elapsed, err)
+		if err == nil && uncompressed != nil && resp.StatusCode == http.StatusUnsupportedMediaType {
+			rejectGzip()
+			drain(resp)
+			if err := uncompressRequest(req, uncompressed); err != nil {
+				return nil, elapsed, err
+			}
+			uncompressed = nil
+			attempt--
+			continue
+		}
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= *argThrottleRetries || !apiRetries.allow() {
+			return resp, elapsed, err
+		}
+		if err := rewind(req); err != nil {
+			return resp, elapsed, nil
+		}
+		apiThrottle.pause(retryAfter(resp))
+		drain(resp)
+	}
+}
+
+// sendOnce sends req to the API through the circuit breaker, recording
+// metrics.
+func sendOnce(req *http.Request) (*http.Response, time.Duration, error) {
+	probe, err := apiBreaker.allow(req.Context())
+	if err != nil {
+		return nil, 0, err
+	}
+	// The request is signed once the circuit let it through, so that its
+	// timestamp is that of its sending, whatever the wait for a closed circuit.
+	if requestSigner != nil {
+		if err := requestSigner.Sign(req); err != nil {
+			apiBreaker.record(probe, true)
+			return nil, 0, err
+		}
+	}
+	_, requestSpan := startSpan(req.Context(), "HTTP "+req.Method, spanKindClient)
+	if requestSpan != nil {
+		req.Header.Set("traceparent", requestSpan.traceparent())
+		requestSpan.set("http.method", req.Method)
+		requestSpan.set("http.url", req.URL.String())
+	}
+	importMetrics.requestStarted()
+	apiTracer.request(req)
+	id := apiRequests.start(req)
+	start := time.Now()
+	resp, err := httpClient.Do(apiConns.trace(req))
+	elapsed := time.Since(start)
+	apiTracer.response(req, resp, elapsed, err)
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+		apiConns.response(resp)
+	}
+	apiRequests.done(id, status, elapsed, err)
+	importHealth.response(status)
+	importMetrics.requestDone(status, elapsed)
+	requestSpan.set("http.status_code", status)
+	if err == nil && status >= 500 {
+		requestSpan.finish(fmt.Errorf("HTTP %d", status))
+	} else {
+		requestSpan.finish(err)
+	}
+	degraded := err != nil || status >= 500
+	cancelled := req.Context().Err() != nil
+	// A probe cut short, e.g. by -request-timeout, does not show the API
+	// recovered: it opens the circuit again, where other cancelled requests
+	// are not counted.
+	apiBreaker.record(probe, degraded && (!cancelled || probe))
+	concurrencyTuner.observe(status, err != nil && !cancelled, elapsed)
+	return resp, elapsed, err
+}
+
+// apiFlags registers into fs the flags needed by commands calling the API.
+func apiFlags(fs *flag.FlagSet) {
+	inheritFlags(fs, "url", "token", "token-source", "auth", "oauth-token-url", "oauth-client-id", "oauth-client-secret", "oauth-scope",
+		"http-timeout", "max-conns", "max-idle-conns", "idle-conn-timeout", "proxy",
+		"tls-cert", "tls-key", "tls-ca", "tls-pin",
+		"breaker-threshold", "breaker-cooldown", "breaker-max-cooldown", "trace", "trace-file",
+		"throttle-retries", "throttle-delay", "max-throttle-delay", "gzip", "otel", "max-bandwidth", "http1",
+		"hmac-key", "hmac-header", "hmac-timestamp-header", "user-agent")
+}
+
+// setupAPI prepares the HTTP client, credentials, circuit breaker and tracer used to
+// call the API.
+func setupAPI(concurrency int) error {
+	var err error
+	if authenticator, err = newAuthenticator(); err != nil {
+		if len(tenants) == 0 {
+			return err
+		}
+		authenticator = &missingAuth{}
+	}
+	if err := setupBandwidth(); err != nil {
+		return err
+	}
+	if requestSigner, err = newSigner(); err != nil {
+		return err
+	}
+	apiConns = newConnStats()
+	setupUserAgent("")
+	if httpClient, err = newHTTPClient(concurrency); err != nil {
+		return err
+	}
+	apiBreaker = newBreaker(*argBreakerThreshold, *argBreakerCooldown, *argBreakerMaxCooldown)
+	setupOtel()
+	setupAuthTokenHeader()
+	if err := setupRetryBudget(); err != nil {
+		return err
+	}
+	return setupTrace()
+}
+
+func newHTTPClient(concurrency int) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: apiConns.countDial(apiBandwidth.limitDial((&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext)),
+		ForceAttemptHTTP2:     true,
+		MaxConnsPerHost:       *argMaxConns,
+		MaxIdleConns:          *argMaxIdleConns,
+		MaxIdleConnsPerHost:   *argMaxIdleConns,
+		IdleConnTimeout:       *argIdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if transport.MaxIdleConns == 0 {
+		transport.MaxIdleConns = concurrency
+		transport.MaxIdleConnsPerHost = concurrency
+	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	if *argProxy != "" {
+		proxy, err := url.Parse(*argProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if *argHTTP1 {
+		disableHTTP2(transport)
+	}
+	return &http.Client{Transport: transport, Timeout: *argHTTPTimeout}, nil
+}
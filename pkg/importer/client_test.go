@@ -0,0 +1,78 @@
+package importer
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// setupTestAPI sends the requests of sendOnce to client through a circuit
+// breaker opening after one failure for cooldown, restoring the previous ones
+// at the end of the test.
+func setupTestAPI(t *testing.T, client GaiaClient, cooldown time.Duration) {
+	previousClient, previousBreaker := httpClient, apiBreaker
+	httpClient, apiBreaker = client, newBreaker(1, cooldown, cooldown)
+	t.Cleanup(func() { httpClient, apiBreaker = previousClient, previousBreaker })
+}
+
+// timeSigner records the time requests are signed at.
+type timeSigner struct {
+	signed time.Time
+}
+
+func (s *timeSigner) Sign(req *http.Request) error {
+	s.signed = time.Now()
+	return nil
+}
+
+func TestSignAfterBreakerWait(t *testing.T) {
+	setupTestAPI(t, &fakeClient{}, 50*time.Millisecond)
+	signer := &timeSigner{}
+	previousSigner := requestSigner
+	requestSigner = signer
+	t.Cleanup(func() { requestSigner = previousSigner })
+
+	opened := time.Now()
+	apiBreaker.record(false, true)
+	req, err := http.NewRequest(http.MethodGet, "https://gaia.test/v2/responses", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sendOnce(req); err != nil {
+		t.Fatal(err)
+	}
+	if waited := signer.signed.Sub(opened); waited < 50*time.Millisecond {
+		t.Errorf("request signed %s after the circuit opened, want it signed once the cool-down elapsed", waited)
+	}
+}
+
+// hangingClient answers no request before it is cancelled.
+type hangingClient struct{}
+
+func (hangingClient) Do(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestCancelledProbeOpensCircuit(t *testing.T) {
+	setupTestAPI(t, hangingClient{}, 10*time.Millisecond)
+	apiBreaker.record(false, true)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, "https://gaia.test/v2/responses", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sendOnce(req.WithContext(ctx)); err == nil {
+		t.Fatal("got no error from a request timing out")
+	}
+	apiBreaker.mu.Lock()
+	state := apiBreaker.state
+	apiBreaker.mu.Unlock()
+	if state != breakerOpen {
+		t.Errorf("got circuit state %d after its probe timed out, want it open again", state)
+	}
+}
@@ -0,0 +1,175 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var argRequireColumns = Flags.Bool("require-columns", false, "fail at start unless the database has all the tables and columns of the current schema, e.g. to validate a prepared database in CI")
+
+// coreColumns are the columns of the imports table no run can do without.
+var coreColumns = []string{"uid", "payload", "response_id", "imported_at"}
+
+// errNoImportsTable is the failure of detectSchema to read the imports table,
+// which the commands creating it expect.
+var errNoImportsTable = errors.New("failed to read the imports table, run init-db first")
+
+// detectSchema records the tables and columns of the current schema the
+// database lacks, as table or table.column, which queries then leave out.
+func (s *sqlStore) detectSchema() error {
+	missing := map[string]bool{}
+	for _, t := range append([]table{{"imports", importColumns(), ""}}, tables...) {
+		rows, err := s.query("SELECT * FROM " + t.name + " WHERE 1 = 0")
+		if err != nil {
+			if t.name == "imports" {
+				return fmt.Errorf("%w: %s", errNoImportsTable, err)
+			}
+			missing[t.name] = true
+			continue
+		}
+		names, err := rows.Columns()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		existing := make(map[string]bool, len(names))
+		for _, name := range names {
+			existing[strings.ToLower(name)] = true
+		}
+		for _, c := range t.columns {
+			if !existing[c.name] {
+				missing[t.name+"."+c.name] = true
+			}
+		}
+	}
+	s.missing = missing
+	return nil
+}
+
+// has tells whether the database has column of table, or table itself if
+// column is empty, assuming it does unless detectSchema found otherwise.
+func (s *sqlStore) has(table, column string) bool {
+	if s.missing[table] {
+		return false
+	}
+	return column == "" || !s.missing[table+"."+column]
+}
+
+// col returns column of the imports table to use in a query, NULL if the
+// database lacks it.
+func (s *sqlStore) col(column string) string {
+	if !s.has("imports", column) {
+		return "NULL"
+	}
+	return column
+}
+
+// assignment is a column set by an UPDATE or INSERT statement.
+type assignment struct {
+	column string
+	value  interface{}
+}
+
+// updateQuery returns the UPDATE of the assignments of table the database
+// has columns for, followed by where, and its arguments.
+func (s *sqlStore) updateQuery(table string, assignments []assignment, where string, whereArgs ...interface{}) (string, []interface{}) {
+	var set []string
+	var args []interface{}
+	for _, a := range assignments {
+		if s.has(table, a.column) {
+			set = append(set, a.column+" = ?")
+			args = append(args, a.value)
+		}
+	}
+	return "UPDATE " + table + " SET " + strings.Join(set, ", ") + " WHERE " + where, append(args, whereArgs...)
+}
+
+// insertQuery returns the INSERT of the assignments of table the database
+// has columns for, and its arguments.
+func (s *sqlStore) insertQuery(table string, assignments []assignment) (string, []interface{}) {
+	var names []string
+	var args []interface{}
+	for _, a := range assignments {
+		if s.has(table, a.column) {
+			names = append(names, a.column)
+			args = append(args, a.value)
+		}
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(names, ", ") + ") VALUES (" + placeholders(len(names)) + ")", args
+}
+
+// schemaStore returns the database store behind store, if any.
+func schemaStore(store Store) *sqlStore {
+	switch s := store.(type) {
+	case *sqlStore:
+		return s
+	case *kafkaStore:
+		return schemaStore(s.Store)
+	case *checkpointStore:
+		return schemaStore(s.Store)
+	}
+	return nil
+}
+
+// checkSchema detects the schema of the database of store, failing with
+// -require-columns if it lacks anything, or if the flags need a column it
+// lacks, and otherwise warning about what is left out.
+func checkSchema(store Store) error {
+	s := schemaStore(store)
+	if s == nil {
+		return nil
+	}
+	if err := s.detectSchema(); err != nil {
+		return err
+	}
+	if len(s.missing) == 0 {
+		return nil
+	}
+	for _, column := range coreColumns {
+		if !s.has("imports", column) {
+			return fmt.Errorf("the imports table has no %s column", column)
+		}
+	}
+	missing := make([]string, 0, len(s.missing))
+	for name := range s.missing {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	if *argRequireColumns {
+		return fmt.Errorf("the database lacks %s, run migrate to add them", strings.Join(missing, ", "))
+	}
+	needs := []struct {
+		enabled bool
+		flag    string
+		columns []string
+	}{
+		{*argClaim, "-claim", []string{"claimed_by", "claimed_at"}},
+		{*argPriority, "-priority", []string{"priority"}},
+		{*argOrderedGroups, "-ordered-groups", []string{"group_key"}},
+		{*argDedupe != "none", "-dedupe", []string{"duplicate_of"}},
+		{len(argResponseFields) > 0, "-response-field", argResponseFields.columns()},
+	}
+	for _, need := range needs {
+		if !need.enabled {
+			continue
+		}
+		for _, column := range need.columns {
+			if !s.has("imports", column) {
+				return fmt.Errorf("%s needs the %s column, run migrate to add it", need.flag, column)
+			}
+		}
+	}
+	logInfo(Fields{"missing": missing}, "the database lacks %s, left out until migrate adds them", strings.Join(missing, ", "))
+	return nil
+}
+
+// checkTenantColumn fails if tenants are configured but the database has no
+// tenant column to route entries with.
+func checkTenantColumn(store Store) error {
+	if s := schemaStore(store); s != nil && len(tenants) > 0 && !s.has("imports", "tenant") {
+		return errors.New("tenants need the tenant column, run migrate to add it")
+	}
+	return nil
+}
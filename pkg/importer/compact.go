@@ -0,0 +1,128 @@
+package importer
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var (
+	argCompactAfter    = Flags.Int("compact-after", 0, "compact the database after runs importing at least this `number` of entries, vacuuming SQLite databases, 0 to never compact")
+	argCompactPayloads = Flags.Bool("compact-payloads", false, "with -compact-after, also drop the payloads of the imported entries, keeping their results")
+)
+
+// importedCondition selects the imported entries whose payload is kept.
+const importedCondition = "imported_at IS NOT NULL AND payload <> ''"
+
+// dropImportedPayloads empties the payloads of the imported entries matching
+// condition, with their archived response bodies if responses is set, and
+// returns the number of entries changed.
+func (s *sqlStore) dropImportedPayloads(condition string, args []interface{}, responses bool) (int64, error) {
+	assignments := "payload = ''"
+	if s.has("imports", "auth_token") {
+		assignments += ", auth_token = NULL"
+	}
+	if responses {
+		assignments += ", response_body = NULL"
+	}
+	result, err := s.exec("UPDATE imports SET "+assignments+" WHERE "+condition, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	return n, nil
+}
+
+// size returns the size in bytes of a SQLite database.
+func (s *sqlStore) size() (int64, error) {
+	var pages, pageBytes int64
+	if err := s.db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, err
+	}
+	if err := s.db.QueryRow("PRAGMA page_size").Scan(&pageBytes); err != nil {
+		return 0, err
+	}
+	return pages * pageBytes, nil
+}
+
+// vacuum rebuilds a SQLite database to reclaim its free space, and returns
+// its size before and after.
+func (s *sqlStore) vacuum() (int64, int64, error) {
+	before, err := s.size()
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := s.exec("VACUUM"); err != nil {
+		return 0, 0, fmt.Errorf("failed to vacuum database: %s", err)
+	}
+	after, err := s.size()
+	return before, after, err
+}
+
+// compact drops the payloads of the imported entries if payloads is set,
+// then vacuums SQLite databases.
+func (s *sqlStore) compact(payloads, responses bool) error {
+	if payloads {
+		n, err := s.dropImportedPayloads(importedCondition, nil, responses)
+		if err != nil {
+			return fmt.Errorf("failed to drop payloads: %s", err)
+		}
+		logInfo(Fields{"scrubbed": n}, "payloads of %d imported entries removed", n)
+	}
+	if s.dialect.driver != "sqlite3" {
+		logInfo(nil, "not vacuuming the %s database, left to its own maintenance", s.dialect.driver)
+		return nil
+	}
+	logInfo(Fields{"db": redactDSN(*argDb)}, "vacuuming %s...", redactDSN(*argDb))
+	before, after, err := s.vacuum()
+	if err != nil {
+		return err
+	}
+	logInfo(Fields{"size": after, "reclaimed": before - after}, "%s is now %d bytes, %d reclaimed", redactDSN(*argDb), after, before-after)
+	return nil
+}
+
+// compactAfterRun compacts the database after a run importing at least
+// -compact-after entries.
+func (im *Importer) compactAfterRun(prog *progress) {
+	s := schemaStore(im.store)
+	if *argCompactAfter <= 0 || s == nil {
+		return
+	}
+	prog.mu.Lock()
+	imported := prog.imported
+	prog.mu.Unlock()
+	if imported < *argCompactAfter {
+		return
+	}
+	if err := s.compact(*argCompactPayloads, false); err != nil {
+		logError(Fields{"error": err}, "failed to compact database: %s", err)
+	}
+}
+
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	commonFlags(fs)
+	payloads := fs.Bool("payloads", false, "also drop the payloads of the imported entries, keeping their results")
+	responses := fs.Bool("responses", false, "with -payloads, also remove their archived response bodies")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compact [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *responses && !*payloads {
+		return errors.New("-responses needs -payloads")
+	}
+
+	db, d, err := openDB(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	defer s.Close()
+	s.detectSchema()
+	return s.compact(*payloads, *responses)
+}
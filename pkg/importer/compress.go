@@ -0,0 +1,191 @@
+package importer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// gzipMagic starts every gzip stream, which tells compressed payloads apart
+// from JSON ones.
+const gzipMagic = "\x1f\x8b"
+
+func isCompressed(payload string) bool {
+	return len(payload) >= 2 && payload[:2] == gzipMagic
+}
+
+func compressPayload(payload string) (string, error) {
+	if isCompressed(payload) {
+		return payload, nil
+	}
+	var b bytes.Buffer
+	w, err := gzip.NewWriterLevel(&b, gzip.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write([]byte(payload)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	// Small payloads are left uncompressed when gzip would make them larger.
+	if b.Len() >= len(payload) {
+		return payload, nil
+	}
+	return b.String(), nil
+}
+
+// decompressPayload returns payload uncompressed, as is if it is not.
+func decompressPayload(payload string) (string, error) {
+	if !isCompressed(payload) {
+		return payload, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader([]byte(payload)))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// payloadArg returns payload as a query argument, compressed payloads being
+// stored as BLOBs.
+func payloadArg(payload string) interface{} {
+	if isCompressed(payload) {
+		return []byte(payload)
+	}
+	return payload
+}
+
+// checkCompression checks the compression algorithm and that the database
+// can hold compressed payloads.
+func checkCompression(algorithm, dsn string) error {
+	if algorithm != "gzip" {
+		return fmt.Errorf("unsupported compression %q, only gzip is supported", algorithm)
+	}
+	if d, _ := parseDSN(dsn); d.driver != "sqlite3" {
+		return errors.New("compressed payloads can only be stored in SQLite databases")
+	}
+	return nil
+}
+
+func runCompress(args []string) error {
+	fs := flag.NewFlagSet("compress", flag.ExitOnError)
+	commonFlags(fs)
+	algorithm := fs.String("algorithm", "gzip", "compression algorithm of the payloads")
+	decompress := fs.Bool("decompress", false, "decompress the compressed payloads instead")
+	pageSize := fs.Int("page-size", 1000, "number of rows rewritten per transaction")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compress [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := checkCompression(*algorithm, *argDb); err != nil {
+		return err
+	}
+
+	db, d, err := openDB(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	defer s.Close()
+
+	transform := compressPayload
+	if *decompress {
+		transform = decompressPayload
+	}
+	// Encrypted payloads are decrypted to be (de)compressed, then encrypted
+	// again.
+	convert := func(payload string) (string, error) {
+		plain, err := openPayload(payload)
+		if err != nil {
+			return "", err
+		}
+		if plain, err = transform(plain); err != nil || !isSealed(payload) {
+			return plain, err
+		}
+		return sealPayload(plain)
+	}
+	rewritten := 0
+	for after := ""; ; {
+		n, last, err := s.rewritePayloads(after, *pageSize, convert)
+		if err != nil {
+			return fmt.Errorf("failed to rewrite payloads: %s", err)
+		}
+		rewritten += n
+		if last == "" {
+			break
+		}
+		after = last
+	}
+	logInfo(Fields{"rewritten": rewritten}, "%d payloads rewritten, reclaiming space...", rewritten)
+	_, size, err := s.vacuum()
+	if err != nil {
+		return err
+	}
+	logInfo(Fields{"size": size}, "%s is now %d bytes", *argDb, size)
+	return nil
+}
+
+// rewritePayloads converts the payloads of a page of rows after the given
+// uid, and returns the number of rewritten payloads and the last uid of the
+// page, empty after the last page.
+func (s *sqlStore) rewritePayloads(after string, limit int, convert func(string) (string, error)) (int, string, error) {
+	rows, err := s.query("SELECT uid, payload FROM imports WHERE uid > ? ORDER BY uid LIMIT ?", after, limit)
+	if err != nil {
+		return 0, "", err
+	}
+	var records []loadRecord
+	for rows.Next() {
+		var r loadRecord
+		if err := rows.Scan(&r.UID, &r.Payload); err != nil {
+			rows.Close()
+			return 0, "", err
+		}
+		records = append(records, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	n := 0
+	for _, r := range records {
+		payload, err := convert(r.Payload)
+		if err != nil {
+			tx.Rollback()
+			return 0, "", fmt.Errorf("uid %s: %s", r.UID, err)
+		}
+		if payload == r.Payload {
+			continue
+		}
+		if _, err := tx.Exec(s.dialect.rebind("UPDATE imports SET payload = ? WHERE uid = ?"), payloadArg(payload), r.UID); err != nil {
+			tx.Rollback()
+			return 0, "", fmt.Errorf("uid %s: %s", r.UID, err)
+		}
+		n++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+	if len(records) < limit {
+		return n, "", nil
+	}
+	return n, records[len(records)-1].UID, nil
+}
@@ -0,0 +1,116 @@
+package importer
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const envPrefix = "GAIA_"
+
+// Flags holds the settings of the import command, set from the command line
+// by ParseFlags, then from the options of New by the Importer it creates.
+var Flags = flag.NewFlagSet("gaia-responses-importer", flag.ExitOnError)
+
+var argConfig = Flags.String("config", os.Getenv(envPrefix+"CONFIG"), "path to a YAML config file holding flag values")
+
+// envName returns the environment variable holding the value of a flag, e.g.
+// GAIA_MAX_IDLE_CONNS for -max-idle-conns.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+func loadConfigFile(path string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+	return values, nil
+}
+
+// fixedSettings are the flags of the import command given on the command line
+// or in the environment, which take precedence over the config file when it
+// is reloaded as well.
+var fixedSettings = map[string]bool{}
+
+// resetFlags sets Flags back to their defaults, as if none had been given.
+func resetFlags() {
+	fresh := flag.NewFlagSet(Flags.Name(), flag.ExitOnError)
+	Flags.VisitAll(func(f *flag.Flag) {
+		if list, ok := f.Value.(interface{ reset() }); ok {
+			list.reset()
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		fresh.Var(f.Value, f.Name, f.Usage)
+	})
+	fresh.Usage = Flags.Usage
+	*Flags = *fresh
+	fixedSettings = map[string]bool{}
+}
+
+// applyConfig completes the flags of fs not given on the command line from
+// the environment, then from the config file.
+func applyConfig(fs *flag.FlagSet) error {
+	var file map[string]interface{}
+	if *argConfig != "" {
+		var err error
+		if file, err = loadConfigFile(*argConfig); err != nil {
+			return err
+		}
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			explicit[f.Name] = true
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value for %s: %s", envName(f.Name), setErr)
+			}
+			return
+		}
+		value, ok := file[f.Name]
+		if !ok {
+			return
+		}
+		values, isList := value.([]interface{})
+		if !isList {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			if setErr := fs.Set(f.Name, fmt.Sprint(v)); setErr != nil {
+				err = fmt.Errorf("invalid value for %s in %s: %s", f.Name, *argConfig, setErr)
+				return
+			}
+		}
+	})
+	if fs == Flags {
+		fixedSettings = explicit
+	}
+	return err
+}
+
+// parseFlags parses args into fs and applies the settings shared by every
+// command.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	if err := applyConfig(fs); err != nil {
+		return err
+	}
+	return setupLogging(*argLogFormat)
+}
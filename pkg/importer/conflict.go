@@ -0,0 +1,86 @@
+package importer
+
+import (
+	"sync"
+)
+
+var argConflicts = Flags.Bool("detect-conflicts", false, "flag imported entries whose response_id is already that of another uid in the database or the run, in their response_conflict column")
+
+// conflictDetector tracks the uid each response_id was imported for, so that
+// a response_id returned again for another uid is flagged as a conflict.
+type conflictDetector struct {
+	mu     sync.Mutex
+	owners map[string]string
+}
+
+var responseConflicts *conflictDetector
+
+// setupConflicts loads the response_id of the entries already imported with
+// -detect-conflicts. Without a database, only the conflicts
+// within the run are detected.
+func setupConflicts(store Store) error {
+	if !*argConflicts {
+		return nil
+	}
+	d := &conflictDetector{owners: make(map[string]string)}
+	if s := schemaStore(store); s != nil {
+		err := s.forEachResponse(func(uid, responseID string) {
+			if _, ok := d.owners[responseID]; !ok {
+				d.owners[responseID] = uid
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	responseConflicts = d
+	return nil
+}
+
+// forEachResponse calls fn with the uid and response_id of every imported
+// entry that is not a -dedupe duplicate, in uid order.
+func (s *sqlStore) forEachResponse(fn func(uid, responseID string)) error {
+	rows, err := s.query("SELECT uid, response_id FROM imports WHERE imported_at IS NOT NULL AND response_id IS NOT NULL AND " + s.col("duplicate_of") + " IS NULL AND " + s.createsOnly() + " ORDER BY uid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid, responseID string
+		if err := rows.Scan(&uid, &responseID); err != nil {
+			return err
+		}
+		fn(uid, responseID)
+	}
+	return rows.Err()
+}
+
+// check records the response_id of the imported entry e and, if another
+// entry was imported with it, sets that entry as e.ConflictsWith and returns
+// true. It is a no-op on a nil detector, for -dedupe duplicates, which share
+// the response of their original, and for updates and deletions.
+func (d *conflictDetector) check(e *Entry) bool {
+	if d == nil || e.ResponseId == nil || *e.ResponseId == "" || e.DuplicateOf != nil || e.operation() != operationCreate {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	owner, ok := d.owners[*e.ResponseId]
+	if !ok || owner == e.UID {
+		d.owners[*e.ResponseId] = e.UID
+		return false
+	}
+	e.ConflictsWith = &owner
+	return true
+}
+
+// checkConflict flags e if its response_id conflicts with that of another
+// entry.
+func (im *Importer) checkConflict(e *Entry) {
+	if !responseConflicts.check(e) {
+		return
+	}
+	logError(e.fields("conflict"), "entry %s got response %s, which is already that of entry %s", e.UID, *e.ResponseId, *e.ConflictsWith)
+	im.progress.recordConflict()
+	auditTrail.record("conflict", e.UID, Fields{"response_id": *e.ResponseId, "conflicts_with": *e.ConflictsWith})
+}
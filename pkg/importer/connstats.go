@@ -0,0 +1,119 @@
+package importer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var argHTTP1 = Flags.Bool("http1", false, "only use HTTP/1.1 with the API, e.g. when a gateway misbehaves with HTTP/2")
+
+// ConnStats counts the connections opened to the API, and the requests sent
+// on a connection already used by a previous one.
+type ConnStats struct {
+	Opened        int64            `json:"opened"`
+	Requests      int64            `json:"requests"`
+	Reused        int64            `json:"reused"`
+	TLSHandshakes int64            `json:"tls_handshakes"`
+	HandshakeMS   int64            `json:"tls_handshake_ms"`
+	Protocols     map[string]int64 `json:"requests_by_protocol"`
+}
+
+// connStats collects ConnStats from the traces of the requests.
+type connStats struct {
+	mu    sync.Mutex
+	stats ConnStats
+}
+
+var apiConns = newConnStats()
+
+func newConnStats() *connStats {
+	return &connStats{stats: ConnStats{Protocols: make(map[string]int64)}}
+}
+
+// trace returns req recording in c whether its connection is reused, and the
+// TLS handshakes of the connections opened for it.
+func (c *connStats) trace(req *http.Request) *http.Request {
+	var handshakeStart time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			c.stats.Requests++
+			if info.Reused {
+				c.stats.Reused++
+			}
+			c.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			handshakeStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			c.mu.Lock()
+			c.stats.TLSHandshakes++
+			c.stats.HandshakeMS += time.Since(handshakeStart).Milliseconds()
+			c.mu.Unlock()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// countDial makes dial count the connections it opens in c.
+func (c *connStats) countDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err == nil {
+			c.mu.Lock()
+			c.stats.Opened++
+			c.mu.Unlock()
+		}
+		return conn, err
+	}
+}
+
+func (c *connStats) response(resp *http.Response) {
+	c.mu.Lock()
+	c.stats.Protocols[resp.Proto]++
+	c.mu.Unlock()
+}
+
+func (c *connStats) snapshot() ConnStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Protocols = make(map[string]int64, len(c.stats.Protocols))
+	for proto, n := range c.stats.Protocols {
+		s.Protocols[proto] = n
+	}
+	return s
+}
+
+// summary describes s in the two lines of the run summary.
+func (s ConnStats) summary() (string, string) {
+	connections := fmt.Sprintf("%d opened, %d of %d requests on reused connections", s.Opened, s.Reused, s.Requests)
+	if s.TLSHandshakes > 0 {
+		connections += fmt.Sprintf(", %d TLS handshakes (%dms average)", s.TLSHandshakes, s.HandshakeMS/s.TLSHandshakes)
+	}
+	protocols := make([]string, 0, len(s.Protocols))
+	for proto, n := range s.Protocols {
+		protocols = append(protocols, fmt.Sprintf("%s %d", proto, n))
+	}
+	sort.Strings(protocols)
+	return connections, strings.Join(protocols, ", ")
+}
+
+// disableHTTP2 makes transport only use HTTP/1.1, even with servers offering
+// HTTP/2 over TLS.
+func disableHTTP2(transport *http.Transport) {
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	if transport.TLSClientConfig != nil {
+		transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	}
+}
@@ -0,0 +1,239 @@
+package importer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// creationList is a repeatable flag of "field=table:/api/path" creations.
+type creationList []creation
+
+// creation creates the missing resources referenced by a -resolve field, by
+// sending the payload found in a companion table of -db to an API path.
+type creation struct {
+	field string
+	table string
+	path  string
+}
+
+func (c *creationList) String() string {
+	creations := make([]string, len(*c))
+	for i, cr := range *c {
+		creations[i] = cr.field + "=" + cr.table + ":" + cr.path
+	}
+	return strings.Join(creations, ", ")
+}
+
+func (c *creationList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) == 2 {
+		if target := strings.SplitN(parts[1], ":", 2); len(target) == 2 && parts[0] != "" && target[0] != "" && strings.HasPrefix(target[1], "/") {
+			*c = append(*c, creation{parts[0], target[0], target[1]})
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid creation %q, expected field=table:/api/path", value)
+}
+
+func (c *creationList) reset() {
+	*c = nil
+}
+
+var argResolveCreate creationList
+
+func init() {
+	Flags.Var(&argResolveCreate, "resolve-create", "`field=table:/api/path` creating the resources missing for a -resolve field from the rows of this table of -db, keyed by uid, before sending the entries referencing them, repeatable and in creation order")
+}
+
+// companionColumns are the columns of the tables holding the resources to
+// create, the payload row of uid being the one referenced by that value.
+var companionColumns = []column{
+	{"uid", "%s NOT NULL UNIQUE"},
+	{"payload", "TEXT NOT NULL"},
+	{"response_id", "TEXT"},
+	{"created_at", "TEXT"},
+	{"error", "TEXT"},
+}
+
+// creator creates missing resources one entry at a time, so that a resource
+// referenced by several entries is only created once.
+type creator struct {
+	mu    sync.Mutex
+	store *sqlStore
+}
+
+var resourceCreator *creator
+
+func setupCreate() error {
+	resourceCreator = nil
+	if len(argResolveCreate) == 0 {
+		return nil
+	}
+	tables := make(map[string]bool)
+	for _, cr := range argResolveCreate {
+		resolved := false
+		for _, ref := range argResolve {
+			resolved = resolved || ref.field == cr.field
+		}
+		if !resolved {
+			return fmt.Errorf("-resolve-create %s has no -resolve for the field", cr.field)
+		}
+		tables[cr.table] = true
+	}
+	db, d, err := openDB(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	for table := range tables {
+		if _, err := s.addMissingColumns(table, companionColumns); err != nil {
+			s.Close()
+			return fmt.Errorf("invalid companion table %s: %s", table, err)
+		}
+	}
+	resourceCreator = &creator{store: s}
+	return nil
+}
+
+func (c *creator) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.store.Close()
+}
+
+// missingReference is a reference of an entry found missing in the API.
+type missingReference struct {
+	field string
+	id    string
+	key   string
+}
+
+// createdResource is a resource created for an entry.
+type createdResource struct {
+	creation   creation
+	ref        missingReference
+	responseID string
+}
+
+// create creates the missing resources of an entry having a -resolve-create
+// companion row, in the order of -resolve-create, and returns those still
+// missing. If one fails, the resources created before it for the entry are
+// deleted again.
+func (c *creator) create(ctx context.Context, api *endpoint, missing []missingReference) ([]missingReference, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var created []createdResource
+	handled := make(map[string]bool)
+	for _, cr := range argResolveCreate {
+		for _, m := range missing {
+			if m.field != cr.field {
+				continue
+			}
+			handled[m.key] = true
+			if references.known(m.key) {
+				continue
+			}
+			payload, found, err := c.companion(cr.table, m.id)
+			if err == nil && !found {
+				handled[m.key] = false
+				continue
+			}
+			var id string
+			if err == nil {
+				id, err = c.post(ctx, api, cr.path, payload)
+			}
+			if err != nil {
+				c.rollback(api, created)
+				err = fmt.Errorf("failed to create %s %s from %s: %s", m.field, m.id, cr.table, err)
+				c.store.exec("UPDATE "+cr.table+" SET error = ? WHERE uid = ?", err.Error(), m.id)
+				return missing, err
+			}
+			logInfo(Fields{"table": cr.table, "uid": m.id, "response_id": id}, "%s %s created from %s as %s", m.field, m.id, cr.table, id)
+			created = append(created, createdResource{cr, m, id})
+		}
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, r := range created {
+		if _, err := c.store.exec("UPDATE "+r.creation.table+" SET response_id = ?, created_at = ?, error = NULL WHERE uid = ?", r.responseID, now, r.ref.id); err != nil {
+			logError(Fields{"table": r.creation.table, "uid": r.ref.id, "error": err}, "failed to record creation of %s %s: %s", r.ref.field, r.ref.id, err)
+		}
+		references.set(r.ref.key, true)
+	}
+	var remaining []missingReference
+	for _, m := range missing {
+		if !handled[m.key] {
+			remaining = append(remaining, m)
+		}
+	}
+	return remaining, nil
+}
+
+func (c *creator) companion(table, uid string) (string, bool, error) {
+	var payload string
+	err := c.store.db.QueryRow(c.store.dialect.rebind("SELECT payload FROM "+table+" WHERE uid = ?"), uid).Scan(&payload)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	payload, err = decodePayload(payload)
+	return payload, err == nil, err
+}
+
+// post sends payload to path and returns the identifier of the resource
+// created, at -response-id-path.
+func (c *creator) post(ctx context.Context, api *endpoint, path, payload string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", api.url+path, strings.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := api.authorize(req); err != nil {
+		return "", err
+	}
+	if *argIdempotency {
+		key, err := newUUID()
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Idempotency-Key", key)
+	}
+	resp, _, err := api.send(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", &APIError{resp.StatusCode, string(body)}
+	}
+	id, ok, err := extractResponseID(body)
+	if err != nil || !ok {
+		return "", &ParseError{string(body)}
+	}
+	return id, nil
+}
+
+// rollback deletes the resources created for an entry whose other resources
+// could not be created.
+func (c *creator) rollback(api *endpoint, created []createdResource) {
+	for i := len(created) - 1; i >= 0; i-- {
+		r := created[i]
+		fields := Fields{"table": r.creation.table, "uid": r.ref.id, "response_id": r.responseID}
+		if err := deleteResource(api, r.creation.path+"/"+url.PathEscape(r.responseID)); err != nil {
+			fields["error"] = err
+			logError(fields, "failed to delete %s %s created as %s: %s", r.ref.field, r.ref.id, r.responseID, err)
+			continue
+		}
+		logInfo(fields, "%s %s created as %s deleted again", r.ref.field, r.ref.id, r.responseID)
+	}
+}
@@ -0,0 +1,511 @@
+package importer
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var argMaxAttempts = Flags.Int("max-attempts", 0, "move entries that errored in this many runs to the dead_letters table, where retry-errors and requeue leave them (0 disables it)")
+
+var attemptColumns = []column{
+	{"uid", "%s NOT NULL"},
+	{"run_id", "TEXT"},
+	{"failed_at", "TEXT"},
+	{"error", "TEXT"},
+	{"error_class", "TEXT"},
+	{"http_status", "INTEGER"},
+}
+
+var deadLetterColumns = []column{
+	{"uid", "%s NOT NULL UNIQUE"},
+	{"payload", "TEXT NOT NULL"},
+	{"errors", "TEXT"},
+	{"attempts", "INTEGER"},
+	{"first_failed_at", "TEXT"},
+	{"last_failed_at", "TEXT"},
+	{"dead_lettered_at", "TEXT"},
+	{"edited_at", "TEXT"},
+}
+
+// AttemptError is an errored attempt at importing an entry.
+type AttemptError struct {
+	RunID      string `json:"run_id,omitempty"`
+	FailedAt   string `json:"failed_at"`
+	Error      string `json:"error"`
+	Class      string `json:"class,omitempty"`
+	HTTPStatus int    `json:"http_status,omitempty"`
+}
+
+// DeadLetter is an entry that errored -max-attempts times.
+type DeadLetter struct {
+	UID            string         `json:"uid"`
+	Payload        string         `json:"payload"`
+	Errors         []AttemptError `json:"errors"`
+	Attempts       int            `json:"attempts"`
+	FirstFailedAt  string         `json:"first_failed_at"`
+	LastFailedAt   string         `json:"last_failed_at"`
+	DeadLetteredAt string         `json:"dead_lettered_at"`
+	EditedAt       *string        `json:"edited_at,omitempty"`
+}
+
+func (d *DeadLetter) lastError() AttemptError {
+	if len(d.Errors) == 0 {
+		return AttemptError{}
+	}
+	return d.Errors[len(d.Errors)-1]
+}
+
+// checkDeadLetters checks that the database was migrated for -max-attempts.
+func checkDeadLetters(store Store) error {
+	if *argMaxAttempts < 0 {
+		return fmt.Errorf("invalid -max-attempts %d", *argMaxAttempts)
+	}
+	if *argMaxAttempts == 0 {
+		return nil
+	}
+	if k, ok := store.(*kafkaStore); ok {
+		store = k.Store
+	}
+	s, ok := store.(*sqlStore)
+	if !ok {
+		return errors.New("-max-attempts needs a -db database, it cannot be used with -pipe or -checkpoint")
+	}
+	for _, query := range []string{"SELECT dead_lettered_at FROM imports WHERE 1 = 0", "SELECT * FROM attempts WHERE 1 = 0", "SELECT * FROM dead_letters WHERE 1 = 0"} {
+		rows, err := s.query(query)
+		if err != nil {
+			return fmt.Errorf("-max-attempts needs the attempts and dead_letters tables, run migrate first: %s", err)
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+// recordAttempt records an errored attempt within tx, and moves the entry to
+// the dead_letters table once it errored -max-attempts times. The attempts
+// of imported entries are forgotten.
+func (s *sqlStore) recordAttempt(tx *sql.Tx, u *StatusUpdate, now string) (bool, error) {
+	e := &u.Entry
+	if u.Imported {
+		_, err := tx.Exec(s.dialect.rebind("DELETE FROM attempts WHERE uid = ?"), e.UID)
+		return false, err
+	}
+	var runID, status interface{}
+	if u.RunID != "" {
+		runID = u.RunID
+	}
+	if e.Status != 0 {
+		status = e.Status
+	}
+	if _, err := tx.Exec(s.dialect.rebind("INSERT INTO attempts (uid, run_id, failed_at, error, error_class, http_status) VALUES (?, ?, ?, ?, ?, ?)"),
+		e.UID, runID, now, s.errorRecord(e).text, classifyError(e.Err), status); err != nil {
+		return false, err
+	}
+	attempts, err := s.attemptErrors(tx, e.UID)
+	if err != nil || len(attempts) < *argMaxAttempts {
+		return false, err
+	}
+	return true, s.moveToDeadLetters(tx, e.UID, attempts, now)
+}
+
+// moveToDeadLetters copies the entry uid to the dead_letters table with its
+// errored attempts, the error of its row if there are none, and marks it.
+func (s *sqlStore) moveToDeadLetters(tx *sql.Tx, uid string, attempts []AttemptError, now string) error {
+	var payload string
+	var runID, failure, class sql.NullString
+	var status sql.NullInt64
+	if err := tx.QueryRow(s.dialect.rebind("SELECT payload, run_id, error, error_class, http_status FROM imports WHERE uid = ?"), uid).
+		Scan(&payload, &runID, &failure, &class, &status); err != nil {
+		return err
+	}
+	if len(attempts) == 0 {
+		attempts = []AttemptError{{RunID: runID.String, FailedAt: now, Error: failure.String, Class: class.String, HTTPStatus: int(status.Int64)}}
+	}
+	payload, err := decodePayload(payload)
+	if err == nil {
+		payload, err = sealPayload(payload)
+	}
+	if err != nil {
+		return err
+	}
+	history, err := json.Marshal(attempts)
+	if err != nil {
+		return err
+	}
+	queries := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM dead_letters WHERE uid = ?", []interface{}{uid}},
+		{"INSERT INTO dead_letters (uid, payload, errors, attempts, first_failed_at, last_failed_at, dead_lettered_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			[]interface{}{uid, payload, string(history), len(attempts), attempts[0].FailedAt, attempts[len(attempts)-1].FailedAt, now}},
+		{"UPDATE imports SET dead_lettered_at = ? WHERE uid = ?", []interface{}{now, uid}},
+		{"DELETE FROM attempts WHERE uid = ?", []interface{}{uid}},
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(s.dialect.rebind(q.query), q.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) attemptErrors(tx *sql.Tx, uid string) ([]AttemptError, error) {
+	rows, err := tx.Query(s.dialect.rebind("SELECT run_id, failed_at, error, error_class, http_status FROM attempts WHERE uid = ? ORDER BY failed_at"), uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var attempts []AttemptError
+	for rows.Next() {
+		var a AttemptError
+		var runID, class sql.NullString
+		var status sql.NullInt64
+		if err := rows.Scan(&runID, &a.FailedAt, &a.Error, &class, &status); err != nil {
+			return nil, err
+		}
+		a.RunID, a.Class, a.HTTPStatus = runID.String, class.String, int(status.Int64)
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+const deadLetterQuery = "SELECT uid, payload, errors, attempts, first_failed_at, last_failed_at, dead_lettered_at, edited_at FROM dead_letters"
+
+func scanDeadLetter(rows interface{ Scan(...interface{}) error }) (DeadLetter, error) {
+	var d DeadLetter
+	var history sql.NullString
+	var editedAt sql.NullString
+	if err := rows.Scan(&d.UID, &d.Payload, &history, &d.Attempts, &d.FirstFailedAt, &d.LastFailedAt, &d.DeadLetteredAt, &editedAt); err != nil {
+		return d, err
+	}
+	if editedAt.Valid {
+		d.EditedAt = &editedAt.String
+	}
+	payload, err := openPayload(d.Payload)
+	if err != nil {
+		return d, fmt.Errorf("failed to decode payload of dead letter %s: %s", d.UID, err)
+	}
+	d.Payload = payload
+	if history.Valid {
+		if err := json.Unmarshal([]byte(history.String), &d.Errors); err != nil {
+			return d, fmt.Errorf("invalid errors of dead letter %s: %s", d.UID, err)
+		}
+	}
+	return d, nil
+}
+
+// deadLetters returns the latest dead letters first.
+func (s *sqlStore) deadLetters(limit int) ([]DeadLetter, error) {
+	rows, err := s.query(deadLetterQuery+" ORDER BY dead_lettered_at DESC, uid LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var letters []DeadLetter
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, d)
+	}
+	return letters, rows.Err()
+}
+
+func (s *sqlStore) deadLetter(uid string) (DeadLetter, error) {
+	d, err := scanDeadLetter(s.db.QueryRow(s.dialect.rebind(deadLetterQuery+" WHERE uid = ?"), uid))
+	if err == sql.ErrNoRows {
+		return d, fmt.Errorf("no dead letter %s", uid)
+	}
+	return d, err
+}
+
+func (s *sqlStore) editDeadLetter(uid, payload string) error {
+	payload, err := sealPayload(payload)
+	if err != nil {
+		return err
+	}
+	result, err := s.exec("UPDATE dead_letters SET payload = ?, edited_at = ? WHERE uid = ?", payload, time.Now().UTC().Format(time.RFC3339), uid)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no dead letter %s", uid)
+	}
+	return nil
+}
+
+// requeueDeadLetters sets the given dead letters, all of them if uids is
+// nil, back to pending with their possibly edited payload, and returns how
+// many were requeued.
+func (s *sqlStore) requeueDeadLetters(uids []string) (int, error) {
+	var letters []string
+	if uids == nil {
+		rows, err := s.query("SELECT uid FROM dead_letters ORDER BY uid")
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var uid string
+			if err := rows.Scan(&uid); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			letters = append(letters, uid)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	} else {
+		letters = uids
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for _, uid := range letters {
+		var payload string
+		if err := tx.QueryRow(s.dialect.rebind("SELECT payload FROM dead_letters WHERE uid = ?"), uid).Scan(&payload); err != nil {
+			tx.Rollback()
+			if err == sql.ErrNoRows {
+				return 0, fmt.Errorf("no dead letter %s", uid)
+			}
+			return 0, err
+		}
+		if _, err := tx.Exec(s.dialect.rebind(`UPDATE imports SET payload = ?, error = NULL, error_class = NULL, http_status = NULL,
+dead_lettered_at = NULL WHERE uid = ?`), payload, uid); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if _, err := tx.Exec(s.dialect.rebind("DELETE FROM dead_letters WHERE uid = ?"), uid); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	auditTrail.requeued(letters)
+	return len(letters), nil
+}
+
+// editPayload opens payload in $EDITOR and returns it once edited.
+func editPayload(uid, payload string) (string, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = defaultEditor
+	}
+	f, err := ioutil.TempFile("", "dead-letter-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if indented, err := indentJSON(payload); err == nil {
+		payload = indented
+	}
+	if _, err := f.WriteString(payload + "\n"); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	cmd := editorCommand(editor, f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to edit dead letter %s: %s", uid, err)
+	}
+	edited, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	return string(edited), nil
+}
+
+func indentJSON(payload string) (string, error) {
+	var b bytes.Buffer
+	err := json.Indent(&b, []byte(payload), "", "  ")
+	return b.String(), err
+}
+
+// normalizePayload checks that payload is JSON and returns it on a single
+// line.
+func normalizePayload(payload string) (string, error) {
+	var b bytes.Buffer
+	if err := json.Compact(&b, []byte(payload)); err != nil {
+		return "", fmt.Errorf("invalid JSON payload: %s", err)
+	}
+	return b.String(), nil
+}
+
+const dlqUsage = `Usage: %s dlq <command> [flags] [uid...]
+
+Commands:
+  list             list the dead letters, the latest first
+  inspect <uid>    print a dead letter with the errors of all its attempts
+  edit <uid>       edit the payload of a dead letter, in $EDITOR or from -file
+  requeue <uid>... set dead letters back to pending, all of them with -all
+
+`
+
+func runDLQ(args []string) error {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, dlqUsage, os.Args[0])
+	}
+	if len(args) == 0 {
+		usage()
+		return errors.New("missing dlq command")
+	}
+	command := args[0]
+	fs := flag.NewFlagSet("dlq "+command, flag.ExitOnError)
+	commonFlags(fs)
+	inheritFlags(fs, "audit-file")
+	limit := fs.Int("n", 50, "number of dead letters to list, with list")
+	file := fs.String("file", "", "read the edited payload from this `file` (- for stdin) instead of $EDITOR, with edit")
+	all := fs.Bool("all", false, "requeue all the dead letters, with requeue")
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+	switch command {
+	case "list", "inspect", "edit", "requeue":
+	default:
+		usage()
+		return fmt.Errorf("unknown dlq command %q", command)
+	}
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if err := setupAudit("dlq " + command); err != nil {
+		return err
+	}
+	defer closeAudit()
+	uids := fs.Args()
+
+	db, d, err := openDB(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	s.detectSchema()
+	defer s.Close()
+
+	switch command {
+	case "list":
+		letters, err := s.deadLetters(*limit)
+		if err != nil {
+			return fmt.Errorf("failed to query dead letters: %s", err)
+		}
+		if jsonLogs {
+			for _, l := range letters {
+				last := l.lastError()
+				logInfo(Fields{
+					"uid":              l.UID,
+					"attempts":         l.Attempts,
+					"dead_lettered_at": l.DeadLetteredAt,
+					"error":            last.Error,
+					"error_class":      last.Class,
+				}, "dead letter %s", l.UID)
+			}
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "UID\tATTEMPTS\tDEAD LETTERED\tCLASS\tLAST ERROR")
+		for _, l := range letters {
+			last := l.lastError()
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", l.UID, l.Attempts, l.DeadLetteredAt, last.Class, truncate(last.Error, 80))
+		}
+		return w.Flush()
+
+	case "inspect":
+		if len(uids) != 1 {
+			return errors.New("dlq inspect needs one uid")
+		}
+		l, err := s.deadLetter(uids[0])
+		if err != nil {
+			return err
+		}
+		out := struct {
+			DeadLetter
+			Payload json.RawMessage `json:"payload"`
+		}{l, json.RawMessage(l.Payload)}
+		if !json.Valid(out.Payload) {
+			raw, _ := json.Marshal(l.Payload)
+			out.Payload = raw
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+
+	case "edit":
+		if len(uids) != 1 {
+			return errors.New("dlq edit needs one uid")
+		}
+		l, err := s.deadLetter(uids[0])
+		if err != nil {
+			return err
+		}
+		var payload string
+		switch *file {
+		case "":
+			payload, err = editPayload(l.UID, l.Payload)
+		case "-":
+			var b []byte
+			b, err = ioutil.ReadAll(os.Stdin)
+			payload = string(b)
+		default:
+			var b []byte
+			b, err = ioutil.ReadFile(*file)
+			payload = string(b)
+		}
+		if err != nil {
+			return err
+		}
+		if payload, err = normalizePayload(payload); err != nil {
+			return err
+		}
+		if current, err := normalizePayload(l.Payload); err == nil && current == payload {
+			logInfo(Fields{"uid": l.UID}, "payload of dead letter %s unchanged", l.UID)
+			return nil
+		}
+		if err := s.editDeadLetter(l.UID, payload); err != nil {
+			return fmt.Errorf("failed to edit dead letter %s: %s", l.UID, err)
+		}
+		logInfo(Fields{"uid": l.UID}, "payload of dead letter %s edited, requeue it to import it", l.UID)
+		return nil
+
+	default:
+		if *all == (len(uids) > 0) {
+			return errors.New("dlq requeue needs either uids or -all")
+		}
+		if *all {
+			uids = nil
+		}
+		n, err := s.requeueDeadLetters(uids)
+		if err != nil {
+			return fmt.Errorf("failed to requeue dead letters: %s", err)
+		}
+		logInfo(Fields{"requeued": n}, "%d dead letters set back to pending", n)
+		return nil
+	}
+}
+
+func truncate(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
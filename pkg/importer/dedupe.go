@@ -0,0 +1,173 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+var argDedupe = Flags.String("dedupe", "none", "what to do with entries whose payload is identical to an earlier one: none, skip them, or link them to its response_id")
+
+// original is the first entry seen with a given payload.
+type original struct {
+	uid        string
+	responseID *string
+	imported   bool
+	done       chan struct{}
+}
+
+// deduper tracks the payloads of imported and in-flight entries, so that
+// later entries with the same payload are not sent again.
+type deduper struct {
+	mu        sync.Mutex
+	originals map[[sha256.Size]byte]*original
+	inFlight  map[string][sha256.Size]byte
+	waiting   sync.WaitGroup
+}
+
+var payloadDeduper *deduper
+
+// setupDedupe validates -dedupe and, unless disabled, loads the payloads of
+// the entries already imported.
+func setupDedupe(store Store) error {
+	switch *argDedupe {
+	case "none":
+		return nil
+	case "skip", "link":
+	default:
+		return fmt.Errorf("invalid dedupe mode %q, expected none, skip or link", *argDedupe)
+	}
+	d := &deduper{
+		originals: make(map[[sha256.Size]byte]*original),
+		inFlight:  make(map[string][sha256.Size]byte),
+	}
+	err := store.ForEachImported(func(uid, payload string, responseID *string) error {
+		if payload == "" {
+			// scrubbed
+			return nil
+		}
+		o := &original{uid: uid, responseID: responseID, imported: true, done: make(chan struct{})}
+		close(o.done)
+		d.originals[sha256.Sum256([]byte(payload))] = o
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	payloadDeduper = d
+	return nil
+}
+
+// original returns the entry e duplicates, or registers e as the original of
+// its payload and returns nil.
+func (d *deduper) original(e *Entry) *original {
+	hash := sha256.Sum256([]byte(e.Payload))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if o, ok := d.originals[hash]; ok && o.uid != e.UID {
+		return o
+	}
+	d.originals[hash] = &original{uid: e.UID, done: make(chan struct{})}
+	d.inFlight[e.UID] = hash
+	return nil
+}
+
+// finished records the outcome of e, which duplicates can then use. A failed
+// original is forgotten, so that a later duplicate takes its place. The hash
+// of e is the one registered by original, since transformation changes the
+// payload.
+func (d *deduper) finished(e *Entry, imported bool) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hash, ok := d.inFlight[e.UID]
+	if !ok {
+		return
+	}
+	delete(d.inFlight, e.UID)
+	o, ok := d.originals[hash]
+	if !ok || o.uid != e.UID {
+		return
+	}
+	o.imported = imported
+	o.responseID = e.ResponseId
+	if !imported {
+		delete(d.originals, hash)
+	}
+	close(o.done)
+}
+
+// wait returns once all duplicates have been processed. It is a no-op on a
+// nil deduper.
+func (d *deduper) wait() {
+	if d == nil {
+		return
+	}
+	d.waiting.Wait()
+}
+
+// duplicate waits for the outcome of o and finishes e accordingly, without
+// holding a worker.
+func (im *Importer) duplicate(e Entry, o *original) {
+	payloadDeduper.waiting.Add(1)
+	go func() {
+		defer payloadDeduper.waiting.Done()
+		select {
+		case <-o.done:
+		case <-im.ctx.Done():
+			im.finish(&e, im.ctx.Err())
+			return
+		}
+		if !o.imported {
+			im.finish(&e, fmt.Errorf("duplicate of entry %s, which failed to import", o.uid))
+			return
+		}
+		e.DuplicateOf = &o.uid
+		if *argDedupe == "link" {
+			e.ResponseId = o.responseID
+		}
+		logInfo(e.fields("duplicate"), "entry %s is a duplicate of %s, skipping", e.UID, o.uid)
+		importMetrics.entryDone("duplicate")
+		im.progress.record(&e, "duplicate")
+		im.writer.markImported(&e)
+		auditTrail.entry("duplicate", &e)
+		onImport.run(&e)
+	}()
+}
+
+// ForEachImported calls fn with the uid, payload and response_id of every
+// imported entry that is not itself a duplicate.
+func (s *sqlStore) ForEachImported(fn func(uid, payload string, responseID *string) error) error {
+	rows, err := s.query("SELECT uid, payload, response_id FROM imports WHERE imported_at IS NOT NULL AND duplicate_of IS NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid, payload string
+		var responseID sql.NullString
+		if err := rows.Scan(&uid, &payload, &responseID); err != nil {
+			return err
+		}
+		if payload, err = decodePayload(payload); err != nil {
+			return fmt.Errorf("failed to decode payload of entry %s: %s", uid, err)
+		}
+		if path, ok := payloadPath(payload); ok {
+			if payload, err = readPayloadFile(path); err != nil {
+				logError(Fields{"uid": uid, "error": err}, "failed to read payload file of imported entry %s, leaving it out: %s", uid, err)
+				continue
+			}
+		}
+		var id *string
+		if responseID.Valid {
+			id = &responseID.String
+		}
+		if err := fn(uid, payload, id); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
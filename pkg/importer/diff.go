@@ -0,0 +1,244 @@
+package importer
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// importState is the state of an entry compared by diff.
+type importState struct {
+	responseID sql.NullString
+	err        sql.NullString
+	errorClass sql.NullString
+}
+
+func (st *importState) name() string {
+	switch {
+	case st == nil:
+		return "absent"
+	case st.responseID.Valid:
+		return "imported"
+	case st.err.Valid:
+		return "errored"
+	}
+	return "pending"
+}
+
+// states returns the states of the entries of uids found in the imports
+// table.
+func (s *sqlStore) states(uids []string) (map[string]*importState, error) {
+	states := make(map[string]*importState, len(uids))
+	for start := 0; start < len(uids); start += maxUIDsPerQuery {
+		end := start + maxUIDsPerQuery
+		if end > len(uids) {
+			end = len(uids)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, uid := range uids[start:end] {
+			args = append(args, uid)
+		}
+		rows, err := s.query("SELECT uid, response_id, error, error_class FROM imports WHERE uid IN ("+placeholders(end-start)+")", args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var uid string
+			var st importState
+			if err := rows.Scan(&uid, &st.responseID, &st.err, &st.errorClass); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			states[uid] = &st
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return states, nil
+}
+
+// uidsAfter returns the next limit uids of the imports table after after.
+func (s *sqlStore) uidsAfter(after string, limit int) ([]string, error) {
+	rows, err := s.query("SELECT uid FROM imports WHERE uid > ? ORDER BY uid LIMIT ?", after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uids []string
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+// difference is an entry whose state differs between the two databases.
+type difference struct {
+	kind   string
+	uid    string
+	before *importState
+	after  *importState
+}
+
+// compareStates returns the kind of difference between the states of an
+// entry, or "" if there is none.
+func compareStates(before, after *importState) string {
+	was, is := before.name(), after.name()
+	switch {
+	case was == "imported" && is == "imported":
+		if before.responseID.String != after.responseID.String {
+			return "changed"
+		}
+		return ""
+	case was == is:
+		return ""
+	case is == "imported":
+		return "imported"
+	case is == "errored":
+		return "errored"
+	case was == "imported":
+		return "unimported"
+	case is == "absent":
+		return "removed"
+	case was == "absent":
+		return "added"
+	}
+	return "reset"
+}
+
+// diffKinds are the kinds of differences, in the order of the summary.
+var diffKinds = []string{"imported", "errored", "changed", "unimported", "reset", "added", "removed"}
+
+// diffStores calls fn with the differences between the entries of a and b,
+// walking a then the entries only found in b.
+func diffStores(a, b *sqlStore, pageSize int, fn func(d difference) error) error {
+	walk := func(from, other *sqlStore, onlyMissing, reversed bool) error {
+		after := ""
+		for {
+			uids, err := from.uidsAfter(after, pageSize)
+			if err != nil {
+				return err
+			}
+			if len(uids) == 0 {
+				return nil
+			}
+			after = uids[len(uids)-1]
+			states, err := from.states(uids)
+			if err != nil {
+				return err
+			}
+			others, err := other.states(uids)
+			if err != nil {
+				return err
+			}
+			for _, uid := range uids {
+				before, current := states[uid], others[uid]
+				if onlyMissing && current != nil {
+					continue
+				}
+				if reversed {
+					before, current = current, before
+				}
+				if kind := compareStates(before, current); kind != "" {
+					if err := fn(difference{kind, uid, before, current}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	if err := walk(a, b, false, false); err != nil {
+		return err
+	}
+	return walk(b, a, true, true)
+}
+
+func (st *importState) detail() string {
+	switch st.name() {
+	case "imported":
+		return st.responseID.String
+	case "errored":
+		if st.errorClass.Valid {
+			return st.errorClass.String + ": " + st.err.String
+		}
+		return st.err.String
+	}
+	return "-"
+}
+
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	commonFlags(fs)
+	inheritFlags(fs, "page-size")
+	db2 := fs.String("db2", "", "database to compare with -db, e.g. the one of a run against a restored backup")
+	summaryOnly := fs.Bool("summary", false, "only print the number of differences of each kind")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff -db a.db -db2 b.db [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *db2 == "" {
+		return fmt.Errorf("-db2 is required")
+	}
+
+	var stores []*sqlStore
+	for _, dsn := range []string{*argDb, *db2} {
+		db, d, err := openDB(dsn)
+		if err != nil {
+			return fmt.Errorf("failed to open database %s: %s", redactDSN(dsn), err)
+		}
+		defer db.Close()
+		stores = append(stores, &sqlStore{db: db, dialect: d})
+	}
+
+	counts := make(map[string]int)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if !*summaryOnly && !jsonLogs {
+		fmt.Fprintln(w, "DIFFERENCE\tUID\tBEFORE\tAFTER")
+	}
+	err := diffStores(stores[0], stores[1], *argPageSize, func(d difference) error {
+		counts[d.kind]++
+		switch {
+		case *summaryOnly:
+		case jsonLogs:
+			logInfo(Fields{
+				"difference": d.kind,
+				"uid":        d.uid,
+				"before":     d.before.name(),
+				"after":      d.after.name(),
+				"was":        d.before.detail(),
+				"is":         d.after.detail(),
+			}, "entry %s %s", d.uid, d.kind)
+		default:
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.kind, d.uid, d.before.detail(), d.after.detail())
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to compare databases: %s", err)
+	}
+	if jsonLogs {
+		fields := Fields{}
+		for _, kind := range diffKinds {
+			fields[kind] = counts[kind]
+		}
+		logInfo(fields, "databases compared")
+		return nil
+	}
+	if !*summaryOnly {
+		fmt.Fprintln(w)
+	}
+	for _, kind := range diffKinds {
+		fmt.Fprintf(w, "%s\t%d\n", kind, counts[kind])
+	}
+	return w.Flush()
+}
@@ -0,0 +1,43 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+func validatePayload(payload string) error {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+		return fmt.Errorf("invalid JSON: %s", err)
+	}
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		return errors.New("payload must be a JSON object")
+	}
+	if len(object) == 0 {
+		return errors.New("payload is empty")
+	}
+	return nil
+}
+
+// dryRun prepares entries as planEntry does, logging whether each is valid,
+// and returns the number of invalid ones.
+func dryRun(entries *entryStream) (int, error) {
+	valid, invalid := 0, 0
+	for entry := range entries.entries {
+		p, err := planEntry(&entry)
+		if err != nil {
+			logError(Fields{"uid": entry.UID, "error": err, "outcome": "invalid"}, "entry %s is invalid: %s", entry.UID, err)
+			invalid++
+			continue
+		}
+		valid++
+		logInfo(Fields{"uid": entry.UID, "bytes": len(entry.Payload), "outcome": "valid"}, "would %s entry %s to %s (%d bytes)", p.Method, entry.UID, p.URL, len(entry.Payload))
+	}
+	if err := entries.Err(); err != nil {
+		return invalid, err
+	}
+	logInfo(Fields{"valid": valid, "invalid": invalid}, "dry run: %d entries valid, %d invalid", valid, invalid)
+	return invalid, nil
+}
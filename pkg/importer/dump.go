@@ -0,0 +1,209 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var argDumpRequests = Flags.Int("dump-requests", 20, "number of the last API requests kept, with their timing, for the state dumped on SIGQUIT")
+
+// flightTracker tracks the entries in flight, for the snapshots and the
+// state dumps.
+type flightTracker struct {
+	mu       sync.Mutex
+	inflight map[string]time.Time
+}
+
+func newFlightTracker() *flightTracker {
+	return &flightTracker{inflight: map[string]time.Time{}}
+}
+
+// begin records batch as in flight. It is a no-op on a nil flightTracker.
+func (t *flightTracker) begin(batch []Entry) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	for _, e := range batch {
+		t.inflight[e.UID] = now
+	}
+	t.mu.Unlock()
+}
+
+// end records batch as done. It is a no-op on a nil flightTracker.
+func (t *flightTracker) end(batch []Entry) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	for _, e := range batch {
+		delete(t.inflight, e.UID)
+	}
+	t.mu.Unlock()
+}
+
+// entries returns the entries in flight, the oldest first.
+func (t *flightTracker) entries() []InFlightEntry {
+	entries := []InFlightEntry{}
+	if t == nil {
+		return entries
+	}
+	t.mu.Lock()
+	for uid, since := range t.inflight {
+		entries = append(entries, InFlightEntry{uid, since.UTC().Format(time.RFC3339Nano)})
+	}
+	t.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Since < entries[j].Since })
+	return entries
+}
+
+// RequestRecord is an API request sent during the run, for the state dumps.
+type RequestRecord struct {
+	Method  string
+	URL     string
+	Started time.Time
+	Elapsed time.Duration
+	Status  int
+	Error   string
+}
+
+// requestLog keeps the API requests in flight and the last ones done.
+type requestLog struct {
+	mu       sync.Mutex
+	next     int
+	inflight map[int]*RequestRecord
+	recent   []RequestRecord
+}
+
+var apiRequests = &requestLog{inflight: map[int]*RequestRecord{}}
+
+// start records req as in flight and returns its id.
+func (l *requestLog) start(req *http.Request) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next++
+	l.inflight[l.next] = &RequestRecord{Method: req.Method, URL: requestPath(req), Started: time.Now()}
+	return l.next
+}
+
+// done records the request id as done, keeping the last -dump-requests.
+func (l *requestLog) done(id, status int, elapsed time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := l.inflight[id]
+	delete(l.inflight, id)
+	if r == nil || *argDumpRequests <= 0 {
+		return
+	}
+	r.Status, r.Elapsed = status, elapsed
+	if err != nil {
+		r.Error = err.Error()
+	}
+	l.recent = append(l.recent, *r)
+	if over := len(l.recent) - *argDumpRequests; over > 0 {
+		l.recent = append(l.recent[:0], l.recent[over:]...)
+	}
+}
+
+// snapshot returns the requests in flight, the oldest first, and the last
+// ones done.
+func (l *requestLog) snapshot() ([]RequestRecord, []RequestRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inflight := make([]RequestRecord, 0, len(l.inflight))
+	for _, r := range l.inflight {
+		inflight = append(inflight, *r)
+	}
+	sort.Slice(inflight, func(i, j int) bool { return inflight[i].Started.Before(inflight[j].Started) })
+	return inflight, append([]RequestRecord(nil), l.recent...)
+}
+
+// occupancy returns the busy workers of l and their current limit.
+func (l *workerLimit) occupancy() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := cap(l.sem) - l.parked
+	return limit - len(l.sem), limit
+}
+
+// DumpState writes the state of the run to w, for debugging a run that looks
+// hung: the entries and API requests in flight, the occupancy of the
+// workers and queues, the last requests and the stacks of all goroutines.
+func (im *Importer) DumpState(w io.Writer) {
+	if im.multi != nil {
+		im.multi.do(func(current *Importer) { current.DumpState(w) })
+		return
+	}
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "=== state of pid %d at %s ===\n", os.Getpid(), now.UTC().Format(time.RFC3339Nano))
+	if im.run != nil {
+		fmt.Fprintf(tw, "run\t%s\n", im.run.ID)
+	}
+	fmt.Fprintf(tw, "db\t%s\n", *argDb)
+	fmt.Fprintf(tw, "paused\t%t\n", im.Paused())
+	if im.progress != nil {
+		fmt.Fprintf(tw, "progress\t%s\n", im.progress.line())
+	}
+	if im.workers != nil {
+		busy, limit := im.workers.occupancy()
+		fmt.Fprintf(tw, "workers\t%d busy of %d\n", busy, limit)
+	}
+	tenants := make([]string, 0, len(im.tenantWorkers))
+	for tenant := range im.tenantWorkers {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		busy, limit := im.tenantWorkers[tenant].occupancy()
+		fmt.Fprintf(tw, "workers of tenant %s\t%d busy of %d\n", tenant, busy, limit)
+	}
+	if im.writer != nil {
+		fmt.Fprintf(tw, "status queue\t%d of %d\n", len(im.writer.updates), cap(im.writer.updates))
+	}
+	for _, s := range stageStatuses() {
+		fmt.Fprintf(tw, "stage %s\t%d queued, %d busy, %d processed\n", s.Stage, s.Queued, s.Busy, s.Processed)
+	}
+	fmt.Fprintf(tw, "goroutines\t%d\n", runtime.NumGoroutine())
+	tw.Flush()
+
+	entries := im.flights.entries()
+	fmt.Fprintf(w, "\n=== %d entries in flight ===\n", len(entries))
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, e := range entries {
+		since, _ := time.Parse(time.RFC3339Nano, e.Since)
+		fmt.Fprintf(tw, "%s\tsince %s\t%s\n", e.UID, e.Since, now.Sub(since).Round(time.Millisecond))
+	}
+	tw.Flush()
+
+	inflight, recent := apiRequests.snapshot()
+	fmt.Fprintf(w, "\n=== %d API requests in flight ===\n", len(inflight))
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, r := range inflight {
+		fmt.Fprintf(tw, "%s %s\tsince %s\t%s\n", r.Method, r.URL, r.Started.UTC().Format(time.RFC3339Nano), now.Sub(r.Started).Round(time.Millisecond))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n=== last %d API requests ===\n", len(recent))
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, r := range recent {
+		outcome := fmt.Sprint(r.Status)
+		if r.Error != "" {
+			outcome = truncate(r.Error, 80)
+		}
+		fmt.Fprintf(tw, "%s\t%s %s\t%s\t%s\n", r.Started.UTC().Format(time.RFC3339Nano), r.Method, r.URL, r.Elapsed.Round(time.Millisecond), outcome)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n=== goroutines ===\n")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+	fmt.Fprintf(w, "=== end of state of pid %d ===\n", os.Getpid())
+}
@@ -0,0 +1,162 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+var argRepairEncoding = Flags.String("repair-encoding", "", "comma-separated `encodings` legacy payloads may be in, e.g. latin1,windows-1252: bytes that are not UTF-8 are decoded from them and text double-encoded through them restored before sending")
+
+// sourceEncoding is an encoding payloads are repaired from.
+type sourceEncoding struct {
+	name    string
+	charmap *charmap.Charmap
+}
+
+var encodingNames = map[string]*charmap.Charmap{
+	"latin1":       charmap.ISO8859_1,
+	"iso-8859-1":   charmap.ISO8859_1,
+	"latin9":       charmap.ISO8859_15,
+	"iso-8859-15":  charmap.ISO8859_15,
+	"windows-1252": charmap.Windows1252,
+	"cp1252":       charmap.Windows1252,
+	"windows-1250": charmap.Windows1250,
+	"cp1250":       charmap.Windows1250,
+	"macintosh":    charmap.Macintosh,
+	"macroman":     charmap.Macintosh,
+}
+
+var sourceEncodings []sourceEncoding
+
+func setupEncodings() error {
+	sourceEncodings = nil
+	if *argRepairEncoding == "" {
+		return nil
+	}
+	for _, name := range strings.Split(*argRepairEncoding, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		m, ok := encodingNames[name]
+		if !ok {
+			return fmt.Errorf("unknown -repair-encoding %q, expected latin1, latin9, windows-1252, windows-1250 or macintosh", name)
+		}
+		sourceEncodings = append(sourceEncodings, sourceEncoding{name, m})
+	}
+	return nil
+}
+
+// EncodingError is a payload whose encoding could not be repaired.
+type EncodingError struct {
+	Err error
+}
+
+func (e *EncodingError) Error() string {
+	return fmt.Sprintf("invalid encoding: %s", e.Err)
+}
+
+// repairEncoding replaces the in-memory payload of e by its UTF-8 repair
+// from -repair-encoding, if it needs one. The stored payload is left
+// untouched.
+func (e *Entry) repairEncoding() error {
+	if len(sourceEncodings) == 0 {
+		return nil
+	}
+	repaired, err := repairText(e.Payload)
+	if err != nil {
+		return &EncodingError{err}
+	}
+	if strings.ContainsRune(repaired, utf8.RuneError) {
+		return &EncodingError{fmt.Errorf("payload contains U+FFFD replacement characters, the original text is lost")}
+	}
+	if repaired == e.Payload {
+		return nil
+	}
+	if !json.Valid([]byte(repaired)) {
+		return &EncodingError{fmt.Errorf("repaired payload is not valid JSON: %s", truncate(repaired, 200))}
+	}
+	logInfo(Fields{"uid": e.UID, "bytes": len(repaired)}, "repaired the encoding of entry %s", e.UID)
+	e.Payload = repaired
+	return nil
+}
+
+// repairText decodes the bytes of s that are not UTF-8 from the first of the
+// source encodings defining them, then restores the runs of non-ASCII
+// characters that are UTF-8 once encoded back with one of them.
+func repairText(s string) (string, error) {
+	if !utf8.ValidString(s) {
+		var b strings.Builder
+		for i := 0; i < len(s); {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				if r = decodeByte(s[i]); r == utf8.RuneError {
+					return "", fmt.Errorf("byte 0x%02x at offset %d is neither UTF-8 nor %s", s[i], i, *argRepairEncoding)
+				}
+			}
+			b.WriteRune(r)
+			i += size
+		}
+		s = b.String()
+	}
+	return undoDoubleEncoding(s), nil
+}
+
+func decodeByte(c byte) rune {
+	for _, enc := range sourceEncodings {
+		if r := enc.charmap.DecodeByte(c); r != utf8.RuneError {
+			return r
+		}
+	}
+	return utf8.RuneError
+}
+
+// undoDoubleEncoding replaces each run of non-ASCII characters of s by the
+// UTF-8 text its bytes in one of the source encodings form, if they do, e.g.
+// "Ã©" by "é".
+func undoDoubleEncoding(s string) string {
+	var b strings.Builder
+	start := -1
+	flush := func(end int) {
+		if start >= 0 {
+			b.WriteString(redecode(s[start:end]))
+			start = -1
+		}
+	}
+	for i, r := range s {
+		if r < utf8.RuneSelf {
+			flush(i)
+			b.WriteRune(r)
+		} else if start < 0 {
+			start = i
+		}
+	}
+	flush(len(s))
+	return b.String()
+}
+
+// redecode returns the UTF-8 text the bytes of run in a source encoding
+// form, or run itself.
+func redecode(run string) string {
+	for _, enc := range sourceEncodings {
+		raw := make([]byte, 0, len(run))
+		ok := true
+		for _, r := range run {
+			c, encoded := enc.charmap.EncodeRune(r)
+			if !encoded {
+				// C1 controls stand for the bytes some encodings leave undefined
+				if r < 0x80 || r > 0x9f {
+					ok = false
+					break
+				}
+				c = byte(r)
+			}
+			raw = append(raw, c)
+		}
+		if ok && utf8.Valid(raw) && len(raw) > utf8.RuneCount(raw) {
+			return string(raw)
+		}
+	}
+	return run
+}
@@ -0,0 +1,278 @@
+package importer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+var argPayloadKey = Flags.String("payload-key", "", "encrypt the payloads stored in -db with this base64 AES key: env:NAME, file:PATH or cmd:COMMAND printing it, e.g. a KMS decrypt call")
+
+// sealedPrefix starts every encrypted payload, followed by the base64 nonce
+// and ciphertext.
+const sealedPrefix = "gaia-aes-gcm:"
+
+var payloadKey struct {
+	once sync.Once
+	aead cipher.AEAD
+	err  error
+}
+
+func isSealed(payload string) bool {
+	return strings.HasPrefix(payload, sealedPrefix)
+}
+
+// readPayloadKey reads the key designated by -payload-key.
+func readPayloadKey(source string) ([]byte, error) {
+	var raw []byte
+	var err error
+	switch {
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		if raw = []byte(os.Getenv(name)); len(raw) == 0 {
+			return nil, fmt.Errorf("%s is not set", name)
+		}
+	case strings.HasPrefix(source, "file:"):
+		raw, err = ioutil.ReadFile(strings.TrimPrefix(source, "file:"))
+	case strings.HasPrefix(source, "cmd:"):
+		cmd := shellCommand(strings.TrimPrefix(source, "cmd:"))
+		cmd.Stderr = os.Stderr
+		raw, err = cmd.Output()
+	default:
+		return nil, fmt.Errorf("invalid key source %q, expected env:NAME, file:PATH or cmd:COMMAND", source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, errors.New("the key is not valid base64")
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, fmt.Errorf("the key is %d bytes long, expected 16, 24 or 32", len(key))
+	}
+	return key, nil
+}
+
+// payloadCipher returns the cipher of -payload-key, nil if it is not set.
+func payloadCipher() (cipher.AEAD, error) {
+	payloadKey.once.Do(func() {
+		if *argPayloadKey == "" {
+			return
+		}
+		key, err := readPayloadKey(*argPayloadKey)
+		if err != nil {
+			payloadKey.err = fmt.Errorf("failed to read -payload-key: %s", err)
+			return
+		}
+		block, err := aes.NewCipher(key)
+		if err == nil {
+			payloadKey.aead, err = cipher.NewGCM(block)
+		}
+		payloadKey.err = err
+	})
+	return payloadKey.aead, payloadKey.err
+}
+
+// sealPayload encrypts payload if -payload-key is set.
+func sealPayload(payload string) (string, error) {
+	aead, err := payloadCipher()
+	if err != nil || aead == nil || isSealed(payload) {
+		return payload, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(payload), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openPayload decrypts payload, returned as is if it is not encrypted.
+func openPayload(payload string) (string, error) {
+	if !isSealed(payload) {
+		return payload, nil
+	}
+	aead, err := payloadCipher()
+	if err != nil {
+		return "", err
+	}
+	if aead == nil {
+		return "", errors.New("payload is encrypted, -payload-key is needed")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(payload, sealedPrefix))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted payload")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt payload, wrong -payload-key?")
+	}
+	return string(plain), nil
+}
+
+// decodePayload returns a payload read from the database decrypted and
+// uncompressed.
+func decodePayload(payload string) (string, error) {
+	payload, err := openPayload(payload)
+	if err != nil {
+		return "", err
+	}
+	return decompressPayload(payload)
+}
+
+func runEncrypt(args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	commonFlags(fs)
+	decrypt := fs.Bool("decrypt", false, "decrypt the encrypted payloads instead")
+	pageSize := fs.Int("page-size", 1000, "number of rows rewritten per transaction")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s encrypt [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *argPayloadKey == "" {
+		return errors.New("-payload-key is needed")
+	}
+	if _, err := payloadCipher(); err != nil {
+		return err
+	}
+
+	db, d, err := openDB(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	defer s.Close()
+
+	convert := sealPayload
+	if *decrypt {
+		convert = openPayload
+	}
+	rewritten := 0
+	for after := ""; ; {
+		n, last, err := s.rewritePayloads(after, *pageSize, convert)
+		if err != nil {
+			return fmt.Errorf("failed to rewrite payloads: %s", err)
+		}
+		rewritten += n
+		if last == "" {
+			break
+		}
+		after = last
+	}
+	n, err := s.rewriteDeadLetters(convert)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite dead letters: %s", err)
+	}
+	rewritten += n
+	logInfo(Fields{"rewritten": rewritten}, "%d payloads rewritten", rewritten)
+	if d.driver == "sqlite3" {
+		// Plaintext payloads would otherwise linger in free pages.
+		if _, err := s.exec("VACUUM"); err != nil {
+			return fmt.Errorf("failed to vacuum database: %s", err)
+		}
+	}
+	return nil
+}
+
+// rewriteDeadLetters converts the payloads of the dead letters, if the
+// dead_letters table exists.
+func (s *sqlStore) rewriteDeadLetters(convert func(string) (string, error)) (int, error) {
+	rows, err := s.query("SELECT uid, payload FROM dead_letters")
+	if err != nil {
+		return 0, nil
+	}
+	var records []loadRecord
+	for rows.Next() {
+		var r loadRecord
+		if err := rows.Scan(&r.UID, &r.Payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		records = append(records, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, r := range records {
+		payload, err := convert(r.Payload)
+		if err != nil {
+			return n, fmt.Errorf("uid %s: %s", r.UID, err)
+		}
+		if payload == r.Payload {
+			continue
+		}
+		if _, err := s.exec("UPDATE dead_letters SET payload = ? WHERE uid = ?", payload, r.UID); err != nil {
+			return n, fmt.Errorf("uid %s: %s", r.UID, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+func runScrub(args []string) error {
+	fs := flag.NewFlagSet("scrub", flag.ExitOnError)
+	commonFlags(fs)
+	before := fs.String("before", "", "only entries imported before this date or RFC 3339 time")
+	responses := fs.Bool("responses", false, "also remove the archived response bodies")
+	dryRun := fs.Bool("dry-run", false, "only count the entries that would be scrubbed")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s scrub [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	condition := importedCondition
+	var conditionArgs []interface{}
+	if *before != "" {
+		t, err := parseTimestamp(*before)
+		if err != nil {
+			return err
+		}
+		condition += " AND imported_at < ?"
+		conditionArgs = append(conditionArgs, t)
+	}
+
+	db, d, err := openDB(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	defer s.Close()
+	s.detectSchema()
+
+	if *dryRun {
+		var n int64
+		if err := db.QueryRow(d.rebind("SELECT COUNT(*) FROM imports WHERE "+condition), conditionArgs...).Scan(&n); err != nil {
+			return fmt.Errorf("failed to count entries: %s", err)
+		}
+		logInfo(Fields{"matching": n}, "%d imported entries would be scrubbed", n)
+		return nil
+	}
+	n, err := s.dropImportedPayloads(condition, conditionArgs, *responses)
+	if err != nil {
+		return fmt.Errorf("failed to scrub entries: %s", err)
+	}
+	logInfo(Fields{"scrubbed": n}, "payloads of %d imported entries removed", n)
+	if d.driver == "sqlite3" {
+		if _, _, err := s.vacuum(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
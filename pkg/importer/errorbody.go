@@ -0,0 +1,79 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sharedErrorBodyMin is the length from which API error bodies are stored
+// once in the errors table, the rows referencing them by hash.
+const sharedErrorBodyMin = 256
+
+var errorBodyColumns = []column{
+	{"hash", "%s NOT NULL UNIQUE"},
+	{"body", "TEXT NOT NULL"},
+	{"http_status", "INTEGER"},
+	{"first_seen_at", "TEXT"},
+}
+
+// errorRecord is how the error of an entry is persisted: the text of its
+// error column and, for long API error bodies, the body stored once in the
+// errors table under hash.
+type errorRecord struct {
+	text   string
+	hash   string
+	body   string
+	status int
+}
+
+func (e *Entry) errorRecord() errorRecord {
+	r := errorRecord{text: e.Err.Error()}
+	var apiErr *APIError
+	if !errors.As(e.Err, &apiErr) || len(apiErr.Payload) < sharedErrorBodyMin {
+		return r
+	}
+	sum := sha256.Sum256([]byte(apiErr.Payload))
+	r.hash, r.body, r.status = hex.EncodeToString(sum[:]), apiErr.Payload, apiErr.Status
+	summary := fmt.Sprintf("%s (%d bytes, body %s in errors)", truncate(apiErr.Payload, 120), len(apiErr.Payload), r.hash[:12])
+	r.text = strings.Replace(r.text, apiErr.Payload, summary, 1)
+	return r
+}
+
+// errorRecord returns the errorRecord of e, only sharing its body if the
+// database has the errors table.
+func (s *sqlStore) errorRecord(e *Entry) errorRecord {
+	if !s.has("errors", "") || !s.has("imports", "error_hash") {
+		return errorRecord{text: e.Err.Error()}
+	}
+	return e.errorRecord()
+}
+
+// hashArg returns the error_hash column value of r.
+func (r errorRecord) hashArg() interface{} {
+	if r.hash == "" {
+		return nil
+	}
+	return r.hash
+}
+
+// saveErrorBody stores the body of r within tx, unless already there.
+func (s *sqlStore) saveErrorBody(tx *sql.Tx, r errorRecord, now string) error {
+	if r.hash == "" {
+		return nil
+	}
+	_, err := tx.Exec(s.dialect.rebind(s.dialect.insertErrorBodyQuery), r.hash, r.body, r.status, now)
+	return err
+}
+
+// responseBodyColumn selects the archived response body of an entry, or else
+// its shared error body.
+func (s *sqlStore) responseBodyColumn() string {
+	if !s.has("errors", "") || !s.has("imports", "error_hash") {
+		return "response_body"
+	}
+	return "COALESCE(response_body, (SELECT body FROM errors WHERE errors.hash = imports.error_hash))"
+}
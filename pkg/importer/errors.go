@@ -0,0 +1,142 @@
+package importer
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	errorClassNetwork     = "network"
+	errorClass4xx         = "4xx"
+	errorClass5xx         = "5xx"
+	errorClassParse       = "parse"
+	errorClassTransform   = "transform"
+	errorClassOversized   = "oversized"
+	errorClassInvalid     = "invalid"
+	errorClassOther       = "other"
+	errorClassBlocked     = "blocked"
+	errorClassQuarantined = "quarantined"
+	errorClassDiscarded   = "discarded"
+)
+
+var errorClasses = []string{errorClassNetwork, errorClass4xx, errorClass5xx, errorClassParse, errorClassTransform, errorClassOversized, errorClassInvalid, errorClassOther, errorClassBlocked, errorClassQuarantined}
+
+type ParseError struct {
+	Payload string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("failed to parse payload: %s", e.Payload)
+}
+
+// classifyError returns the error class persisted along with err.
+func classifyError(err error) string {
+	var apiErr *APIError
+	var parseErr *ParseError
+	var transformErr *TransformError
+	var pluginErr *PluginError
+	var oversizedErr *OversizedError
+	var tenantErr *TenantError
+	var groupErr *GroupError
+	var schemaErr *SchemaError
+	var lookupErr *LookupError
+	var columnErr *ColumnError
+	var createdAtErr *CreatedAtError
+	var lintErr *LintError
+	var encodingErr *EncodingError
+	var payloadFileErr *PayloadFileError
+	var referenceErr *ReferenceError
+	var normalizeErr *NormalizeError
+	var quarantineErr *QuarantineError
+	var adapterErr *AdapterError
+	var planErr *PlanError
+	var mappingErr *MappingError
+	var attachmentErr *AttachmentError
+	switch {
+	case errors.As(err, &apiErr):
+		switch {
+		case apiErr.Status == http.StatusRequestEntityTooLarge:
+			return errorClassOversized
+		case apiErr.Status >= 400 && apiErr.Status < 500:
+			return errorClass4xx
+		case apiErr.Status >= 500:
+			return errorClass5xx
+		}
+		return errorClassOther
+	case errors.As(err, &parseErr):
+		return errorClassParse
+	case errors.As(err, &transformErr), errors.As(err, &pluginErr), errors.As(err, &adapterErr),
+		errors.As(err, &mappingErr):
+		return errorClassTransform
+	case errors.As(err, &oversizedErr):
+		return errorClassOversized
+	case errors.As(err, &schemaErr), errors.As(err, &createdAtErr), errors.As(err, &lintErr), errors.As(err, &encodingErr),
+		errors.As(err, &payloadFileErr), errors.As(err, &normalizeErr), errors.As(err, &planErr), errors.As(err, &attachmentErr):
+		return errorClassInvalid
+	case errors.As(err, &referenceErr):
+		return errorClassBlocked
+	case errors.As(err, &quarantineErr):
+		return errorClassQuarantined
+	case errors.As(err, &tenantErr), errors.As(err, &groupErr), errors.As(err, &lookupErr), errors.As(err, &columnErr):
+		return errorClassOther
+	}
+	return errorClassNetwork
+}
+
+func parseErrorClasses(list string) ([]string, error) {
+	if list == "" {
+		return errorClasses, nil
+	}
+	var classes []string
+	for _, class := range strings.Split(list, ",") {
+		class = strings.TrimSpace(class)
+		known := false
+		for _, c := range errorClasses {
+			known = known || c == class
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown error class %q (expected one of %s)", class, strings.Join(errorClasses, ", "))
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+func runRetryErrors(args []string) error {
+	fs := flag.NewFlagSet("retry-errors", flag.ExitOnError)
+	commonFlags(fs)
+	inheritFlags(fs, "audit-file")
+	only := fs.String("only", "", "comma-separated error classes to retry ("+strings.Join(errorClasses, ",")+"), all by default")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s retry-errors [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := setupAudit("retry-errors"); err != nil {
+		return err
+	}
+	defer closeAudit()
+	classes, err := parseErrorClasses(*only)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+
+	n, err := store.ResetErrors(classes)
+	if err != nil {
+		return fmt.Errorf("failed to reset errors: %s", err)
+	}
+	logInfo(Fields{"requeued": n, "classes": classes}, "%d errored entries set back to pending", n)
+	return nil
+}
@@ -0,0 +1,136 @@
+package importer
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	argConfirmOver = Flags.String("confirm-over", "", "ask for confirmation before runs estimated to take longer than this `duration` or to send more than this number of requests, e.g. 2h or 100000, and fail without a terminal unless -yes is given")
+	argYes         = Flags.Bool("yes", false, "start the run whatever its estimate, without asking for confirmation")
+)
+
+// latencySample is the number of latest imported entries whose import time
+// gives the latency of the estimate.
+const latencySample = 1000
+
+// Estimate is the expected size and duration of a run, before it starts.
+type Estimate struct {
+	Pending  int
+	Requests int
+	// Latency is the average time of the latest imports, zero without any.
+	Latency  time.Duration
+	Duration time.Duration
+}
+
+func (e Estimate) String() string {
+	if e.Latency == 0 {
+		return fmt.Sprintf("%d entries in %d requests, duration unknown without previous imports", e.Pending, e.Requests)
+	}
+	duration := e.Duration.Round(time.Second)
+	if e.Duration < time.Second {
+		duration = e.Duration.Round(time.Millisecond)
+	}
+	return fmt.Sprintf("%d entries in %d requests, about %s at %s per request with -j %d", e.Pending, e.Requests, duration, e.Latency.Round(time.Millisecond), *argConcurrency)
+}
+
+// averageLatency returns the average import time of the latest imported
+// entries.
+func (s *sqlStore) averageLatency() (time.Duration, error) {
+	if !s.has("imports", "import_time_ms") || !s.has("imports", "imported_at") {
+		return 0, nil
+	}
+	var ms sql.NullFloat64
+	err := s.db.QueryRow(s.dialect.rebind("SELECT AVG(import_time_ms) FROM (SELECT import_time_ms FROM imports WHERE import_time_ms IS NOT NULL AND imported_at IS NOT NULL ORDER BY imported_at DESC LIMIT ?) latest"), latencySample).Scan(&ms)
+	if err != nil || !ms.Valid {
+		return 0, err
+	}
+	return time.Duration(ms.Float64 * float64(time.Millisecond)), nil
+}
+
+// estimateRun estimates the run of the pending entries of store: one request
+// per entry, or per batch with -batch-size, plus a lookup per entry with
+// -lookup, sent -j at a time at the latency of the latest imports.
+func estimateRun(store Store) (Estimate, error) {
+	pending, err := pendingSelection.countPending(store)
+	if err != nil {
+		return Estimate{}, fmt.Errorf("failed to count pending entries: %s", err)
+	}
+	if *argSample != "" {
+		fraction, count, _ := parseSample(*argSample)
+		if count == 0 {
+			count = int(float64(pending)*fraction + 0.5)
+		}
+		if count < pending {
+			pending = count
+		}
+	}
+	e := Estimate{Pending: pending, Requests: pending}
+	if n := *argBatchSize; n > 1 {
+		e.Requests = (pending + n - 1) / n
+	}
+	if lookupTemplate != nil {
+		e.Requests += pending
+	}
+	if s := schemaStore(store); s != nil {
+		if e.Latency, err = s.averageLatency(); err != nil {
+			return Estimate{}, fmt.Errorf("failed to read import times: %s", err)
+		}
+	}
+	if concurrency := *argConcurrency; concurrency > 0 {
+		e.Duration = time.Duration(int64(e.Requests) * int64(e.Latency) / int64(concurrency))
+	}
+	return e, nil
+}
+
+// parseConfirmOver reads a -confirm-over value, either a duration or a
+// number of requests.
+func parseConfirmOver(value string) (time.Duration, int, error) {
+	if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n > 0 {
+		return 0, n, nil
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("invalid -confirm-over %q, expected a duration such as 2h or a number of requests such as 100000", value)
+	}
+	return d, 0, nil
+}
+
+// confirmRun logs the estimate of the run of store and, past -confirm-over,
+// asks for confirmation on the terminal unless -yes is given.
+func confirmRun(store Store) error {
+	var maxDuration time.Duration
+	var maxRequests int
+	if *argConfirmOver != "" {
+		var err error
+		if maxDuration, maxRequests, err = parseConfirmOver(*argConfirmOver); err != nil {
+			return err
+		}
+	}
+	e, err := estimateRun(store)
+	if err != nil {
+		return err
+	}
+	logInfo(Fields{"pending": e.Pending, "requests": e.Requests, "latency_ms": e.Latency.Milliseconds(), "estimated_ms": e.Duration.Milliseconds()},
+		"estimated run: %s", e)
+	over := maxRequests > 0 && e.Requests > maxRequests || maxDuration > 0 && e.Duration > maxDuration
+	if !over || *argYes {
+		return nil
+	}
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stderr) {
+		return fmt.Errorf("the run is estimated above -confirm-over %s (%s), give -yes to start it", *argConfirmOver, e)
+	}
+	fmt.Fprintf(os.Stderr, "The run is estimated above -confirm-over %s: %s.\nStart it? [y/N] ", *argConfirmOver, e)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return errors.New("run not confirmed")
+}
@@ -0,0 +1,134 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// existsStatusList is a repeatable flag of the API answers meaning that the
+// response of an entry already exists.
+type existsStatusList []existsStatus
+
+// existsStatus is an HTTP status, with the error code its body must hold if
+// not empty.
+type existsStatus struct {
+	status int
+	code   string
+}
+
+func (l *existsStatusList) String() string {
+	statuses := make([]string, len(*l))
+	for i, s := range *l {
+		statuses[i] = strconv.Itoa(s.status)
+		if s.code != "" {
+			statuses[i] += ":" + s.code
+		}
+	}
+	return strings.Join(statuses, ", ")
+}
+
+func (l *existsStatusList) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	status, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || status < 400 || status > 599 {
+		return fmt.Errorf("invalid status %q, expected an error status such as 409 or 422:duplicate_response", value)
+	}
+	s := existsStatus{status: status}
+	if len(parts) == 2 {
+		if s.code = strings.TrimSpace(parts[1]); s.code == "" {
+			return fmt.Errorf("invalid status %q, expected an error code after the colon", value)
+		}
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+func (l *existsStatusList) reset() {
+	*l = nil
+}
+
+var (
+	argExistsStatuses existsStatusList
+	argExistsCodePath = Flags.String("exists-code-path", "code", "dot-separated path of the error code in the bodies of the -exists-status answers given with a code")
+	argExistsIDPath   = Flags.String("exists-id-path", "", "dot-separated path of the identifier of the existing response in the bodies of the -exists-status answers, -exists-lookup being used when absent (default: the -response-id-path)")
+	argExistsLookup   = Flags.String("exists-lookup", "", "text/template of the API path and query looking up the existing response after an -exists-status answer without its identifier, as -lookup, the identifier being read at -lookup-id-path (default: the -lookup)")
+)
+
+func init() {
+	Flags.Var(&argExistsStatuses, "exists-status", "`status[:code]` of the API answers meaning the response of an entry already exists, e.g. 409 or 422:duplicate_response, the entry being marked as a duplicate linked to the existing response rather than errored, repeatable")
+}
+
+// existsLookup renders the path of the lookups after -exists-status answers.
+var existsLookup *template.Template
+
+func setupExists() error {
+	existsLookup = lookupTemplate
+	if *argExistsLookup == "" {
+		return nil
+	}
+	if len(argExistsStatuses) == 0 {
+		return errors.New("-exists-lookup needs -exists-status")
+	}
+	t, err := template.New("exists-lookup").Funcs(transformFuncs).Option("missingkey=error").Parse(*argExistsLookup)
+	if err != nil {
+		return fmt.Errorf("invalid -exists-lookup template: %s", err)
+	}
+	existsLookup = t
+	return nil
+}
+
+// ExistsError is the answer of the API to an entry whose response already
+// exists, with the identifier of that response if known.
+type ExistsError struct {
+	Status int
+	ID     string
+}
+
+func (e *ExistsError) Error() string {
+	return fmt.Sprintf("response already exists (HTTP %d)", e.Status)
+}
+
+// existsAnswer tells whether the API answered status and body to an entry
+// whose response already exists.
+func existsAnswer(status int, body []byte) bool {
+	for _, s := range argExistsStatuses {
+		if s.status != status {
+			continue
+		}
+		if s.code == "" {
+			return true
+		}
+		if code, ok, _ := extractID(body, *argExistsCodePath); ok && code == s.code {
+			return true
+		}
+	}
+	return false
+}
+
+// alreadyExists returns the ExistsError of e, answered status and body, with
+// the identifier of the existing response found in body or by -exists-lookup.
+func (e *Entry) alreadyExists(ctx context.Context, status int, body []byte) error {
+	path := *argExistsIDPath
+	if path == "" {
+		path = *argResponseID
+	}
+	if id, ok, _ := extractID(body, path); ok && id != "" {
+		return &ExistsError{status, id}
+	}
+	if existsLookup == nil {
+		return &ExistsError{Status: status}
+	}
+	id, found, err := e.lookup(ctx, existsLookup)
+	if err != nil {
+		e.Err = &APIError{status, string(body)}
+		return fmt.Errorf("response already exists (HTTP %d), but %s", status, err)
+	}
+	if !found {
+		return &ExistsError{Status: status}
+	}
+	return &ExistsError{status, id}
+}
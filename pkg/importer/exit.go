@@ -0,0 +1,49 @@
+package importer
+
+// The exit statuses of the import command.
+const (
+	// ExitOK is a run that imported all its entries.
+	ExitOK = 0
+	// ExitFailed is a run that failed, e.g. as the database went away.
+	ExitFailed = 1
+	// ExitConfig is an invalid flag or a failed setup, nothing being
+	// imported.
+	ExitConfig = 2
+	// ExitErrors is a run that completed with errored entries, or a
+	// -dry-run that found invalid ones.
+	ExitErrors = 3
+	// ExitAborted is a run stopped by -fail-fast or -max-error-rate.
+	ExitAborted = 4
+	// ExitInterrupted is a run stopped by a stop signal, or the cancellation
+	// of its context, with entries left pending.
+	ExitInterrupted = 5
+)
+
+// ExitCode returns the exit status of a run that returned err.
+func (im *Importer) ExitCode(err error) int {
+	if im.multi != nil {
+		return im.multi.exitCode()
+	}
+	switch err.(type) {
+	case nil:
+	case *RunStoppedError:
+		return ExitAborted
+	default:
+		if err == ErrInvalidEntries {
+			return ExitErrors
+		}
+		return ExitFailed
+	}
+	if im.interrupted && im.progress != nil {
+		im.progress.mu.Lock()
+		remaining := im.progress.remaining()
+		im.progress.mu.Unlock()
+		if remaining > 0 {
+			return ExitInterrupted
+		}
+	}
+	if im.progress != nil && im.progress.errored() > 0 {
+		return ExitErrors
+	}
+	return ExitOK
+}
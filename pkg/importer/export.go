@@ -0,0 +1,155 @@
+package importer
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var argReport = Flags.String("report", "", "write a CSV or JSON report of all entries to this path after the run")
+
+// ExportRow is one line of an export report.
+type ExportRow struct {
+	UID          string  `json:"uid"`
+	ResponseID   *string `json:"response_id"`
+	ImportedAt   *string `json:"imported_at"`
+	ImportTimeMs *int64  `json:"import_time_ms"`
+	Error        *string `json:"error"`
+}
+
+func (s *sqlStore) Export(fn func(row ExportRow) error) error {
+	rows, err := s.query("SELECT uid, response_id, imported_at, import_time_ms, error FROM imports ORDER BY uid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row ExportRow
+		var importTime sql.NullInt64
+		if err := rows.Scan(&row.UID, &row.ResponseID, &row.ImportedAt, &importTime, &row.Error); err != nil {
+			return err
+		}
+		if importTime.Valid {
+			row.ImportTimeMs = &importTime.Int64
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func formatFromPath(path, fallback string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return "csv"
+	case ".json":
+		return "json"
+	}
+	return fallback
+}
+
+func writeReport(store Store, w io.Writer, format string) error {
+	switch format {
+	case "csv":
+		return writeCSVReport(store, w)
+	case "json":
+		return writeJSONReport(store, w)
+	}
+	return fmt.Errorf("unsupported report format %q", format)
+}
+
+func optional(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func writeCSVReport(store Store, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"uid", "response_id", "imported_at", "import_time_ms", "error"})
+	err := store.Export(func(row ExportRow) error {
+		importTime := ""
+		if row.ImportTimeMs != nil {
+			importTime = strconv.FormatInt(*row.ImportTimeMs, 10)
+		}
+		return writer.Write([]string{row.UID, optional(row.ResponseID), optional(row.ImportedAt), importTime, optional(row.Error)})
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeJSONReport(store Store, w io.Writer) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	first := true
+	err := store.Export(func(row ExportRow) error {
+		line, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		if !first {
+			io.WriteString(w, ",")
+		}
+		first = false
+		_, err = fmt.Fprintf(w, "\n  %s", line)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return err
+}
+
+func writeReportFile(store Store, path, format string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeReport(store, f, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	commonFlags(fs)
+	format := fs.String("format", "", "report format: csv or json (guessed from the output file extension, csv by default)")
+	output := fs.String("o", "", "output file (default: stdout)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = formatFromPath(*output, "csv")
+	}
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+
+	if *output == "" {
+		return writeReport(store, os.Stdout, *format)
+	}
+	return writeReportFile(store, *output, *format)
+}
@@ -0,0 +1,207 @@
+package importer
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	argPageSize        = Flags.Int("page-size", 1000, "number of pending entries fetched from the database at once")
+	argReaders         = Flags.Int("readers", 1, "number of goroutines fetching pending entries, each from its own range of uids")
+	argFetchRetries    = Flags.Int("fetch-retries", 5, "number of times a failed fetch of pending entries, e.g. after the database connection dropped, is retried from the last fetched uid before the run gives up")
+	argFetchRetryDelay = Flags.Duration("fetch-retry-delay", time.Second, "pause before retrying a failed fetch of pending entries, doubled on each retry")
+)
+
+// uidRange is the range of uids read by one reader: those sorting after
+// after, and up to last included unless empty.
+type uidRange struct {
+	after, last string
+}
+
+// entryStream feeds pending entries read from the store page by page, so
+// that memory stays bounded whatever the size of the table. Entries come in
+// uid order, priority after priority when the priorities of the lane are not
+// nil, unless several -readers interleave their ranges.
+type entryStream struct {
+	entries chan Entry
+	done    chan struct{}
+	mu      sync.Mutex
+	err     error
+}
+
+func streamPending(store Store, pageSize int, l lane) *entryStream {
+	s := &entryStream{
+		entries: make(chan Entry, pageSize),
+		done:    make(chan struct{}),
+	}
+	classes := []pendingScope{{tenant: l.tenant, excluded: l.excluded}}
+	if l.priorities != nil {
+		classes = make([]pendingScope, len(l.priorities))
+		for i := range l.priorities {
+			classes[i] = pendingScope{&l.priorities[i], l.tenant, l.excluded}
+		}
+	}
+	go func() {
+		defer close(s.entries)
+		ranges, err := readerRanges(store, *argReaders)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		for _, scope := range classes {
+			if !s.streamRanges(store, pageSize, scope, ranges) {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// readerRanges splits the pending uids in n ranges of about the same size.
+func readerRanges(store Store, n int) ([]uidRange, error) {
+	if n <= 1 {
+		return []uidRange{{}}, nil
+	}
+	boundaries, err := store.PendingBoundaries(n)
+	if err != nil {
+		return nil, err
+	}
+	ranges := make([]uidRange, 0, len(boundaries)+1)
+	after := ""
+	for _, boundary := range boundaries {
+		ranges = append(ranges, uidRange{after: after, last: boundary})
+		after = boundary
+	}
+	return append(ranges, uidRange{after: after}), nil
+}
+
+// streamRanges feeds the pending entries of scope with one reader per range,
+// and reports whether the next priority should be streamed.
+func (s *entryStream) streamRanges(store Store, pageSize int, scope pendingScope, ranges []uidRange) bool {
+	if len(ranges) == 1 {
+		return s.stream(store, pageSize, scope, ranges[0])
+	}
+	var wg sync.WaitGroup
+	results := make([]bool, len(ranges))
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r uidRange) {
+			defer wg.Done()
+			results[i] = s.stream(store, pageSize, scope, r)
+		}(i, r)
+	}
+	wg.Wait()
+	for _, ok := range results {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *entryStream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// stream feeds the pending entries of scope within r, and reports whether
+// the next priority should be streamed.
+func (s *entryStream) stream(store Store, pageSize int, scope pendingScope, r uidRange) bool {
+	after := r.after
+	for {
+		page, err := s.fetchPage(store, pageSize, scope, after)
+		if err != nil {
+			s.fail(err)
+			return false
+		}
+		for _, entry := range page {
+			if r.last != "" && entry.UID > r.last {
+				return true
+			}
+			if !pendingSelection.accept(&entry) {
+				if pendingSelection.exhausted() {
+					return false
+				}
+				continue
+			}
+			fetchStage.queue(1)
+			select {
+			case s.entries <- entry:
+			case <-s.done:
+				fetchStage.queue(-1)
+				return false
+			}
+		}
+		// Topics are never exhausted, only stopped.
+		if _, endless := store.(*kafkaStore); endless && len(page) > 0 {
+			continue
+		}
+		if len(page) < pageSize {
+			return true
+		}
+		after = page[len(page)-1].UID
+	}
+}
+
+// fetchPage fetches the page of pending entries of scope after the uid after,
+// retrying -fetch-retries times. Pages being read by uid, a retry resumes
+// where the failed fetch started, the database/sql pool reconnecting.
+func (s *entryStream) fetchPage(store Store, pageSize int, scope pendingScope, after string) ([]Entry, error) {
+	delay := *argFetchRetryDelay
+	for retry := 1; ; retry++ {
+		start := fetchStage.begin()
+		page, err := store.FetchPending(scope, after, pageSize)
+		fetchStage.end(start, len(page))
+		if err == nil && retry > 1 {
+			logInfo(Fields{"after_uid": after, "retry": retry - 1}, "fetching pending entries resumed after uid %q", after)
+		}
+		if err == nil || retry > *argFetchRetries {
+			return page, err
+		}
+		logError(Fields{"error": err, "after_uid": after, "retry": retry},
+			"failed to fetch pending entries after uid %q, resuming from there in %s: %s", after, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// next returns up to n entries, blocking until they are available or the
+// stream is exhausted.
+func (s *entryStream) next(n int) []Entry {
+	if n < 1 {
+		n = 1
+	}
+	var batch []Entry
+	for len(batch) < n {
+		entry, ok := <-s.entries
+		if !ok {
+			break
+		}
+		fetchStage.queue(-1)
+		batch = append(batch, entry)
+	}
+	return batch
+}
+
+// Err returns the error that interrupted the stream, once it is exhausted.
+func (s *entryStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *entryStream) Close() {
+	close(s.done)
+	go func() {
+		for range s.entries {
+			fetchStage.queue(-1)
+		}
+	}()
+}
@@ -0,0 +1,225 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var argFieldMapping = Flags.String("field-mapping", "", "YAML `file` mapping the fields of the stored payloads to those sent: renames, nesting, constants and lookups, applied before the other transformations")
+
+// FieldMapping builds the payload sent from the stored one, from the
+// -field-mapping file. Without Keep, the payload only holds the mapped
+// fields; with it, the other fields are kept where they are.
+type FieldMapping struct {
+	Keep    bool                      `yaml:"keep"`
+	Fields  []*MappedField            `yaml:"fields"`
+	Lookups map[string]*MappingLookup `yaml:"lookups"`
+}
+
+// MappedField sets the field at To, a dot-separated path, to the value
+// found at From in the stored payload, mapped by Lookup, or to Const.
+// Default replaces a missing value, or one Lookup does not know.
+type MappedField struct {
+	To       string      `yaml:"to"`
+	From     string      `yaml:"from"`
+	Const    interface{} `yaml:"const"`
+	Default  interface{} `yaml:"default"`
+	Lookup   string      `yaml:"lookup"`
+	Required bool        `yaml:"required"`
+
+	lookup *MappingLookup
+}
+
+// MappingLookup maps the text of source values to the values sent, given
+// inline or by a CSV file of key and value pairs.
+type MappingLookup struct {
+	Values map[string]interface{} `yaml:"values"`
+	File   string                 `yaml:"file"`
+}
+
+// MappingError is a payload the -field-mapping could not map.
+type MappingError struct {
+	Field string
+	Err   error
+}
+
+func (e *MappingError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("failed to map payload: %s", e.Err)
+	}
+	return fmt.Sprintf("failed to map %s: %s", e.Field, e.Err)
+}
+
+var fieldMapping *FieldMapping
+
+func setupFieldMapping() error {
+	fieldMapping = nil
+	if *argFieldMapping == "" {
+		return nil
+	}
+	m, err := loadFieldMapping(*argFieldMapping)
+	if err != nil {
+		return fmt.Errorf("invalid field mapping %s: %s", *argFieldMapping, err)
+	}
+	fieldMapping = m
+	return nil
+}
+
+func loadFieldMapping(path string) (*FieldMapping, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m FieldMapping
+	if err := yaml.UnmarshalStrict(content, &m); err != nil {
+		return nil, err
+	}
+	if len(m.Fields) == 0 {
+		return nil, errors.New("no fields")
+	}
+	for name, lookup := range m.Lookups {
+		if lookup == nil || lookup.Values == nil && lookup.File == "" {
+			return nil, fmt.Errorf("lookup %s has no values nor file", name)
+		}
+		if _, err := json.Marshal(lookup.Values); err != nil {
+			return nil, fmt.Errorf("lookup %s: cannot be sent as JSON: %s", name, err)
+		}
+		if lookup.File != "" {
+			if err := lookup.loadFile(); err != nil {
+				return nil, fmt.Errorf("lookup %s: failed to read %s: %s", name, lookup.File, err)
+			}
+		}
+	}
+	for i, field := range m.Fields {
+		switch {
+		case field == nil || field.To == "":
+			return nil, fmt.Errorf("field %d has no to", i+1)
+		case field.From == "" && field.Const == nil && field.Default == nil:
+			return nil, fmt.Errorf("field %s needs from, const or default", field.To)
+		case field.From != "" && field.Const != nil:
+			return nil, fmt.Errorf("field %s cannot have both from and const", field.To)
+		case field.Lookup != "" && field.From == "":
+			return nil, fmt.Errorf("field %s needs from with lookup", field.To)
+		}
+		if field.Lookup != "" {
+			if field.lookup = m.Lookups[field.Lookup]; field.lookup == nil {
+				return nil, fmt.Errorf("field %s: unknown lookup %q", field.To, field.Lookup)
+			}
+		}
+		for _, value := range []interface{}{field.Const, field.Default} {
+			if _, err := json.Marshal(value); err != nil {
+				return nil, fmt.Errorf("field %s: cannot be sent as JSON: %s", field.To, err)
+			}
+		}
+	}
+	return &m, nil
+}
+
+// loadFile adds the key and value pairs of the lookup CSV file to its
+// values, those given inline taking precedence.
+func (l *MappingLookup) loadFile() error {
+	f, err := os.Open(l.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+	if l.Values == nil {
+		l.Values = make(map[string]interface{}, len(records))
+	}
+	for _, record := range records {
+		if _, ok := l.Values[record[0]]; !ok {
+			l.Values[record[0]] = record[1]
+		}
+	}
+	return nil
+}
+
+// value returns the value of field for the stored payload doc, and false if
+// the field is left out.
+func (f *MappedField) value(doc interface{}) (interface{}, bool, error) {
+	if f.From == "" {
+		if f.Const != nil {
+			return f.Const, true, nil
+		}
+		return f.Default, true, nil
+	}
+	value, found := valueAt(doc, f.From)
+	if !found || value == nil {
+		switch {
+		case f.Default != nil:
+			return f.Default, true, nil
+		case f.Required:
+			return nil, false, fmt.Errorf("%s is missing", f.From)
+		}
+		return nil, false, nil
+	}
+	if f.lookup == nil {
+		return value, true, nil
+	}
+	if key, ok := lintString(value); ok {
+		if mapped, found := f.lookup.Values[key]; found {
+			return mapped, true, nil
+		}
+	}
+	if f.Default != nil {
+		return f.Default, true, nil
+	}
+	return nil, false, fmt.Errorf("%s is not in lookup %s", compactJSON(value), f.Lookup)
+}
+
+// mapFields replaces the in-memory payload of e by the one built by the
+// -field-mapping. The stored payload is left untouched.
+func (e *Entry) mapFields() error {
+	if fieldMapping == nil {
+		return nil
+	}
+	doc, err := decodeJSON([]byte(e.Payload))
+	if err != nil {
+		return &MappingError{Err: fmt.Errorf("payload is not valid JSON: %s", err)}
+	}
+	var out interface{} = map[string]interface{}{}
+	if fieldMapping.Keep {
+		if out, err = decodeJSON([]byte(e.Payload)); err != nil {
+			return &MappingError{Err: err}
+		}
+		for _, field := range fieldMapping.Fields {
+			if field.From != "" {
+				removeAt(out, strings.Split(field.From, "."))
+			}
+		}
+	}
+	for _, field := range fieldMapping.Fields {
+		value, ok, err := field.value(doc)
+		if err != nil {
+			return &MappingError{field.To, err}
+		}
+		if !ok {
+			continue
+		}
+		if err := setAt(out, strings.Split(field.To, "."), value); err != nil {
+			return &MappingError{field.To, err}
+		}
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(out); err != nil {
+		return &MappingError{Err: err}
+	}
+	e.Payload = strings.TrimSuffix(b.String(), "\n")
+	return nil
+}
@@ -0,0 +1,167 @@
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	argLimit   = Flags.Int("limit", 0, "maximum number of entries to import (0 means no limit)")
+	argUIDFile = Flags.String("uid-file", "", "only import the entries whose uid is listed in this file, one per line")
+	argWhere   = Flags.String("where", "", "only import the entries matching this SQL condition on the imports table")
+	argShard   = Flags.String("shard", "", "only import the i-th of n disjoint slices of the entries, by uid hash (e.g. 2/8)")
+)
+
+// selection restricts the pending entries of a run to the -uid-file list, the
+// -shard slice and the -limit count; the -where condition is applied by the
+// store itself.
+type selection struct {
+	uids []string
+	set  map[string]bool
+
+	// shard is 0-based, shards is 0 without -shard.
+	shard  uint32
+	shards uint32
+
+	mu       sync.Mutex
+	limit    int
+	selected int
+}
+
+var pendingSelection = &selection{}
+
+func readUIDFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var uids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if uid := strings.TrimSpace(scanner.Text()); uid != "" {
+			uids = append(uids, uid)
+		}
+	}
+	return uids, scanner.Err()
+}
+
+// parseShard parses an "i/n" shard, i being 1-based.
+func parseShard(s string) (shard, shards uint32, err error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected i/n", s)
+	}
+	i, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected i/n", s)
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected i/n", s)
+	}
+	if n == 0 || i == 0 || i > n {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected 1 <= i <= n", s)
+	}
+	return uint32(i - 1), uint32(n), nil
+}
+
+func setupSelection(store Store) error {
+	sampled, err := sampledFilter()
+	if err != nil {
+		return err
+	}
+	filter := *argWhere
+	switch {
+	case sampled != "" && filter != "":
+		filter = "(" + filter + ") AND " + sampled
+	case sampled != "":
+		filter = sampled
+	}
+	store.SetPendingFilter(filter)
+	pendingSelection = &selection{limit: *argLimit}
+	if *argShard != "" {
+		shard, shards, err := parseShard(*argShard)
+		if err != nil {
+			return err
+		}
+		pendingSelection.shard, pendingSelection.shards = shard, shards
+	}
+	if *argUIDFile == "" {
+		return nil
+	}
+	uids, err := readUIDFile(*argUIDFile)
+	if err != nil {
+		return err
+	}
+	pendingSelection.set = make(map[string]bool, len(uids))
+	for _, uid := range uids {
+		if pendingSelection.inShard(uid) {
+			pendingSelection.uids = append(pendingSelection.uids, uid)
+			pendingSelection.set[uid] = true
+		}
+	}
+	if pendingSelection.uids == nil {
+		pendingSelection.uids = []string{}
+	}
+	return nil
+}
+
+// inShard reports whether uid belongs to the -shard slice, which only
+// depends on the uid so that instances agree without coordination.
+func (s *selection) inShard(uid string) bool {
+	if s.shards == 0 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(uid))
+	return h.Sum32()%s.shards == s.shard
+}
+
+// accept reports whether entry is part of the selection, and counts it
+// against the limit if so.
+func (s *selection) accept(entry *Entry) bool {
+	if s.set != nil && !s.set[entry.UID] {
+		return false
+	}
+	if s.set == nil && !s.inShard(entry.UID) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limit > 0 && s.selected >= s.limit {
+		return false
+	}
+	s.selected++
+	return true
+}
+
+// exhausted reports whether the limit has been reached.
+func (s *selection) exhausted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit > 0 && s.selected >= s.limit
+}
+
+// countPending returns the number of pending entries the selection would
+// accept. Without -uid-file, the size of a -shard slice is estimated.
+func (s *selection) countPending(store Store) (int, error) {
+	n, err := store.CountPending(s.uids)
+	if err != nil {
+		return 0, err
+	}
+	if s.shards > 1 && s.set == nil {
+		n = (n + int(s.shards) - 1) / int(s.shards)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limit > 0 && n > s.limit-s.selected {
+		n = s.limit - s.selected
+	}
+	return n, nil
+}
@@ -0,0 +1,102 @@
+package importer
+
+import (
+	"fmt"
+	"sync"
+)
+
+var argOrderedGroups = Flags.Bool("ordered-groups", false, "import the entries sharing a group_key one at a time, in uid order, later ones failing if an earlier one does")
+
+type GroupError struct {
+	Group string
+	UID   string
+}
+
+func (e *GroupError) Error() string {
+	return fmt.Sprintf("entry %s of group %s failed before", e.UID, e.Group)
+}
+
+// sequencer holds back the entries of a group while another entry of the
+// group is in flight, and hands them over in order once it is done.
+type sequencer struct {
+	mu      sync.Mutex
+	waiting map[string][]Entry
+	failed  map[string]string
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{waiting: make(map[string][]Entry), failed: make(map[string]string)}
+}
+
+// admit returns the entries of batch that can be processed now, holding back
+// the others. It returns batch itself on a nil sequencer.
+func (s *sequencer) admit(batch []Entry) []Entry {
+	if s == nil {
+		return batch
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ready []Entry
+	for _, entry := range batch {
+		if entry.GroupKey == "" {
+			ready = append(ready, entry)
+			continue
+		}
+		if queue, busy := s.waiting[entry.GroupKey]; busy {
+			s.waiting[entry.GroupKey] = append(queue, entry)
+			continue
+		}
+		s.waiting[entry.GroupKey] = nil
+		ready = append(ready, entry)
+	}
+	return ready
+}
+
+// release returns the entries to process next, now that those of batch are
+// done.
+func (s *sequencer) release(batch []Entry) []Entry {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ready []Entry
+	for _, entry := range batch {
+		if entry.GroupKey == "" {
+			continue
+		}
+		queue := s.waiting[entry.GroupKey]
+		if len(queue) == 0 {
+			delete(s.waiting, entry.GroupKey)
+			continue
+		}
+		ready = append(ready, queue[0])
+		s.waiting[entry.GroupKey] = queue[1:]
+	}
+	return ready
+}
+
+// fail records that an entry of the group of e failed.
+func (s *sequencer) fail(e *Entry) {
+	if s == nil || e.GroupKey == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.failed[e.GroupKey]; !ok {
+		s.failed[e.GroupKey] = e.UID
+	}
+}
+
+// check fails if an earlier entry of the group of e failed.
+func (s *sequencer) check(e *Entry) error {
+	if s == nil || e.GroupKey == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if uid, ok := s.failed[e.GroupKey]; ok {
+		return &GroupError{e.GroupKey, uid}
+	}
+	return nil
+}
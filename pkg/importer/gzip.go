@@ -0,0 +1,84 @@
+package importer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+)
+
+var argGzip = Flags.Bool("gzip", false, "compress request bodies with gzip, back to uncompressed requests once the API answers 415 Unsupported Media Type")
+
+// gzipRejected is set once the API refused a compressed request.
+var gzipRejected int32
+
+func gzipEnabled() bool {
+	return *argGzip && atomic.LoadInt32(&gzipRejected) == 0
+}
+
+// compressRequest replaces the body of req by its gzipped copy, and returns
+// the function giving the uncompressed body back.
+func compressRequest(req *http.Request) (func() (io.ReadCloser, error), error) {
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := io.Copy(w, body); err != nil {
+		return nil, err
+	}
+	body.Close()
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	original := req.GetBody
+	data := compressed.Bytes()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	req.Body, _ = req.GetBody()
+	req.ContentLength = int64(len(data))
+	req.Header.Set("Content-Encoding", "gzip")
+	return original, nil
+}
+
+// uncompressRequest gives req back the body returned by original.
+func uncompressRequest(req *http.Request, original func() (io.ReadCloser, error)) error {
+	body, err := original()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	req.GetBody = original
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	req.ContentLength = int64(len(data))
+	req.Header.Del("Content-Encoding")
+	return nil
+}
+
+func rejectGzip() {
+	if atomic.CompareAndSwapInt32(&gzipRejected, 0, 1) {
+		logInfo(nil, "API does not accept gzipped requests, sending them uncompressed")
+	}
+}
+
+// gunzip returns the uncompressed content of data, or data itself if it is
+// not valid gzip.
+func gunzip(data []byte) []byte {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+	uncompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return data
+	}
+	return uncompressed
+}
@@ -0,0 +1,71 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headerList is a repeatable flag of "Name: value" headers.
+type headerList []string
+
+func (h *headerList) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerList) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("invalid header %q, expected Name: value", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+func (h *headerList) reset() {
+	*h = nil
+}
+
+var argHeaders headerList
+
+func init() {
+	Flags.Var(&argHeaders, "header", "`Name: value` header added to every API request, repeatable; the headers column of an entry, a JSON object, overrides them")
+}
+
+// ColumnError is an invalid value in a column of an entry.
+type ColumnError struct {
+	Column string
+	Err    error
+}
+
+func (e *ColumnError) Error() string {
+	return fmt.Sprintf("invalid %s column: %s", e.Column, e.Err)
+}
+
+// setHeaders adds the -header headers to req, except those it already has
+// from the headers column.
+func setHeaders(req *http.Request) {
+	for _, header := range argHeaders {
+		parts := strings.SplitN(header, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if req.Header.Get(name) == "" {
+			req.Header.Add(name, strings.TrimSpace(parts[1]))
+		}
+	}
+}
+
+// setEntryHeaders adds the headers of the headers column of e to req.
+func (e *Entry) setEntryHeaders(req *http.Request) error {
+	if e.Headers == "" {
+		return nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(e.Headers), &headers); err != nil {
+		return &ColumnError{"headers", err}
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return nil
+}
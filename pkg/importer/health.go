@@ -0,0 +1,141 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var argHealthAddr = Flags.String("health-addr", "", "address to serve the /healthz liveness and /readyz readiness endpoints on, for container orchestrators (e.g. :8081)")
+
+// healthTimeout bounds the checks of a readiness request.
+const healthTimeout = 2 * time.Second
+
+// healthCheck is a readiness condition, failing with the reason it is not
+// met.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthHandler answers /healthz while the process is up, and /readyz with
+// the results of checks, 503 Service Unavailable if any fails.
+func healthHandler(checks func() []healthCheck) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		defer cancel()
+		status, results := http.StatusOK, map[string]string{}
+		for _, c := range checks() {
+			results[c.name] = "ok"
+			if err := c.check(ctx); err != nil {
+				status, results[c.name] = http.StatusServiceUnavailable, err.Error()
+			}
+		}
+		state := "ok"
+		if status != http.StatusOK {
+			state = "unavailable"
+		}
+		writeJSON(w, status, map[string]interface{}{"status": state, "checks": results})
+	})
+	return mux
+}
+
+// databaseCheck checks that the database of s answers, named after its index
+// i among the databases checked and its driver, as the endpoints are not
+// authenticated and DSNs are not shown there.
+func databaseCheck(i int, s *sqlStore) healthCheck {
+	return healthCheck{fmt.Sprintf("database %d (%s)", i, s.dialect.driver), func(ctx context.Context) error {
+		return s.db.PingContext(ctx)
+	}}
+}
+
+// runHealth is the state of the runs of the process checked by /readyz: the
+// databases of its open Importers, and whether the API rejected the token
+// since it last accepted a request.
+type runHealth struct {
+	mu       sync.Mutex
+	stores   []*sqlStore
+	rejected bool
+}
+
+var importHealth = &runHealth{}
+
+// healthServer serves the health endpoints once per process, the Importers
+// of the databases of a run sharing them.
+var healthServer sync.Once
+
+// serveHealth serves the health endpoints on addr, checking store until
+// unregisterHealth.
+func serveHealth(addr string, store Store) {
+	if s := schemaStore(store); s != nil {
+		importHealth.mu.Lock()
+		importHealth.stores = append(importHealth.stores, s)
+		importHealth.mu.Unlock()
+	}
+	healthServer.Do(func() {
+		go func() {
+			if err := http.ListenAndServe(addr, healthHandler(importHealth.checks)); err != nil {
+				logError(Fields{"error": err}, "health server stopped: %s", err)
+			}
+		}()
+	})
+}
+
+// unregisterHealth stops checking store, once its Importer is closed.
+func unregisterHealth(store Store) {
+	s := schemaStore(store)
+	if s == nil {
+		return
+	}
+	importHealth.mu.Lock()
+	defer importHealth.mu.Unlock()
+	stores := importHealth.stores[:0]
+	for _, h := range importHealth.stores {
+		if h != s {
+			stores = append(stores, h)
+		}
+	}
+	importHealth.stores = stores
+}
+
+// response records the status of an API answer, 0 for a network error.
+func (h *runHealth) response(status int) {
+	if status == 0 || status != http.StatusUnauthorized && status >= 300 {
+		return
+	}
+	h.mu.Lock()
+	h.rejected = status == http.StatusUnauthorized
+	h.mu.Unlock()
+}
+
+func (h *runHealth) checks() []healthCheck {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	checks := make([]healthCheck, 0, len(h.stores)+2)
+	for i, s := range h.stores {
+		checks = append(checks, databaseCheck(i, s))
+	}
+	return append(checks,
+		healthCheck{"token", func(context.Context) error {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if h.rejected {
+				return errors.New("the API answered 401 Unauthorized")
+			}
+			return nil
+		}},
+		healthCheck{"breaker", func(context.Context) error {
+			if apiBreaker.isOpen() {
+				return errors.New("circuit breaker open")
+			}
+			return nil
+		}},
+	)
+}
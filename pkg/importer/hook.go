@@ -0,0 +1,86 @@
+package importer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	argOnImportCommand = Flags.String("on-import-command", "", "shell command run after each import, with the uid and response_id as $1 and $2 and in GAIA_UID and GAIA_RESPONSE_ID")
+	argOnImportSQL     = Flags.String("on-import-sql", "", "SQL statement run against -on-import-db after each import, with :uid and :response_id placeholders")
+	argOnImportDB      = Flags.String("on-import-db", "", "database receiving -on-import-sql, in the same formats as -db")
+)
+
+// importHook passes the response_id of each imported entry back to another
+// system. Its failures are logged, without affecting the entry.
+type importHook struct {
+	command string
+	db      *sql.DB
+	query   string
+	params  []string
+}
+
+var onImport *importHook
+
+var hookParam = regexp.MustCompile(`:(uid|response_id)\b`)
+
+func setupHooks() error {
+	if *argOnImportCommand == "" && *argOnImportSQL == "" {
+		return nil
+	}
+	h := &importHook{command: *argOnImportCommand}
+	if *argOnImportSQL != "" {
+		if *argOnImportDB == "" {
+			return errors.New("-on-import-db is needed with -on-import-sql")
+		}
+		db, d, err := openDB(*argOnImportDB)
+		if err != nil {
+			return fmt.Errorf("failed to open hook database: %s", err)
+		}
+		h.db = db
+		h.query = d.rebind(hookParam.ReplaceAllStringFunc(*argOnImportSQL, func(param string) string {
+			h.params = append(h.params, strings.TrimPrefix(param, ":"))
+			return "?"
+		}))
+	}
+	onImport = h
+	return nil
+}
+
+// run calls the hook for e. It is a no-op on a nil hook.
+func (h *importHook) run(e *Entry) {
+	if h == nil || e.ResponseId == nil {
+		return
+	}
+	if h.command != "" {
+		cmd := shellCommand(h.command, e.UID, *e.ResponseId)
+		cmd.Env = append(os.Environ(), "GAIA_UID="+e.UID, "GAIA_RESPONSE_ID="+*e.ResponseId)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			logError(Fields{"uid": e.UID, "error": err, "output": string(output)}, "import command failed for entry %s: %s: %s", e.UID, err, output)
+		}
+	}
+	if h.db != nil {
+		args := make([]interface{}, len(h.params))
+		for i, param := range h.params {
+			if param == "uid" {
+				args[i] = e.UID
+			} else {
+				args[i] = *e.ResponseId
+			}
+		}
+		if _, err := h.db.Exec(h.query, args...); err != nil {
+			logError(Fields{"uid": e.UID, "error": err}, "import SQL failed for entry %s: %s", e.UID, err)
+		}
+	}
+}
+
+func (h *importHook) Close() error {
+	if h == nil || h.db == nil {
+		return nil
+	}
+	return h.db.Close()
+}
@@ -0,0 +1,47 @@
+package importer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// ensureIdempotencyKey gives e a key and persists it before the first
+// attempt, so that later attempts, in this run or another, reuse it.
+func ensureIdempotencyKey(store Store, e *Entry) error {
+	if e.IdempotencyKey != "" {
+		return nil
+	}
+	key, err := newUUID()
+	if err != nil {
+		return err
+	}
+	if err := store.SetIdempotencyKey(e, key); err != nil {
+		return err
+	}
+	e.IdempotencyKey = key
+	return nil
+}
+
+// batchIdempotencyKey derives the key of a batch request from the keys of its
+// entries.
+func batchIdempotencyKey(entries []Entry) string {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.IdempotencyKey
+	}
+	sum := sha256.Sum256([]byte(strings.Join(keys, ",")))
+	return hex.EncodeToString(sum[:16])
+}
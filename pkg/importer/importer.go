@@ -0,0 +1,1375 @@
+package importer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const dbUsage = "path to the SQLite database to import, or a postgres:// or mysql:// DSN"
+
+var (
+	argBatchSize    = Flags.Int("batch-size", 1, "number of entries sent per request to the batch endpoint (1 disables batching)")
+	argClaim        = Flags.Bool("claim", false, "claim entries before importing them so several instances can share a database")
+	argClaimTTL     = Flags.Duration("claim-ttl", 10*time.Minute, "age after which a claim from another instance is considered stale")
+	argConcurrency  = Flags.Int("j", 5, "level of concurrency (simultaneous tasks)")
+	argDryRun       = Flags.Bool("dry-run", false, "validate pending payloads without sending them")
+	argIdempotency  = Flags.Bool("idempotency", true, "send an Idempotency-Key header, persisted per entry, with every request")
+	argLogFormat    = Flags.String("log-format", "text", "log output format: text or json")
+	argMetricsAddr  = Flags.String("metrics-addr", "", "address to serve Prometheus metrics on (e.g. :9090)")
+	argStopTimeout  = Flags.Duration("stop-timeout", 0, "time in-flight requests are given to finish once the run is stopped, before being aborted (0 waits for them)")
+	argProgress     = Flags.Bool("progress", isTerminal(os.Stderr), "show a live progress indicator")
+	argPollInterval = Flags.Duration("poll-interval", 30*time.Second, "interval between two checks for new pending entries in watch mode")
+	argToken        = Flags.String("token", "", "Gaia API token")
+	argURL          = Flags.String("url", "https://api.critizr.com/v2", "Gaia base URL")
+	argWatch        = Flags.Bool("watch", false, "keep running and import new pending entries as they appear")
+)
+
+type APIError struct {
+	Status  int
+	Payload string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error: HTTP %d > %s", e.Status, e.Payload)
+}
+
+type Entry struct {
+	UID        string
+	Payload    string
+	ResponseId *string
+	ImportedAt *string
+	Err        error
+	ImportTime int64
+	Status     int
+	Attempts   int
+
+	IdempotencyKey string
+	ResponseBody   *string
+	RequestID      string
+	CorrelationID  string
+	Target         string
+	Operation      string
+	DuplicateOf    *string
+	ConflictsWith  *string
+	Tenant         string
+	GroupKey       string
+	Headers        string
+	QueryParams    string
+	AuthToken      string
+
+	history        []RequestAttempt
+	responseFields map[string]*string
+	span           *span
+	position       *kafkaPosition
+	createdAt      string
+}
+
+// inheritFlags registers the named flags of the main command into fs, bound
+// to the same variables.
+func inheritFlags(fs *flag.FlagSet, names ...string) {
+	for _, name := range names {
+		f := Flags.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+}
+
+func commonFlags(fs *flag.FlagSet) {
+	inheritFlags(fs, "db", "log-format", "q", "v", "color", "config", "payload-key")
+}
+
+func makeEntry(rows *sql.Rows) (entry Entry, err error) {
+	var idempotencyKey, target, tenant, groupKey, headers, queryParams, operation, responseID, authToken sql.NullString
+	err = rows.Scan(&entry.UID, &entry.Payload, &entry.ImportedAt, &idempotencyKey, &target, &tenant, &groupKey, &headers, &queryParams, &operation, &responseID, &authToken)
+	if err != nil {
+		return Entry{}, err
+	}
+	if entry.Payload, err = decodePayload(entry.Payload); err != nil {
+		return Entry{}, fmt.Errorf("failed to decode payload of entry %s: %s", entry.UID, err)
+	}
+	entry.IdempotencyKey = idempotencyKey.String
+	entry.Target = target.String
+	entry.Tenant = tenant.String
+	entry.GroupKey = groupKey.String
+	entry.Headers = headers.String
+	entry.QueryParams = queryParams.String
+	entry.AuthToken = authToken.String
+	entry.Operation = strings.ToLower(strings.TrimSpace(operation.String))
+	if entry.operation() != operationCreate && responseID.Valid {
+		entry.ResponseId = &responseID.String
+	}
+	return entry, nil
+}
+
+func (e *Entry) doImport(ctx context.Context) error {
+	if e.operation() != operationCreate {
+		return e.doOperation(ctx)
+	}
+	api, err := e.endpoint()
+	if err != nil {
+		return err
+	}
+	method, target := e.request(api)
+	req, err := http.NewRequestWithContext(withEntryUIDs(withAttemptLog(ctx, &e.history), e.UID), method, target, strings.NewReader(e.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	e.setCreatedAtParam(req)
+	if err := e.setQueryParams(req); err != nil {
+		return err
+	}
+	if err := api.authorize(req); err != nil {
+		return err
+	}
+	if *argIdempotency {
+		req.Header.Set("Idempotency-Key", e.IdempotencyKey)
+	}
+	if err := e.setEntryHeaders(req); err != nil {
+		return err
+	}
+	e.setAuthToken(req)
+	if e.CorrelationID, err = setCorrelationID(req); err != nil {
+		return err
+	}
+
+	auditTrail.sent(e, req.Method, req.URL.String(), e.Payload)
+	resp, elapsed, err := api.send(req)
+	e.Attempts++
+	e.ImportTime = elapsed.Milliseconds()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	e.Status = resp.StatusCode
+	body, _ := ioutil.ReadAll(resp.Body)
+	e.recordResponse(resp, body)
+	if !successStatuses[resp.StatusCode] {
+		if existsAnswer(resp.StatusCode, body) {
+			return e.alreadyExists(ctx, resp.StatusCode, body)
+		}
+		e.Err = &APIError{resp.StatusCode, string(body)}
+		return fmt.Errorf("unexpected status: %v", e.Err)
+	}
+
+	id, ok, err := extractResponseID(body)
+	if err != nil || !ok {
+		return &ParseError{string(body)}
+	}
+	e.ResponseId = &id
+	e.extractFields(body)
+
+	return nil
+}
+
+func (im *Importer) claim(entry *Entry) bool {
+	if !*argClaim {
+		return true
+	}
+	claimed, err := im.store.Claim(entry, im.instance, *argClaimTTL)
+	if err != nil {
+		logError(Fields{"uid": entry.UID, "error": err}, "failed to claim entry %s: %s", entry.UID, err)
+		return false
+	}
+	if !claimed {
+		logInfo(entry.fields("skipped"), "entry %s is claimed by another instance, skipping", entry.UID)
+		importMetrics.entryDone("skipped")
+		im.progress.record(entry, "skipped")
+		return false
+	}
+	auditTrail.record("claimed", entry.UID, Fields{"claimed_by": im.instance})
+	return true
+}
+
+// process prepares the entries of batch, then sends those left.
+func (im *Importer) process(batch []Entry) {
+	im.send(im.prepare(batch))
+}
+
+// preparationStep is a step of the preparation of the payload of an entry
+// before it is sent, named after its transformation in plans if it has one.
+// Runs, dry runs and plans prepare entries with the same steps.
+type preparationStep struct {
+	name    string
+	offline func() error
+	// online replaces offline in runs for the steps calling the API, which
+	// dry runs and plans leave out or only check offline.
+	online func(ctx context.Context) error
+}
+
+// preparationSteps returns the steps preparing the payload of e, in order.
+func (e *Entry) preparationSteps() []preparationStep {
+	steps := []preparationStep{
+		{name: "repair-encoding", offline: e.repairEncoding},
+		{name: "field-mapping", offline: e.mapFields},
+		{name: "normalize", offline: e.normalize},
+		{offline: e.checkQuarantine},
+		{offline: e.readCreatedAt},
+		{name: "transform", offline: e.transform},
+		{name: "backdate", offline: e.backdate},
+		{name: "plugins", offline: e.beforeSend},
+		{offline: func() error { return validateSchema(e) }},
+		{offline: func() error { return lint(e) }},
+	}
+	if references != nil {
+		steps = append(steps, preparationStep{online: e.resolve})
+	}
+	if attachmentUploader != nil {
+		steps = append(steps, preparationStep{offline: e.checkAttachments, online: e.uploadAttachments})
+	}
+	return append(steps,
+		preparationStep{name: "adapt " + apiVersion, offline: e.adapt},
+		preparationStep{offline: func() error { return checkPayloadSize(e) }},
+	)
+}
+
+// runSteps prepares the payload of e for sending, calling the API with the
+// context of the entry for the online steps.
+func (im *Importer) runSteps(e *Entry) error {
+	for _, step := range e.preparationSteps() {
+		if step.online == nil {
+			if err := step.offline(); err != nil {
+				return err
+			}
+			continue
+		}
+		ctx, cancel := im.entryContext(withSpan(im.ctx, e.span))
+		err := timedOut(ctx, step.online(ctx))
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reject finishes e, which failed to be prepared with err: quarantined or
+// blocked as err tells, errored otherwise.
+func (im *Importer) reject(e *Entry, err error) {
+	var quarantineErr *QuarantineError
+	var referenceErr *ReferenceError
+	switch {
+	case errors.As(err, &quarantineErr):
+		im.quarantine(e, err)
+	case errors.As(err, &referenceErr):
+		im.block(e, err)
+	default:
+		im.finish(e, err)
+	}
+}
+
+// prepare claims, transforms and checks the entries of batch, finishing
+// those that fail, and returns those to send.
+func (im *Importer) prepare(batch []Entry) []Entry {
+	start := prepareStage.begin()
+	defer prepareStage.end(start, len(batch))
+	var claimed []Entry
+	for _, entry := range batch {
+		if !im.claim(&entry) {
+			continue
+		}
+		if err := entry.loadPayload(); err != nil {
+			im.finish(&entry, err)
+			continue
+		}
+		if err := im.groups.check(&entry); err != nil {
+			im.finish(&entry, err)
+			continue
+		}
+		if *argIdempotency {
+			if err := ensureIdempotencyKey(im.store, &entry); err != nil {
+				logError(Fields{"uid": entry.UID, "error": err}, "failed to store idempotency key of entry %s: %s", entry.UID, err)
+				continue
+			}
+		}
+		if payloadDeduper != nil && entry.operation() == operationCreate {
+			if o := payloadDeduper.original(&entry); o != nil {
+				im.duplicate(entry, o)
+				continue
+			}
+		}
+		_, entry.span = startSpan(im.ctx, "import entry", spanKindInternal)
+		entry.span.set("uid", entry.UID)
+		logInfo(entry.fields("processing"), "processing entry %s", entry.UID)
+		if err := entry.checkOperation(); err != nil {
+			im.finish(&entry, err)
+			continue
+		}
+		if entry.operation() == operationDelete {
+			if err := checkPlan(&entry); err != nil {
+				im.finish(&entry, err)
+				continue
+			}
+			claimed = append(claimed, entry)
+			continue
+		}
+		if err := im.runSteps(&entry); err != nil {
+			im.reject(&entry, err)
+			continue
+		}
+		if err := checkPlan(&entry); err != nil {
+			im.finish(&entry, err)
+			continue
+		}
+		if lookupTemplate != nil && entry.operation() == operationCreate {
+			ctx, cancel := im.entryContext(withSpan(im.ctx, entry.span))
+			id, found, err := entry.lookup(ctx, lookupTemplate)
+			err = timedOut(ctx, err)
+			cancel()
+			if err != nil {
+				im.finish(&entry, err)
+				continue
+			}
+			if found {
+				im.existing(&entry, id, *argLookupAction == "link")
+				continue
+			}
+		}
+		claimed = append(claimed, entry)
+	}
+	return claimed
+}
+
+// send imports the prepared entries, creations in batches with -batch-size.
+func (im *Importer) send(claimed []Entry) {
+	if len(claimed) == 0 {
+		return
+	}
+	start := sendStage.begin()
+	defer sendStage.end(start, len(claimed))
+
+	var creations []Entry
+	for i := range claimed {
+		entry := &claimed[i]
+		if *argBatchSize > 1 && entry.operation() == operationCreate {
+			creations = append(creations, *entry)
+			continue
+		}
+		ctx, cancel := im.entryContext(withSpan(im.ctx, entry.span))
+		err := timedOut(ctx, entry.doImport(ctx))
+		cancel()
+		im.finish(entry, err)
+	}
+	for _, group := range groupByTarget(creations) {
+		ctx, batchSpan := startSpan(im.ctx, "import batch", spanKindInternal)
+		batchSpan.set("entries", len(group))
+		ctx, cancel := im.entryContext(ctx)
+		err := timedOut(ctx, importBatch(ctx, group))
+		cancel()
+		batchSpan.finish(err)
+		if err != nil {
+			for i := range group {
+				im.finish(&group[i], err)
+			}
+			continue
+		}
+		for i := range group {
+			im.finish(&group[i], group[i].Err)
+		}
+	}
+}
+
+// entryContext bounds the sending of an entry, or a batch, by
+// -request-timeout.
+func (im *Importer) entryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *argRequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, *argRequestTimeout)
+}
+
+// timedOut tells err apart as a timeout if it happened once ctx expired.
+func timedOut(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s (-request-timeout): %w", *argRequestTimeout, err)
+	}
+	return err
+}
+
+func (im *Importer) finish(entry *Entry, err error) {
+	if err != nil && im.ctx.Err() != nil {
+		logInfo(entry.fields("aborted"), "import of entry %s aborted, leaving it pending", entry.UID)
+		importMetrics.entryDone("aborted")
+		im.progress.record(entry, "aborted")
+		payloadDeduper.finished(entry, false)
+		entry.span.set("outcome", "aborted")
+		entry.span.finish(err)
+		return
+	}
+	var existsErr *ExistsError
+	if errors.As(err, &existsErr) {
+		im.existing(entry, existsErr.ID, existsErr.ID != "")
+		return
+	}
+	if err != nil {
+		if entry.Err == nil {
+			entry.Err = err
+		}
+		logError(entry.fields("errored"), "failed to import entry %s: %s", entry.UID, err)
+		importMetrics.entryDone("errored")
+		im.progress.record(entry, "errored")
+		im.writer.markErrored(entry)
+		im.groups.fail(entry)
+		im.kill.observe(entry.Err)
+		auditTrail.entry("errored", entry)
+		if classifyError(entry.Err) == errorClassOversized {
+			oversizedSpill.write(entry)
+		}
+		payloadDeduper.finished(entry, false)
+		entry.span.set("outcome", "errored")
+		entry.span.set("error.class", classifyError(entry.Err))
+		entry.span.finish(entry.Err)
+		runNotifier.observe(im.progress)
+		entry.afterImport(entry.Err)
+		return
+	}
+	switch entry.operation() {
+	case operationUpdate:
+		logInfo(entry.fields("imported"), "entry %s updated response %s", entry.UID, *entry.ResponseId)
+	case operationDelete:
+		logInfo(entry.fields("imported"), "entry %s deleted response %s", entry.UID, *entry.ResponseId)
+	default:
+		logInfo(entry.fields("imported"), "entry %s imported as %s", entry.UID, *entry.ResponseId)
+	}
+	im.checkConflict(entry)
+	importMetrics.entryDone("imported")
+	im.progress.record(entry, "imported")
+	im.writer.markImported(entry)
+	im.kill.observe(nil)
+	auditTrail.entry("imported", entry)
+	payloadDeduper.finished(entry, true)
+	onImport.run(entry)
+	entry.afterImport(nil)
+	entry.span.set("outcome", "imported")
+	entry.span.set("response_id", *entry.ResponseId)
+	entry.span.finish(nil)
+}
+
+// runPending imports the entries pending at call time, and reports whether
+// it was interrupted by stop. It returns an error if the pending entries
+// could not be fetched, once the entries already scheduled are done.
+func (im *Importer) runPending(total int, sem chan bool, stop <-chan struct{}) (bool, error) {
+	lanes, err := im.lanes(sem)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch data: %s", err)
+	}
+	var wg sync.WaitGroup
+	var scheduled int64
+	stopped := make([]bool, len(lanes))
+	errs := make([]error, len(lanes))
+	for i, l := range lanes {
+		wg.Add(1)
+		go func(i int, l lane) {
+			defer wg.Done()
+			stopped[i], errs[i] = im.runLane(l, total, &scheduled, stop)
+		}(i, l)
+	}
+	wg.Wait()
+	payloadDeduper.wait()
+	im.writer.Flush()
+	for _, err := range errs {
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, laneStopped := range stopped {
+		if laneStopped {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// runLane imports the pending entries of l, using its workers, and reports
+// whether it was interrupted by stop, or the error that ended the fetching
+// of its entries.
+func (im *Importer) runLane(l lane, total int, scheduled *int64, stop <-chan struct{}) (bool, error) {
+	entries := streamPending(im.store, *argPageSize, l)
+	defer entries.Close()
+
+	// Batches are fetched while a worker of the lane is free, or with
+	// -prepare-workers a token of the pipeline.
+	slots := l.sem
+	if im.pipeline != nil {
+		slots = im.pipeline.tokens
+	}
+	var wg sync.WaitGroup
+	stopped := false
+	for !stopped {
+		importMetrics.setQueueDepth(total - int(atomic.LoadInt64(scheduled)))
+		if !im.currentWindow().wait(stop) || !im.pause.wait(stop) {
+			stopped = true
+			continue
+		}
+		select {
+		case <-stop:
+			stopped = true
+			continue
+		case <-slots:
+		}
+		batch := entries.next(batchSize())
+		if len(batch) == 0 {
+			slots <- true
+			break
+		}
+		if batch = im.groups.admit(batch); len(batch) == 0 {
+			slots <- true
+			continue
+		}
+		weight := payloadBytes(batch)
+		if !im.inflight.acquire(weight, stop) {
+			slots <- true
+			stopped = true
+			continue
+		}
+		n := atomic.AddInt64(scheduled, int64(len(batch)))
+		if im.checkpoint != nil {
+			im.checkpoint.track(batch)
+		}
+		importMetrics.setQueueDepth(total - int(n))
+		wg.Add(1)
+		go func(batch []Entry) {
+			held := true
+			defer func() {
+				im.inflight.release(weight)
+				if held {
+					slots <- true
+				}
+				wg.Done()
+			}()
+			for len(batch) > 0 {
+				im.flights.begin(batch)
+				if im.pipeline == nil {
+					im.process(batch)
+				} else {
+					prepared := im.pipeline.prepare(im, batch)
+					sendStage.queue(len(prepared))
+					<-l.sem
+					sendStage.queue(-len(prepared))
+					if held {
+						slots <- true
+						held = false
+					}
+					im.send(prepared)
+					l.sem <- true
+				}
+				im.flights.end(batch)
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				batch = im.groups.release(batch)
+			}
+		}(batch)
+	}
+
+	wg.Wait()
+	if stopped {
+		if next := entries.next(1); len(next) > 0 {
+			n := atomic.LoadInt64(scheduled)
+			logInfo(Fields{"scheduled": n, "next_uid": next[0].UID}, "run stopped after scheduling %d of %d entries, next pending entry is %s", n, total, next[0].UID)
+		}
+	} else if err := entries.Err(); err != nil {
+		return false, fmt.Errorf("failed to fetch data: %s", err)
+	}
+	return stopped, nil
+}
+
+// pollDelay returns the time to wait before the next check for pending
+// entries in watch mode: -poll-interval, or less when an entry becomes
+// eligible before by its not_before time.
+func (im *Importer) pollDelay() time.Duration {
+	s, ok := im.store.(*sqlStore)
+	if !ok {
+		return *argPollInterval
+	}
+	next, found, err := s.NextScheduled()
+	if err != nil {
+		logError(Fields{"error": err}, "failed to fetch scheduled entries: %s", err)
+		return *argPollInterval
+	}
+	if delay := time.Until(next); found && delay < *argPollInterval {
+		logInfo(Fields{"not_before": next.Format(time.RFC3339)}, "next scheduled entry eligible at %s", next.Format(time.RFC3339))
+		return delay
+	}
+	return *argPollInterval
+}
+
+func instanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// Commands are the subcommands of the CLI, by name.
+var Commands = map[string]func(args []string) error{
+	"export":          runExport,
+	"export-map":      runExportMap,
+	"init-db":         runInitDB,
+	"analyze":         runAnalyze,
+	"bench":           runBench,
+	"compact":         runCompact,
+	"compress":        runCompress,
+	"diff":            runDiff,
+	"dlq":             runDLQ,
+	"encrypt":         runEncrypt,
+	"load":            runLoad,
+	"migrate":         runMigrate,
+	"quarantine":      runQuarantine,
+	"mockserver":      runMockServer,
+	"requeue":         runRequeue,
+	"rollback":        runRollback,
+	"retry-errors":    runRetryErrors,
+	"runs":            runRuns,
+	"merge":           runMerge,
+	"reconcile":       runReconcile,
+	"scrub":           runScrub,
+	"serve":           runServe,
+	"status":          runStatus,
+	"triage":          runTriage,
+	"verify":          runVerify,
+	"verify-checksum": runVerifyChecksum,
+}
+
+// ErrInvalidEntries is returned by Run in -dry-run mode when some pending
+// entries are invalid.
+var ErrInvalidEntries = errors.New("some entries are invalid")
+
+// ParseFlags parses the command-line arguments of the import command into
+// Flags, completing them from the environment and the config file. The
+// Importers created afterwards start from these settings.
+func ParseFlags(args []string) error {
+	resetFlags()
+	commandLine = args
+	return parseFlags(Flags, args)
+}
+
+// commandLine are the arguments last given to ParseFlags.
+var commandLine []string
+
+// config holds the settings of an Importer: the arguments of the command
+// line, then those set by the options of New, those of WithFlag last. New
+// sets Flags from them.
+type config struct {
+	args        []string
+	databases   []string
+	url, token  string
+	concurrency int
+	flags       []setting
+	store       Store
+	client      GaiaClient
+	signer      RequestSigner
+}
+
+// setting is the value of a flag set by an option.
+type setting struct {
+	name, value string
+}
+
+// apply sets Flags back to their defaults, then to the settings of c.
+func (c *config) apply() error {
+	resetFlags()
+	if err := parseFlags(Flags, c.args); err != nil {
+		return err
+	}
+	var settings []setting
+	if c.url != "" {
+		settings = append(settings, setting{"url", c.url}, setting{"token", c.token})
+	}
+	if c.concurrency > 0 {
+		settings = append(settings, setting{"j", strconv.Itoa(c.concurrency)})
+	}
+	for _, s := range append(settings, c.flags...) {
+		if err := Flags.Set(s.name, s.value); err != nil {
+			return fmt.Errorf("invalid value %q for flag -%s: %s", s.value, s.name, err)
+		}
+		fixedSettings[s.name] = true
+	}
+	if len(c.databases) > 0 {
+		argDatabases = append([]string(nil), c.databases...)
+		*argDb = c.databases[len(c.databases)-1]
+	}
+	return nil
+}
+
+// Option configures an Importer created by New.
+type Option func(c *config) error
+
+// WithFlag sets one of Flags as on the command line, e.g. WithFlag("j", "10"),
+// for this Importer.
+func WithFlag(name, value string) Option {
+	return func(c *config) error {
+		c.flags = append(c.flags, setting{name, value})
+		return nil
+	}
+}
+
+// WithDB imports the entries of the database at dsn, like -db, in place of
+// those of the command line; several of them import each database in turn.
+func WithDB(dsn string) Option {
+	return func(c *config) error {
+		c.databases = append(c.databases, dsn)
+		return nil
+	}
+}
+
+// WithAPI sends the entries to the API at url with token, like -url and
+// -token.
+func WithAPI(url, token string) Option {
+	return func(c *config) error {
+		c.url, c.token = url, token
+		return nil
+	}
+}
+
+// WithConcurrency sets the number of simultaneous imports, like -j.
+func WithConcurrency(n int) Option {
+	return func(c *config) error {
+		c.concurrency = n
+		return nil
+	}
+}
+
+// WithStore imports the entries of store instead of opening -db.
+func WithStore(store Store) Option {
+	return func(c *config) error {
+		c.store = store
+		return nil
+	}
+}
+
+// WithClient sends the requests to the API with client instead of the HTTP
+// client set up from the flags, whose transport settings (-http-timeout,
+// -max-conns, -proxy, TLS, -max-bandwidth, -http1) then do not apply.
+func WithClient(client GaiaClient) Option {
+	return func(c *config) error {
+		c.client = client
+		return nil
+	}
+}
+
+// WithSigner signs the requests to the API with signer, e.g. for a gateway
+// scheme other than the HMAC-SHA256 one of -hmac-key.
+func WithSigner(signer RequestSigner) Option {
+	return func(c *config) error {
+		c.signer = signer
+		return nil
+	}
+}
+
+// Importer imports the pending entries of a store into Gaia. Its settings are
+// its own, set by the options of New from the defaults and the command line
+// given to ParseFlags, so the settings of one Importer never carry over to the
+// next. They are applied to Flags when it is created, an Importer being run
+// at a time.
+type Importer struct {
+	config      config
+	ctx         context.Context
+	cancel      context.CancelFunc
+	store       Store
+	writer      *statusWriter
+	checkpoint  *checkpointStore
+	groups      *sequencer
+	progress    *progress
+	instance    string
+	run         *Run
+	sem         chan bool
+	workers     *workerLimit
+	ramp        *ramp
+	snapshots   *snapshotter
+	flights     *flightTracker
+	pause       *pauser
+	reloadMu    sync.Mutex
+	window      *timeWindow
+	kill        *killSwitch
+	source      entrySource
+	sourceStore *sqlStore
+	ui          *http.Server
+	client      GaiaClient
+	signer      RequestSigner
+	inflight    *byteLimit
+	pipeline    *pipeline
+	multi       *multiRun
+	summaryPath string
+	interrupted bool
+
+	tenantWorkers map[string]*workerLimit
+}
+
+// New sets up an Importer from the options.
+func New(options ...Option) (*Importer, error) {
+	c := config{args: commandLine}
+	for _, option := range options {
+		if err := option(&c); err != nil {
+			return nil, err
+		}
+	}
+	return newImporter(c)
+}
+
+// newImporter sets up an Importer with the settings of c.
+func newImporter(c config) (*Importer, error) {
+	if err := c.apply(); err != nil {
+		return nil, err
+	}
+	im := &Importer{config: c, store: c.store, client: c.client, signer: c.signer, summaryPath: *argSummaryJSON}
+	if im.store == nil {
+		databases, err := importDatabases()
+		if err != nil {
+			return nil, err
+		}
+		if len(databases) > 1 {
+			if im.multi, err = newMultiRun(databases, c); err != nil {
+				return nil, err
+			}
+			return im, nil
+		}
+		*argDb = databases[0]
+	}
+	if err := im.setup(); err != nil {
+		im.Close()
+		return nil, err
+	}
+	return im, nil
+}
+
+func (im *Importer) setup() error {
+	shared, err := setupPriorities(*argConcurrency)
+	if err != nil {
+		return err
+	}
+	if err := setupAudit("import"); err != nil {
+		return err
+	}
+	reimporting, err := reimportFilter()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case im.store != nil:
+	case *argPipe:
+		if err := checkPipeFlags(); err != nil {
+			return err
+		}
+		im.store = openPipe(os.Stdin, os.Stdout)
+	case *argKafkaBrokers != "":
+		if err := checkKafkaFlags(); err != nil {
+			return err
+		}
+		store, err := openStore(*argDb)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %s", err)
+		}
+		k, err := openKafka(store)
+		if err != nil {
+			store.Close()
+			return err
+		}
+		im.store = k
+	default:
+		if im.store, err = openStore(*argDb); err != nil {
+			return fmt.Errorf("failed to open database: %s", err)
+		}
+	}
+
+	if *argCheckpoint != "" {
+		if *argClaim {
+			return errors.New("-claim cannot be used with -checkpoint")
+		}
+		if *argPriority {
+			return errors.New("-priority cannot be used with -checkpoint")
+		}
+		if *argReaders > 1 {
+			return errors.New("-readers cannot be used with -checkpoint")
+		}
+		if *argOrderedGroups {
+			return errors.New("-ordered-groups cannot be used with -checkpoint")
+		}
+		if im.checkpoint, err = openCheckpoint(im.store, *argCheckpoint); err != nil {
+			return fmt.Errorf("failed to open checkpoint: %s", err)
+		}
+		im.store = im.checkpoint
+	}
+
+	if err := checkSchema(im.store); err != nil {
+		return err
+	}
+	if err := setupSelection(im.store); err != nil {
+		return fmt.Errorf("failed to set up entry selection: %s", err)
+	}
+	if err := checkSampleFlags(im.store); err != nil {
+		return err
+	}
+	if im.source, im.sourceStore, err = setupSource(im.store); err != nil {
+		return err
+	}
+	if im.window, err = setupWindow(); err != nil {
+		return err
+	}
+	if im.kill, err = setupKillSwitch(); err != nil {
+		return err
+	}
+	if err := checkDeadLetters(im.store); err != nil {
+		return err
+	}
+	if err := checkAttemptHistory(im.store); err != nil {
+		return err
+	}
+	if err := checkRunStats(im.store); err != nil {
+		return err
+	}
+	if _, err := payloadCipher(); err != nil {
+		return err
+	}
+	if err := setupHooks(); err != nil {
+		return err
+	}
+	if err := setupPlugins(); err != nil {
+		return err
+	}
+	if err := setupOversizedFile(); err != nil {
+		return err
+	}
+	if im.inflight, err = setupInflightBytes(); err != nil {
+		return err
+	}
+	if im.pipeline, err = setupPipeline(); err != nil {
+		return err
+	}
+	if err := setupSchema(); err != nil {
+		return err
+	}
+	if err := setupLint(); err != nil {
+		return err
+	}
+	if err := setupAPIAdapters(); err != nil {
+		return err
+	}
+	if err := setupFieldMapping(); err != nil {
+		return err
+	}
+	if err := checkCreatedAtFlags(); err != nil {
+		return err
+	}
+	if *argCompactPayloads && *argCompactAfter <= 0 {
+		return errors.New("-compact-payloads needs -compact-after")
+	}
+	if err := setupLookup(); err != nil {
+		return err
+	}
+	if err := setupExists(); err != nil {
+		return err
+	}
+	if err := setupQuarantine(im.store); err != nil {
+		return err
+	}
+	if err := setupResolve(im.store); err != nil {
+		return err
+	}
+	if err := setupAttachments(im.store); err != nil {
+		return err
+	}
+	if err := setupPlan(); err != nil {
+		return err
+	}
+	if err := setupCreate(); err != nil {
+		return err
+	}
+	if err := setupDedupe(im.store); err != nil {
+		return fmt.Errorf("failed to set up deduplication: %s", err)
+	}
+	if err := setupConflicts(im.store); err != nil {
+		return fmt.Errorf("failed to load response ids: %s", err)
+	}
+	if successStatuses, err = parseSuccessStatuses(*argSuccessStatus); err != nil {
+		return err
+	}
+	if err := validateArchiveMode(*argArchive); err != nil {
+		return err
+	}
+	if err := setupEncodings(); err != nil {
+		return err
+	}
+	if err := checkNormalizeFlags(); err != nil {
+		return err
+	}
+	if err := checkUpdateMethod(); err != nil {
+		return err
+	}
+	if err := checkRampUp(); err != nil {
+		return err
+	}
+	if *argTransform != "" {
+		if err := loadTransform(*argTransform); err != nil {
+			return fmt.Errorf("failed to load transformation: %s", err)
+		}
+	}
+
+	if err := setupTenants(); err != nil {
+		return err
+	}
+	if err := checkTenantColumn(im.store); err != nil {
+		return err
+	}
+	if len(tenantLanes) > 0 && (im.checkpoint != nil || *argPipe || *argKafkaBrokers != "") {
+		return errors.New("tenant concurrency cannot be used with -checkpoint, -pipe or -kafka-brokers")
+	}
+
+	if *argDryRun {
+		if err := im.setupSample("", "", true); err != nil {
+			return err
+		}
+		if reimporting != nil {
+			return reimport(im.store, reimporting, true)
+		}
+		return nil
+	}
+
+	if err := setupAPI(*argConcurrency + tenantWorkers()); err != nil {
+		return err
+	}
+	if im.client != nil {
+		httpClient = im.client
+	}
+	if httpClient, err = setupCassette(httpClient); err != nil {
+		return err
+	}
+	if im.signer != nil {
+		requestSigner = im.signer
+	}
+	if err := preflight(); err != nil {
+		return err
+	}
+	if err := detectAPIVersion(); err != nil {
+		return err
+	}
+	if reimporting != nil {
+		if err := reimport(im.store, reimporting, false); err != nil {
+			return err
+		}
+	}
+	if !*argPipe && *argKafkaBrokers == "" {
+		if err := confirmRun(im.store); err != nil {
+			return err
+		}
+	}
+
+	if *argMetricsAddr != "" {
+		serveMetrics(*argMetricsAddr)
+		logInfo(Fields{"addr": *argMetricsAddr}, "serving metrics on %s", *argMetricsAddr)
+	}
+	if *argHealthAddr != "" {
+		serveHealth(*argHealthAddr, im.store)
+		logInfo(Fields{"addr": *argHealthAddr}, "serving health checks on %s", *argHealthAddr)
+	}
+
+	im.instance = instanceID()
+	if *argClaim {
+		logInfo(Fields{"instance": im.instance}, "claiming entries as %s", im.instance)
+	}
+	setupNotifier(im.instance)
+
+	if *argAdaptiveBatch {
+		if *argBatchSize <= 1 {
+			return errors.New("-adaptive-batch needs a -batch-size above 1, the largest batch size it may use")
+		}
+		batchTuner = newBatchSizer(*argAdaptiveBatchMin, *argBatchSize)
+		batchTuner.run(*argAdaptiveInterval)
+	}
+
+	if im.checkpoint == nil && !*argPipe {
+		if im.run, err = newRun(im.instance); err != nil {
+			return fmt.Errorf("failed to create run: %s", err)
+		}
+		if err := im.store.StartRun(im.run); err != nil {
+			return fmt.Errorf("failed to record run (run migrate on databases created by older versions): %s", err)
+		}
+		logInfo(Fields{"run_id": im.run.ID, "tag": im.run.Tag}, "starting run %s", im.run.ID)
+		setupUserAgent(im.run.ID)
+		if err := im.setupSample(im.run.ID, im.run.ID, false); err != nil {
+			return err
+		}
+	}
+	if auditTrail != nil {
+		auditTrail.instance = im.instance
+		if im.run != nil {
+			auditTrail.runID = im.run.ID
+		}
+	}
+
+	logInfo(Fields{"concurrency": *argConcurrency}, "setting concurrency to %d", *argConcurrency)
+	for tenant, sem := range tenantLanes {
+		logInfo(Fields{"tenant": tenant, "concurrency": cap(sem)}, "setting concurrency of tenant %s to %d", tenant, cap(sem))
+	}
+	im.sem = make(chan bool, shared)
+	for i := 0; i < shared; i++ {
+		im.sem <- true
+	}
+	im.workers = newWorkerLimit(im.sem)
+	im.tenantWorkers = make(map[string]*workerLimit, len(tenantLanes))
+	for tenant, sem := range tenantLanes {
+		im.tenantWorkers[tenant] = newWorkerLimit(sem)
+	}
+	if *argAdaptive {
+		concurrencyTuner = newTuner(im.sem, *argAdaptiveMin, shared)
+		concurrencyTuner.run(*argAdaptiveInterval)
+	}
+	if *argRampUp > 0 && shared > 1 {
+		im.ramp = startRamp(im.workers, shared, *argRampUp, *argRampSteps)
+	}
+
+	im.ctx, im.cancel = context.WithCancel(context.Background())
+	im.flights = newFlightTracker()
+	im.progress = newProgress(0)
+	runID := ""
+	if im.run != nil {
+		runID = im.run.ID
+	}
+	im.writer = newStatusWriter(im.store, runID)
+	im.pause = &pauser{}
+	im.progress.pause = im.pause
+	if *argRunStats {
+		im.progress.series = startRunStats(schemaStore(im.store), runID)
+	}
+	if *argUI != "" {
+		if im.ui, err = serveUI(im, *argUI); err != nil {
+			return fmt.Errorf("failed to serve dashboard: %s", err)
+		}
+		logInfo(Fields{"addr": *argUI}, "serving dashboard on %s", *argUI)
+	}
+	if *argSnapshotFile != "" {
+		if *argSnapshotInterval <= 0 {
+			return errors.New("-snapshot-interval must be positive")
+		}
+		im.snapshots = startSnapshots(im, *argSnapshotFile, *argSnapshotInterval)
+	}
+	if *argOrderedGroups {
+		if *argReaders > 1 {
+			return errors.New("-ordered-groups cannot be used with -readers")
+		}
+		im.groups = newSequencer()
+	}
+	return nil
+}
+
+// Run imports the pending entries. Once ctx is done, no more entries are
+// started and Run returns when the in-flight ones are done; Abort also
+// aborts them. Run returns an error if -max-error-rate stopped it, or if the
+// pending entries could not be fetched.
+func (im *Importer) Run(ctx context.Context) error {
+	if im.multi != nil {
+		return im.multi.run(ctx)
+	}
+	if *argDryRun {
+		im.previewSource(ctx)
+		entries := streamPending(im.store, *argPageSize, lane{})
+		defer entries.Close()
+		var invalid int
+		var err error
+		if *argPlan != "" {
+			invalid, err = writePlan(entries, *argPlan)
+		} else if invalid, err = dryRun(entries); err != nil {
+			err = fmt.Errorf("failed to fetch data: %s", err)
+		}
+		if err != nil {
+			return err
+		}
+		if invalid > 0 {
+			return ErrInvalidEntries
+		}
+		return nil
+	}
+
+	prog := im.progress
+	if *argProgress && !jsonLogs {
+		prog.render(500 * time.Millisecond)
+	}
+	ctx, stopRun := context.WithCancel(ctx)
+	defer stopRun()
+	im.kill.arm(stopRun)
+	stop := ctx.Done()
+	if k, ok := im.store.(*kafkaStore); ok {
+		go func() {
+			<-stop
+			k.stopFetching()
+		}()
+	}
+	finished := make(chan struct{})
+	if *argStopTimeout > 0 {
+		go func() {
+			select {
+			case <-stop:
+			case <-finished:
+				return
+			}
+			select {
+			case <-time.After(*argStopTimeout):
+				logInfo(nil, "in-flight requests still running after -stop-timeout %s, aborting them", *argStopTimeout)
+				im.Abort()
+			case <-finished:
+			}
+		}()
+	}
+	// fetchErr is a failure to fetch the pending entries, past -fetch-retries,
+	// which ends the run, in watch mode too.
+	var fetchErr error
+	for stopped := false; !stopped; {
+		im.syncSource(ctx)
+		total, err := pendingSelection.countPending(im.store)
+		switch {
+		case err != nil:
+			fetchErr = fmt.Errorf("failed to fetch data: %s", err)
+		case *argPipe:
+			logInfo(nil, "reading entries from stdin")
+			stopped, fetchErr = im.runPending(total, im.sem, stop)
+		case *argKafkaBrokers != "":
+			logInfo(Fields{"topic": *argKafkaTopic}, "consuming entries from Kafka topic %s", *argKafkaTopic)
+			stopped, fetchErr = im.runPending(total, im.sem, stop)
+		case total > 0 || !*argWatch:
+			logInfo(Fields{"pending": total}, "%d entries to process", total)
+			prog.addTotal(total)
+			stopped, fetchErr = im.runPending(total, im.sem, stop)
+		}
+		if fetchErr != nil || !*argWatch {
+			break
+		}
+		if !stopped {
+			select {
+			case <-stop:
+				stopped = true
+			case <-time.After(im.pollDelay()):
+			}
+		}
+	}
+
+	close(finished)
+	im.interrupted = ctx.Err() != nil
+
+	im.writer.Close()
+	spans.Close()
+	prog.finish()
+	prog.series.close()
+	apiRetries.report()
+	slowRequests.report()
+	if im.run != nil {
+		im.run.finish(prog)
+		if *argChecksum {
+			recordChecksum(im.store, im.run)
+		}
+		if err := im.store.FinishRun(im.run); err != nil {
+			logError(Fields{"run_id": im.run.ID, "error": err}, "failed to record end of run %s: %s", im.run.ID, err)
+		}
+	}
+	if jsonLogs {
+		logInfo(prog.summaryFields(), "run finished")
+	} else {
+		prog.printSummary()
+	}
+	if *argStats != "" {
+		if err := writeStatsFile(*argStats, prog.stats()); err != nil {
+			logError(Fields{"error": err}, "failed to write statistics: %s", err)
+		}
+	}
+	runNotifier.finished(prog)
+	if err := references.save(); err != nil {
+		logError(Fields{"error": err}, "failed to write resolve cache: %s", err)
+	}
+	if err := attachmentUploader.save(); err != nil {
+		logError(Fields{"error": err}, "failed to write attachment cache: %s", err)
+	}
+
+	if *argReport != "" {
+		if err := writeReportFile(im.store, *argReport, formatFromPath(*argReport, "csv")); err != nil {
+			logError(Fields{"error": err}, "failed to write report: %s", err)
+		} else {
+			logInfo(Fields{"report": *argReport}, "report written to %s", *argReport)
+		}
+	}
+	im.compactAfterRun(prog)
+	err := im.kill.tripped()
+	if err == nil {
+		err = fetchErr
+	}
+	if im.summaryPath != "" {
+		if err := writeJSONFile(im.summaryPath, im.runSummary(prog.start, err)); err != nil {
+			logError(Fields{"error": err}, "failed to write summary: %s", err)
+		}
+	}
+	return err
+}
+
+// Abort cancels the in-flight requests of Run, leaving their entries pending.
+func (im *Importer) Abort() {
+	if im.multi != nil {
+		im.multi.do((*Importer).Abort)
+	}
+	if im.cancel != nil {
+		im.cancel()
+	}
+}
+
+// Summary returns the counts of the entries processed by Run, by outcome.
+func (im *Importer) Summary() Fields {
+	if im.multi != nil {
+		return im.multi.summary()
+	}
+	if im.progress == nil {
+		return Fields{}
+	}
+	return im.progress.summaryFields()
+}
+
+// Close releases the database and the other resources of the Importer.
+func (im *Importer) Close() error {
+	if im.multi != nil {
+		return nil
+	}
+	im.ramp.Stop()
+	if im.progress != nil {
+		im.progress.series.close()
+	}
+	if im.snapshots != nil {
+		im.snapshots.Close()
+		im.snapshots = nil
+	}
+	if concurrencyTuner != nil {
+		concurrencyTuner.Stop()
+		concurrencyTuner = nil
+	}
+	if batchTuner != nil {
+		batchTuner.Stop()
+		batchTuner = nil
+	}
+	im.Abort()
+	if im.ui != nil {
+		im.ui.Close()
+	}
+	onImport.Close()
+	closePlugins()
+	oversizedSpill.Close()
+	closeAudit()
+	resourceCreator.Close()
+	if c, ok := im.source.(io.Closer); ok {
+		c.Close()
+	}
+	if im.store == nil {
+		return nil
+	}
+	unregisterHealth(im.store)
+	return im.store.Close()
+}
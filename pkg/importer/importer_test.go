@@ -0,0 +1,481 @@
+package importer
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClient is a GaiaClient answering the requests of the importer from the
+// "mode" field of their payloads, without a network: "ok" creates a response,
+// "exists" answers 409 with an existing one and "invalid" answers 422.
+type fakeClient struct {
+	mu       sync.Mutex
+	requests []fakeRequest
+}
+
+type fakeRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+func (c *fakeClient) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	c.requests = append(c.requests, fakeRequest{req.Method, req.URL.Path, req.Header.Clone(), string(body)})
+	c.mu.Unlock()
+
+	if strings.HasSuffix(req.URL.Path, "/batch") {
+		var items []map[string]interface{}
+		if err := json.Unmarshal(body, &items); err != nil {
+			return fakeResponse(req, http.StatusBadRequest, `{"error":"invalid batch"}`), nil
+		}
+		results := make([]map[string]interface{}, len(items))
+		for i, item := range items {
+			status, answer := fakeAnswer(item)
+			result := map[string]interface{}{"status": status}
+			if status == http.StatusCreated {
+				result["ID"] = answer["ID"]
+			} else {
+				result["error"] = answer
+			}
+			results[i] = result
+		}
+		answer, _ := json.Marshal(results)
+		return fakeResponse(req, 207, string(answer)), nil
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return fakeResponse(req, http.StatusBadRequest, `{"error":"invalid payload"}`), nil
+	}
+	status, answer := fakeAnswer(payload)
+	content, _ := json.Marshal(answer)
+	return fakeResponse(req, status, string(content)), nil
+}
+
+// fakeAnswer returns the status and body of the answer to payload.
+func fakeAnswer(payload map[string]interface{}) (int, map[string]interface{}) {
+	switch payload["mode"] {
+	case "exists":
+		return http.StatusConflict, map[string]interface{}{"ID": "existing-" + payload["ref"].(string)}
+	case "invalid":
+		return http.StatusUnprocessableEntity, map[string]interface{}{"error": "invalid rating"}
+	}
+	return http.StatusCreated, map[string]interface{}{"ID": "response-" + payload["ref"].(string)}
+}
+
+func fakeResponse(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
+
+func (c *fakeClient) sent() []fakeRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakeRequest(nil), c.requests...)
+}
+
+// testDatabase creates a SQLite database holding records, and returns its
+// path.
+func testDatabase(t *testing.T, records ...loadRecord) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "importer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "import.db")
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Upsert(records); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testOptions are the options of the imports of the tests, sending the
+// requests through client, followed by options.
+func testOptions(client GaiaClient, options ...Option) []Option {
+	return append([]Option{WithAPI("https://gaia.test/v2", "secret"), WithConcurrency(2), WithClient(client),
+		WithFlag("preflight", "none"), WithFlag("progress", "false"), WithFlag("q", "true"), WithFlag("batch-size", "1")}, options...)
+}
+
+// runImport imports the entries of the database at path through client with
+// options, and returns the summary of the run.
+func runImport(t *testing.T, path string, client GaiaClient, options ...Option) Fields {
+	t.Helper()
+	im, err := New(testOptions(client, append([]Option{WithDB(path)}, options...)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	summary := im.Summary()
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return summary
+}
+
+// importRow is the outcome of an entry as written back to the database.
+type importRow struct {
+	responseID     sql.NullString
+	importedAt     sql.NullString
+	err            sql.NullString
+	errorClass     sql.NullString
+	httpStatus     sql.NullInt64
+	idempotencyKey sql.NullString
+}
+
+func readRows(t *testing.T, path string) map[string]importRow {
+	t.Helper()
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	rows, err := store.(*sqlStore).query("SELECT uid, response_id, imported_at, error, error_class, http_status, idempotency_key FROM imports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	result := make(map[string]importRow)
+	for rows.Next() {
+		var uid string
+		var r importRow
+		if err := rows.Scan(&uid, &r.responseID, &r.importedAt, &r.err, &r.errorClass, &r.httpStatus, &r.idempotencyKey); err != nil {
+			t.Fatal(err)
+		}
+		result[uid] = r
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func checkImported(t *testing.T, uid string, r importRow, responseID string) {
+	t.Helper()
+	if !r.importedAt.Valid || r.responseID.String != responseID || r.err.Valid {
+		t.Errorf("entry %s: got imported_at %v, response_id %q and error %q, want imported as %s", uid, r.importedAt.String, r.responseID.String, r.err.String, responseID)
+	}
+}
+
+func checkErrored(t *testing.T, uid string, r importRow, status int64) {
+	t.Helper()
+	if r.importedAt.Valid || !r.err.Valid || r.errorClass.String != errorClass4xx || r.httpStatus.Int64 != status {
+		t.Errorf("entry %s: got imported_at %v, error %q, class %q and status %d, want errored with %d", uid, r.importedAt.String, r.err.String, r.errorClass.String, r.httpStatus.Int64, status)
+	}
+}
+
+func checkCounts(t *testing.T, summary Fields, imported, duplicate, errored int) {
+	t.Helper()
+	if summary["imported"] != imported || summary["duplicate"] != duplicate || summary["errored"] != errored {
+		t.Errorf("got %v imported, %v duplicate and %v errored, want %d, %d and %d", summary["imported"], summary["duplicate"], summary["errored"], imported, duplicate, errored)
+	}
+}
+
+var testRecords = []loadRecord{
+	{"u1", `{"ref":"u1","mode":"ok"}`},
+	{"u2", `{"ref":"u2","mode":"exists"}`},
+	{"u3", `{"ref":"u3","mode":"invalid"}`},
+	{"u4", `{"ref":"u4","mode":"ok"}`},
+}
+
+func TestImportOutcomes(t *testing.T) {
+	path := testDatabase(t, testRecords...)
+	client := &fakeClient{}
+	summary := runImport(t, path, client, WithFlag("exists-status", "409"))
+
+	checkCounts(t, summary, 2, 1, 1)
+	rows := readRows(t, path)
+	checkImported(t, "u1", rows["u1"], "response-u1")
+	checkImported(t, "u2", rows["u2"], "existing-u2")
+	checkErrored(t, "u3", rows["u3"], http.StatusUnprocessableEntity)
+	checkImported(t, "u4", rows["u4"], "response-u4")
+
+	requests := client.sent()
+	if len(requests) != len(testRecords) {
+		t.Fatalf("got %d requests, want one per entry", len(requests))
+	}
+	keys := make(map[string]bool)
+	for _, req := range requests {
+		if req.method != http.MethodPost || req.path != "/v2/responses" {
+			t.Errorf("got request %s %s, want POST /v2/responses", req.method, req.path)
+		}
+		if got := req.header.Get("Authorization"); got != "secret" && got != "Bearer secret" {
+			t.Errorf("got Authorization %q, want the token", got)
+		}
+		keys[req.header.Get("Idempotency-Key")] = true
+	}
+	for uid, r := range rows {
+		if !r.idempotencyKey.Valid || !keys[r.idempotencyKey.String] {
+			t.Errorf("entry %s: idempotency key %q was not sent", uid, r.idempotencyKey.String)
+		}
+	}
+}
+
+func TestImportWithoutExistsStatus(t *testing.T) {
+	path := testDatabase(t, testRecords...)
+	summary := runImport(t, path, &fakeClient{})
+
+	checkCounts(t, summary, 2, 0, 2)
+	checkErrored(t, "u2", readRows(t, path)["u2"], http.StatusConflict)
+}
+
+func TestImportResumesPendingEntries(t *testing.T) {
+	path := testDatabase(t, testRecords...)
+	runImport(t, path, &fakeClient{}, WithFlag("exists-status", "409"))
+
+	client := &fakeClient{}
+	summary := runImport(t, path, client, WithFlag("exists-status", "409"))
+	checkCounts(t, summary, 0, 0, 0)
+	if requests := client.sent(); len(requests) != 0 {
+		t.Errorf("got %d requests, want none: imported entries are done and errored ones wait for retry-errors", len(requests))
+	}
+}
+
+func TestImportBatches(t *testing.T) {
+	path := testDatabase(t, testRecords...)
+	client := &fakeClient{}
+	summary := runImport(t, path, client, WithFlag("exists-status", "409"), WithFlag("batch-size", "2"), WithFlag("j", "1"))
+
+	checkCounts(t, summary, 2, 1, 1)
+	rows := readRows(t, path)
+	checkImported(t, "u1", rows["u1"], "response-u1")
+	checkImported(t, "u2", rows["u2"], "existing-u2")
+	checkErrored(t, "u3", rows["u3"], http.StatusUnprocessableEntity)
+	checkImported(t, "u4", rows["u4"], "response-u4")
+
+	requests := client.sent()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2 batches of 2 entries", len(requests))
+	}
+	for _, req := range requests {
+		var items []json.RawMessage
+		if req.path != "/v2/responses/batch" || json.Unmarshal([]byte(req.body), &items) != nil || len(items) != 2 {
+			t.Errorf("got request %s %s with %s, want 2 entries sent to /v2/responses/batch", req.method, req.path, req.body)
+		}
+	}
+}
+
+func TestImportStatus(t *testing.T) {
+	path := testDatabase(t, append(testRecords, loadRecord{"u5", `{"ref":"u5","mode":"invalid"}`})...)
+	runImport(t, path, &fakeClient{}, WithFlag("exists-status", "409"), WithFlag("limit", "4"))
+
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	status, err := store.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Imported != 3 || status.Errored != 1 || status.Pending != 1 {
+		t.Errorf("got %d imported, %d errored and %d pending, want 3, 1 and 1", status.Imported, status.Errored, status.Pending)
+	}
+	if n := status.ErrorsByHTTP["4xx (HTTP 422)"]; n != 1 {
+		t.Errorf("got %d errors with HTTP 422, want 1 (%v)", n, status.ErrorsByHTTP)
+	}
+}
+
+func TestDryRunSendsNothing(t *testing.T) {
+	path := testDatabase(t, testRecords...)
+	client := &fakeClient{}
+	runImport(t, path, client, WithFlag("dry-run", "true"))
+
+	if requests := client.sent(); len(requests) != 0 {
+		t.Errorf("got %d requests, want none in a dry run", len(requests))
+	}
+	for uid, r := range readRows(t, path) {
+		if r.importedAt.Valid || r.err.Valid {
+			t.Errorf("entry %s: got imported_at %q and error %q, want it left pending", uid, r.importedAt.String, r.err.String)
+		}
+	}
+}
+
+func TestClaimSkipsErroredEntries(t *testing.T) {
+	path := testDatabase(t, testRecords...)
+	runImport(t, path, &fakeClient{}, WithFlag("exists-status", "409"), WithFlag("claim", "true"))
+
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	claimed, err := store.Claim(&Entry{UID: "u3"}, "other", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed {
+		t.Error("claimed the errored entry u3, want it left to retry-errors")
+	}
+}
+
+// failingStore is a Store whose fetches of pending entries fail past the
+// first page.
+type failingStore struct {
+	Store
+}
+
+func (s failingStore) FetchPending(scope pendingScope, after string, limit int) ([]Entry, error) {
+	if after != "" {
+		return nil, errors.New("connection lost")
+	}
+	return s.Store.FetchPending(scope, after, limit)
+}
+
+func TestImportFailsWhenFetchingFails(t *testing.T) {
+	path := testDatabase(t, testRecords...)
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	im, err := New(testOptions(&fakeClient{}, WithStore(failingStore{store}), WithConcurrency(1),
+		WithFlag("page-size", "2"), WithFlag("fetch-retries", "0"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	err = im.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "connection lost") {
+		t.Fatalf("got error %v, want the failure to fetch entries", err)
+	}
+	if code := im.ExitCode(err); code != ExitFailed {
+		t.Errorf("got exit status %d, want %d", code, ExitFailed)
+	}
+	summary := im.runSummary(im.progress.start, err)
+	if summary.Outcome != "failed" || summary.Remaining != 2 {
+		t.Errorf("got outcome %q with %d remaining, want failed with 2", summary.Outcome, summary.Remaining)
+	}
+}
+
+// oldDatabase creates a SQLite database with the imports table of the first
+// versions, holding an imported and an errored entry, and returns its path.
+func oldDatabase(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "importer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "old.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, query := range []string{
+		"CREATE TABLE imports (uid TEXT NOT NULL UNIQUE, payload TEXT NOT NULL, response_id TEXT, imported_at TEXT, error TEXT)",
+		`INSERT INTO imports VALUES ('u1', '{"ref":"u1"}', 'response-u1', '2024-01-02T00:00:00Z', NULL), ('u2', '{"ref":"u2"}', NULL, NULL, 'HTTP 500'), ('u3', '{"ref":"u3"}', NULL, NULL, NULL)`,
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestUnmigratedDatabase(t *testing.T) {
+	path := oldDatabase(t)
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	status, err := store.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Pending != 1 || status.Imported != 1 || status.Errored != 1 {
+		t.Errorf("got %d pending, %d imported and %d errored, want 1 of each", status.Pending, status.Imported, status.Errored)
+	}
+	n, err := store.Requeue(&RequeueFilter{State: "errored"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("requeued %d entries, want the errored one", n)
+	}
+	if n, err = store.Requeue(&RequeueFilter{State: "all"}, false); err != nil || n != 1 {
+		t.Errorf("requeued %d entries (%v), want the imported one", n, err)
+	}
+	if status, err = store.Status(); err != nil {
+		t.Fatal(err)
+	}
+	if status.Pending != 3 {
+		t.Errorf("got %d pending, want 3", status.Pending)
+	}
+}
+
+func TestRequeueErroredByDate(t *testing.T) {
+	path := testDatabase(t, testRecords...)
+	runImport(t, path, &fakeClient{}, WithFlag("exists-status", "409"))
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	tomorrow := time.Now().UTC().Add(24 * time.Hour).Format(time.RFC3339)
+	filter := &RequeueFilter{State: "errored", Statuses: [][2]int{{400, 499}}, After: tomorrow}
+	if n, err := store.Requeue(filter, true); err != nil || n != 0 {
+		t.Errorf("got %d entries errored after tomorrow (%v), want none", n, err)
+	}
+	filter = &RequeueFilter{State: "errored", Statuses: [][2]int{{400, 499}}, Before: tomorrow}
+	n, err := store.Requeue(filter, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("requeued %d entries errored before tomorrow, want u3", n)
+	}
+	if r := readRows(t, path)["u3"]; r.err.Valid || r.importedAt.Valid {
+		t.Errorf("got u3 with error %q, want it pending", r.err.String)
+	}
+}
+
+func TestDryRunPreparesAsRuns(t *testing.T) {
+	path := testDatabase(t, append(testRecords, loadRecord{"u5", `{"ref":"u5","mode":"ok","comment":"` + strings.Repeat("x", 100) + `"}`})...)
+	client := &fakeClient{}
+	im, err := New(testOptions(client, WithDB(path), WithFlag("dry-run", "true"), WithFlag("max-payload-size", "80"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if err := im.Run(context.Background()); err != ErrInvalidEntries {
+		t.Errorf("got error %v, want the oversized entry u5 found invalid", err)
+	}
+	if requests := client.sent(); len(requests) != 0 {
+		t.Errorf("got %d requests, want none in a dry run", len(requests))
+	}
+}
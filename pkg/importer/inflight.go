@@ -0,0 +1,79 @@
+package importer
+
+import (
+	"fmt"
+	"sync"
+)
+
+var argMaxInflightBytes = Flags.String("max-inflight-bytes", "", "cap the payload bytes held by the workers at once, e.g. 256MB, so that large payloads are sent fewer at a time while small ones use all of -j")
+
+// byteLimit is a semaphore weighted by payload size. A payload larger than
+// the limit waits for the others to finish and is then processed alone.
+type byteLimit struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+	freed chan struct{}
+}
+
+func setupInflightBytes() (*byteLimit, error) {
+	if *argMaxInflightBytes == "" {
+		return nil, nil
+	}
+	limit, ok := parseBytes(*argMaxInflightBytes)
+	if !ok || limit < 1 {
+		return nil, fmt.Errorf("invalid -max-inflight-bytes %q, expected e.g. 256MB", *argMaxInflightBytes)
+	}
+	logInfo(Fields{"max_inflight_bytes": int64(limit)}, "limiting in-flight payloads to %s", *argMaxInflightBytes)
+	return &byteLimit{limit: int64(limit), freed: make(chan struct{})}, nil
+}
+
+// payloadBytes returns the size of the payloads of entries.
+func payloadBytes(entries []Entry) int64 {
+	var n int64
+	for _, e := range entries {
+		n += int64(len(e.Payload))
+	}
+	return n
+}
+
+// acquire waits until n more bytes fit under the limit, and reports false if
+// stop was closed first. It always succeeds on a nil byteLimit.
+func (b *byteLimit) acquire(n int64, stop <-chan struct{}) bool {
+	if b == nil {
+		return true
+	}
+	if n > b.limit {
+		n = b.limit
+	}
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return true
+		}
+		freed := b.freed
+		b.mu.Unlock()
+		select {
+		case <-freed:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// release gives back n bytes acquired before.
+func (b *byteLimit) release(n int64) {
+	if b == nil {
+		return
+	}
+	if n > b.limit {
+		n = b.limit
+	}
+	b.mu.Lock()
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+	b.mu.Unlock()
+}
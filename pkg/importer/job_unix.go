@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package importer
+
+import (
+	"os"
+	"os/exec"
+)
+
+// jobCommand runs executable with args, as the child process of a job.
+func jobCommand(executable string, args ...string) *exec.Cmd {
+	return exec.Command(executable, args...)
+}
+
+// interruptJob sends p, the child process of a job, SIGINT.
+func interruptJob(p *os.Process) error {
+	return p.Signal(os.Interrupt)
+}
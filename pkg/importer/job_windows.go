@@ -0,0 +1,27 @@
+package importer
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+var generateConsoleCtrlEvent = syscall.NewLazyDLL("kernel32.dll").NewProc("GenerateConsoleCtrlEvent")
+
+// jobCommand runs executable with args, as the child process of a job, in a
+// process group of its own so that it can be sent Ctrl+Break alone.
+func jobCommand(executable string, args ...string) *exec.Cmd {
+	cmd := exec.Command(executable, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+	return cmd
+}
+
+// interruptJob sends Ctrl+Break to p, the child process of a job, which stops
+// its run as Ctrl+C does. Windows has no signals, and console events need a
+// console: this fails if the service has none, e.g. run as a Windows service.
+func interruptJob(p *os.Process) error {
+	if ok, _, err := generateConsoleCtrlEvent.Call(syscall.CTRL_BREAK_EVENT, uintptr(p.Pid)); ok == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var argSchema = Flags.String("schema", "", "JSON Schema `file` payloads are validated against before being sent, invalid ones failing with the invalid error class")
+
+// SchemaError lists the reasons why a payload does not match -schema.
+type SchemaError struct {
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return "payload does not match the schema: " + strings.Join(e.Problems, "; ")
+}
+
+// schemaValidator checks documents against a JSON Schema, supporting the
+// keywords of draft 7 about types, objects, arrays, strings, numbers and
+// combinations, and local $ref.
+type schemaValidator struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+var payloadSchema *schemaValidator
+
+func setupSchema() error {
+	if *argSchema == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(*argSchema)
+	if err != nil {
+		return fmt.Errorf("failed to read schema: %s", err)
+	}
+	if payloadSchema, err = newSchemaValidator(content); err != nil {
+		return fmt.Errorf("invalid schema %s: %s", *argSchema, err)
+	}
+	return nil
+}
+
+func newSchemaValidator(content []byte) (*schemaValidator, error) {
+	root, err := decodeJSON(content)
+	if err != nil {
+		return nil, err
+	}
+	v := &schemaValidator{root: root, patterns: make(map[string]*regexp.Regexp)}
+	if err := v.compilePatterns(root); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func decodeJSON(content []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	return value, err
+}
+
+// compilePatterns compiles the pattern keywords of schema ahead, so that
+// validation cannot fail on them.
+func (v *schemaValidator) compilePatterns(schema interface{}) error {
+	switch s := schema.(type) {
+	case map[string]interface{}:
+		for key, value := range s {
+			if pattern, ok := value.(string); ok && key == "pattern" {
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return fmt.Errorf("invalid pattern %q: %s", pattern, err)
+				}
+				v.patterns[pattern] = re
+				continue
+			}
+			if err := v.compilePatterns(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, value := range s {
+			if err := v.compilePatterns(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateSchema fails with a SchemaError if the payload of e does not match
+// -schema. It is a no-op without one.
+func validateSchema(e *Entry) error {
+	if payloadSchema == nil {
+		return nil
+	}
+	doc, err := decodeJSON([]byte(e.Payload))
+	if err != nil {
+		return &SchemaError{[]string{"invalid JSON: " + err.Error()}}
+	}
+	var problems []string
+	payloadSchema.validate(payloadSchema.root, doc, "", &problems)
+	if len(problems) > 0 {
+		return &SchemaError{problems}
+	}
+	return nil
+}
+
+func (v *schemaValidator) resolve(ref string) (interface{}, bool) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, false
+	}
+	node := v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if node, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+func (v *schemaValidator) validate(schema, value interface{}, path string, problems *[]string) {
+	fail := func(format string, args ...interface{}) {
+		at := path
+		if at == "" {
+			at = "/"
+		}
+		*problems = append(*problems, at+": "+fmt.Sprintf(format, args...))
+	}
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			fail("not allowed")
+		}
+		return
+	case map[string]interface{}:
+		schema := s
+		if ref, ok := schema["$ref"].(string); ok {
+			target, ok := v.resolve(ref)
+			if !ok {
+				fail("unresolvable $ref %s", ref)
+				return
+			}
+			v.validate(target, value, path, problems)
+			return
+		}
+		if types, ok := schema["type"]; ok && !matchesType(types, value) {
+			fail("must be of type %s, got %s", typeList(types), jsonType(value))
+			return
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, candidate := range enum {
+				found = found || jsonEqual(candidate, value)
+			}
+			if !found {
+				fail("must be one of %s", compactJSON(enum))
+			}
+		}
+		if constant, ok := schema["const"]; ok && !jsonEqual(constant, value) {
+			fail("must be %s", compactJSON(constant))
+		}
+		switch val := value.(type) {
+		case map[string]interface{}:
+			v.validateObject(schema, val, path, fail, problems)
+		case []interface{}:
+			v.validateArray(schema, val, path, fail, problems)
+		case string:
+			v.validateString(schema, val, fail)
+		case json.Number:
+			validateNumber(schema, val, fail)
+		}
+		for _, sub := range schemaList(schema["allOf"]) {
+			v.validate(sub, value, path, problems)
+		}
+		if anyOf := schemaList(schema["anyOf"]); len(anyOf) > 0 && v.countMatches(anyOf, value, path) == 0 {
+			fail("must match at least one schema of anyOf")
+		}
+		if oneOf := schemaList(schema["oneOf"]); len(oneOf) > 0 {
+			if n := v.countMatches(oneOf, value, path); n != 1 {
+				fail("must match exactly one schema of oneOf, matches %d", n)
+			}
+		}
+		if not, ok := schema["not"]; ok && v.countMatches([]interface{}{not}, value, path) == 1 {
+			fail("must not match the schema of not")
+		}
+	}
+}
+
+func (v *schemaValidator) countMatches(schemas []interface{}, value interface{}, path string) int {
+	n := 0
+	for _, sub := range schemas {
+		var problems []string
+		v.validate(sub, value, path, &problems)
+		if len(problems) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (v *schemaValidator) validateObject(schema map[string]interface{}, object map[string]interface{}, path string, fail func(string, ...interface{}), problems *[]string) {
+	for _, name := range schemaList(schema["required"]) {
+		if name, ok := name.(string); ok {
+			if _, present := object[name]; !present {
+				fail("missing required property %s", name)
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := object[name]
+		property := path + "/" + name
+		if sub, ok := properties[name]; ok {
+			v.validate(sub, value, property, problems)
+			continue
+		}
+		if additional, ok := schema["additionalProperties"]; ok {
+			if allowed, isBool := additional.(bool); isBool && !allowed {
+				fail("unexpected property %s", name)
+				continue
+			}
+			v.validate(additional, value, property, problems)
+		}
+	}
+	if n, ok := schemaInt(schema["minProperties"]); ok && len(object) < n {
+		fail("must have at least %d properties", n)
+	}
+	if n, ok := schemaInt(schema["maxProperties"]); ok && len(object) > n {
+		fail("must have at most %d properties", n)
+	}
+}
+
+func (v *schemaValidator) validateArray(schema map[string]interface{}, array []interface{}, path string, fail func(string, ...interface{}), problems *[]string) {
+	if items, ok := schema["items"]; ok {
+		if tuple, isTuple := items.([]interface{}); isTuple {
+			for i := 0; i < len(tuple) && i < len(array); i++ {
+				v.validate(tuple[i], array[i], path+"/"+strconv.Itoa(i), problems)
+			}
+		} else {
+			for i, item := range array {
+				v.validate(items, item, path+"/"+strconv.Itoa(i), problems)
+			}
+		}
+	}
+	if n, ok := schemaInt(schema["minItems"]); ok && len(array) < n {
+		fail("must have at least %d items", n)
+	}
+	if n, ok := schemaInt(schema["maxItems"]); ok && len(array) > n {
+		fail("must have at most %d items", n)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range array {
+			for j := i + 1; j < len(array); j++ {
+				if jsonEqual(array[i], array[j]) {
+					fail("items %d and %d are identical", i, j)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (v *schemaValidator) validateString(schema map[string]interface{}, s string, fail func(string, ...interface{})) {
+	length := len([]rune(s))
+	if n, ok := schemaInt(schema["minLength"]); ok && length < n {
+		fail("must be at least %d characters long", n)
+	}
+	if n, ok := schemaInt(schema["maxLength"]); ok && length > n {
+		fail("must be at most %d characters long", n)
+	}
+	if pattern, ok := schema["pattern"].(string); ok && !v.patterns[pattern].MatchString(s) {
+		fail("must match pattern %s", pattern)
+	}
+	if format, ok := schema["format"].(string); ok && !matchesFormat(format, s) {
+		fail("must be a valid %s", format)
+	}
+}
+
+func validateNumber(schema map[string]interface{}, n json.Number, fail func(string, ...interface{})) {
+	f, _ := n.Float64()
+	if min, ok := schemaFloat(schema["minimum"]); ok && f < min {
+		fail("must be >= %v", min)
+	}
+	if max, ok := schemaFloat(schema["maximum"]); ok && f > max {
+		fail("must be <= %v", max)
+	}
+	if min, ok := schemaFloat(schema["exclusiveMinimum"]); ok && f <= min {
+		fail("must be > %v", min)
+	}
+	if max, ok := schemaFloat(schema["exclusiveMaximum"]); ok && f >= max {
+		fail("must be < %v", max)
+	}
+	if m, ok := schemaFloat(schema["multipleOf"]); ok && m > 0 && math.Abs(math.Remainder(f, m)) > 1e-9 {
+		fail("must be a multiple of %v", m)
+	}
+}
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// matchesFormat checks the common formats, the other ones being accepted.
+func matchesFormat(format, s string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	case "date":
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	case "email":
+		return emailPattern.MatchString(s)
+	}
+	return true
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if isInteger(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func isInteger(n json.Number) bool {
+	f, err := n.Float64()
+	return err == nil && f == math.Trunc(f)
+}
+
+func matchesType(types, value interface{}) bool {
+	actual := jsonType(value)
+	for _, t := range schemaList(types) {
+		if t == actual || t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func typeList(types interface{}) string {
+	var names []string
+	for _, t := range schemaList(types) {
+		names = append(names, fmt.Sprint(t))
+	}
+	return strings.Join(names, " or ")
+}
+
+// schemaList returns value as a list, wrapping a single value.
+func schemaList(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return v
+	}
+	return []interface{}{value}
+}
+
+func schemaFloat(value interface{}) (float64, bool) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+func schemaInt(value interface{}) (int, bool) {
+	f, ok := schemaFloat(value)
+	return int(f), ok
+}
+
+func jsonEqual(a, b interface{}) bool {
+	return compactJSON(a) == compactJSON(b)
+}
+
+func compactJSON(value interface{}) string {
+	if n, ok := value.(json.Number); ok {
+		f, _ := n.Float64()
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	content, _ := json.Marshal(value)
+	return string(content)
+}
@@ -0,0 +1,277 @@
+package importer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	argKafkaBrokers = Flags.String("kafka-brokers", "", "comma-separated Kafka brokers to consume entries from, instead of the pending rows of -db")
+	argKafkaTopic   = Flags.String("kafka-topic", "", "Kafka topic to consume entries from")
+	argKafkaGroup   = Flags.String("kafka-group", "gaia-responses-importer", "Kafka consumer group")
+	argKafkaUID     = Flags.String("kafka-uid", "", "field of the Kafka messages holding the entry uid (default: the message key, or topic-partition-offset)")
+	argKafkaPayload = Flags.String("kafka-payload", "", "field of the Kafka messages holding their payload (default: the whole message)")
+)
+
+var errKafka = errors.New("not possible in Kafka mode")
+
+// kafkaPosition is the partition and offset of the message an entry was read
+// from.
+type kafkaPosition struct {
+	partition int
+	offset    int64
+}
+
+// partitionOffsets tracks the messages of a partition in flight, so that
+// offsets are only committed once all the messages before them are done.
+type partitionOffsets struct {
+	fetched []int64
+	done    map[int64]bool
+}
+
+// kafkaStore consumes entries from a Kafka topic, committing the offset of
+// each message once it is imported or dead-lettered: errored entries are
+// written to the imports table of the embedded store, which also records the
+// runs.
+type kafkaStore struct {
+	Store
+	reader *kafka.Reader
+	topic  string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	partitions map[int]*partitionOffsets
+}
+
+func openKafka(store Store) (*kafkaStore, error) {
+	if *argKafkaTopic == "" {
+		return nil, errors.New("-kafka-topic is needed with -kafka-brokers")
+	}
+	if err := store.InitSchema(); err != nil {
+		return nil, fmt.Errorf("failed to create tables: %s", err)
+	}
+	var brokers []string
+	for _, broker := range strings.Split(*argKafkaBrokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kafkaStore{
+		Store: store,
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     brokers,
+			GroupID:     *argKafkaGroup,
+			Topic:       *argKafkaTopic,
+			StartOffset: kafka.FirstOffset,
+			ErrorLogger: kafka.LoggerFunc(func(format string, args ...interface{}) {
+				logError(Fields{"topic": *argKafkaTopic}, "kafka: "+format, args...)
+			}),
+		}),
+		topic:      *argKafkaTopic,
+		ctx:        ctx,
+		cancel:     cancel,
+		partitions: make(map[int]*partitionOffsets),
+	}, nil
+}
+
+// stopFetching makes FetchPending return no entries from now on.
+func (s *kafkaStore) stopFetching() {
+	s.cancel()
+}
+
+func (s *kafkaStore) SetPendingFilter(where string) {}
+
+func (s *kafkaStore) SetPendingAfter(uid string) {}
+
+// CountPending returns 0 as entries are only known once consumed.
+func (s *kafkaStore) CountPending(uids []string) (int, error) {
+	return 0, nil
+}
+
+// FetchPending blocks until a message is available and returns its entry,
+// ignoring priority, after and limit. It returns no entries once stopped.
+func (s *kafkaStore) FetchPending(scope pendingScope, after string, limit int) ([]Entry, error) {
+	for {
+		m, err := s.reader.FetchMessage(s.ctx)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return nil, nil
+			}
+			return nil, err
+		}
+		s.mu.Lock()
+		p := s.partitions[m.Partition]
+		if p == nil {
+			p = &partitionOffsets{done: make(map[int64]bool)}
+			s.partitions[m.Partition] = p
+		}
+		p.fetched = append(p.fetched, m.Offset)
+		s.mu.Unlock()
+
+		entry, err := kafkaEntry(m)
+		if err == nil {
+			return []Entry{entry}, nil
+		}
+		// Messages that cannot be parsed are dead-lettered as is.
+		logError(Fields{"uid": entry.UID, "error": err}, "invalid Kafka message %s: %s", entry.UID, err)
+		entry.Payload, entry.Err = string(m.Value), err
+		if err := s.WriteStatus([]StatusUpdate{{Entry: entry}}); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func kafkaEntry(m kafka.Message) (Entry, error) {
+	coordinates := fmt.Sprintf("%s-%d-%d", m.Topic, m.Partition, m.Offset)
+	sum := sha256.Sum256([]byte(coordinates))
+	b := sum[:16]
+	e := Entry{
+		UID:     string(m.Key),
+		Payload: string(m.Value),
+		// Derived from the message, so that the API recognizes a message
+		// delivered again after a crash.
+		IdempotencyKey: fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]),
+		position:       &kafkaPosition{m.Partition, m.Offset},
+	}
+	if e.UID == "" {
+		e.UID = coordinates
+	}
+	if *argKafkaUID == "" && *argKafkaPayload == "" {
+		return e, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(m.Value, &fields); err != nil {
+		return e, err
+	}
+	if *argKafkaUID != "" {
+		if err := json.Unmarshal(fields[*argKafkaUID], &e.UID); err != nil {
+			return e, fmt.Errorf("invalid %q field", *argKafkaUID)
+		}
+	}
+	if *argKafkaPayload != "" {
+		payload, ok := fields[*argKafkaPayload]
+		if !ok {
+			return e, fmt.Errorf("no %q field", *argKafkaPayload)
+		}
+		e.Payload = string(payload)
+	}
+	return e, nil
+}
+
+func (s *kafkaStore) PendingPriorities() ([]int, error) {
+	return nil, errKafka
+}
+
+func (s *kafkaStore) PendingBoundaries(parts int) ([]string, error) {
+	return nil, errKafka
+}
+
+// WriteStatus dead-letters the errored entries, then commits the offsets
+// the updates complete.
+func (s *kafkaStore) WriteStatus(updates []StatusUpdate) error {
+	var dead []StatusUpdate
+	var records []loadRecord
+	for _, update := range updates {
+		if !update.Imported {
+			dead = append(dead, update)
+			records = append(records, loadRecord{UID: update.Entry.UID, Payload: update.Entry.Payload})
+		}
+	}
+	if len(dead) > 0 {
+		if err := s.Store.Upsert(records); err != nil {
+			return err
+		}
+		if err := s.Store.WriteStatus(dead); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	var commits []kafka.Message
+	for _, update := range updates {
+		if pos := update.Entry.position; pos != nil {
+			if offset, ok := s.partitions[pos.partition].complete(pos.offset); ok {
+				commits = append(commits, kafka.Message{Topic: s.topic, Partition: pos.partition, Offset: offset})
+			}
+		}
+	}
+	s.mu.Unlock()
+	if len(commits) == 0 {
+		return nil
+	}
+	// Commit even once stopped, for the entries finished meanwhile.
+	return s.reader.CommitMessages(context.Background(), commits...)
+}
+
+// complete marks offset as done, and returns the offset to commit if all
+// the messages up to it are done.
+func (p *partitionOffsets) complete(offset int64) (int64, bool) {
+	if p == nil || len(p.fetched) == 0 || offset < p.fetched[0] {
+		return 0, false
+	}
+	p.done[offset] = true
+	committed := int64(-1)
+	for len(p.fetched) > 0 && p.done[p.fetched[0]] {
+		committed = p.fetched[0]
+		delete(p.done, committed)
+		p.fetched = p.fetched[1:]
+	}
+	return committed, committed >= 0
+}
+
+// SetIdempotencyKey does nothing, as keys are derived from the messages.
+func (s *kafkaStore) SetIdempotencyKey(e *Entry, key string) error {
+	return nil
+}
+
+// ForEachImported finds nothing, so only duplicates within the run are
+// detected.
+func (s *kafkaStore) ForEachImported(fn func(uid, payload string, responseID *string) error) error {
+	return nil
+}
+
+func (s *kafkaStore) Close() error {
+	s.cancel()
+	err := s.reader.Close()
+	if closeErr := s.Store.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// checkKafkaFlags rejects the flags that do not apply to a topic.
+func checkKafkaFlags() error {
+	conflicts := []struct {
+		set  bool
+		name string
+	}{
+		{*argPipe, "-pipe"},
+		{*argCheckpoint != "", "-checkpoint"},
+		{*argClaim, "-claim"},
+		{*argDryRun, "-dry-run"},
+		{*argPriority, "-priority"},
+		{*argReaders > 1, "-readers"},
+		{*argWatch, "-watch"},
+		{*argWhere != "", "-where"},
+		{*argUIDFile != "", "-uid-file"},
+		{*argExecute != "", "-execute"},
+		{*argShard != "", "-shard"},
+		{*argSource != "", "-source"},
+		{*argCompactAfter > 0, "-compact-after"},
+	}
+	for _, c := range conflicts {
+		if c.set {
+			return fmt.Errorf("%s cannot be used with -kafka-brokers", c.name)
+		}
+	}
+	return nil
+}
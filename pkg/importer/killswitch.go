@@ -0,0 +1,142 @@
+package importer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	argMaxErrorRate    = Flags.String("max-error-rate", "", "stop the run when the rate of errored entries among the latest -error-rate-window ones exceeds this, e.g. 5%")
+	argErrorRateWindow = Flags.Int("error-rate-window", 100, "number of latest imported or errored entries -max-error-rate is evaluated over")
+	argFailFast        = Flags.Bool("fail-fast", false, "stop the run at the first errored entry, leaving the remaining ones pending, and exit with status 4")
+)
+
+// RunStoppedError is returned by Run when -fail-fast or -max-error-rate
+// stopped it.
+type RunStoppedError struct {
+	Reason string
+}
+
+func (e *RunStoppedError) Error() string {
+	return "run stopped " + e.Reason + ", remaining entries are left pending"
+}
+
+// killSwitch stops a run at the first errored entry with -fail-fast, or once
+// the rate of errored entries over a sliding window of the latest imported or
+// errored ones exceeds max.
+type killSwitch struct {
+	mu       sync.Mutex
+	failFast bool
+	max      float64
+	outcomes []bool
+	next     int
+	seen     int
+	errored  int
+	stop     func()
+	err      error
+}
+
+// parseRate parses a rate given as a percentage (5%) or a fraction (0.05).
+func parseRate(s string) (float64, error) {
+	number, scale := strings.TrimSpace(s), 1.0
+	if strings.HasSuffix(number, "%") {
+		number, scale = strings.TrimSpace(strings.TrimSuffix(number, "%")), 100
+	}
+	rate, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	rate /= scale
+	if rate <= 0 || rate >= 1 {
+		return 0, fmt.Errorf("invalid rate %q, expected between 0 and 100%%", s)
+	}
+	return rate, nil
+}
+
+func setupKillSwitch() (*killSwitch, error) {
+	if *argMaxErrorRate == "" && !*argFailFast {
+		return nil, nil
+	}
+	k := &killSwitch{failFast: *argFailFast}
+	if *argMaxErrorRate == "" {
+		return k, nil
+	}
+	rate, err := parseRate(*argMaxErrorRate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -max-error-rate: %s", err)
+	}
+	if *argErrorRateWindow <= 0 {
+		return nil, fmt.Errorf("invalid -error-rate-window %d", *argErrorRateWindow)
+	}
+	k.max, k.outcomes = rate, make([]bool, *argErrorRateWindow)
+	return k, nil
+}
+
+// arm sets the function stopping the run.
+func (k *killSwitch) arm(stop func()) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	k.stop = stop
+	k.mu.Unlock()
+}
+
+// observe records an imported entry, or one errored with err, and stops the
+// run if it errored with -fail-fast, or if the window is full and its error
+// rate exceeds the limit.
+func (k *killSwitch) observe(err error) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	errored := err != nil
+	if errored && k.failFast && k.err == nil {
+		logError(Fields{"error": err}, "entry errored with -fail-fast, stopping the run")
+		k.trip(&RunStoppedError{fmt.Sprintf("at the first error with -fail-fast: %s", err)})
+		return
+	}
+	if len(k.outcomes) == 0 {
+		return
+	}
+	if k.seen == len(k.outcomes) && k.outcomes[k.next] {
+		k.errored--
+	}
+	k.outcomes[k.next] = errored
+	if errored {
+		k.errored++
+	}
+	k.next = (k.next + 1) % len(k.outcomes)
+	if k.seen < len(k.outcomes) {
+		k.seen++
+	}
+	if k.err != nil || k.seen < len(k.outcomes) {
+		return
+	}
+	if rate := float64(k.errored) / float64(k.seen); rate > k.max {
+		logError(Fields{"error_rate": rate, "entries": k.seen}, "error rate at %.1f%% over the latest %d entries exceeds -max-error-rate %s, stopping the run",
+			rate*100, k.seen, *argMaxErrorRate)
+		k.trip(&RunStoppedError{fmt.Sprintf("as the error rate exceeded -max-error-rate %s", *argMaxErrorRate)})
+	}
+}
+
+// trip records err and stops the run. k.mu must be held.
+func (k *killSwitch) trip(err error) {
+	k.err = err
+	if k.stop != nil {
+		k.stop()
+	}
+}
+
+// tripped returns the error of a kill switch that stopped the run.
+func (k *killSwitch) tripped() error {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err
+}
@@ -0,0 +1,257 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	argLintRules  = Flags.String("lint-rules", "", "YAML `file` of rules checked on the payloads before they are sent, violations being logged per entry")
+	argLintStrict = Flags.Bool("lint-strict", false, "fail the entries violating -lint-rules rules of the error severity, with the invalid error class")
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// LintRule is a check on the value found at Path in the payloads, from the
+// -lint-rules file. Values absent or null are only checked by Required.
+type LintRule struct {
+	Name       string   `yaml:"name"`
+	Path       string   `yaml:"path"`
+	Severity   string   `yaml:"severity"`
+	Required   bool     `yaml:"required"`
+	Min        *float64 `yaml:"min"`
+	Max        *float64 `yaml:"max"`
+	MinLength  *int     `yaml:"min_length"`
+	MaxLength  *int     `yaml:"max_length"`
+	Pattern    string   `yaml:"pattern"`
+	Format     string   `yaml:"format"`
+	OneOf      []string `yaml:"one_of"`
+	ValuesFile string   `yaml:"values_file"`
+
+	pattern *regexp.Regexp
+	values  map[string]bool
+}
+
+// LintViolation is a rule a payload does not follow.
+type LintViolation struct {
+	Rule     string
+	Severity string
+	Path     string
+	Message  string
+}
+
+func (v LintViolation) String() string {
+	return fmt.Sprintf("%s: %s (%s)", v.Path, v.Message, v.Rule)
+}
+
+// LintError is returned with -lint-strict for payloads violating rules of
+// the error severity.
+type LintError struct {
+	Violations []LintViolation
+}
+
+func (e *LintError) Error() string {
+	problems := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		problems[i] = v.String()
+	}
+	return "payload violates lint rules: " + strings.Join(problems, "; ")
+}
+
+var lintRules []*LintRule
+
+func setupLint() error {
+	lintRules = nil
+	if *argLintRules == "" {
+		return nil
+	}
+	rules, err := loadLintRules(*argLintRules)
+	if err != nil {
+		return fmt.Errorf("invalid lint rules %s: %s", *argLintRules, err)
+	}
+	lintRules = rules
+	return nil
+}
+
+func loadLintRules(path string) ([]*LintRule, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []*LintRule `yaml:"rules"`
+	}
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Rules) == 0 {
+		return nil, errors.New("no rules")
+	}
+	for i, rule := range file.Rules {
+		if rule.Path == "" {
+			return nil, fmt.Errorf("rule %d has no path", i+1)
+		}
+		if rule.Name == "" {
+			rule.Name = rule.Path
+		}
+		switch rule.Severity {
+		case "":
+			rule.Severity = severityError
+		case severityError, severityWarning:
+		default:
+			return nil, fmt.Errorf("rule %s: invalid severity %q, expected error or warning", rule.Name, rule.Severity)
+		}
+		switch rule.Format {
+		case "", "email", "date", "date-time":
+		default:
+			return nil, fmt.Errorf("rule %s: unsupported format %q, expected email, date or date-time", rule.Name, rule.Format)
+		}
+		if rule.Pattern != "" {
+			if rule.pattern, err = regexp.Compile(rule.Pattern); err != nil {
+				return nil, fmt.Errorf("rule %s: invalid pattern: %s", rule.Name, err)
+			}
+		}
+		if len(rule.OneOf) > 0 || rule.ValuesFile != "" {
+			rule.values = make(map[string]bool)
+			for _, value := range rule.OneOf {
+				rule.values[value] = true
+			}
+		}
+		if rule.ValuesFile != "" {
+			if err := rule.loadValues(); err != nil {
+				return nil, fmt.Errorf("rule %s: failed to read values: %s", rule.Name, err)
+			}
+		}
+	}
+	return file.Rules, nil
+}
+
+// loadValues adds the non-empty lines of the values file to the allowed
+// values.
+func (r *LintRule) loadValues() error {
+	f, err := os.Open(r.ValuesFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value := strings.TrimSpace(scanner.Text()); value != "" {
+			r.values[value] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// lintString returns the text form of scalar values compared to the allowed
+// values, and false for objects and arrays.
+func lintString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+func (r *LintRule) check(doc interface{}) []string {
+	value, found := valueAt(doc, r.Path)
+	if !found || value == nil {
+		if r.Required {
+			return []string{"is missing"}
+		}
+		return nil
+	}
+	var problems []string
+	if r.Min != nil || r.Max != nil {
+		n, ok := value.(json.Number)
+		f, err := n.Float64()
+		switch {
+		case !ok || err != nil:
+			problems = append(problems, fmt.Sprintf("must be a number, got %s", jsonType(value)))
+		case r.Min != nil && f < *r.Min:
+			problems = append(problems, fmt.Sprintf("%s is below %v", n, *r.Min))
+		case r.Max != nil && f > *r.Max:
+			problems = append(problems, fmt.Sprintf("%s is above %v", n, *r.Max))
+		}
+	}
+	if r.MinLength != nil || r.MaxLength != nil || r.pattern != nil || r.Format != "" {
+		s, ok := value.(string)
+		length := len([]rune(s))
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("must be a string, got %s", jsonType(value)))
+		case r.MinLength != nil && length < *r.MinLength:
+			problems = append(problems, fmt.Sprintf("must be at least %d characters long", *r.MinLength))
+		case r.MaxLength != nil && length > *r.MaxLength:
+			problems = append(problems, fmt.Sprintf("must be at most %d characters long", *r.MaxLength))
+		case r.pattern != nil && !r.pattern.MatchString(s):
+			problems = append(problems, fmt.Sprintf("%q does not match %s", s, r.Pattern))
+		case r.Format != "" && !matchesFormat(r.Format, s):
+			problems = append(problems, fmt.Sprintf("%q is not a valid %s", s, r.Format))
+		}
+	}
+	if r.values != nil {
+		if s, ok := lintString(value); !ok || !r.values[s] {
+			problems = append(problems, fmt.Sprintf("%s is not a known value", compactJSON(value)))
+		}
+	}
+	return problems
+}
+
+// lintPayload returns the violations of -lint-rules by payload.
+func lintPayload(payload string) ([]LintViolation, error) {
+	doc, err := decodeJSON([]byte(payload))
+	if err != nil {
+		return nil, err
+	}
+	var violations []LintViolation
+	for _, rule := range lintRules {
+		for _, problem := range rule.check(doc) {
+			violations = append(violations, LintViolation{Rule: rule.Name, Severity: rule.Severity, Path: rule.Path, Message: problem})
+		}
+	}
+	return violations, nil
+}
+
+// lint logs the violations of -lint-rules by the payload of e, and with
+// -lint-strict fails with a LintError if some have the error severity. It is
+// a no-op without rules.
+func lint(e *Entry) error {
+	if len(lintRules) == 0 {
+		return nil
+	}
+	violations, err := lintPayload(e.Payload)
+	if err != nil {
+		return &SchemaError{[]string{"invalid JSON: " + err.Error()}}
+	}
+	var blocking []LintViolation
+	for _, v := range violations {
+		fields := Fields{"uid": e.UID, "rule": v.Rule, "severity": v.Severity, "path": v.Path, "violation": v.Message}
+		if v.Severity == severityError {
+			logError(fields, "entry %s: %s: %s", e.UID, v.Severity, v)
+			blocking = append(blocking, v)
+		} else {
+			logWarn(fields, "entry %s: %s: %s", e.UID, v.Severity, v)
+		}
+	}
+	if *argLintStrict && len(blocking) > 0 {
+		return &LintError{blocking}
+	}
+	return nil
+}
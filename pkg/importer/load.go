@@ -0,0 +1,178 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type loadRecord struct {
+	UID     string
+	Payload string
+}
+
+func runLoad(args []string) error {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	commonFlags(fs)
+	format := fs.String("format", "", "input format: csv or ndjson (guessed from the file extension by default)")
+	uidField := fs.String("uid", "uid", "column (CSV) or field (NDJSON) holding the entry uid")
+	payloadField := fs.String("payload", "", "column (CSV) or field (NDJSON) holding the payload (default: the whole row)")
+	compression := fs.String("compress", "", "store the payloads compressed with this algorithm (gzip, SQLite only)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s load [flags] <file or s3://bucket/prefix or gs://bucket/prefix>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("an input file is needed")
+	}
+	if *compression != "" {
+		if err := checkCompression(*compression, *argDb); err != nil {
+			return err
+		}
+	}
+	path := fs.Arg(0)
+	if isSourceURL(path) {
+		return loadSource(path, *uidField, *payloadField, *compression != "")
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var records []loadRecord
+	switch *format {
+	case "csv":
+		records, err = readCSV(f, *uidField, *payloadField)
+	case "ndjson", "jsonl":
+		records, err = readNDJSON(f, *uidField, *payloadField)
+	default:
+		return fmt.Errorf("unsupported input format %q", *format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	if *compression != "" {
+		for i := range records {
+			if records[i].Payload, err = compressPayload(records[i].Payload); err != nil {
+				return fmt.Errorf("failed to compress payload of %s: %s", records[i].UID, err)
+			}
+		}
+	}
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.Upsert(records); err != nil {
+		return fmt.Errorf("failed to load records: %s", err)
+	}
+	logInfo(Fields{"loaded": len(records)}, "%d entries loaded into %s", len(records), *argDb)
+	return nil
+}
+
+func readCSV(r io.Reader, uidColumn, payloadColumn string) ([]loadRecord, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	uidIndex, ok := columns[uidColumn]
+	if !ok {
+		return nil, fmt.Errorf("no %q column", uidColumn)
+	}
+	payloadIndex := -1
+	if payloadColumn != "" {
+		if payloadIndex, ok = columns[payloadColumn]; !ok {
+			return nil, fmt.Errorf("no %q column", payloadColumn)
+		}
+	}
+
+	var records []loadRecord
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := loadRecord{UID: row[uidIndex]}
+		if payloadIndex >= 0 {
+			record.Payload = row[payloadIndex]
+		} else {
+			fields := make(map[string]string, len(row))
+			for i, value := range row {
+				if i != uidIndex {
+					fields[header[i]] = value
+				}
+			}
+			payload, err := json.Marshal(fields)
+			if err != nil {
+				return nil, err
+			}
+			record.Payload = string(payload)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func readNDJSON(r io.Reader, uidField, payloadField string) ([]loadRecord, error) {
+	var records []loadRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+		record, err := parseNDJSONLine(raw, uidField, payloadField)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func parseNDJSONLine(raw, uidField, payloadField string) (loadRecord, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return loadRecord{}, err
+	}
+	var uid string
+	if err := json.Unmarshal(fields[uidField], &uid); err != nil {
+		return loadRecord{}, fmt.Errorf("invalid %q field", uidField)
+	}
+	record := loadRecord{UID: uid, Payload: raw}
+	if payloadField != "" {
+		payload, ok := fields[payloadField]
+		if !ok {
+			return loadRecord{}, fmt.Errorf("no %q field", payloadField)
+		}
+		record.Payload = string(payload)
+	}
+	return record, nil
+}
@@ -0,0 +1,181 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Fields are extra attributes attached to a log record. They only show up in
+// JSON output, text output keeps the plain message.
+type Fields map[string]interface{}
+
+var (
+	argQuiet   = Flags.Bool("q", false, "only log errors")
+	argVerbose = Flags.Bool("v", false, "also log every entry processed, imported or skipped, left out by default")
+	argColor   = Flags.String("color", "auto", "color text logs by level: auto (on a terminal, unless NO_COLOR is set), always or never")
+)
+
+// The verbosity levels of -q and -v.
+const (
+	verbosityQuiet = iota
+	verbosityNormal
+	verbosityVerbose
+)
+
+var (
+	jsonLogs  bool
+	verbosity = verbosityNormal
+	colorLogs bool
+	logMutex  sync.Mutex
+)
+
+func setupLogging(format string) error {
+	switch format {
+	case "text":
+		jsonLogs = false
+	case "json":
+		jsonLogs = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	switch {
+	case *argQuiet && *argVerbose:
+		return errors.New("-q and -v cannot be combined")
+	case *argQuiet:
+		verbosity = verbosityQuiet
+	case *argVerbose:
+		verbosity = verbosityVerbose
+	default:
+		verbosity = verbosityNormal
+	}
+	switch *argColor {
+	case "auto":
+		colorLogs = isTerminal(os.Stderr) && os.Getenv("NO_COLOR") == ""
+	case "always":
+		colorLogs = true
+	case "never":
+		colorLogs = false
+	default:
+		return fmt.Errorf("invalid -color %q, expected auto, always or never", *argColor)
+	}
+	return nil
+}
+
+// logged tells whether records of level are written at the verbosity of the
+// run. The info records about a single entry, those with a uid field, are
+// only written with -v.
+func logged(level string, fields Fields) bool {
+	switch {
+	case level == "error" || level == "fatal":
+		return true
+	case verbosity == verbosityQuiet:
+		return false
+	case level == "info" && fields["uid"] != nil:
+		return verbosity == verbosityVerbose
+	}
+	return true
+}
+
+// levelColors are the ANSI colors of the text records by level, those of a
+// single entry being dimmed.
+var levelColors = map[string]string{
+	"error": "\x1b[31m",
+	"fatal": "\x1b[1;31m",
+	"warn":  "\x1b[33m",
+	"entry": "\x1b[2m",
+}
+
+func logEvent(level string, fields Fields, format string, args ...interface{}) {
+	if !logged(level, fields) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if !jsonLogs {
+		color := levelColors[level]
+		if level == "info" && fields["uid"] != nil {
+			color = levelColors["entry"]
+		}
+		if colorLogs && color != "" {
+			msg = color + msg + "\x1b[0m"
+		}
+		log.Print(msg)
+		return
+	}
+	record := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		record[k] = v
+	}
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	record["level"] = level
+	record["msg"] = msg
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("failed to encode log record: %s", err)
+		return
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	os.Stderr.Write(append(line, '\n'))
+}
+
+func logInfo(fields Fields, format string, args ...interface{}) {
+	logEvent("info", fields, format, args...)
+}
+
+func logWarn(fields Fields, format string, args ...interface{}) {
+	logEvent("warn", fields, format, args...)
+}
+
+func logError(fields Fields, format string, args ...interface{}) {
+	logEvent("error", fields, format, args...)
+}
+
+func logFatal(fields Fields, format string, args ...interface{}) {
+	logEvent("fatal", fields, format, args...)
+	os.Exit(1)
+}
+
+// LogInfo and LogFatal log in the -log-format of the importer, for the
+// programs using it.
+func LogInfo(format string, args ...interface{}) {
+	logInfo(nil, format, args...)
+}
+
+func LogFatal(format string, args ...interface{}) {
+	logFatal(nil, format, args...)
+}
+
+// LogExit is LogFatal exiting with status code.
+func LogExit(code int, format string, args ...interface{}) {
+	logEvent("fatal", nil, format, args...)
+	os.Exit(code)
+}
+
+func (e *Entry) fields(outcome string) Fields {
+	fields := Fields{
+		"uid":     e.UID,
+		"attempt": e.Attempts,
+		"outcome": outcome,
+	}
+	if e.Status != 0 {
+		fields["status"] = e.Status
+	}
+	if e.Attempts > 0 {
+		fields["latency_ms"] = e.ImportTime
+	}
+	if e.CorrelationID != "" {
+		fields["correlation_id"] = e.CorrelationID
+	}
+	if e.Err != nil {
+		fields["error"] = e.Err
+	}
+	return fields
+}
@@ -0,0 +1,106 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+)
+
+var (
+	argLookup       = Flags.String("lookup", "", "text/template of the API path and query looking up an existing response before sending each entry, e.g. '/responses?external_id={{urlquery .Payload.external_id}}'")
+	argLookupIDPath = Flags.String("lookup-id-path", "0.ID", "dot-separated path of the identifier of the existing response in the lookup response, numbers indexing arrays")
+	argLookupAction = Flags.String("lookup-action", "link", "what to do with entries found by -lookup: skip them, or link them to the existing response_id")
+)
+
+var lookupTemplate *template.Template
+
+// LookupError is a failure to render the lookup path of an entry.
+type LookupError struct {
+	Err error
+}
+
+func (e *LookupError) Error() string {
+	return fmt.Sprintf("failed to render lookup path: %s", e.Err)
+}
+
+func setupLookup() error {
+	if *argLookup == "" {
+		return nil
+	}
+	if *argLookupAction != "skip" && *argLookupAction != "link" {
+		return fmt.Errorf("invalid lookup action %q, expected skip or link", *argLookupAction)
+	}
+	t, err := template.New("lookup").Funcs(transformFuncs).Option("missingkey=error").Parse(*argLookup)
+	if err != nil {
+		return fmt.Errorf("invalid lookup template: %s", err)
+	}
+	lookupTemplate = t
+	return nil
+}
+
+// lookup queries the API at the path rendered by t for a response already
+// created for e, returning its identifier if found.
+func (e *Entry) lookup(ctx context.Context, t *template.Template) (string, bool, error) {
+	data := TransformData{UID: e.UID, Raw: e.Payload}
+	if err := json.Unmarshal([]byte(e.Payload), &data.Payload); err != nil {
+		return "", false, &ParseError{e.Payload}
+	}
+	var path bytes.Buffer
+	if err := t.Execute(&path, data); err != nil {
+		return "", false, &LookupError{err}
+	}
+	api, err := e.endpoint()
+	if err != nil {
+		return "", false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", api.url+path.String(), nil)
+	if err != nil {
+		return "", false, err
+	}
+	if err := api.authorize(req); err != nil {
+		return "", false, err
+	}
+	resp, _, err := api.send(req)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to look up existing response: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", false, nil
+	case resp.StatusCode != http.StatusOK:
+		return "", false, fmt.Errorf("failed to look up existing response: %w", &APIError{resp.StatusCode, string(body)})
+	}
+	id, ok, err := extractID(body, *argLookupIDPath)
+	if err != nil {
+		return "", false, &ParseError{string(body)}
+	}
+	return id, ok, nil
+}
+
+// existing finishes e, for which the API already holds the response id,
+// linking e to it if link is set.
+func (im *Importer) existing(e *Entry, id string, link bool) {
+	e.span.set("outcome", "duplicate")
+	e.span.finish(nil)
+	if link {
+		e.ResponseId = &id
+	}
+	if id == "" {
+		logInfo(e.fields("duplicate"), "entry %s already exists, skipping", e.UID)
+	} else {
+		logInfo(e.fields("duplicate"), "entry %s already exists as response %s, skipping", e.UID, id)
+	}
+	im.checkConflict(e)
+	importMetrics.entryDone("duplicate")
+	im.progress.record(e, "duplicate")
+	im.writer.markImported(e)
+	auditTrail.entry("duplicate", e)
+	payloadDeduper.finished(e, true)
+	onImport.run(e)
+}
@@ -0,0 +1,160 @@
+package importer
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/lib/pq"
+)
+
+// responseMapColumns are the columns of the response_map table, mapping the
+// uid of each imported entry to the response created for it.
+var responseMapColumns = []column{
+	{"uid", "%s NOT NULL UNIQUE"},
+	{"response_id", "TEXT NOT NULL"},
+	{"tenant", "TEXT"},
+	{"imported_at", "TEXT"},
+}
+
+// fillResponseMap fills a response_map table created by Migrate from the
+// entries imported before it existed.
+const fillResponseMap = `INSERT INTO response_map (uid, response_id, tenant, imported_at)
+SELECT uid, response_id, tenant, imported_at FROM imports WHERE imported_at IS NOT NULL AND response_id IS NOT NULL`
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// mapResponse records within tx the response of the imported entry e, if
+// it has one.
+func (s *sqlStore) mapResponse(tx *sql.Tx, e *Entry, importedAt string) error {
+	if !s.has("response_map", "") || e.operation() != operationCreate {
+		return nil
+	}
+	if _, err := tx.Exec(s.dialect.rebind("DELETE FROM response_map WHERE uid = ?"), e.UID); err != nil {
+		return err
+	}
+	if e.ResponseId == nil || *e.ResponseId == "" {
+		return nil
+	}
+	var tenant *string
+	if e.Tenant != "" {
+		tenant = &e.Tenant
+	}
+	_, err := tx.Exec(s.dialect.rebind("INSERT INTO response_map (uid, response_id, tenant, imported_at) VALUES (?, ?, ?, ?)"),
+		e.UID, *e.ResponseId, tenant, importedAt)
+	return err
+}
+
+// unmapResponse forgets the response of the entry uid, once deleted.
+func (s *sqlStore) unmapResponse(uid string) error {
+	if !s.has("response_map", "") {
+		return nil
+	}
+	_, err := s.exec("DELETE FROM response_map WHERE uid = ?", uid)
+	return err
+}
+
+// exportResponseMap replaces the rows of the table in schema of the
+// Postgres database target with those of the response_map table, in a
+// single transaction, and returns their number.
+func (s *sqlStore) exportResponseMap(target *sql.DB, schema, table string) (int, error) {
+	rows, err := s.query("SELECT uid, response_id, tenant, imported_at FROM response_map ORDER BY uid")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read response_map, run migrate first: %s", err)
+	}
+	defer rows.Close()
+
+	tx, err := target.Begin()
+	if err != nil {
+		return 0, err
+	}
+	name := pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table)
+	for _, query := range []string{
+		"CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(schema),
+		"CREATE TABLE IF NOT EXISTS " + name + " (uid TEXT PRIMARY KEY, response_id TEXT NOT NULL, tenant TEXT, imported_at TIMESTAMPTZ)",
+		"DELETE FROM " + name,
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	statement, err := tx.Prepare(pq.CopyInSchema(schema, table, "uid", "response_id", "tenant", "imported_at"))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	exported := 0
+	for rows.Next() {
+		var uid, responseID string
+		var tenant, importedAt sql.NullString
+		if err := rows.Scan(&uid, &responseID, &tenant, &importedAt); err != nil {
+			tx.Rollback()
+			return exported, err
+		}
+		if _, err := statement.Exec(uid, responseID, tenant, importedAt); err != nil {
+			tx.Rollback()
+			return exported, fmt.Errorf("uid %s: %s", uid, err)
+		}
+		exported++
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return exported, err
+	}
+	if _, err := statement.Exec(); err != nil {
+		tx.Rollback()
+		return exported, err
+	}
+	if err := statement.Close(); err != nil {
+		tx.Rollback()
+		return exported, err
+	}
+	return exported, tx.Commit()
+}
+
+func runExportMap(args []string) error {
+	fs := flag.NewFlagSet("export-map", flag.ExitOnError)
+	commonFlags(fs)
+	to := fs.String("to", "", "postgres:// URL of the database the response_map table is exported to")
+	schema := fs.String("schema", "public", "schema of the -to database the table is created in")
+	table := fs.String("table", "response_map", "name of the table in -schema")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export-map -to postgres://... [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *to == "" {
+		return errors.New("-to is required")
+	}
+	if d, _ := parseDSN(*to); d.driver != postgresDialect.driver {
+		return errors.New("-to must be a postgres:// URL")
+	}
+	if !identifier.MatchString(*schema) || !identifier.MatchString(*table) {
+		return fmt.Errorf("invalid -schema %q or -table %q", *schema, *table)
+	}
+
+	db, d, err := openDB(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	defer s.Close()
+	target, _, err := openDB(*to)
+	if err != nil {
+		return fmt.Errorf("failed to open target database: %s", err)
+	}
+	defer target.Close()
+
+	exported, err := s.exportResponseMap(target, *schema, *table)
+	if err != nil {
+		return fmt.Errorf("failed to export response map: %s", err)
+	}
+	logInfo(Fields{"exported": exported, "table": *schema + "." + *table}, "exported %d responses to %s.%s in %s", exported, *schema, *table, redactDSN(*to))
+	return nil
+}
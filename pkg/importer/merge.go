@@ -0,0 +1,308 @@
+package importer
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// mergePolicies are the -on-conflict policies of merge, choosing between the
+// rows of a uid found in several databases.
+var mergePolicies = map[string]bool{"best": true, "first": true, "last": true, "fail": true}
+
+// entryTables are the tables whose rows belong to an entry, merged from the
+// database its imports row was taken from.
+var entryTables = map[string]bool{"attachments": true, "attempts": true, "attempt_history": true, "dead_letters": true, "quarantine_reviews": true, "response_map": true, "samples": true}
+
+// sharedTables are the tables whose rows are shared by the entries, by key,
+// merged when the output lacks them.
+var sharedTables = map[string]string{"runs": "id", "errors": "hash"}
+
+// mergeCounts are the entries of an input database merged into the output.
+type mergeCounts struct {
+	db       string
+	added    int
+	replaced int
+	skipped  int
+	diverged int
+}
+
+func (c *mergeCounts) fields() Fields {
+	return Fields{"db": c.db, "added": c.added, "replaced": c.replaced, "skipped": c.skipped, "diverged": c.diverged}
+}
+
+// entryRank orders the states of an entry for the best policy: imported,
+// then errored, then pending.
+func entryRank(importedAt, errMsg sql.NullString) int {
+	switch {
+	case importedAt.Valid:
+		return 2
+	case errMsg.Valid:
+		return 1
+	}
+	return 0
+}
+
+// tableColumns returns the columns of table name that s has, out of all.
+func tableColumns(s *sqlStore, name string, all []column) []string {
+	var names []string
+	for _, c := range all {
+		if s.has(name, c.name) {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+func scanValues(rows *sql.Rows, n int) ([]interface{}, error) {
+	values := make([]interface{}, n)
+	pointers := make([]interface{}, n)
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	return values, rows.Scan(pointers...)
+}
+
+func insertRow(tx *sql.Tx, d dialect, table string, names []string, values []interface{}) error {
+	_, err := tx.Exec(d.rebind("INSERT INTO "+table+" ("+strings.Join(names, ", ")+") VALUES ("+placeholders(len(names))+")"), values...)
+	return err
+}
+
+// mergeInto merges the entries of in into the transaction tx of out, the
+// rows of a uid they both have being chosen by policy.
+func mergeInto(tx *sql.Tx, out, in *sqlStore, policy string, counts *mergeCounts) error {
+	names := tableColumns(in, "imports", columns)
+	rows, err := in.query("SELECT " + strings.Join(names, ", ") + " FROM imports ORDER BY uid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	index := make(map[string]int, len(names))
+	for i, name := range names {
+		index[name] = i
+	}
+	taken := map[string]bool{}
+	for rows.Next() {
+		values, err := scanValues(rows, len(names))
+		if err != nil {
+			return err
+		}
+		uid := asString(values[index["uid"]])
+		var importedAt, errMsg, responseID sql.NullString
+		err = tx.QueryRow(out.dialect.rebind("SELECT imported_at, error, response_id FROM imports WHERE uid = ?"), uid).Scan(&importedAt, &errMsg, &responseID)
+		switch {
+		case err == sql.ErrNoRows:
+			counts.added++
+		case err != nil:
+			return err
+		default:
+			incomingImported, incomingError, incomingResponse := nullValue(values, index, "imported_at"), nullValue(values, index, "error"), nullValue(values, index, "response_id")
+			if importedAt.Valid && incomingImported.Valid && responseID.String != incomingResponse.String {
+				counts.diverged++
+				logError(Fields{"uid": uid, "db": counts.db, "response_id": incomingResponse.String, "other_response_id": responseID.String},
+					"entry %s was imported in several databases, as %s and %s", uid, responseID.String, incomingResponse.String)
+			}
+			replace := false
+			switch policy {
+			case "fail":
+				return fmt.Errorf("entry %s of %s is already in the output", uid, counts.db)
+			case "last":
+				replace = true
+			case "best":
+				replace = entryRank(incomingImported, incomingError) > entryRank(importedAt, errMsg)
+			}
+			if !replace {
+				counts.skipped++
+				continue
+			}
+			counts.replaced++
+			for _, t := range append([]table{{name: "imports"}}, tables...) {
+				if t.name != "imports" && !entryTables[t.name] || !out.has(t.name, "") {
+					continue
+				}
+				if _, err := tx.Exec(out.dialect.rebind("DELETE FROM "+t.name+" WHERE uid = ?"), uid); err != nil {
+					return err
+				}
+			}
+		}
+		if err := insertRow(tx, out.dialect, "imports", names, values); err != nil {
+			return fmt.Errorf("failed to insert entry %s: %s", uid, err)
+		}
+		taken[uid] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, t := range tables {
+		if !in.has(t.name, "") || !out.has(t.name, "") {
+			continue
+		}
+		key, shared := sharedTables[t.name]
+		if !shared && !entryTables[t.name] {
+			continue
+		}
+		if err := mergeTable(tx, out, in, t, key, taken); err != nil {
+			return fmt.Errorf("failed to merge table %s: %s", t.name, err)
+		}
+	}
+	return nil
+}
+
+// mergeTable copies the rows of table t of in to out: those of the entries
+// taken from in, or those whose key out lacks if key is not empty.
+func mergeTable(tx *sql.Tx, out, in *sqlStore, t table, key string, taken map[string]bool) error {
+	names := tableColumns(in, t.name, t.columns)
+	column := key
+	if column == "" {
+		column = "uid"
+	}
+	rows, err := in.query("SELECT " + strings.Join(names, ", ") + " FROM " + t.name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var position int
+	for i, name := range names {
+		if name == column {
+			position = i
+		}
+	}
+	for rows.Next() {
+		values, err := scanValues(rows, len(names))
+		if err != nil {
+			return err
+		}
+		value := asString(values[position])
+		if key == "" {
+			if !taken[value] {
+				continue
+			}
+		} else {
+			var n int
+			if err := tx.QueryRow(out.dialect.rebind("SELECT COUNT(*) FROM "+t.name+" WHERE "+key+" = ?"), value).Scan(&n); err != nil {
+				return err
+			}
+			if n > 0 {
+				continue
+			}
+		}
+		if err := insertRow(tx, out.dialect, t.name, names, values); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func asString(value interface{}) string {
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func nullValue(values []interface{}, index map[string]int, name string) sql.NullString {
+	i, ok := index[name]
+	if !ok || values[i] == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: asString(values[i]), Valid: true}
+}
+
+// sameDatabase tells whether two DSNs name the same SQLite file.
+func sameDatabase(a, b string) bool {
+	if a == b {
+		return true
+	}
+	da, sa := parseDSN(a)
+	db, sb := parseDSN(b)
+	if da.driver != "sqlite3" || db.driver != "sqlite3" {
+		return false
+	}
+	pa, errA := filepath.Abs(strings.SplitN(sa, "?", 2)[0])
+	pb, errB := filepath.Abs(strings.SplitN(sb, "?", 2)[0])
+	return errA == nil && errB == nil && pa == pb
+}
+
+func runMerge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	inheritFlags(fs, "log-format", "config")
+	policy := fs.String("on-conflict", "best", "how to merge a uid found in several databases: best (imported, then errored, then pending, the first one on a tie), first, last or fail")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s merge [flags] out.db a.db b.db...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("an output database and at least one input database are needed")
+	}
+	if !mergePolicies[*policy] {
+		return fmt.Errorf("unknown -on-conflict %q, expected best, first, last or fail", *policy)
+	}
+	outDSN, inputs := fs.Arg(0), fs.Args()[1:]
+	for _, dsn := range inputs {
+		if sameDatabase(dsn, outDSN) {
+			return fmt.Errorf("the output database %s cannot be one of the inputs", redactDSN(outDSN))
+		}
+	}
+
+	store, err := openStore(outDSN)
+	if err != nil {
+		return fmt.Errorf("failed to open database %s: %s", redactDSN(outDSN), err)
+	}
+	defer store.Close()
+	out := schemaStore(store)
+	if err := out.InitSchema(); err != nil {
+		return fmt.Errorf("failed to create tables: %s", err)
+	}
+	if _, err := out.Migrate(); err != nil {
+		return fmt.Errorf("failed to migrate database %s: %s", redactDSN(outDSN), err)
+	}
+	out.detectSchema()
+
+	tx, err := out.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var results []*mergeCounts
+	for _, dsn := range inputs {
+		in, err := openStore(dsn)
+		if err != nil {
+			return fmt.Errorf("failed to open database %s: %s", redactDSN(dsn), err)
+		}
+		counts := &mergeCounts{db: redactDSN(dsn)}
+		err = mergeInto(tx, out, schemaStore(in), *policy, counts)
+		in.Close()
+		if err != nil {
+			return fmt.Errorf("failed to merge %s: %s", counts.db, err)
+		}
+		logInfo(counts.fields(), "merged %s: %d entries added, %d replaced, %d skipped", counts.db, counts.added, counts.replaced, counts.skipped)
+		results = append(results, counts)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit merge: %s", err)
+	}
+
+	if jsonLogs {
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATABASE\tADDED\tREPLACED\tSKIPPED\tDIVERGED")
+	for _, c := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", c.db, c.added, c.replaced, c.skipped, c.diverged)
+	}
+	return w.Flush()
+}
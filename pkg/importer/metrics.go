@@ -0,0 +1,133 @@
+package importer
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metrics holds the counters published in the Prometheus text format.
+type metrics struct {
+	mu           sync.Mutex
+	outcomes     map[string]int64
+	statuses     map[string]int64
+	inFlight     int64
+	queueDepth   int64
+	bucketCounts []int64
+	latencySum   float64
+	latencyCount int64
+}
+
+var importMetrics = newMetrics()
+
+func newMetrics() *metrics {
+	return &metrics{
+		outcomes:     make(map[string]int64),
+		statuses:     make(map[string]int64),
+		bucketCounts: make([]int64, len(latencyBuckets)),
+	}
+}
+
+func (m *metrics) setQueueDepth(n int) {
+	m.mu.Lock()
+	m.queueDepth = int64(n)
+	m.mu.Unlock()
+}
+
+func (m *metrics) requestStarted() {
+	m.mu.Lock()
+	m.inFlight++
+	m.mu.Unlock()
+}
+
+// requestDone records a finished request. A zero status denotes a request
+// that did not get an HTTP response.
+func (m *metrics) requestDone(status int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	label := "none"
+	if status != 0 {
+		label = strconv.Itoa(status)
+	}
+	m.statuses[label]++
+	seconds := latency.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			m.bucketCounts[i]++
+		}
+	}
+	m.latencySum += seconds
+	m.latencyCount++
+}
+
+func (m *metrics) entryDone(outcome string) {
+	m.mu.Lock()
+	m.outcomes[outcome]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP gaia_importer_entries_processed_total Entries processed, by outcome.")
+	fmt.Fprintln(w, "# TYPE gaia_importer_entries_processed_total counter")
+	for _, outcome := range sortedKeys(m.outcomes) {
+		fmt.Fprintf(w, "gaia_importer_entries_processed_total{outcome=%q} %d\n", outcome, m.outcomes[outcome])
+	}
+	fmt.Fprintln(w, "# HELP gaia_importer_requests_total API requests, by HTTP status (none when no response was received).")
+	fmt.Fprintln(w, "# TYPE gaia_importer_requests_total counter")
+	for _, status := range sortedKeys(m.statuses) {
+		fmt.Fprintf(w, "gaia_importer_requests_total{status=%q} %d\n", status, m.statuses[status])
+	}
+	fmt.Fprintln(w, "# HELP gaia_importer_requests_in_flight API requests currently in flight.")
+	fmt.Fprintln(w, "# TYPE gaia_importer_requests_in_flight gauge")
+	fmt.Fprintf(w, "gaia_importer_requests_in_flight %d\n", m.inFlight)
+	fmt.Fprintln(w, "# HELP gaia_importer_queue_depth Entries waiting to be scheduled.")
+	fmt.Fprintln(w, "# TYPE gaia_importer_queue_depth gauge")
+	fmt.Fprintf(w, "gaia_importer_queue_depth %d\n", m.queueDepth)
+	fmt.Fprintln(w, "# HELP gaia_importer_request_duration_seconds API request latency.")
+	fmt.Fprintln(w, "# TYPE gaia_importer_request_duration_seconds histogram")
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "gaia_importer_request_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.bucketCounts[i])
+	}
+	fmt.Fprintf(w, "gaia_importer_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyCount)
+	fmt.Fprintf(w, "gaia_importer_request_duration_seconds_sum %g\n", m.latencySum)
+	fmt.Fprintf(w, "gaia_importer_request_duration_seconds_count %d\n", m.latencyCount)
+	writeStageMetrics(w)
+	writeSlowMetrics(w)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsServer serves the metrics once per process, the Importers of the
+// databases of a run sharing them.
+var metricsServer sync.Once
+
+func serveMetrics(addr string) {
+	metricsServer.Do(func() { startMetrics(addr) })
+}
+
+func startMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", importMetrics)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logError(Fields{"error": err}, "metrics server stopped: %s", err)
+		}
+	}()
+}
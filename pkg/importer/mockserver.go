@@ -0,0 +1,236 @@
+package importer
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mockServer emulates the responses endpoints of Gaia: payloads POSTed to any
+// path are stored under a new identifier, sent back in the response body,
+// and can then be read and deleted at that path followed by the identifier.
+type mockServer struct {
+	latency        time.Duration
+	jitter         time.Duration
+	errorRate      float64
+	errorStatus    int
+	errorBody      string
+	throttleRate   float64
+	retryAfter     int
+	responseStatus int
+	responseBody   string
+	token          string
+
+	mu        sync.Mutex
+	rand      *rand.Rand
+	responses map[string]string
+}
+
+// outcome draws the status of a request: an error, a throttling or success.
+func (m *mockServer) outcome() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch draw := m.rand.Float64(); {
+	case draw < m.errorRate:
+		return m.errorStatus
+	case draw < m.errorRate+m.throttleRate:
+		return http.StatusTooManyRequests
+	}
+	return m.responseStatus
+}
+
+func (m *mockServer) delay() {
+	delay := m.latency
+	if m.jitter > 0 {
+		m.mu.Lock()
+		delay += time.Duration(m.rand.Int63n(int64(m.jitter)))
+		m.mu.Unlock()
+	}
+	time.Sleep(delay)
+}
+
+// create stores payload and returns the response body of its creation.
+func (m *mockServer) create(path string, payload []byte) (string, error) {
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	m.responses[strings.TrimSuffix(path, "/")+"/"+id] = string(payload)
+	m.mu.Unlock()
+	return strings.Replace(m.responseBody, "{id}", id, -1), nil
+}
+
+func (m *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := m.serve(w, r)
+	logInfo(Fields{"method": r.Method, "path": r.URL.Path, "status": status, "latency_ms": time.Since(start).Milliseconds()},
+		"%s %s %d (%s)", r.Method, r.URL.Path, status, time.Since(start).Round(time.Millisecond))
+}
+
+func (m *mockServer) serve(w http.ResponseWriter, r *http.Request) int {
+	m.delay()
+	if m.token != "" && r.Header.Get("Authorization") != "Bearer "+m.token {
+		return m.reply(w, http.StatusUnauthorized, `{"error":"invalid token"}`)
+	}
+	if r.URL.Path == "/" {
+		return m.reply(w, http.StatusOK, "")
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		m.mu.Lock()
+		payload, ok := m.responses[r.URL.Path]
+		if ok && r.Method == http.MethodDelete {
+			delete(m.responses, r.URL.Path)
+		}
+		m.mu.Unlock()
+		switch {
+		case !ok:
+			return m.reply(w, http.StatusNotFound, `{"error":"not found"}`)
+		case r.Method == http.MethodDelete:
+			return m.reply(w, http.StatusNoContent, "")
+		}
+		return m.reply(w, http.StatusOK, payload)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return m.reply(w, http.StatusBadRequest, `{"error":"unreadable body"}`)
+	}
+	if strings.HasSuffix(r.URL.Path, "/batch") {
+		return m.serveBatch(w, strings.TrimSuffix(r.URL.Path, "/batch"), body)
+	}
+	if !json.Valid(body) {
+		return m.reply(w, http.StatusBadRequest, `{"error":"invalid JSON"}`)
+	}
+	switch status := m.outcome(); {
+	case status == m.responseStatus && (r.Method == http.MethodPut || r.Method == http.MethodPatch):
+		payload, ok := m.update(r.URL.Path, body, r.Method == http.MethodPatch)
+		if !ok {
+			return m.reply(w, http.StatusNotFound, `{"error":"not found"}`)
+		}
+		return m.reply(w, http.StatusOK, payload)
+	case status == m.responseStatus:
+		response, err := m.create(r.URL.Path, body)
+		if err != nil {
+			return m.reply(w, http.StatusInternalServerError, `{"error":"failed to create identifier"}`)
+		}
+		return m.reply(w, status, response)
+	case status == http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", strconv.Itoa(m.retryAfter))
+		return m.reply(w, status, `{"error":"too many requests"}`)
+	default:
+		return m.reply(w, status, m.errorBody)
+	}
+}
+
+// update replaces the payload stored at path by payload or, if merge, sets
+// its fields in it, and returns the result, or false if there is none.
+func (m *mockServer) update(path string, payload []byte, merge bool) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.responses[path]
+	if !ok {
+		return "", false
+	}
+	fields := map[string]json.RawMessage{}
+	if merge && json.Unmarshal([]byte(stored), &fields) == nil && json.Unmarshal(payload, &fields) == nil {
+		if merged, err := json.Marshal(fields); err == nil {
+			payload = merged
+		}
+	}
+	m.responses[path] = string(payload)
+	return string(payload), true
+}
+
+// serveBatch answers a batch request with a 207 holding the result of each
+// payload, each drawing its own outcome.
+func (m *mockServer) serveBatch(w http.ResponseWriter, path string, body []byte) int {
+	var payloads []json.RawMessage
+	if err := json.Unmarshal(body, &payloads); err != nil {
+		return m.reply(w, http.StatusBadRequest, `{"error":"invalid JSON array"}`)
+	}
+	results := make([]map[string]interface{}, len(payloads))
+	for i, payload := range payloads {
+		result := map[string]interface{}{"status": m.outcome()}
+		switch result["status"] {
+		case m.responseStatus:
+			response, err := m.create(path, payload)
+			if err != nil {
+				return m.reply(w, http.StatusInternalServerError, `{"error":"failed to create identifier"}`)
+			}
+			if err := json.Unmarshal([]byte(response), &result); err != nil {
+				return m.reply(w, http.StatusInternalServerError, `{"error":"-response-body is not a JSON object"}`)
+			}
+			result["status"] = m.responseStatus
+		default:
+			result["error"] = json.RawMessage(m.errorBody)
+		}
+		results[i] = result
+	}
+	content, err := json.Marshal(results)
+	if err != nil {
+		return m.reply(w, http.StatusInternalServerError, `{"error":"failed to encode results"}`)
+	}
+	return m.reply(w, http.StatusMultiStatus, string(content))
+}
+
+func (m *mockServer) reply(w http.ResponseWriter, status int, body string) int {
+	if body != "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+	return status
+}
+
+func runMockServer(args []string) error {
+	fs := flag.NewFlagSet("mockserver", flag.ExitOnError)
+	inheritFlags(fs, "log-format", "config")
+	port := fs.Int("port", 8081, "port to listen on")
+	m := &mockServer{}
+	fs.DurationVar(&m.latency, "latency", 0, "time taken to answer each request")
+	fs.DurationVar(&m.jitter, "jitter", 0, "maximum random time added to -latency")
+	fs.Float64Var(&m.errorRate, "error-rate", 0, "`ratio` of payloads answered with -error-status")
+	fs.IntVar(&m.errorStatus, "error-status", http.StatusInternalServerError, "HTTP status of the errors")
+	fs.StringVar(&m.errorBody, "error-body", `{"error":"mock error"}`, "JSON body of the errors")
+	fs.Float64Var(&m.throttleRate, "throttle-rate", 0, "`ratio` of payloads answered with 429 Too Many Requests")
+	fs.IntVar(&m.retryAfter, "retry-after", 1, "Retry-After `seconds` of the 429 responses")
+	fs.IntVar(&m.responseStatus, "response-status", http.StatusCreated, "HTTP status of the payloads created")
+	fs.StringVar(&m.responseBody, "response-body", `{"ID":"{id}"}`, "JSON body answered for the payloads created, {id} being replaced by their new identifier")
+	fs.StringVar(&m.token, "token", "", "bearer token requests must hold, any if empty")
+	seed := fs.Int64("seed", 0, "seed of the random outcomes (0 for a random one)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s mockserver [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if m.errorRate < 0 || m.throttleRate < 0 || m.errorRate+m.throttleRate > 1 {
+		return fmt.Errorf("-error-rate and -throttle-rate must be between 0 and 1 together")
+	}
+	if !json.Valid([]byte(m.errorBody)) {
+		return fmt.Errorf("-error-body is not valid JSON")
+	}
+	if !json.Valid([]byte(strings.Replace(m.responseBody, "{id}", "id", -1))) {
+		return fmt.Errorf("-response-body is not valid JSON")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	m.rand = rand.New(rand.NewSource(*seed))
+	m.responses = make(map[string]string)
+
+	addr := fmt.Sprintf(":%d", *port)
+	logInfo(Fields{"addr": addr}, "mock Gaia API listening on %s", addr)
+	return http.ListenAndServe(addr, m)
+}
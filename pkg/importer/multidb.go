@@ -0,0 +1,337 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// databaseFlag is the -db flag: the last value is *argDb, as for the other
+// commands, and the import command imports all of them.
+type databaseFlag struct{}
+
+func (databaseFlag) String() string {
+	if argDb == nil {
+		return ""
+	}
+	return *argDb
+}
+
+func (databaseFlag) Set(value string) error {
+	argDatabases = append(argDatabases, value)
+	*argDb = value
+	return nil
+}
+
+func (databaseFlag) reset() {
+	argDatabases = nil
+	*argDb = defaultDatabase
+}
+
+const defaultDatabase = "./import.db"
+
+var (
+	argDb = new(string)
+	// argDatabases are the -db values.
+	argDatabases []string
+)
+
+func init() {
+	*argDb = defaultDatabase
+	Flags.Var(databaseFlag{}, "db", dbUsage+"; repeated or given a glob such as exports/*.db, the import command imports each database in turn in one run")
+}
+
+// importDatabases returns the databases given to -db, their globs expanded,
+// in order and once each. DSNs are never expanded.
+func importDatabases() ([]string, error) {
+	values := argDatabases
+	if len(values) == 0 {
+		values = []string{*argDb}
+	}
+	var databases []string
+	seen := map[string]bool{}
+	for _, value := range values {
+		matches := []string{value}
+		if !strings.Contains(value, "://") && !strings.HasPrefix(value, "file:") && strings.ContainsAny(value, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(value); err != nil {
+				return nil, fmt.Errorf("invalid -db glob %q: %s", value, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no database matches -db %s", value)
+			}
+		}
+		for _, db := range matches {
+			if !seen[db] {
+				seen[db] = true
+				databases = append(databases, db)
+			}
+		}
+	}
+	return databases, nil
+}
+
+func checkDatabasesFlags() error {
+	for name, set := range map[string]bool{
+		"-watch":         *argWatch,
+		"-pipe":          *argPipe,
+		"-kafka-brokers": *argKafkaBrokers != "",
+		"-checkpoint":    *argCheckpoint != "",
+		"-report":        *argReport != "",
+		"-stats":         *argStats != "",
+		"-record-api":    *argRecordAPI != "",
+		"-plan":          *argPlan != "",
+		"-execute":       *argExecute != "",
+	} {
+		if set {
+			return fmt.Errorf("%s cannot be used with several databases", name)
+		}
+	}
+	return nil
+}
+
+// databaseRun is the outcome of the import of one of several databases.
+type databaseRun struct {
+	db      string
+	started bool
+	summary Fields
+	result  RunSummary
+	err     error
+	code    int
+}
+
+// multiRun imports several databases in turn, each with its own Importer, a
+// database failing to open or to import not stopping the others.
+type multiRun struct {
+	config  config
+	mu      sync.Mutex
+	current *Importer
+	paused  bool
+	runs    []databaseRun
+}
+
+func newMultiRun(databases []string, c config) (*multiRun, error) {
+	if err := checkDatabasesFlags(); err != nil {
+		return nil, err
+	}
+	m := &multiRun{config: c, runs: make([]databaseRun, len(databases))}
+	for i, db := range databases {
+		m.runs[i].db = db
+	}
+	logInfo(Fields{"databases": len(databases)}, "importing %d databases", len(databases))
+	return m, nil
+}
+
+// run imports each database in turn until ctx is done.
+func (m *multiRun) run(ctx context.Context) error {
+	started := time.Now()
+	for i := range m.runs {
+		r := &m.runs[i]
+		if ctx.Err() != nil {
+			break
+		}
+		logInfo(Fields{"db": r.db, "database": i + 1, "databases": len(m.runs)}, "importing database %d of %d: %s", i+1, len(m.runs), r.db)
+		r.started = true
+		c := m.config
+		c.databases = []string{r.db}
+		im, err := newImporter(c)
+		if err != nil {
+			logError(Fields{"db": r.db, "error": err}, "failed to set up the import of %s: %s", r.db, err)
+			r.err, r.code = err, ExitConfig
+			r.result = RunSummary{DB: r.db, Outcome: exitOutcome(ExitConfig), ExitStatus: ExitConfig, Error: err.Error()}
+			continue
+		}
+		im.summaryPath = ""
+		m.mu.Lock()
+		m.current = im
+		if m.paused {
+			im.Pause()
+		}
+		m.mu.Unlock()
+		err = im.Run(ctx)
+		m.mu.Lock()
+		m.current = nil
+		m.mu.Unlock()
+		r.err, r.code, r.summary = err, im.ExitCode(err), im.Summary()
+		r.result = im.runSummary(im.progress.start, err)
+		im.Close()
+		if r.failed() {
+			logError(Fields{"db": r.db, "error": err}, "import of %s failed: %s", r.db, err)
+		}
+	}
+	m.printSummary()
+	failed := 0
+	for _, r := range m.runs {
+		if r.failed() {
+			failed++
+		}
+	}
+	var err error
+	switch {
+	case failed > 0:
+		err = fmt.Errorf("%d of %d databases failed", failed, len(m.runs))
+	case m.exitCode() == ExitErrors && *argDryRun:
+		err = ErrInvalidEntries
+	}
+	if *argSummaryJSON != "" {
+		if err := writeJSONFile(*argSummaryJSON, m.runSummary(started, err)); err != nil {
+			logError(Fields{"error": err}, "failed to write summary: %s", err)
+		}
+	}
+	return err
+}
+
+// runSummary returns the summary of the import of all the databases, with
+// that of each one under databases.
+func (m *multiRun) runSummary(started time.Time, err error) RunSummary {
+	code := m.exitCode()
+	s := RunSummary{
+		StartedAt:  started.UTC().Format(time.RFC3339),
+		FinishedAt: time.Now().UTC().Format(time.RFC3339),
+		DurationMS: time.Since(started).Milliseconds(),
+		Outcome:    exitOutcome(code),
+		ExitStatus: code,
+		Errors:     map[string]int{},
+		ErrorClass: map[string]int{},
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	for _, r := range m.runs {
+		d := r.result
+		if !r.started {
+			d = RunSummary{DB: r.db, Outcome: "not started"}
+		}
+		s.add(d)
+	}
+	return s
+}
+
+// pause pauses, or resumes, the import of the current database and of the
+// next ones.
+func (m *multiRun) pause(paused bool) {
+	m.mu.Lock()
+	m.paused = paused
+	m.mu.Unlock()
+	m.do(func(im *Importer) {
+		if paused {
+			im.Pause()
+		} else {
+			im.Resume()
+		}
+	})
+}
+
+// do calls f with the Importer of the database being imported, if any.
+func (m *multiRun) do(f func(im *Importer)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current != nil {
+		f(m.current)
+	}
+}
+
+// failed reports whether the import of r failed, rather than being stopped
+// or finding errored entries.
+func (r *databaseRun) failed() bool {
+	var stopped *RunStoppedError
+	return r.err != nil && r.err != ErrInvalidEntries && !errors.As(r.err, &stopped)
+}
+
+// exitCode is ExitFailed if the import of a database failed, otherwise
+// ExitAborted if one was stopped, ExitInterrupted if a stop signal left
+// entries or databases to import, ExitErrors if one had errored entries, and
+// ExitOK.
+func (m *multiRun) exitCode() int {
+	code := ExitOK
+	for _, r := range m.runs {
+		switch {
+		case r.failed():
+			return ExitFailed
+		case r.code == ExitAborted:
+			code = ExitAborted
+		case (r.code == ExitInterrupted || !r.started) && code != ExitAborted:
+			code = ExitInterrupted
+		case r.code == ExitErrors && code == ExitOK:
+			code = ExitErrors
+		}
+	}
+	return code
+}
+
+// summaryOutcomes are the counts of the summary of each database.
+var summaryOutcomes = []string{"imported", "errored", "duplicate", "skipped", "blocked", "quarantined", "remaining"}
+
+// summary returns the counts of the entries of all the databases, by
+// outcome.
+func (m *multiRun) summary() Fields {
+	totals := Fields{}
+	for _, o := range summaryOutcomes {
+		n := 0
+		for _, r := range m.runs {
+			n += summaryCount(r.summary, o)
+		}
+		totals[o] = n
+	}
+	return totals
+}
+
+func summaryCount(summary Fields, outcome string) int {
+	n, _ := summary[outcome].(int)
+	return n
+}
+
+// printSummary prints the outcome of the import of each database, and their
+// totals.
+func (m *multiRun) printSummary() {
+	failed, notStarted := 0, 0
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nDATABASE\tIMPORTED\tERRORED\tDUPLICATE\tSKIPPED\tBLOCKED\tQUARANTINED\tREMAINING\tOUTCOME")
+	for _, r := range m.runs {
+		outcome := "ok"
+		switch {
+		case !r.started:
+			outcome = "not started"
+			notStarted++
+		case r.failed():
+			outcome = "failed: " + truncate(r.err.Error(), 80)
+			failed++
+		case r.code == ExitAborted:
+			outcome = "stopped: " + truncate(r.err.Error(), 80)
+		case r.code == ExitInterrupted:
+			outcome = "interrupted"
+		case r.code == ExitErrors:
+			outcome = "errors"
+		}
+		fields := Fields{"db": r.db, "outcome": outcome}
+		row := r.db
+		for _, o := range summaryOutcomes {
+			n := summaryCount(r.summary, o)
+			fields[o] = n
+			row += fmt.Sprintf("\t%d", n)
+		}
+		if jsonLogs {
+			logInfo(fields, "database %s: %s", r.db, outcome)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\n", row, outcome)
+	}
+	fields := m.summary()
+	row := "total"
+	for _, o := range summaryOutcomes {
+		row += fmt.Sprintf("\t%d", fields[o])
+	}
+	fields["databases"], fields["failed"], fields["not_started"] = len(m.runs), failed, notStarted
+	if jsonLogs {
+		logInfo(fields, "%d databases imported, %d failed", len(m.runs)-failed-notStarted, failed)
+		return
+	}
+	fmt.Fprintf(w, "%s\t%d of %d databases failed\n", row, failed, len(m.runs))
+	w.Flush()
+}
@@ -0,0 +1,219 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// normalizeNumberList is a repeatable flag of the payload paths whose
+// locale-formatted numbers are converted to JSON numbers.
+type normalizeNumberList []string
+
+func (n *normalizeNumberList) String() string {
+	return strings.Join(*n, ", ")
+}
+
+func (n *normalizeNumberList) Set(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("invalid number path %q", value)
+	}
+	*n = append(*n, value)
+	return nil
+}
+
+func (n *normalizeNumberList) reset() {
+	*n = nil
+}
+
+// normalizeDateList is a repeatable flag of "path=layout" payload dates
+// converted to RFC 3339.
+type normalizeDateList []normalizeDate
+
+// normalizeDate is a payload date, at a dot-separated path, in a Go layout.
+type normalizeDate struct {
+	path   string
+	layout string
+}
+
+func (n *normalizeDateList) String() string {
+	dates := make([]string, len(*n))
+	for i, d := range *n {
+		dates[i] = d.path + "=" + d.layout
+	}
+	return strings.Join(dates, ", ")
+}
+
+func (n *normalizeDateList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid date %q, expected path=layout", value)
+	}
+	*n = append(*n, normalizeDate{parts[0], parts[1]})
+	return nil
+}
+
+func (n *normalizeDateList) reset() {
+	*n = nil
+}
+
+var (
+	argNormalizeNumbers normalizeNumberList
+	argNormalizeDates   normalizeDateList
+	argDecimalSeparator = Flags.String("decimal-separator", ",", "decimal separator of the -normalize-number numbers, . or , the other one, spaces and apostrophes being read as thousands separators")
+)
+
+func init() {
+	Flags.Var(&argNormalizeNumbers, "normalize-number", "dot-separated `path` of a payload field holding numbers formatted for a locale, e.g. \"4,5\" or \"1 234,5\", sent as JSON numbers, * matching every element of an array, repeatable")
+	Flags.Var(&argNormalizeDates, "normalize-date", "`path=layout` payload field holding dates in this Go layout, e.g. answered_at=02/01/2006 15:04, sent as RFC 3339 in UTC, or 2006-01-02 for layouts without time, * matching every element of an array, repeatable")
+}
+
+func checkNormalizeFlags() error {
+	if *argDecimalSeparator != "," && *argDecimalSeparator != "." {
+		return fmt.Errorf("invalid -decimal-separator %q, expected , or .", *argDecimalSeparator)
+	}
+	return nil
+}
+
+// NormalizeError is a payload field that could not be normalized.
+type NormalizeError struct {
+	Path  string
+	Value string
+	Err   error
+}
+
+func (e *NormalizeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("failed to normalize payload: %s", e.Err)
+	}
+	return fmt.Sprintf("failed to normalize %q at %s: %s", e.Value, e.Path, e.Err)
+}
+
+// normalize replaces the in-memory payload of e by its copy with the
+// -normalize-number and -normalize-date fields converted. Missing fields and
+// values that are not strings are left as they are.
+func (e *Entry) normalize() error {
+	if len(argNormalizeNumbers) == 0 && len(argNormalizeDates) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(e.Payload))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return &NormalizeError{Err: fmt.Errorf("payload is not valid JSON: %s", err)}
+	}
+	changed := 0
+	for _, path := range argNormalizeNumbers {
+		n, err := normalizeAt(&doc, strings.Split(path, "."), path, parseLocaleNumber)
+		if err != nil {
+			return err
+		}
+		changed += n
+	}
+	for _, d := range argNormalizeDates {
+		layout := d.layout
+		n, err := normalizeAt(&doc, strings.Split(d.path, "."), d.path, func(value string) (interface{}, error) {
+			return parseLocaleDate(value, layout)
+		})
+		if err != nil {
+			return err
+		}
+		changed += n
+	}
+	if changed == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return &NormalizeError{Err: err}
+	}
+	e.Payload = strings.TrimSuffix(b.String(), "\n")
+	return nil
+}
+
+// normalizeAt converts the strings at keys under node with convert, a key of
+// * matching every element of an array or object, and returns how many it
+// converted.
+func normalizeAt(node *interface{}, keys []string, path string, convert func(string) (interface{}, error)) (int, error) {
+	if len(keys) == 0 {
+		value, ok := (*node).(string)
+		if !ok || strings.TrimSpace(value) == "" {
+			return 0, nil
+		}
+		converted, err := convert(value)
+		if err != nil {
+			return 0, &NormalizeError{path, value, err}
+		}
+		*node = converted
+		return 1, nil
+	}
+	key, total := keys[0], 0
+	switch n := (*node).(type) {
+	case map[string]interface{}:
+		for k, child := range n {
+			if key != "*" && k != key {
+				continue
+			}
+			count, err := normalizeAt(&child, keys[1:], path, convert)
+			if err != nil {
+				return 0, err
+			}
+			n[k] = child
+			total += count
+		}
+	case []interface{}:
+		for i := range n {
+			if key != "*" && strconv.Itoa(i) != key {
+				continue
+			}
+			count, err := normalizeAt(&n[i], keys[1:], path, convert)
+			if err != nil {
+				return 0, err
+			}
+			total += count
+		}
+	}
+	return total, nil
+}
+
+// parseLocaleNumber returns value, a number written with -decimal-separator
+// and optional thousands separators, as a JSON number.
+func parseLocaleNumber(value string) (interface{}, error) {
+	decimal, thousands := *argDecimalSeparator, "."
+	if decimal == "." {
+		thousands = ","
+	}
+	s := strings.TrimSpace(value)
+	for _, sep := range []string{" ", "\u00a0", "\u202f", "'", "\u2019", thousands} {
+		s = strings.ReplaceAll(s, sep, "")
+	}
+	if strings.Count(s, decimal) > 1 {
+		return nil, fmt.Errorf("more than one decimal separator %q", decimal)
+	}
+	s = strings.Replace(s, decimal, ".", 1)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("not a number with decimal separator %q", decimal)
+	}
+	return json.Number(strconv.FormatFloat(f, 'f', -1, 64)), nil
+}
+
+// parseLocaleDate returns value, a date in layout read in the local time zone
+// unless it has one, as RFC 3339 in UTC, or as 2006-01-02 if layout has no
+// time.
+func parseLocaleDate(value, layout string) (interface{}, error) {
+	t, err := time.ParseInLocation(layout, strings.TrimSpace(value), time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("does not match layout %q", layout)
+	}
+	if !strings.Contains(layout, "04") && !strings.Contains(layout, "15") && !strings.Contains(layout, "03") {
+		return t.Format("2006-01-02"), nil
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
@@ -0,0 +1,99 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	argNotifyURL        = Flags.String("notify-url", "", "webhook `URL` receiving a JSON summary when the run finishes")
+	argNotifySlack      = Flags.String("notify-slack", "", "Slack incoming webhook `URL` notified when the run finishes")
+	argNotifyErrorRate  = Flags.Float64("notify-error-rate", 0, "also notify during the run when the `ratio` of errored entries exceeds this value (0 disables)")
+	argNotifyMinEntries = Flags.Int("notify-min-entries", 50, "number of processed entries before the error rate is checked")
+)
+
+// notifier posts run notifications to the configured webhooks.
+type notifier struct {
+	client   *http.Client
+	instance string
+	alerted  sync.Once
+	pending  sync.WaitGroup
+}
+
+var runNotifier *notifier
+
+func setupNotifier(instance string) {
+	if *argNotifyURL == "" && *argNotifySlack == "" {
+		return
+	}
+	runNotifier = &notifier{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		instance: instance,
+	}
+}
+
+// observe sends a single alert per run once the error rate crosses
+// -notify-error-rate.
+func (n *notifier) observe(p *progress) {
+	if n == nil || *argNotifyErrorRate <= 0 {
+		return
+	}
+	processed, rate := p.errorRate()
+	if processed < *argNotifyMinEntries || rate <= *argNotifyErrorRate {
+		return
+	}
+	n.alerted.Do(func() {
+		fields := p.summaryFields()
+		fields["error_rate"] = rate
+		message := fmt.Sprintf("gaia import on %s: error rate at %.1f%% after %d entries", n.instance, rate*100, processed)
+		n.pending.Add(1)
+		go func() {
+			defer n.pending.Done()
+			n.send("error_rate", message, fields)
+		}()
+	})
+}
+
+func (n *notifier) finished(p *progress) {
+	if n == nil {
+		return
+	}
+	n.pending.Wait()
+	fields := p.summaryFields()
+	message := fmt.Sprintf("gaia import on %s finished: %d imported, %d errored, %d remaining", n.instance, fields["imported"], fields["errored"], fields["remaining"])
+	n.send("finished", message, fields)
+}
+
+func (n *notifier) send(event, message string, fields Fields) {
+	if *argNotifyURL != "" {
+		body := Fields{"event": event, "instance": n.instance, "message": message}
+		for k, v := range fields {
+			body[k] = v
+		}
+		n.post(*argNotifyURL, body)
+	}
+	if *argNotifySlack != "" {
+		n.post(*argNotifySlack, Fields{"text": message})
+	}
+}
+
+func (n *notifier) post(url string, body Fields) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		logError(Fields{"error": err}, "failed to encode notification: %s", err)
+		return
+	}
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		logError(Fields{"error": err}, "failed to send notification: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logError(Fields{"status": resp.StatusCode}, "failed to send notification: unexpected status %d", resp.StatusCode)
+	}
+}
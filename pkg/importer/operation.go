@@ -0,0 +1,116 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	operationCreate = "create"
+	operationUpdate = "update"
+	operationDelete = "delete"
+)
+
+var argUpdateMethod = Flags.String("update-method", "PATCH", "HTTP method sending the payload of the entries whose operation is update to their response_id, PATCH or PUT")
+
+// operation returns the operation column of e, create by default.
+func (e *Entry) operation() string {
+	if e.Operation == "" {
+		return operationCreate
+	}
+	return e.Operation
+}
+
+// checkOperation fails for an unknown operation, or an update or delete
+// without the response_id it applies to.
+func (e *Entry) checkOperation() error {
+	switch e.operation() {
+	case operationCreate:
+		return nil
+	case operationUpdate, operationDelete:
+		if e.ResponseId == nil || *e.ResponseId == "" {
+			return &ColumnError{"response_id", fmt.Errorf("an %s needs the response_id to %s", e.operation(), e.operation())}
+		}
+		return nil
+	}
+	return &ColumnError{"operation", fmt.Errorf("unknown operation %q, expected create, update or delete", e.Operation)}
+}
+
+// doOperation sends the update or the deletion of the response of e. A
+// response already gone counts as deleted.
+func (e *Entry) doOperation(ctx context.Context) error {
+	api, err := e.endpoint()
+	if err != nil {
+		return err
+	}
+	method, target := e.request(api)
+	payload := e.Payload
+	var body io.Reader = strings.NewReader(payload)
+	if e.operation() == operationDelete {
+		payload, body = "", nil
+	}
+	req, err := http.NewRequestWithContext(withEntryUIDs(withAttemptLog(ctx, &e.history), e.UID), method, target, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := api.authorize(req); err != nil {
+		return err
+	}
+	if *argIdempotency && e.IdempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", e.IdempotencyKey)
+	}
+	if err := e.setEntryHeaders(req); err != nil {
+		return err
+	}
+	if err := e.setQueryParams(req); err != nil {
+		return err
+	}
+	e.setAuthToken(req)
+	if e.CorrelationID, err = setCorrelationID(req); err != nil {
+		return err
+	}
+
+	auditTrail.sent(e, req.Method, req.URL.String(), payload)
+	resp, elapsed, err := api.send(req)
+	e.Attempts++
+	e.ImportTime = elapsed.Milliseconds()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	e.Status = resp.StatusCode
+	response, _ := ioutil.ReadAll(resp.Body)
+	e.recordResponse(resp, response)
+	if e.operation() == operationDelete && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		e.Err = &APIError{resp.StatusCode, string(response)}
+		return fmt.Errorf("unexpected status: %v", e.Err)
+	}
+	if e.operation() == operationUpdate {
+		e.extractFields(response)
+	}
+	return nil
+}
+
+func checkUpdateMethod() error {
+	switch *argUpdateMethod {
+	case http.MethodPatch, http.MethodPut:
+		return nil
+	}
+	return errors.New("-update-method must be PATCH or PUT")
+}
+
+// createsOnly is the condition selecting the entries creating a response.
+func (s *sqlStore) createsOnly() string {
+	return "COALESCE(" + s.col("operation") + ", 'create') = 'create'"
+}
@@ -0,0 +1,286 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var argOtel = Flags.Bool("otel", false, "export traces of imports and API requests over OTLP/HTTP, configured by the standard OTEL_* environment variables")
+
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+
+	maxSpanBatch = 512
+)
+
+// span is a unit of work exported to the OTLP collector.
+type span struct {
+	exporter *spanExporter
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	status   int
+	message  string
+}
+
+type spanKey struct{}
+
+// startSpan starts a span, child of the one in ctx if any, and returns ctx
+// holding it. The span is nil when tracing is disabled.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if spans == nil {
+		return ctx, nil
+	}
+	s := &span{exporter: spans, name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok && parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// withSpan returns ctx holding s, if not nil.
+func withSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// traceparent returns the W3C Trace Context header propagating s.
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+// finish ends s, failed if err is not nil, and queues it for export. It is a
+// no-op on a nil span.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.status = spanStatusOK
+	if err != nil {
+		s.status = spanStatusError
+		s.message = err.Error()
+	}
+	s.exporter.add(s)
+}
+
+// spanExporter sends finished spans to the collector in batches, every few
+// seconds or as soon as a batch is full.
+type spanExporter struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []*span
+	flushes chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+var spans *spanExporter
+
+// setupOtel enables tracing with -otel, unless OTEL_SDK_DISABLED or
+// OTEL_TRACES_EXPORTER=none say otherwise.
+func setupOtel() {
+	if !*argOtel || os.Getenv("OTEL_SDK_DISABLED") == "true" || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			base = "http://localhost:4318"
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	headers := map[string]string{}
+	for _, list := range []string{os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")} {
+		for _, pair := range strings.Split(list, ",") {
+			if parts := strings.SplitN(pair, "=", 2); len(parts) == 2 {
+				headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+			}
+		}
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "gaia-responses-importer"
+	}
+	spans = &spanExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		flushes:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go spans.run(5 * time.Second)
+	logInfo(Fields{"endpoint": endpoint}, "exporting traces to %s", endpoint)
+}
+
+func (e *spanExporter) add(s *span) {
+	e.mu.Lock()
+	e.pending = append(e.pending, s)
+	full := len(e.pending) >= maxSpanBatch
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.flushes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *spanExporter) run(interval time.Duration) {
+	defer close(e.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			e.flush()
+			return
+		case <-ticker.C:
+		case <-e.flushes:
+		}
+		e.flush()
+	}
+}
+
+func (e *spanExporter) flush() {
+	e.mu.Lock()
+	batch := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	data, err := json.Marshal(e.request(batch))
+	if err != nil {
+		logError(Fields{"error": err}, "failed to encode traces: %s", err)
+		return
+	}
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(data))
+	if err != nil {
+		logError(Fields{"error": err}, "failed to export traces: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		logError(Fields{"error": err}, "failed to export traces: %s", err)
+		return
+	}
+	drain(resp)
+	if resp.StatusCode >= 300 {
+		logError(Fields{"status": resp.StatusCode}, "failed to export traces: unexpected status %d", resp.StatusCode)
+	}
+}
+
+// Close exports the remaining spans. It is a no-op on a nil exporter.
+func (e *spanExporter) Close() {
+	if e == nil {
+		return
+	}
+	close(e.stop)
+	<-e.done
+}
+
+// request builds the OTLP/HTTP JSON payload exporting batch.
+func (e *spanExporter) request(batch []*span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, len(batch))
+	for i, s := range batch {
+		attrs := make(map[string]interface{}, len(s.attrs))
+		for k, v := range s.attrs {
+			attrs[k] = v
+		}
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(attrs),
+			"status":            map[string]interface{}{"code": s.status, "message": s.message},
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		encoded[i] = span
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": e.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "gaia-responses-importer"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	encoded := make([]interface{}, 0, len(attrs))
+	for _, key := range keys {
+		var value map[string]interface{}
+		switch v := attrs[key].(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": key, "value": value})
+	}
+	return encoded
+}
@@ -0,0 +1,92 @@
+package importer
+
+import "sync"
+
+// pauser holds back the scheduling of new entries while the run is paused.
+// In-flight entries are not affected.
+type pauser struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+// pause pauses the run, and reports whether it was running.
+func (p *pauser) pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return false
+	}
+	p.paused = true
+	p.resumed = make(chan struct{})
+	return true
+}
+
+// resume resumes the run, and reports whether it was paused.
+func (p *pauser) resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return false
+	}
+	p.paused = false
+	close(p.resumed)
+	return true
+}
+
+func (p *pauser) isPaused() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// wait blocks while the run is paused, and reports false if stop is closed
+// first.
+func (p *pauser) wait(stop <-chan struct{}) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	paused, resumed := p.paused, p.resumed
+	p.mu.Unlock()
+	if !paused {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Pause stops scheduling new entries until Resume is called. The entries
+// in flight are still imported.
+func (im *Importer) Pause() {
+	if im.multi != nil {
+		im.multi.pause(true)
+		return
+	}
+	if im.pause != nil && im.pause.pause() {
+		logInfo(nil, "run paused, in-flight entries are still being imported")
+	}
+}
+
+// Resume resumes a run paused by Pause.
+func (im *Importer) Resume() {
+	if im.multi != nil {
+		im.multi.pause(false)
+		return
+	}
+	if im.pause != nil && im.pause.resume() {
+		logInfo(nil, "run resumed")
+	}
+}
+
+// Paused reports whether the run is paused.
+func (im *Importer) Paused() bool {
+	return im.pause.isPaused()
+}
@@ -0,0 +1,84 @@
+package importer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	argPayloadFiles = Flags.Bool("payload-files", false, "read the payloads that are a file path or file:// URI instead of inline JSON from that file when the entry is scheduled, .gz files being decompressed")
+	argPayloadDir   = Flags.String("payload-dir", "", "`directory` relative payload file paths are resolved from (default: the current directory)")
+)
+
+// PayloadFileError is a payload file that could not be read.
+type PayloadFileError struct {
+	Path string
+	Err  error
+}
+
+func (e *PayloadFileError) Error() string {
+	return fmt.Sprintf("failed to read payload file %s: %s", e.Path, e.Err)
+}
+
+// payloadPath returns the file payload refers to with -payload-files, and
+// false if it is inline JSON.
+func payloadPath(payload string) (string, bool) {
+	path := strings.TrimSpace(payload)
+	if !*argPayloadFiles || path == "" || strings.ContainsAny(path[:1], `{["`) {
+		return "", false
+	}
+	if strings.HasPrefix(path, "file://") {
+		u, err := url.Parse(path)
+		if err != nil {
+			return path, true
+		}
+		path = u.Host + u.Path
+	}
+	if !filepath.IsAbs(path) && *argPayloadDir != "" {
+		path = filepath.Join(*argPayloadDir, path)
+	}
+	return path, true
+}
+
+func readPayloadFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// loadPayload replaces the payload of e by the content of the file it refers
+// to, if any.
+func (e *Entry) loadPayload() error {
+	path, ok := payloadPath(e.Payload)
+	if !ok {
+		return nil
+	}
+	payload, err := readPayloadFile(path)
+	if err != nil {
+		return &PayloadFileError{path, err}
+	}
+	e.Payload = payload
+	return nil
+}
@@ -0,0 +1,224 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	argPipe        = Flags.Bool("pipe", false, "read NDJSON entries from stdin and write their outcome as NDJSON to stdout, without any database")
+	argPipeUID     = Flags.String("pipe-uid", "uid", "field of the stdin entries holding their uid, in -pipe mode")
+	argPipePayload = Flags.String("pipe-payload", "", "field of the stdin entries holding their payload, in -pipe mode (default: the whole line)")
+)
+
+var errPipe = errors.New("not possible in -pipe mode")
+
+// PipeResult is the line written to stdout for each entry in pipe mode.
+type PipeResult struct {
+	UID         string  `json:"uid"`
+	ResponseID  *string `json:"response_id,omitempty"`
+	DuplicateOf *string `json:"duplicate_of,omitempty"`
+	Status      int     `json:"status,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	Class       string  `json:"class,omitempty"`
+}
+
+// pipeStore reads entries from stdin as they are fetched and writes their
+// outcome to stdout, so the importer can be used in shell pipelines.
+type pipeStore struct {
+	mu      sync.Mutex
+	scanner *bufio.Scanner
+	line    int
+	out     *bufio.Writer
+}
+
+func openPipe(in io.Reader, out io.Writer) *pipeStore {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	return &pipeStore{scanner: scanner, out: bufio.NewWriter(out)}
+}
+
+func (s *pipeStore) SetPendingFilter(where string) {}
+
+func (s *pipeStore) SetPendingAfter(uid string) {}
+
+// CountPending returns 0 as entries are only known once read.
+func (s *pipeStore) CountPending(uids []string) (int, error) {
+	return 0, nil
+}
+
+// FetchPending reads the next limit entries from stdin, ignoring scope and
+// after since stdin can only be read in order.
+func (s *pipeStore) FetchPending(scope pendingScope, after string, limit int) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []Entry
+	for len(entries) < limit && s.scanner.Scan() {
+		s.line++
+		raw := strings.TrimSpace(s.scanner.Text())
+		if raw == "" {
+			continue
+		}
+		record, err := parsePipeLine(raw)
+		if err != nil {
+			return entries, fmt.Errorf("line %d: %s", s.line, err)
+		}
+		entries = append(entries, Entry{UID: record.UID, Payload: record.Payload})
+	}
+	return entries, s.scanner.Err()
+}
+
+func parsePipeLine(raw string) (loadRecord, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return loadRecord{}, err
+	}
+	var uid string
+	if err := json.Unmarshal(fields[*argPipeUID], &uid); err != nil {
+		return loadRecord{}, fmt.Errorf("invalid %q field", *argPipeUID)
+	}
+	record := loadRecord{UID: uid, Payload: raw}
+	if *argPipePayload != "" {
+		payload, ok := fields[*argPipePayload]
+		if !ok {
+			return loadRecord{}, fmt.Errorf("no %q field", *argPipePayload)
+		}
+		record.Payload = string(payload)
+	}
+	return record, nil
+}
+
+func (s *pipeStore) PendingPriorities() ([]int, error) {
+	return nil, errPipe
+}
+
+func (s *pipeStore) PendingBoundaries(parts int) ([]string, error) {
+	return nil, errPipe
+}
+
+func (s *pipeStore) WriteStatus(updates []StatusUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	encoder := json.NewEncoder(s.out)
+	for _, update := range updates {
+		e := &update.Entry
+		result := PipeResult{UID: e.UID, Status: e.Status}
+		if update.Imported {
+			result.ResponseID = e.ResponseId
+			result.DuplicateOf = e.DuplicateOf
+		} else {
+			result.Error = e.Err.Error()
+			result.Class = classifyError(e.Err)
+		}
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	}
+	return s.out.Flush()
+}
+
+// SetIdempotencyKey keeps keys for the current run only.
+func (s *pipeStore) SetIdempotencyKey(e *Entry, key string) error {
+	return nil
+}
+
+func (s *pipeStore) ResetErrors(classes []string) (int64, error) {
+	return 0, errPipe
+}
+
+func (s *pipeStore) Requeue(filter *RequeueFilter, dryRun bool) (int64, error) {
+	return 0, errPipe
+}
+
+func (s *pipeStore) Claim(e *Entry, instance string, expiry time.Duration) (bool, error) {
+	return false, errPipe
+}
+
+func (s *pipeStore) Upsert(records []loadRecord) error {
+	return errPipe
+}
+
+// ForEachImported finds nothing, so only duplicates within stdin are
+// detected.
+func (s *pipeStore) ForEachImported(fn func(uid, payload string, responseID *string) error) error {
+	return nil
+}
+
+func (s *pipeStore) InitSchema() error {
+	return errPipe
+}
+
+func (s *pipeStore) StartRun(r *Run) error {
+	return errPipe
+}
+
+func (s *pipeStore) FinishRun(r *Run) error {
+	return errPipe
+}
+
+func (s *pipeStore) Runs(limit int) ([]Run, error) {
+	return nil, errPipe
+}
+
+func (s *pipeStore) Migrate() ([]string, error) {
+	return nil, errPipe
+}
+
+func (s *pipeStore) Status() (*ImportStatus, error) {
+	return nil, errPipe
+}
+
+func (s *pipeStore) Export(fn func(row ExportRow) error) error {
+	return errPipe
+}
+
+func (s *pipeStore) FetchToVerify(after string, limit int, all bool) ([]Entry, error) {
+	return nil, errPipe
+}
+
+func (s *pipeStore) MarkVerified(e *Entry, verifyErr error) error {
+	return errPipe
+}
+
+func (s *pipeStore) FetchToRollback(filter *RequeueFilter, after string, limit int) ([]Entry, error) {
+	return nil, errPipe
+}
+
+func (s *pipeStore) MarkRolledBack(e *Entry) error {
+	return errPipe
+}
+
+func (s *pipeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.Flush()
+}
+
+// checkPipeFlags rejects the flags needing a database.
+func checkPipeFlags() error {
+	conflicts := []struct {
+		set  bool
+		name string
+	}{
+		{*argCheckpoint != "", "-checkpoint"},
+		{*argClaim, "-claim"},
+		{*argPriority, "-priority"},
+		{*argReaders > 1, "-readers"},
+		{*argWatch, "-watch"},
+		{*argWhere != "", "-where"},
+		{*argReport != "", "-report"},
+		{*argCompactAfter > 0, "-compact-after"},
+	}
+	for _, c := range conflicts {
+		if c.set {
+			return fmt.Errorf("%s cannot be used with -pipe", c.name)
+		}
+	}
+	return nil
+}
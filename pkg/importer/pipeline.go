@@ -0,0 +1,150 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	argPrepareWorkers = Flags.Int("prepare-workers", 0, "prepare the entries, from claiming them to linting and resolving their payloads, in this many workers ahead of the -j sending ones, so that sending never waits for them (0 prepares in the sending workers, -1 uses one worker per CPU)")
+	argPrepareQueue   = Flags.Int("prepare-queue", 0, "number of prepared batches waiting for a sending worker with -prepare-workers (default: -prepare-workers)")
+	argStatusQueue    = Flags.Int("status-queue", 0, "number of status updates waiting for the database before the sending workers wait for it (default: -status-batch)")
+)
+
+// stage counts the work of a stage of the pipeline entries go through.
+type stage struct {
+	name      string
+	queued    int64
+	busy      int64
+	processed int64
+	busyNanos int64
+}
+
+// begin records a worker of s starting, and returns the time it did.
+func (s *stage) begin() time.Time {
+	atomic.AddInt64(&s.busy, 1)
+	return time.Now()
+}
+
+// end records a worker of s started at start done with n entries.
+func (s *stage) end(start time.Time, n int) {
+	atomic.AddInt64(&s.busy, -1)
+	atomic.AddInt64(&s.processed, int64(n))
+	atomic.AddInt64(&s.busyNanos, int64(time.Since(start)))
+}
+
+// queue records n more entries, or fewer if negative, waiting to enter s.
+func (s *stage) queue(n int) {
+	atomic.AddInt64(&s.queued, int64(n))
+}
+
+// StageStatus is the state of a stage of the pipeline.
+type StageStatus struct {
+	Stage       string  `json:"stage"`
+	Queued      int64   `json:"queued"`
+	Busy        int64   `json:"busy"`
+	Processed   int64   `json:"processed"`
+	BusySeconds float64 `json:"busy_seconds"`
+}
+
+func (s *stage) status() StageStatus {
+	return StageStatus{
+		Stage:       s.name,
+		Queued:      atomic.LoadInt64(&s.queued),
+		Busy:        atomic.LoadInt64(&s.busy),
+		Processed:   atomic.LoadInt64(&s.processed),
+		BusySeconds: time.Duration(atomic.LoadInt64(&s.busyNanos)).Seconds(),
+	}
+}
+
+// fetchStage reads the pending entries from the store, prepareStage claims,
+// transforms and checks them, sendStage sends them to the API and
+// persistStage writes their status.
+var (
+	fetchStage   = &stage{name: "fetch"}
+	prepareStage = &stage{name: "prepare"}
+	sendStage    = &stage{name: "send"}
+	persistStage = &stage{name: "persist"}
+)
+
+var stages = []*stage{fetchStage, prepareStage, sendStage, persistStage}
+
+func stageStatuses() []StageStatus {
+	statuses := make([]StageStatus, len(stages))
+	for i, s := range stages {
+		statuses[i] = s.status()
+	}
+	return statuses
+}
+
+func writeStageMetrics(w io.Writer) {
+	statuses := stageStatuses()
+	fmt.Fprintln(w, "# HELP gaia_importer_stage_queued Entries waiting to enter each stage of the pipeline.")
+	fmt.Fprintln(w, "# TYPE gaia_importer_stage_queued gauge")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "gaia_importer_stage_queued{stage=%q} %d\n", s.Stage, s.Queued)
+	}
+	fmt.Fprintln(w, "# HELP gaia_importer_stage_busy Workers busy in each stage of the pipeline.")
+	fmt.Fprintln(w, "# TYPE gaia_importer_stage_busy gauge")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "gaia_importer_stage_busy{stage=%q} %d\n", s.Stage, s.Busy)
+	}
+	fmt.Fprintln(w, "# HELP gaia_importer_stage_entries_total Entries through each stage of the pipeline.")
+	fmt.Fprintln(w, "# TYPE gaia_importer_stage_entries_total counter")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "gaia_importer_stage_entries_total{stage=%q} %d\n", s.Stage, s.Processed)
+	}
+	fmt.Fprintln(w, "# HELP gaia_importer_stage_busy_seconds_total Time spent by the workers of each stage of the pipeline.")
+	fmt.Fprintln(w, "# TYPE gaia_importer_stage_busy_seconds_total counter")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "gaia_importer_stage_busy_seconds_total{stage=%q} %g\n", s.Stage, s.BusySeconds)
+	}
+}
+
+// pipeline runs the prepare stage in its own workers with -prepare-workers.
+// Batches are fetched while a token is free, prepared while a worker is,
+// and hand their token back once a sending worker takes them, so that at
+// most -prepare-queue prepared batches wait for one.
+type pipeline struct {
+	tokens  chan bool
+	workers chan bool
+}
+
+func setupPipeline() (*pipeline, error) {
+	workers, queue := *argPrepareWorkers, *argPrepareQueue
+	switch {
+	case workers == 0:
+		return nil, nil
+	case workers < -1:
+		return nil, fmt.Errorf("invalid -prepare-workers %d", workers)
+	case queue < 0:
+		return nil, errors.New("-prepare-queue must not be negative")
+	case workers == -1:
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if queue == 0 {
+		queue = workers
+	}
+	p := &pipeline{tokens: make(chan bool, workers+queue), workers: make(chan bool, workers)}
+	for i := 0; i < cap(p.tokens); i++ {
+		p.tokens <- true
+	}
+	for i := 0; i < workers; i++ {
+		p.workers <- true
+	}
+	logInfo(Fields{"prepare_workers": workers, "prepare_queue": queue}, "preparing entries in %d workers, up to %d batches ahead of the sending ones", workers, queue)
+	return p, nil
+}
+
+// prepare prepares batch in a worker of p.
+func (p *pipeline) prepare(im *Importer, batch []Entry) []Entry {
+	prepareStage.queue(len(batch))
+	<-p.workers
+	prepareStage.queue(-len(batch))
+	defer func() { p.workers <- true }()
+	return im.prepare(batch)
+}
@@ -0,0 +1,230 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+var (
+	argPlan    = Flags.String("plan", "", "with -dry-run, write the work manifest of the run to this `file` instead: the entries that would be sent, in order, with their request, the transformations applied and their payload, for review before -execute")
+	argExecute = Flags.String("execute", "", "only import the entries of this -plan manifest `file`, failing those whose request or payload is no longer the planned one")
+)
+
+// Plan is the work manifest written by -plan and run by -execute.
+type Plan struct {
+	CreatedAt  string            `json:"created_at"`
+	DB         string            `json:"db"`
+	APIVersion string            `json:"api_version,omitempty"`
+	Flags      map[string]string `json:"flags"`
+	Entries    []PlannedEntry    `json:"entries"`
+	Rejected   []RejectedEntry   `json:"rejected"`
+}
+
+// PlannedEntry is an entry of a plan, as it would be sent.
+type PlannedEntry struct {
+	UID             string          `json:"uid"`
+	Operation       string          `json:"operation"`
+	Method          string          `json:"method"`
+	URL             string          `json:"url"`
+	Transformations []string        `json:"transformations"`
+	Bytes           int             `json:"bytes"`
+	PayloadSHA256   string          `json:"payload_sha256,omitempty"`
+	Payload         json.RawMessage `json:"payload,omitempty"`
+}
+
+// RejectedEntry is a pending entry left out of a plan.
+type RejectedEntry struct {
+	UID   string `json:"uid"`
+	Error string `json:"error"`
+}
+
+// PlanError is an entry of an -execute run no longer prepared as planned.
+type PlanError struct {
+	Field   string
+	Planned string
+	Got     string
+}
+
+func (e *PlanError) Error() string {
+	return fmt.Sprintf("%s differs from the plan: %s planned, %s now", e.Field, e.Planned, e.Got)
+}
+
+// plannedEntries are the entries of the -execute plan, by uid.
+var plannedEntries map[string]*PlannedEntry
+
+func payloadDigest(payload string) string {
+	h := sha256.Sum256([]byte(payload))
+	return checksumPrefix + hex.EncodeToString(h[:])
+}
+
+// plannedRequest returns the method and URL e is sent to, in a batch with
+// -batch-size, with the parameters of its query_params column.
+func plannedRequest(e *Entry, api *endpoint) (string, string) {
+	method, url := e.request(api)
+	if *argBatchSize > 1 && e.operation() == operationCreate {
+		url += "/batch"
+	}
+	if params, _ := e.queryParams(); len(params) > 0 {
+		url += "?" + params.Encode()
+	}
+	return method, url
+}
+
+// setupPlan checks the -plan flags and restricts the selection of the run to
+// the entries of the -execute plan.
+func setupPlan() error {
+	plannedEntries = nil
+	if *argPlan == "" && *argExecute == "" {
+		return nil
+	}
+	switch {
+	case *argPlan != "" && *argExecute != "":
+		return errors.New("-plan and -execute cannot be combined")
+	case *argPlan != "" && !*argDryRun:
+		return errors.New("-plan needs -dry-run, the plan being written instead of sending the entries")
+	case *argPlan != "" && *argAPIVersion == "auto":
+		return errors.New("-plan needs the -api-version, -api-version auto asking the API")
+	case *argExecute != "" && *argDryRun:
+		return errors.New("-execute cannot be used with -dry-run")
+	case *argExecute != "" && (*argUIDFile != "" || *argSample != ""):
+		return errors.New("-execute cannot be used with -uid-file or -sample, the plan selecting the entries")
+	case references != nil:
+		return errors.New("-plan and -execute cannot be used with -resolve, whose lookups depend on the API")
+	case attachmentUploader != nil:
+		return errors.New("-plan and -execute cannot be used with -attachment, whose media identifiers come from the API")
+	}
+	if *argExecute == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(*argExecute)
+	if err != nil {
+		return fmt.Errorf("failed to read plan: %s", err)
+	}
+	var plan Plan
+	if err := json.Unmarshal(content, &plan); err != nil {
+		return fmt.Errorf("invalid plan %s: %s", *argExecute, err)
+	}
+	plannedEntries = make(map[string]*PlannedEntry, len(plan.Entries))
+	pendingSelection.uids, pendingSelection.set = []string{}, make(map[string]bool, len(plan.Entries))
+	for i, p := range plan.Entries {
+		if p.UID == "" || plannedEntries[p.UID] != nil {
+			return fmt.Errorf("invalid plan %s: entry %d has an empty or repeated uid", *argExecute, i+1)
+		}
+		plannedEntries[p.UID] = &plan.Entries[i]
+		if pendingSelection.inShard(p.UID) {
+			pendingSelection.uids = append(pendingSelection.uids, p.UID)
+			pendingSelection.set[p.UID] = true
+		}
+	}
+	digest := payloadDigest(string(content))
+	logInfo(Fields{"plan": *argExecute, "plan_sha256": digest, "planned": len(plan.Entries), "planned_at": plan.CreatedAt},
+		"executing plan %s (%s) of %d entries, planned at %s", *argExecute, digest, len(plan.Entries), plan.CreatedAt)
+	return nil
+}
+
+// checkPlan fails if e is not prepared as its entry of the -execute plan.
+func checkPlan(e *Entry) error {
+	if plannedEntries == nil {
+		return nil
+	}
+	p := plannedEntries[e.UID]
+	if p == nil {
+		return &PlanError{"entry", "nothing", e.UID}
+	}
+	if e.operation() != p.Operation {
+		return &PlanError{"operation", p.Operation, e.operation()}
+	}
+	api, err := e.endpoint()
+	if err != nil {
+		return err
+	}
+	method, url := plannedRequest(e, api)
+	if method != p.Method || url != p.URL {
+		return &PlanError{"request", p.Method + " " + p.URL, method + " " + url}
+	}
+	if e.operation() == operationDelete {
+		return nil
+	}
+	if digest := payloadDigest(e.Payload); digest != p.PayloadSHA256 {
+		return &PlanError{"payload", p.PayloadSHA256, digest}
+	}
+	return nil
+}
+
+// planEntry prepares e as a run would, but for the steps calling the API, and
+// returns it as planned with the transformations that changed its payload.
+func planEntry(e *Entry) (PlannedEntry, error) {
+	if err := e.loadPayload(); err != nil {
+		return PlannedEntry{}, err
+	}
+	if err := e.checkOperation(); err != nil {
+		return PlannedEntry{}, err
+	}
+	if _, err := e.queryParams(); err != nil {
+		return PlannedEntry{}, err
+	}
+	api, err := e.endpoint()
+	if err != nil {
+		return PlannedEntry{}, err
+	}
+	p := PlannedEntry{UID: e.UID, Operation: e.operation(), Transformations: []string{}}
+	p.Method, p.URL = plannedRequest(e, api)
+	if e.operation() == operationDelete {
+		return p, nil
+	}
+	for _, step := range e.preparationSteps() {
+		if step.offline == nil {
+			continue
+		}
+		before := e.Payload
+		if err := step.offline(); err != nil {
+			return PlannedEntry{}, err
+		}
+		if step.name != "" && e.Payload != before {
+			p.Transformations = append(p.Transformations, step.name)
+		}
+	}
+	if err := validatePayload(e.Payload); err != nil {
+		return PlannedEntry{}, err
+	}
+	p.Bytes = len(e.Payload)
+	p.PayloadSHA256 = payloadDigest(e.Payload)
+	p.Payload = json.RawMessage(e.Payload)
+	return p, nil
+}
+
+// writePlan writes the plan of entries to path, returning the number of
+// entries rejected.
+func writePlan(entries *entryStream, path string) (int, error) {
+	plan := Plan{
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+		DB:         redactDSN(*argDb),
+		APIVersion: apiVersion,
+		Flags:      setFlags(),
+		Entries:    []PlannedEntry{},
+		Rejected:   []RejectedEntry{},
+	}
+	for entry := range entries.entries {
+		p, err := planEntry(&entry)
+		if err != nil {
+			logError(Fields{"uid": entry.UID, "error": err, "outcome": "invalid"}, "entry %s is invalid: %s", entry.UID, err)
+			plan.Rejected = append(plan.Rejected, RejectedEntry{entry.UID, err.Error()})
+			continue
+		}
+		plan.Entries = append(plan.Entries, p)
+	}
+	if err := entries.Err(); err != nil {
+		return len(plan.Rejected), fmt.Errorf("failed to fetch data: %s", err)
+	}
+	if err := writeJSONFile(path, plan); err != nil {
+		return len(plan.Rejected), fmt.Errorf("failed to write plan: %s", err)
+	}
+	logInfo(Fields{"plan": path, "planned": len(plan.Entries), "rejected": len(plan.Rejected)},
+		"plan of %d entries written to %s, %d rejected", len(plan.Entries), path, len(plan.Rejected))
+	return len(plan.Rejected), nil
+}
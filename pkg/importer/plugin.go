@@ -0,0 +1,258 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Plugin is called around the sending of each entry, for enrichment or side
+// effects without forking the importer. BeforeSend may change the Payload of
+// the entry, or fail it by returning an error; AfterSuccess and AfterFailure
+// are told how its import ended, with the response body of the API, if any.
+type Plugin interface {
+	BeforeSend(e *Entry) error
+	AfterSuccess(e *Entry, response string)
+	AfterFailure(e *Entry, err error)
+}
+
+var plugins []Plugin
+
+// RegisterPlugin adds p to the plugins called for each entry, in the order
+// they are registered, before those of -plugin.
+func RegisterPlugin(p Plugin) {
+	plugins = append(plugins, p)
+}
+
+// pluginList is a repeatable flag of plugin commands.
+type pluginList []string
+
+func (p *pluginList) String() string {
+	return strings.Join(*p, ", ")
+}
+
+func (p *pluginList) Set(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return errors.New("empty plugin command")
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+func (p *pluginList) reset() {
+	*p = nil
+}
+
+var argPlugins pluginList
+
+func init() {
+	Flags.Var(&argPlugins, "plugin", "shell `command` started for the run and called before sending and after importing each entry, exchanging JSON lines on its stdin and stdout, repeatable")
+}
+
+type PluginError struct {
+	Plugin string
+	Err    error
+}
+
+func (e *PluginError) Error() string {
+	return fmt.Sprintf("plugin %s failed: %s", e.Plugin, e.Err)
+}
+
+// pluginCall is the JSON line written to an exec plugin for each hook.
+type pluginCall struct {
+	Hook       string          `json:"hook"`
+	UID        string          `json:"uid"`
+	Payload    json.RawMessage `json:"payload"`
+	Target     string          `json:"target,omitempty"`
+	Tenant     string          `json:"tenant,omitempty"`
+	ResponseID string          `json:"response_id,omitempty"`
+	Status     int             `json:"status,omitempty"`
+	Response   string          `json:"response,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// pluginReply is the JSON line an exec plugin answers each call with. A
+// payload replaces that of the entry, an error fails it, and both are only
+// heeded from before_send.
+type pluginReply struct {
+	Payload json.RawMessage `json:"payload"`
+	Error   string          `json:"error"`
+}
+
+// execPlugin is a Plugin run as a separate process for the whole run, called
+// one entry at a time.
+type execPlugin struct {
+	command string
+	cmd     *exec.Cmd
+	mu      sync.Mutex
+	in      io.WriteCloser
+	out     *bufio.Reader
+}
+
+func startPlugin(command string) (*execPlugin, error) {
+	p := &execPlugin{command: command, cmd: shellCommand(command)}
+	p.cmd.Stderr = os.Stderr
+	in, err := p.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.cmd.Start(); err != nil {
+		return nil, err
+	}
+	p.in, p.out = in, bufio.NewReader(out)
+	return p, nil
+}
+
+// call sends c to the plugin and reads its reply.
+func (p *execPlugin) call(c pluginCall) (pluginReply, error) {
+	var reply pluginReply
+	line, err := json.Marshal(c)
+	if err != nil {
+		return reply, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.in.Write(append(line, '\n')); err != nil {
+		return reply, err
+	}
+	answer, err := p.out.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = errors.New("exited without replying")
+		}
+		return reply, err
+	}
+	if err := json.Unmarshal(answer, &reply); err != nil {
+		return reply, fmt.Errorf("invalid reply %q: %s", strings.TrimSpace(string(answer)), err)
+	}
+	return reply, nil
+}
+
+func (p *execPlugin) entryCall(hook string, e *Entry) pluginCall {
+	c := pluginCall{Hook: hook, UID: e.UID, Payload: json.RawMessage(e.Payload), Target: e.Target, Tenant: e.Tenant, Status: e.Status}
+	if !json.Valid(c.Payload) {
+		c.Payload, _ = json.Marshal(e.Payload)
+	}
+	return c
+}
+
+func (p *execPlugin) BeforeSend(e *Entry) error {
+	reply, err := p.call(p.entryCall("before_send", e))
+	if err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	if len(reply.Payload) > 0 && string(reply.Payload) != "null" {
+		if !json.Valid(reply.Payload) {
+			return fmt.Errorf("payload is not valid JSON: %s", reply.Payload)
+		}
+		e.Payload = string(reply.Payload)
+	}
+	return nil
+}
+
+func (p *execPlugin) AfterSuccess(e *Entry, response string) {
+	c := p.entryCall("after_success", e)
+	c.ResponseID, c.Response = *e.ResponseId, response
+	p.notify(e, c)
+}
+
+func (p *execPlugin) AfterFailure(e *Entry, err error) {
+	c := p.entryCall("after_failure", e)
+	c.Error = err.Error()
+	p.notify(e, c)
+}
+
+func (p *execPlugin) notify(e *Entry, c pluginCall) {
+	if _, err := p.call(c); err != nil {
+		logError(Fields{"uid": e.UID, "plugin": p.command, "error": err}, "plugin %s failed on %s of entry %s: %s", p.command, c.Hook, e.UID, err)
+	}
+}
+
+func (p *execPlugin) String() string {
+	return p.command
+}
+
+// Close ends the input of the plugin and waits for it to exit.
+func (p *execPlugin) Close() error {
+	p.in.Close()
+	return p.cmd.Wait()
+}
+
+var execPlugins []*execPlugin
+
+// setupPlugins starts the -plugin commands.
+func setupPlugins() error {
+	for _, command := range argPlugins {
+		p, err := startPlugin(command)
+		if err != nil {
+			closePlugins()
+			return fmt.Errorf("failed to start plugin %s: %s", command, err)
+		}
+		execPlugins = append(execPlugins, p)
+	}
+	return nil
+}
+
+func allPlugins() []Plugin {
+	all := append([]Plugin(nil), plugins...)
+	for _, p := range execPlugins {
+		all = append(all, p)
+	}
+	return all
+}
+
+// beforeSend calls the BeforeSend hook of the plugins on e, stopping at the
+// first failing.
+func (e *Entry) beforeSend() error {
+	for _, p := range allPlugins() {
+		if err := p.BeforeSend(e); err != nil {
+			return &PluginError{pluginName(p), err}
+		}
+	}
+	return nil
+}
+
+// afterImport calls the AfterSuccess or AfterFailure hook of the plugins on e,
+// depending on err.
+func (e *Entry) afterImport(err error) {
+	response := ""
+	if e.ResponseBody != nil {
+		response = *e.ResponseBody
+	}
+	for _, p := range allPlugins() {
+		if err != nil {
+			p.AfterFailure(e, err)
+		} else {
+			p.AfterSuccess(e, response)
+		}
+	}
+}
+
+func pluginName(p Plugin) string {
+	if s, ok := p.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", p)
+}
+
+func closePlugins() {
+	for _, p := range execPlugins {
+		if err := p.Close(); err != nil {
+			logError(Fields{"plugin": p.command, "error": err}, "plugin %s exited with %s", p.command, err)
+		}
+	}
+	execPlugins = nil
+}
@@ -0,0 +1,70 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var argPreflight = Flags.String("preflight", "HEAD /", "request checking the URL, credentials and network path before importing, as a method and a path (none disables it): network errors and 401, 403 or 5xx answers abort the run")
+
+// preflight sends the -preflight request to the API of the flags and to the
+// one of every tenant, failing on the first that is unreachable or refuses
+// the credentials.
+func preflight() error {
+	if *argPreflight == "none" || *argPreflight == "" {
+		return nil
+	}
+	method, path := "GET", *argPreflight
+	if fields := strings.Fields(*argPreflight); len(fields) == 2 {
+		method, path = strings.ToUpper(fields[0]), fields[1]
+	}
+	if _, missing := authenticator.(*missingAuth); !missing {
+		if err := preflightEndpoint("", &endpoint{url: *argURL}, method, path); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := preflightEndpoint(name, tenants[name], method, path); err != nil {
+			return fmt.Errorf("tenant %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func preflightEndpoint(tenant string, api *endpoint, method, path string) error {
+	req, err := http.NewRequest(method, api.url+path, nil)
+	if err != nil {
+		return fmt.Errorf("invalid preflight request: %s", err)
+	}
+	if err := api.authorize(req); err != nil {
+		return fmt.Errorf("preflight failed to get credentials: %s", err)
+	}
+	setHeaders(req)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("preflight %s %s failed, check -url and the network: %s", method, req.URL, err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	detail := ""
+	if len(body) > 0 {
+		detail = ": " + string(body)
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("preflight %s %s was refused with HTTP %d, check the credentials%s", method, req.URL, resp.StatusCode, detail)
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("preflight %s %s failed with HTTP %d%s", method, req.URL, resp.StatusCode, detail)
+	}
+	logInfo(Fields{"tenant": tenant, "status": resp.StatusCode}, "preflight %s %s answered HTTP %d", method, req.URL, resp.StatusCode)
+	return nil
+}
@@ -0,0 +1,101 @@
+package importer
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	argPriority        = Flags.Bool("priority", false, "import pending entries by decreasing value of the priority column")
+	argPriorityReserve = Flags.String("priority-reserve", "", "comma-separated `priority=fraction` pairs reserving a fraction of -j for the entries of a priority, e.g. 10=0.25 (implies -priority)")
+)
+
+// lane is a set of workers importing the entries of some priorities: each
+// reserved priority gets its own lane, the others share the remaining
+// workers. A tenant with its own concurrency gets a lane importing its
+// entries of all priorities, which the other lanes exclude.
+type lane struct {
+	sem        chan bool
+	priorities []int
+	tenant     string
+	excluded   []string
+}
+
+// reservedLanes maps reserved priorities to the semaphore of their workers.
+var reservedLanes = map[int]chan bool{}
+
+// setupPriorities creates the lanes of -priority-reserve out of concurrency,
+// and returns the number of workers left for the shared lane.
+func setupPriorities(concurrency int) (int, error) {
+	reservedLanes = map[int]chan bool{}
+	if *argPriorityReserve == "" {
+		return concurrency, nil
+	}
+	*argPriority = true
+	shared := concurrency
+	for _, pair := range strings.Split(*argPriorityReserve, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return 0, fmt.Errorf("invalid priority reservation %q", pair)
+		}
+		priority, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return 0, fmt.Errorf("invalid priority in reservation %q", pair)
+		}
+		fraction, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || fraction <= 0 || fraction >= 1 {
+			return 0, fmt.Errorf("invalid fraction in reservation %q", pair)
+		}
+		if _, ok := reservedLanes[priority]; ok {
+			return 0, fmt.Errorf("priority %d reserved twice", priority)
+		}
+		n := int(math.Max(1, math.Round(fraction*float64(concurrency))))
+		sem := make(chan bool, n)
+		for i := 0; i < n; i++ {
+			sem <- true
+		}
+		reservedLanes[priority] = sem
+		shared -= n
+	}
+	if shared < 1 {
+		return 0, fmt.Errorf("priority reservations leave no worker out of %d for other entries", concurrency)
+	}
+	return shared, nil
+}
+
+// lanes returns the lanes of a run, sem being the one of the shared lane.
+func (im *Importer) lanes(sem chan bool) ([]lane, error) {
+	var priorities []int
+	if *argPriority {
+		var err error
+		if priorities, err = im.store.PendingPriorities(); err != nil {
+			return nil, err
+		}
+	}
+	excluded := make([]string, 0, len(tenantLanes))
+	for tenant := range tenantLanes {
+		excluded = append(excluded, tenant)
+	}
+	sort.Strings(excluded)
+	var tenants []lane
+	for _, tenant := range excluded {
+		tenants = append(tenants, lane{sem: tenantLanes[tenant], priorities: priorities, tenant: tenant})
+	}
+	if !*argPriority {
+		return append([]lane{{sem: sem, excluded: excluded}}, tenants...), nil
+	}
+	shared := lane{sem: sem, priorities: []int{}, excluded: excluded}
+	var lanes []lane
+	for _, priority := range priorities {
+		if reserved, ok := reservedLanes[priority]; ok {
+			lanes = append(lanes, lane{sem: reserved, priorities: []int{priority}, excluded: excluded})
+			continue
+		}
+		shared.priorities = append(shared.priorities, priority)
+	}
+	sort.Slice(lanes, func(i, j int) bool { return lanes[i].priorities[0] > lanes[j].priorities[0] })
+	return append(append([]lane{shared}, lanes...), tenants...), nil
+}
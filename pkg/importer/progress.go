@@ -0,0 +1,254 @@
+package importer
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// progress tracks the outcome of a run, to render a live indicator and the
+// final summary.
+type progress struct {
+	mu          sync.Mutex
+	total       int
+	imported    int
+	skipped     int
+	duplicate   int
+	aborted     int
+	blocked     int
+	quarantined int
+	conflicts   int
+	errors      map[string]int
+	classes     map[string]int
+	latency     *latencyStats
+	recent      []ErrorEvent
+	pause       *pauser
+	series      *runStats
+	start       time.Time
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func newProgress(total int) *progress {
+	return &progress{
+		total:   total,
+		errors:  make(map[string]int),
+		classes: make(map[string]int),
+		latency: newLatencyStats(),
+		start:   time.Now(),
+	}
+}
+
+func (p *progress) addTotal(n int) {
+	p.mu.Lock()
+	p.total += n
+	p.mu.Unlock()
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *progress) record(e *Entry, outcome string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if outcome != "aborted" && outcome != "skipped" {
+		p.latency.record(e, time.Since(p.start))
+	}
+	p.series.record(e, outcome)
+	switch outcome {
+	case "imported":
+		p.imported++
+	case "skipped":
+		p.skipped++
+	case "duplicate":
+		p.duplicate++
+	case "aborted":
+		p.aborted++
+	case "blocked":
+		p.blocked++
+	case "quarantined":
+		p.quarantined++
+	default:
+		class := classifyError(e.Err)
+		status := class
+		if e.Status != 0 {
+			status = strconv.Itoa(e.Status)
+		}
+		p.errors[status]++
+		p.classes[class]++
+		p.recordError(e, status)
+	}
+}
+
+// recordConflict counts an imported entry whose response_id conflicts with
+// that of another.
+func (p *progress) recordConflict() {
+	p.mu.Lock()
+	p.conflicts++
+	p.mu.Unlock()
+}
+
+func (p *progress) errored() int {
+	n := 0
+	for _, count := range p.errors {
+		n += count
+	}
+	return n
+}
+
+// errorRate returns the number of entries imported or errored so far, and
+// the ratio of errored ones among them.
+func (p *progress) errorRate() (int, float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	errored := p.errored()
+	processed := p.imported + errored
+	if processed == 0 {
+		return 0, 0
+	}
+	return processed, float64(errored) / float64(processed)
+}
+
+// remaining counts entries left pending, including the aborted ones. It is 0
+// when the total is unknown, in -pipe mode.
+func (p *progress) remaining() int {
+	if remaining := p.total - p.imported - p.skipped - p.duplicate - p.blocked - p.quarantined - p.errored(); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+func (p *progress) line() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	processed := p.imported + p.skipped + p.duplicate + p.aborted + p.blocked + p.quarantined + p.errored()
+	elapsed := time.Since(p.start)
+	rate := float64(processed) / elapsed.Seconds()
+	eta := "-"
+	if rate > 0 {
+		eta = (time.Duration(float64(p.total-processed)/rate) * time.Second).String()
+	}
+	percent := 100.0
+	if p.total > 0 {
+		percent = float64(processed) * 100 / float64(p.total)
+	}
+	line := fmt.Sprintf("%d/%d (%.1f%%) %.1f/s ETA %s, %d errors", processed, p.total, percent, rate, eta, p.errored())
+	if p.pause.isPaused() {
+		line += ", paused"
+	}
+	return line
+}
+
+// render redraws the progress line on stderr at the given interval until
+// finish is called.
+func (p *progress) render(interval time.Duration) {
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				fmt.Fprintf(os.Stderr, "\r\033[K%s\n", p.line())
+				return
+			case <-ticker.C:
+				fmt.Fprintf(os.Stderr, "\r\033[K%s", p.line())
+			}
+		}
+	}()
+}
+
+func (p *progress) finish() {
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+	}
+}
+
+func (p *progress) printSummary() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "imported\t%d\n", p.imported)
+	if p.conflicts > 0 {
+		fmt.Fprintf(w, "  conflicts\t%d\n", p.conflicts)
+	}
+	if p.skipped > 0 {
+		fmt.Fprintf(w, "skipped\t%d\n", p.skipped)
+	}
+	if p.duplicate > 0 {
+		fmt.Fprintf(w, "duplicate\t%d\n", p.duplicate)
+	}
+	if p.aborted > 0 {
+		fmt.Fprintf(w, "aborted\t%d\n", p.aborted)
+	}
+	if p.blocked > 0 {
+		fmt.Fprintf(w, "blocked\t%d\n", p.blocked)
+	}
+	if p.quarantined > 0 {
+		fmt.Fprintf(w, "quarantined\t%d\n", p.quarantined)
+	}
+	fmt.Fprintf(w, "errored\t%d\n", p.errored())
+	statuses := make([]string, 0, len(p.errors))
+	for status := range p.errors {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "  %s\t%d\n", status, p.errors[status])
+	}
+	fmt.Fprintf(w, "remaining\t%d\n", p.remaining())
+	elapsed := time.Since(p.start)
+	fmt.Fprintf(w, "elapsed\t%s\n", elapsed.Round(time.Millisecond))
+	if latency := p.latency.all.latency(); latency.Count > 0 {
+		fmt.Fprintf(w, "rate\t%.1f/s\n", float64(p.imported+p.duplicate+p.errored())/elapsed.Seconds())
+		fmt.Fprintf(w, "latency\tp50 %dms, p95 %dms, p99 %dms, max %dms\n", latency.P50, latency.P95, latency.P99, latency.Max)
+		slowest := make([]string, len(p.latency.slowest))
+		for i, e := range p.latency.slowest {
+			slowest[i] = fmt.Sprintf("%s (%dms)", e.UID, e.LatencyMS)
+		}
+		if len(slowest) > 3 {
+			slowest = slowest[:3]
+		}
+		fmt.Fprintf(w, "slowest\t%s\n", strings.Join(slowest, ", "))
+	}
+	if conns := apiConns.snapshot(); conns.Requests > 0 {
+		connections, protocols := conns.summary()
+		fmt.Fprintf(w, "connections\t%s\n", connections)
+		fmt.Fprintf(w, "protocols\t%s\n", protocols)
+	}
+	w.Flush()
+}
+
+func (p *progress) summaryFields() Fields {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	errors := make(map[string]int, len(p.errors))
+	for status, count := range p.errors {
+		errors[status] = count
+	}
+	return Fields{
+		"imported":    p.imported,
+		"conflicts":   p.conflicts,
+		"skipped":     p.skipped,
+		"duplicate":   p.duplicate,
+		"errored":     p.errored(),
+		"errors":      errors,
+		"aborted":     p.aborted,
+		"blocked":     p.blocked,
+		"quarantined": p.quarantined,
+		"remaining":   p.remaining(),
+		"elapsed_ms":  time.Since(p.start).Milliseconds(),
+		"latency_ms":  p.latency.all.latency(),
+		"connections": apiConns.snapshot(),
+	}
+}
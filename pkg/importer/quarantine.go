@@ -0,0 +1,510 @@
+package importer
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+)
+
+var (
+	argQuarantineTestData = Flags.Bool("quarantine-test-data", false, "quarantine the entries whose payload looks like test data: a value such as test, asdf, qwerty or lorem ipsum, or an email at example.com, test.* or mailinator.com")
+	argQuarantineWords    = Flags.String("quarantine-words", "", "`file` of words or phrases, one per line, quarantining the entries whose payload contains one of them, e.g. profanity markers")
+	argQuarantineEmail    = Flags.String("quarantine-duplicate-email", "", "dot-separated `path` of the author email in the payloads, quarantining the entries with the email of another entry of the run")
+)
+
+// quarantinePatternList is a repeatable flag of "path=regexp" patterns of
+// payload fields quarantining the entries they match.
+type quarantinePatternList []quarantinePattern
+
+type quarantinePattern struct {
+	path string
+	re   *regexp.Regexp
+}
+
+func (q *quarantinePatternList) String() string {
+	patterns := make([]string, len(*q))
+	for i, p := range *q {
+		patterns[i] = p.path + "=" + p.re.String()
+	}
+	return strings.Join(patterns, ", ")
+}
+
+func (q *quarantinePatternList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid quarantine pattern %q, expected path=regexp", value)
+	}
+	re, err := regexp.Compile(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid quarantine pattern %q: %s", value, err)
+	}
+	*q = append(*q, quarantinePattern{parts[0], re})
+	return nil
+}
+
+func (q *quarantinePatternList) reset() {
+	*q = nil
+}
+
+var argQuarantinePatterns quarantinePatternList
+
+func init() {
+	Flags.Var(&argQuarantinePatterns, "quarantine-pattern", "`path=regexp` quarantining the entries whose payload field at this dot-separated path matches the regular expression, e.g. author.name=(?i)^test, repeatable")
+}
+
+var quarantineReviewColumns = []column{
+	{"uid", "%s NOT NULL UNIQUE"},
+	{"decision", "TEXT"},
+	{"reason", "TEXT"},
+	{"reviewed_at", "TEXT"},
+}
+
+var (
+	testDataValue = regexp.MustCompile(`(?i)^\s*(test(ing)?[ _-]?\d*|asdf+|qwerty|dummy|foo ?bar|lorem ipsum\b.*)\s*$`)
+	testDataEmail = regexp.MustCompile(`(?i)^[^@\s]+@(example\.(com|net|org)|test\.[a-z]+|mailinator\.com)$`)
+)
+
+// QuarantineError is an entry that looks suspicious, left quarantined for
+// review instead of being imported.
+type QuarantineError struct {
+	Reason string
+}
+
+func (e *QuarantineError) Error() string {
+	return "quarantined: " + e.Reason
+}
+
+// quarantineRules are the heuristics quarantining entries, along with the
+// emails seen during the run for -quarantine-duplicate-email.
+type quarantineRules struct {
+	store   *sqlStore
+	words   map[string]bool
+	phrases []string
+	mu      sync.Mutex
+	emails  map[string]string
+}
+
+// quarantiner is nil when no heuristic is set.
+var quarantiner *quarantineRules
+
+func setupQuarantine(store Store) error {
+	quarantiner = nil
+	if !*argQuarantineTestData && *argQuarantineWords == "" && *argQuarantineEmail == "" && len(argQuarantinePatterns) == 0 {
+		return nil
+	}
+	s := schemaStore(store)
+	if s == nil {
+		return errors.New("quarantine heuristics need a -db database, they cannot be used with -pipe")
+	}
+	if !s.has("quarantine_reviews", "") {
+		return errors.New("quarantine heuristics need the quarantine_reviews table, run migrate first")
+	}
+	q := &quarantineRules{store: s, words: map[string]bool{}, emails: map[string]string{}}
+	if *argQuarantineWords != "" {
+		f, err := os.Open(*argQuarantineWords)
+		if err != nil {
+			return fmt.Errorf("failed to read quarantine words: %s", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+			switch {
+			case word == "" || strings.HasPrefix(word, "#"):
+			case strings.ContainsAny(word, " -'"):
+				q.phrases = append(q.phrases, word)
+			default:
+				q.words[word] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read quarantine words: %s", err)
+		}
+	}
+	quarantiner = q
+	return nil
+}
+
+// findString returns the dot-separated path and the value of the first
+// string under node, in key order, matching match.
+func findString(node interface{}, path string, match func(string) bool) (string, string, bool) {
+	switch n := node.(type) {
+	case string:
+		return path, n, match(n)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(n))
+		for k := range n {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := k
+			if path != "" {
+				child = path + "." + k
+			}
+			if p, v, ok := findString(n[k], child, match); ok {
+				return p, v, true
+			}
+		}
+	case []interface{}:
+		for i, v := range n {
+			child := fmt.Sprint(i)
+			if path != "" {
+				child = path + "." + child
+			}
+			if p, v, ok := findString(v, child, match); ok {
+				return p, v, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+func isTestData(value string) bool {
+	return testDataValue.MatchString(value) || testDataEmail.MatchString(strings.TrimSpace(value))
+}
+
+// marker returns the word or phrase of -quarantine-words value contains, if
+// any.
+func (q *quarantineRules) marker(value string) string {
+	text := strings.ToLower(value)
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if q.words[word] {
+			return word
+		}
+	}
+	for _, phrase := range q.phrases {
+		if strings.Contains(text, phrase) {
+			return phrase
+		}
+	}
+	return ""
+}
+
+// reason returns why the entry uid with payload doc is quarantined, if it
+// is. The email of the entries that are not is remembered for
+// -quarantine-duplicate-email.
+func (q *quarantineRules) reason(uid string, doc interface{}) string {
+	if *argQuarantineTestData {
+		if path, value, ok := findString(doc, "", isTestData); ok {
+			return fmt.Sprintf("test data %q at %s", truncate(value, 40), path)
+		}
+	}
+	if len(q.words) > 0 || len(q.phrases) > 0 {
+		if path, value, ok := findString(doc, "", func(s string) bool { return q.marker(s) != "" }); ok {
+			return fmt.Sprintf("word %q at %s", q.marker(value), path)
+		}
+	}
+	for _, p := range argQuarantinePatterns {
+		value, found := valueAt(doc, p.path)
+		text, scalar := lintString(value)
+		if found && scalar && p.re.MatchString(text) {
+			return fmt.Sprintf("%s matches %s", p.path, p.re)
+		}
+	}
+	if *argQuarantineEmail != "" {
+		value, _ := valueAt(doc, *argQuarantineEmail)
+		email, _ := value.(string)
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email != "" {
+			q.mu.Lock()
+			first, seen := q.emails[email]
+			if !seen {
+				q.emails[email] = uid
+			}
+			q.mu.Unlock()
+			if seen && first != uid {
+				return fmt.Sprintf("email %s already used by entry %s", email, first)
+			}
+		}
+	}
+	return ""
+}
+
+// released reports whether the entry uid was released from quarantine.
+func (q *quarantineRules) released(uid string) (bool, error) {
+	var decision string
+	err := q.store.db.QueryRow(q.store.dialect.rebind("SELECT decision FROM quarantine_reviews WHERE uid = ?"), uid).Scan(&decision)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return decision == "released", err
+}
+
+// checkQuarantine returns a QuarantineError if the payload of e trips one of
+// the heuristics, unless e was released from quarantine. Payloads that are
+// not JSON are left to the validation.
+func (e *Entry) checkQuarantine() error {
+	if quarantiner == nil {
+		return nil
+	}
+	doc, err := decodeJSON([]byte(e.Payload))
+	if err != nil {
+		return nil
+	}
+	reason := quarantiner.reason(e.UID, doc)
+	if reason == "" {
+		return nil
+	}
+	released, err := quarantiner.released(e.UID)
+	if err != nil {
+		return fmt.Errorf("failed to read the quarantine review of entry %s: %s", e.UID, err)
+	}
+	if released {
+		return nil
+	}
+	return &QuarantineError{reason}
+}
+
+// quarantine finishes e, which looks suspicious, leaving it quarantined until
+// it is released or discarded.
+func (im *Importer) quarantine(e *Entry, err error) {
+	e.Err = err
+	logInfo(e.fields("quarantined"), "entry %s %s", e.UID, err)
+	importMetrics.entryDone("quarantined")
+	im.progress.record(e, "quarantined")
+	im.writer.markErrored(e)
+	im.groups.fail(e)
+	auditTrail.entry("quarantined", e)
+	payloadDeduper.finished(e, false)
+	e.span.set("outcome", "quarantined")
+	e.span.finish(err)
+}
+
+// QuarantinedEntry is an entry left quarantined for review.
+type QuarantinedEntry struct {
+	UID     string `json:"uid"`
+	Reason  string `json:"reason"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// quarantined returns the first limit quarantined entries, all of them if
+// limit is 0, without their payload.
+func (s *sqlStore) quarantined(limit int) ([]QuarantinedEntry, error) {
+	query, args := "SELECT uid, error FROM imports WHERE imported_at IS NULL AND error_class = ? ORDER BY uid", []interface{}{errorClassQuarantined}
+	if limit > 0 {
+		query, args = query+" LIMIT ?", append(args, limit)
+	}
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []QuarantinedEntry
+	for rows.Next() {
+		var q QuarantinedEntry
+		if err := rows.Scan(&q.UID, &q.Reason); err != nil {
+			return nil, err
+		}
+		q.Reason = strings.TrimPrefix(q.Reason, "quarantined: ")
+		entries = append(entries, q)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqlStore) quarantinedEntry(uid string) (QuarantinedEntry, error) {
+	q := QuarantinedEntry{UID: uid}
+	err := s.db.QueryRow(s.dialect.rebind("SELECT error, payload FROM imports WHERE uid = ? AND imported_at IS NULL AND error_class = ?"), uid, errorClassQuarantined).
+		Scan(&q.Reason, &q.Payload)
+	if err == sql.ErrNoRows {
+		return q, fmt.Errorf("no quarantined entry %s", uid)
+	}
+	if err != nil {
+		return q, err
+	}
+	q.Reason = strings.TrimPrefix(q.Reason, "quarantined: ")
+	q.Payload, err = decodePayload(q.Payload)
+	return q, err
+}
+
+// reviewQuarantined records decision for the given quarantined entries, all
+// of them if uids is nil: released entries are set back to pending and
+// imported despite the heuristics, discarded ones are never imported.
+func (s *sqlStore) reviewQuarantined(uids []string, decision string) ([]string, error) {
+	if uids == nil {
+		entries, err := s.quarantined(0)
+		if err != nil {
+			return nil, err
+		}
+		uids = []string{}
+		for _, q := range entries {
+			uids = append(uids, q.UID)
+		}
+	}
+	set := "error = NULL, error_class = NULL, http_status = NULL"
+	if s.has("imports", "error_hash") {
+		set += ", error_hash = NULL"
+	}
+	if decision == "discarded" {
+		set = "error_class = '" + errorClassDiscarded + "'"
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	for _, uid := range uids {
+		var reason string
+		err := tx.QueryRow(s.dialect.rebind("SELECT error FROM imports WHERE uid = ? AND imported_at IS NULL AND error_class = ?"), uid, errorClassQuarantined).Scan(&reason)
+		if err != nil {
+			tx.Rollback()
+			if err == sql.ErrNoRows {
+				return nil, fmt.Errorf("no quarantined entry %s", uid)
+			}
+			return nil, err
+		}
+		queries := []struct {
+			query string
+			args  []interface{}
+		}{
+			{"DELETE FROM quarantine_reviews WHERE uid = ?", []interface{}{uid}},
+			{"INSERT INTO quarantine_reviews (uid, decision, reason, reviewed_at) VALUES (?, ?, ?, ?)",
+				[]interface{}{uid, decision, strings.TrimPrefix(reason, "quarantined: "), now}},
+			{"UPDATE imports SET " + set + " WHERE uid = ?", []interface{}{uid}},
+		}
+		for _, q := range queries {
+			if _, err := tx.Exec(s.dialect.rebind(q.query), q.args...); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return uids, nil
+}
+
+const quarantineUsage = `Usage: %s quarantine <command> [flags] [uid...]
+
+Commands:
+  list               list the quarantined entries with the reason
+  inspect <uid>      print a quarantined entry with its payload
+  release <uid>...   set quarantined entries back to pending, imported despite
+                     the heuristics, all of them with -all
+  discard <uid>...   never import quarantined entries, all of them with -all
+
+`
+
+func runQuarantine(args []string) error {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, quarantineUsage, os.Args[0])
+	}
+	if len(args) == 0 {
+		usage()
+		return errors.New("missing quarantine command")
+	}
+	command := args[0]
+	fs := flag.NewFlagSet("quarantine "+command, flag.ExitOnError)
+	commonFlags(fs)
+	inheritFlags(fs, "audit-file")
+	limit := fs.Int("n", 50, "number of quarantined entries to list, with list")
+	all := fs.Bool("all", false, "review all the quarantined entries, with release and discard")
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+	switch command {
+	case "list", "inspect", "release", "discard":
+	default:
+		usage()
+		return fmt.Errorf("unknown quarantine command %q", command)
+	}
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if err := setupAudit("quarantine " + command); err != nil {
+		return err
+	}
+	defer closeAudit()
+	uids := fs.Args()
+
+	db, d, err := openDB(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	s.detectSchema()
+	defer s.Close()
+
+	switch command {
+	case "list":
+		entries, err := s.quarantined(*limit)
+		if err != nil {
+			return fmt.Errorf("failed to query quarantined entries: %s", err)
+		}
+		if jsonLogs {
+			for _, q := range entries {
+				logInfo(Fields{"uid": q.UID, "reason": q.Reason}, "quarantined entry %s", q.UID)
+			}
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "UID\tREASON")
+		for _, q := range entries {
+			fmt.Fprintf(w, "%s\t%s\n", q.UID, truncate(q.Reason, 100))
+		}
+		return w.Flush()
+
+	case "inspect":
+		if len(uids) != 1 {
+			return errors.New("quarantine inspect needs one uid")
+		}
+		q, err := s.quarantinedEntry(uids[0])
+		if err != nil {
+			return err
+		}
+		out := struct {
+			QuarantinedEntry
+			Payload json.RawMessage `json:"payload"`
+		}{q, json.RawMessage(q.Payload)}
+		if !json.Valid(out.Payload) {
+			raw, _ := json.Marshal(q.Payload)
+			out.Payload = raw
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+
+	default:
+		if !s.has("quarantine_reviews", "") {
+			return errors.New("quarantine " + command + " needs the quarantine_reviews table, run migrate first")
+		}
+		if *all == (len(uids) > 0) {
+			return fmt.Errorf("quarantine %s needs either uids or -all", command)
+		}
+		if *all {
+			uids = nil
+		}
+		decision := "released"
+		if command == "discard" {
+			decision = "discarded"
+		}
+		reviewed, err := s.reviewQuarantined(uids, decision)
+		if err != nil {
+			return fmt.Errorf("failed to review quarantined entries: %s", err)
+		}
+		if decision == "released" {
+			auditTrail.requeued(reviewed)
+			logInfo(Fields{"released": len(reviewed)}, "%d quarantined entries set back to pending", len(reviewed))
+			return nil
+		}
+		for _, uid := range reviewed {
+			auditTrail.record("discarded", uid, nil)
+		}
+		logInfo(Fields{"discarded": len(reviewed)}, "%d quarantined entries discarded", len(reviewed))
+		return nil
+	}
+}
@@ -0,0 +1,57 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// queryParams returns the parameters of the query_params column of e, a JSON
+// object of strings, numbers or booleans, or of arrays of them for repeated
+// parameters.
+func (e *Entry) queryParams() (url.Values, error) {
+	if e.QueryParams == "" {
+		return nil, nil
+	}
+	doc, err := decodeJSON([]byte(e.QueryParams))
+	if err != nil {
+		return nil, &ColumnError{"query_params", err}
+	}
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, &ColumnError{"query_params", errors.New("not a JSON object")}
+	}
+	params := make(url.Values, len(object))
+	for name, value := range object {
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			switch v.(type) {
+			case string, json.Number, bool:
+				params.Add(name, fmt.Sprint(v))
+			default:
+				return nil, &ColumnError{"query_params", fmt.Errorf("%s is not a string, number or boolean", name)}
+			}
+		}
+	}
+	return params, nil
+}
+
+// setQueryParams adds the parameters of the query_params column of e to the
+// query of req, replacing those of the same name.
+func (e *Entry) setQueryParams(req *http.Request) error {
+	params, err := e.queryParams()
+	if err != nil || len(params) == 0 {
+		return err
+	}
+	query := req.URL.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	req.URL.RawQuery = query.Encode()
+	return nil
+}
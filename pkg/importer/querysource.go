@@ -0,0 +1,290 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	argSourceQuery       = Flags.String("source-query", "", "SQL query run against the -source database, whose new rows are loaded into -db before importing, e.g. SELECT id AS uid, ... FROM reviews WHERE id > :cursor ORDER BY id")
+	argSourceTemplate    = Flags.String("source-template", "", "path to a Go text/template rendering the payload of a -source-query row from its columns (default: a JSON object of the columns but the uid)")
+	argSourceCursor      = Flags.String("source-cursor", "", "column of the -source-query rows, which come in its increasing order, whose last value loaded is bound to :cursor in the next sync")
+	argSourceCursorStart = Flags.String("source-cursor-start", "", "value bound to :cursor before any -source-query row was loaded, e.g. 0")
+)
+
+// SourceRow is the value the -source-template is executed with.
+type SourceRow struct {
+	UID     string
+	Columns map[string]interface{}
+}
+
+// querySource loads the rows of a query against another database into the
+// imports table, only inserting the uids not there yet.
+type querySource struct {
+	dsn       string
+	db        *sql.DB
+	dialect   dialect
+	query     string
+	uidColumn string
+	template  *template.Template
+	cursor    string
+}
+
+func openQuerySource(dsn string) (*querySource, error) {
+	db, d, err := openDB(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source database: %s", err)
+	}
+	src := &querySource{dsn: dsn, db: db, dialect: d, query: *argSourceQuery, uidColumn: *argSourceUID, cursor: *argSourceCursor}
+	if strings.Contains(src.query, ":cursor") && src.cursor == "" {
+		db.Close()
+		return nil, fmt.Errorf("-source-query uses :cursor without -source-cursor")
+	}
+	if *argSourceTemplate != "" {
+		t, err := template.New(*argSourceTemplate).Funcs(transformFuncs).Option("missingkey=error").ParseFiles(*argSourceTemplate)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to load source template: %s", err)
+		}
+		src.template = t.Lookup(t.Name())
+	}
+	return src, nil
+}
+
+func (src *querySource) String() string {
+	return redactDSN(src.dsn)
+}
+
+func (src *querySource) Close() error {
+	return src.db.Close()
+}
+
+// name is the key of the query in the sources table, keeping its cursor.
+func (src *querySource) name() string {
+	sum := sha256.Sum256([]byte(src.query))
+	return "query:" + redactDSN(src.dsn) + "#" + hex.EncodeToString(sum[:6])
+}
+
+// sync runs the query from the cursor reached by the last sync, inserts the
+// rows whose uid is new and returns their number.
+func (src *querySource) sync(ctx context.Context, s *sqlStore) (int, error) {
+	name := src.name()
+	cursor, err := s.sourceCursor(name)
+	if err != nil {
+		return 0, err
+	}
+	if cursor == "" {
+		cursor = *argSourceCursorStart
+	}
+	query := src.query
+	var args []interface{}
+	for strings.Contains(query, ":cursor") {
+		query = strings.Replace(query, ":cursor", "?", 1)
+		args = append(args, cursor)
+	}
+	rows, err := src.db.QueryContext(ctx, src.dialect.rebind(query), args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to run -source-query: %s", err)
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	loaded := 0
+	var records []loadRecord
+	for {
+		more := rows.Next()
+		if more {
+			columns, err := scanColumns(rows, names)
+			if err != nil {
+				return loaded, err
+			}
+			record, err := src.record(columns)
+			if err != nil {
+				return loaded, err
+			}
+			records = append(records, record)
+			if src.cursor != "" {
+				value, ok := columns[src.cursor]
+				if !ok {
+					return loaded, fmt.Errorf("no %q column in the -source-query rows", src.cursor)
+				}
+				cursor = fmt.Sprint(value)
+			}
+		}
+		if !more || len(records) >= sourceChunkLines {
+			n, err := s.insertSourceChunk(name, records, cursor)
+			if err != nil {
+				return loaded, err
+			}
+			loaded += n
+			records = records[:0]
+		}
+		if !more {
+			return loaded, rows.Err()
+		}
+	}
+}
+
+// preview runs the query from the cursor reached by the last sync and
+// returns the number of rows it returns, once rendered.
+func (src *querySource) preview(ctx context.Context, s *sqlStore) (int, error) {
+	var cursor string
+	if s.has("sources", "cursor_value") {
+		var err error
+		if cursor, err = s.sourceCursor(src.name()); err != nil {
+			return 0, err
+		}
+	}
+	if cursor == "" {
+		cursor = *argSourceCursorStart
+	}
+	query := src.query
+	var args []interface{}
+	for strings.Contains(query, ":cursor") {
+		query = strings.Replace(query, ":cursor", "?", 1)
+		args = append(args, cursor)
+	}
+	rows, err := src.db.QueryContext(ctx, src.dialect.rebind(query), args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to run -source-query: %s", err)
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for rows.Next() {
+		columns, err := scanColumns(rows, names)
+		if err != nil {
+			return n, err
+		}
+		if _, err := src.record(columns); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// scanColumns reads the current row of rows into a map of its columns, text
+// columns returned as bytes being converted to strings.
+func scanColumns(rows *sql.Rows, names []string) (map[string]interface{}, error) {
+	values := make([]interface{}, len(names))
+	pointers := make([]interface{}, len(names))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return nil, err
+	}
+	columns := make(map[string]interface{}, len(names))
+	for i, name := range names {
+		switch v := values[i].(type) {
+		case []byte:
+			columns[name] = string(v)
+		case time.Time:
+			columns[name] = v.UTC().Format(time.RFC3339)
+		default:
+			columns[name] = v
+		}
+	}
+	return columns, nil
+}
+
+// record renders the payload of a row with -source-template, or else as a
+// JSON object of its columns but the uid.
+func (src *querySource) record(columns map[string]interface{}) (loadRecord, error) {
+	value, ok := columns[src.uidColumn]
+	if !ok || value == nil {
+		return loadRecord{}, fmt.Errorf("no %q column in the -source-query rows", src.uidColumn)
+	}
+	record := loadRecord{UID: fmt.Sprint(value)}
+	if src.template == nil {
+		fields := make(map[string]interface{}, len(columns))
+		for name, value := range columns {
+			if name != src.uidColumn {
+				fields[name] = value
+			}
+		}
+		payload, err := json.Marshal(fields)
+		if err != nil {
+			return record, fmt.Errorf("uid %s: %s", record.UID, err)
+		}
+		record.Payload = string(payload)
+		return record, nil
+	}
+	var out bytes.Buffer
+	if err := src.template.Execute(&out, SourceRow{record.UID, columns}); err != nil {
+		return record, fmt.Errorf("uid %s: failed to render -source-template: %s", record.UID, err)
+	}
+	if !json.Valid(out.Bytes()) {
+		return record, fmt.Errorf("uid %s: -source-template did not render valid JSON", record.UID)
+	}
+	record.Payload = out.String()
+	return record, nil
+}
+
+func (s *sqlStore) sourceCursor(name string) (string, error) {
+	var cursor sql.NullString
+	err := s.db.QueryRow(s.dialect.rebind("SELECT cursor_value FROM sources WHERE object_url = ?"), name).Scan(&cursor)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return cursor.String, err
+}
+
+// insertSourceChunk inserts the records whose uid is new and records cursor
+// in the same transaction, and returns the number of records inserted.
+func (s *sqlStore) insertSourceChunk(name string, records []loadRecord, cursor string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	statement, err := tx.Prepare(s.dialect.rebind(s.dialect.insertNewQuery))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer statement.Close()
+	inserted := 0
+	for _, record := range records {
+		if record.UID == "" {
+			tx.Rollback()
+			return 0, fmt.Errorf("empty uid")
+		}
+		payload, err := sealPayload(record.Payload)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		result, err := statement.Exec(record.UID, payloadArg(payload))
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("uid %s: %s", record.UID, err)
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			inserted += int(n)
+		}
+	}
+	if _, err := tx.Exec(s.dialect.rebind("DELETE FROM sources WHERE object_url = ?"), name); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if _, err := tx.Exec(s.dialect.rebind("INSERT INTO sources (object_url, cursor_value, loaded_at) VALUES (?, ?, ?)"),
+		name, cursor, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return inserted, tx.Commit()
+}
@@ -0,0 +1,96 @@
+package importer
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	argRampUp    = Flags.Duration("ramp-up", 0, "start with 1 worker and raise the concurrency to -j over this `duration`, e.g. 10m, for the autoscaling of the API to keep up")
+	argRampSteps = Flags.Int("ramp-steps", 0, "raise the concurrency in this many equal steps over -ramp-up instead of one worker at a time")
+)
+
+func checkRampUp() error {
+	switch {
+	case *argRampUp < 0:
+		return errors.New("-ramp-up must not be negative")
+	case *argRampSteps < 0:
+		return errors.New("-ramp-steps must not be negative")
+	case *argRampUp > 0 && *argAdaptive:
+		return errors.New("-ramp-up cannot be combined with -adaptive, which already starts from -adaptive-min")
+	}
+	return nil
+}
+
+// rampLevel returns the concurrency elapsed into a ramp of duration from 1 to
+// max, in steps equal steps if not 0.
+func rampLevel(elapsed, duration time.Duration, max, steps int) int {
+	if elapsed >= duration || max <= 1 {
+		return max
+	}
+	fraction := float64(elapsed) / float64(duration)
+	if steps > 0 {
+		fraction = math.Floor(fraction*float64(steps)) / float64(steps)
+	}
+	return 1 + int(fraction*float64(max-1))
+}
+
+// ramp raises the number of shared workers from 1 to its maximum over
+// -ramp-up.
+type ramp struct {
+	workers  *workerLimit
+	max      int
+	duration time.Duration
+	steps    int
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startRamp(workers *workerLimit, max int, duration time.Duration, steps int) *ramp {
+	r := &ramp{workers: workers, max: max, duration: duration, steps: steps, stop: make(chan struct{}), done: make(chan struct{})}
+	workers.set(1)
+	logInfo(Fields{"concurrency": 1, "j": max, "ramp_up": duration.String()}, "ramping up concurrency from 1 to %d over %s", max, duration)
+	interval := time.Second
+	if tick := duration / time.Duration(4*max); tick < interval {
+		interval = tick
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	go r.run(interval)
+	return r
+}
+
+func (r *ramp) run(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start, current := time.Now(), 1
+	for current < r.max {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+		level := rampLevel(time.Since(start), r.duration, r.max, r.steps)
+		if level != current {
+			current = r.workers.set(level)
+			logInfo(Fields{"concurrency": current}, "concurrency ramped up to %d", current)
+		}
+	}
+	logInfo(Fields{"concurrency": current}, "ramp-up done, concurrency at %d", current)
+}
+
+// Stop ends the ramp, leaving the concurrency where it is. It is a no-op on a
+// nil or finished ramp.
+func (r *ramp) Stop() {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() { close(r.stop) })
+	<-r.done
+}
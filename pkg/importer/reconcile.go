@@ -0,0 +1,338 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// reconcileKinds are the differences found by reconcile, in report order.
+var reconcileKinds = []string{"pending", "missing", "changed", "unknown"}
+
+// remoteListing describes how to page through the responses listed by the
+// API.
+type remoteListing struct {
+	path        string
+	itemsPath   string
+	idPath      string
+	uidPath     string
+	nextPath    string
+	pageParam   string
+	cursorParam string
+}
+
+var linkNext = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// idString returns the string or number value, and false if it is neither.
+func idString(value interface{}) (string, bool) {
+	switch id := value.(type) {
+	case string:
+		return id, id != ""
+	case json.Number:
+		return id.String(), true
+	}
+	return "", false
+}
+
+// withParam returns path with the query parameter name set to value.
+func withParam(path, name, value string) string {
+	u, err := url.Parse(path)
+	if err != nil {
+		return path
+	}
+	query := u.Query()
+	query.Set(name, value)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// list calls fn with the uid and response ID of each response listed by the
+// API, following the Link header, the next field of the pages or, failing
+// both, page numbers until an empty page. It returns the number of listed
+// responses without uid.
+func (l *remoteListing) list(ctx context.Context, fn func(uid, id string)) (int, error) {
+	api, err := (&Entry{}).endpoint()
+	if err != nil {
+		return 0, err
+	}
+	unlabelled, page := 0, 1
+	next := l.path
+	if l.pageParam != "" {
+		next = withParam(l.path, l.pageParam, "1")
+	}
+	seen := map[string]bool{}
+	for next != "" && !seen[next] {
+		seen[next] = true
+		target := next
+		if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+			target = api.url + target
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			return unlabelled, err
+		}
+		if err := api.authorize(req); err != nil {
+			return unlabelled, err
+		}
+		resp, _, err := api.send(req)
+		if err != nil {
+			return unlabelled, fmt.Errorf("failed to list responses: %w", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return unlabelled, fmt.Errorf("failed to list responses: %w", &APIError{resp.StatusCode, string(body)})
+		}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var doc interface{}
+		if err := decoder.Decode(&doc); err != nil {
+			return unlabelled, &ParseError{string(body)}
+		}
+		items, ok := doc, true
+		if l.itemsPath != "" {
+			items, ok = valueAt(doc, l.itemsPath)
+		}
+		list, isList := items.([]interface{})
+		if !ok || !isList {
+			return unlabelled, fmt.Errorf("no list of responses at %q in %s", l.itemsPath, truncate(string(body), 200))
+		}
+		for _, item := range list {
+			value, _ := valueAt(item, l.idPath)
+			id, hasID := idString(value)
+			value, _ = valueAt(item, l.uidPath)
+			uid, hasUID := idString(value)
+			if !hasID || !hasUID {
+				unlabelled++
+				continue
+			}
+			fn(uid, id)
+		}
+		logInfo(Fields{"page": page, "responses": len(list)}, "listed page %d: %d responses", page, len(list))
+		page++
+
+		next = ""
+		if m := linkNext.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			next = m[1]
+		} else if value, found := valueAt(doc, l.nextPath); found && l.nextPath != "" {
+			if link, ok := idString(value); ok {
+				if strings.HasPrefix(link, "/") || strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://") {
+					next = link
+				} else {
+					next = withParam(l.path, l.cursorParam, link)
+				}
+			}
+		} else if l.pageParam != "" && len(list) > 0 {
+			next = withParam(l.path, l.pageParam, strconv.Itoa(page))
+		}
+	}
+	return unlabelled, nil
+}
+
+// reconcileDifference is an entry whose local and remote states disagree.
+type reconcileDifference struct {
+	kind   string
+	uid    string
+	local  string
+	remote string
+}
+
+// reconcile compares remote, the response ID of the uids listed by the API,
+// with the entries of s, those imported in [since, until) only for missing
+// ones, and calls fn with each difference in uid order.
+func reconcile(s *sqlStore, remote map[string]string, since, until string, fn func(d reconcileDifference) error) error {
+	rows, err := s.query("SELECT uid, response_id, imported_at, error FROM imports WHERE " + s.createsOnly() + " ORDER BY uid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid string
+		var responseID, importedAt, errMsg sql.NullString
+		if err := rows.Scan(&uid, &responseID, &importedAt, &errMsg); err != nil {
+			return err
+		}
+		id, listed := remote[uid]
+		delete(remote, uid)
+		var d *reconcileDifference
+		switch {
+		case listed && !importedAt.Valid:
+			state := "pending"
+			if errMsg.Valid {
+				state = "errored"
+			}
+			d = &reconcileDifference{"pending", uid, state, id}
+		case listed && responseID.String != id:
+			d = &reconcileDifference{"changed", uid, responseID.String, id}
+		case !listed && importedAt.Valid && responseID.Valid &&
+			(since == "" || importedAt.String >= since) && (until == "" || importedAt.String < until):
+			d = &reconcileDifference{"missing", uid, responseID.String, "-"}
+		}
+		if d != nil {
+			if err := fn(*d); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	uids := make([]string, 0, len(remote))
+	for uid := range remote {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	for _, uid := range uids {
+		if err := fn(reconcileDifference{"unknown", uid, "-", remote[uid]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkRemote marks the entry uid, not imported yet, as imported as the
+// response id the API already holds.
+func (s *sqlStore) linkRemote(uid, id string) error {
+	query, args := s.updateQuery("imports", []assignment{
+		{"response_id", id},
+		{"imported_at", time.Now().UTC().Format(time.RFC3339)},
+		{"error", nil},
+		{"error_class", nil},
+		{"http_status", nil},
+		{"error_hash", nil},
+		{"errored_at", nil},
+	}, "uid = ? AND imported_at IS NULL", uid)
+	_, err := s.exec(query, args...)
+	return err
+}
+
+func runReconcile(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	commonFlags(fs)
+	apiFlags(fs)
+	inheritFlags(fs, "response-id-path")
+	var l remoteListing
+	fs.StringVar(&l.path, "list", "/responses", "API path and query listing the responses created by the import, e.g. '/responses?source=migration-2024'")
+	fs.StringVar(&l.itemsPath, "items-path", "results", "dot-separated path of the list of responses in each page, empty if the page is the list")
+	fs.StringVar(&l.uidPath, "uid-path", "external_id", "dot-separated path of the uid of the entry in each listed response")
+	fs.StringVar(&l.nextPath, "next-path", "next", "dot-separated path of the URL or cursor of the next page in each page")
+	fs.StringVar(&l.pageParam, "page-param", "page", "query parameter numbering the pages when they give no next page, empty for a single page")
+	fs.StringVar(&l.cursorParam, "cursor-param", "cursor", "query parameter the cursor of the next page is sent in")
+	since := fs.String("since", "", "only responses created from this date or RFC 3339 time")
+	until := fs.String("until", "", "only responses created before this date or RFC 3339 time")
+	sinceParam := fs.String("since-param", "created_after", "query parameter -since is sent in")
+	untilParam := fs.String("until-param", "created_before", "query parameter -until is sent in")
+	link := fs.Bool("link", false, "mark the pending or errored entries the API already holds as imported as the listed response, so that runs skip them")
+	summaryOnly := fs.Bool("summary", false, "only print the number of differences of each kind")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s reconcile [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	l.idPath = *argResponseID
+	var err error
+	for _, window := range []struct {
+		value *string
+		param string
+	}{{since, *sinceParam}, {until, *untilParam}} {
+		if *window.value == "" {
+			continue
+		}
+		if *window.value, err = parseTimestamp(*window.value); err != nil {
+			return err
+		}
+		l.path = withParam(l.path, window.param, *window.value)
+	}
+	if *since != "" && *until != "" && *since >= *until {
+		return errors.New("-since must be before -until")
+	}
+	if err := setupAPI(1); err != nil {
+		return err
+	}
+	defer spans.Close()
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+	s := schemaStore(store)
+
+	remote := map[string]string{}
+	duplicates := 0
+	unlabelled, err := l.list(context.Background(), func(uid, id string) {
+		if previous, ok := remote[uid]; ok && previous != id {
+			duplicates++
+			logError(Fields{"uid": uid, "response_id": id, "other_response_id": previous}, "entry %s is listed twice, as %s and %s", uid, previous, id)
+		}
+		remote[uid] = id
+	})
+	if err != nil {
+		return err
+	}
+	listed := len(remote)
+	logInfo(Fields{"listed": listed, "unlabelled": unlabelled, "duplicates": duplicates},
+		"%d responses listed, %d without uid, %d uids listed twice", listed, unlabelled, duplicates)
+
+	counts := make(map[string]int)
+	linked := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if !*summaryOnly && !jsonLogs {
+		fmt.Fprintln(w, "DIFFERENCE\tUID\tLOCAL\tREMOTE")
+	}
+	err = reconcile(s, remote, *since, *until, func(d reconcileDifference) error {
+		counts[d.kind]++
+		if *link && d.kind == "pending" {
+			if err := s.linkRemote(d.uid, d.remote); err != nil {
+				return fmt.Errorf("failed to link entry %s: %s", d.uid, err)
+			}
+			linked++
+		}
+		switch {
+		case *summaryOnly:
+		case jsonLogs:
+			logInfo(Fields{"difference": d.kind, "uid": d.uid, "local": d.local, "remote": d.remote}, "entry %s %s", d.uid, d.kind)
+		default:
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.kind, d.uid, d.local, d.remote)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reconcile: %s", err)
+	}
+	if *link {
+		logInfo(Fields{"linked": linked}, "%d entries linked to their existing response", linked)
+	}
+	if jsonLogs {
+		fields := Fields{"listed": listed}
+		for _, kind := range reconcileKinds {
+			fields[kind] = counts[kind]
+		}
+		logInfo(fields, "database reconciled")
+		return nil
+	}
+	if !*summaryOnly {
+		fmt.Fprintln(w)
+	}
+	for _, kind := range reconcileKinds {
+		fmt.Fprintf(w, "%s\t%d\n", kind, counts[kind])
+	}
+	return w.Flush()
+}
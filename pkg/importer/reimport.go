@@ -0,0 +1,85 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	argReimportSince    = Flags.String("reimport-since", "", "before importing, set the entries imported at or after this date or RFC 3339 time back to pending, to send them again")
+	argReimportUntil    = Flags.String("reimport-until", "", "before importing, set the entries imported before this date or RFC 3339 time back to pending, to send them again")
+	argReimportUpstream = Flags.String("reimport-upstream", "delete", "what to do with the responses of the -reimport-since/-reimport-until entries: delete them in the API first, or keep them, once removed otherwise")
+)
+
+// reimportFilter returns the filter of the entries -reimport-since and
+// -reimport-until set back to pending, nil without them.
+func reimportFilter() (*RequeueFilter, error) {
+	if *argReimportSince == "" && *argReimportUntil == "" {
+		return nil, nil
+	}
+	if *argReimportUpstream != "delete" && *argReimportUpstream != "keep" {
+		return nil, fmt.Errorf("invalid -reimport-upstream %q, expected delete or keep", *argReimportUpstream)
+	}
+	if *argCheckpoint != "" || *argPipe {
+		return nil, errors.New("-reimport-since and -reimport-until cannot be used with -checkpoint or -pipe")
+	}
+	filter := &RequeueFilter{State: "imported"}
+	var err error
+	if *argReimportSince != "" {
+		if filter.After, err = parseTimestamp(*argReimportSince); err != nil {
+			return nil, err
+		}
+	}
+	if *argReimportUntil != "" {
+		if filter.Before, err = parseTimestamp(*argReimportUntil); err != nil {
+			return nil, err
+		}
+	}
+	if filter.After != "" && filter.Before != "" && filter.Before <= filter.After {
+		return nil, fmt.Errorf("-reimport-until %s is not after -reimport-since %s", *argReimportUntil, *argReimportSince)
+	}
+	return filter, nil
+}
+
+// reimportRange describes the range of filter in log messages.
+func reimportRange(filter *RequeueFilter) string {
+	switch {
+	case filter.After == "":
+		return "before " + filter.Before
+	case filter.Before == "":
+		return "since " + filter.After
+	}
+	return "between " + filter.After + " and " + filter.Before
+}
+
+// reimport sets the imported entries matching filter back to pending, after
+// deleting their responses unless -reimport-upstream is keep, or only counts
+// them if dryRun.
+func reimport(store Store, filter *RequeueFilter, dryRun bool) error {
+	within := reimportRange(filter)
+	if dryRun {
+		n, err := store.Requeue(filter, true)
+		if err != nil {
+			return fmt.Errorf("failed to count entries to reimport: %s", err)
+		}
+		logInfo(Fields{"matching": n}, "%d entries imported %s would be reimported", n, within)
+		return nil
+	}
+	if *argReimportUpstream == "keep" {
+		n, err := store.Requeue(filter, false)
+		if err != nil {
+			return fmt.Errorf("failed to set entries back to pending: %s", err)
+		}
+		logInfo(Fields{"requeued": n}, "%d entries imported %s set back to pending, keeping their responses", n, within)
+		return nil
+	}
+	rolledBack, failed, err := rollbackEntries(store, filter, *argConcurrency, *argPageSize)
+	if err != nil {
+		return err
+	}
+	logInfo(Fields{"rolled_back": rolledBack, "failed": failed}, "%d entries imported %s rolled back and set back to pending, %d failed", rolledBack, within, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d entries could not be rolled back, stopping before reimporting the others", failed)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package importer
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// workerLimit lowers the number of workers of a semaphore, and raises it back
+// up to its capacity, by parking the tokens taken off like the adaptive
+// tuner does.
+type workerLimit struct {
+	mu     sync.Mutex
+	sem    chan bool
+	parked int
+}
+
+func newWorkerLimit(sem chan bool) *workerLimit {
+	return &workerLimit{sem: sem}
+}
+
+// set changes the number of workers to n, between 1 and the capacity of the
+// semaphore, waiting for busy workers to finish when lowering it, and
+// returns the number set.
+func (l *workerLimit) set(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n > cap(l.sem) {
+		n = cap(l.sem)
+	}
+	if n < 1 {
+		n = 1
+	}
+	for cap(l.sem)-l.parked > n {
+		<-l.sem
+		l.parked++
+	}
+	for cap(l.sem)-l.parked < n {
+		l.sem <- true
+		l.parked--
+	}
+	return n
+}
+
+// Reload applies the settings of the -config file that can change during a
+// run: j, window and max-bandwidth, and the concurrency and rate of the
+// tenants. Settings missing from the file, or given on the command line or in
+// the environment, are left as they are.
+func (im *Importer) Reload() {
+	if im.multi != nil {
+		im.multi.do((*Importer).Reload)
+		return
+	}
+	if *argConfig == "" {
+		logInfo(nil, "no -config file to reload settings from")
+		return
+	}
+	file, err := loadConfigFile(*argConfig)
+	if err != nil {
+		logError(Fields{"config": *argConfig, "error": err}, "failed to reload settings: %s", err)
+		return
+	}
+	logInfo(Fields{"config": *argConfig}, "reloading settings from %s", *argConfig)
+	for _, name := range []string{"j", "window", "max-bandwidth"} {
+		if _, ok := file[name]; ok && fixedSettings[name] {
+			logInfo(Fields{"setting": name}, "%s is set on the command line or in the environment, not reloading it", name)
+			delete(file, name)
+		}
+	}
+	if value, ok := file["j"]; ok {
+		im.reloadConcurrency(fmt.Sprint(value))
+	}
+	if value, ok := file["window"]; ok {
+		im.reloadWindow(fmt.Sprint(value))
+	}
+	if value, ok := file["max-bandwidth"]; ok {
+		reloadBandwidth(fmt.Sprint(value))
+	}
+	configs, err := tenantConfigs(file)
+	if err != nil {
+		logError(Fields{"config": *argConfig, "error": err}, "failed to reload tenants: %s", err)
+		return
+	}
+	for name, config := range configs {
+		im.reloadTenant(name, config)
+	}
+}
+
+// reloadConcurrency sets the number of shared workers, in the background as
+// lowering it waits for busy workers to finish their entries.
+func (im *Importer) reloadConcurrency(value string) {
+	n, err := strconv.Atoi(value)
+	switch {
+	case err != nil || n < 1:
+		logError(Fields{"j": value}, "invalid concurrency %q, ignoring it", value)
+		return
+	case im.workers == nil:
+		return
+	case *argAdaptive:
+		logInfo(nil, "concurrency is tuned by -adaptive, ignoring j")
+		return
+	}
+	im.ramp.Stop()
+	if n > cap(im.sem) {
+		logInfo(Fields{"j": n, "max": cap(im.sem)}, "concurrency cannot be raised above its initial %d", cap(im.sem))
+	}
+	go func() {
+		n := im.workers.set(n)
+		logInfo(Fields{"concurrency": n}, "concurrency set to %d", n)
+	}()
+}
+
+func (im *Importer) reloadWindow(value string) {
+	var window *timeWindow
+	if value != "" {
+		var err error
+		if window, err = parseWindow(value); err != nil {
+			logError(Fields{"window": value, "error": err}, "%s, ignoring it", err)
+			return
+		}
+	}
+	im.reloadMu.Lock()
+	im.window = window
+	im.reloadMu.Unlock()
+	if window == nil {
+		logInfo(nil, "import window removed")
+		return
+	}
+	logInfo(Fields{"window": window.String()}, "import window set to %s", window)
+}
+
+// currentWindow returns the import window, which Reload can replace.
+func (im *Importer) currentWindow() *timeWindow {
+	im.reloadMu.Lock()
+	defer im.reloadMu.Unlock()
+	return im.window
+}
+
+func reloadBandwidth(value string) {
+	if apiBandwidth == nil {
+		logInfo(nil, "-max-bandwidth can only be reloaded when set at the start of the run, ignoring it")
+		return
+	}
+	rate, err := parseBandwidth(value)
+	if err != nil {
+		logError(Fields{"max_bandwidth": value, "error": err}, "%s, ignoring it", err)
+		return
+	}
+	apiBandwidth.mu.Lock()
+	apiBandwidth.rate = rate
+	apiBandwidth.mu.Unlock()
+	logInfo(Fields{"max_bandwidth": value}, "bandwidth limit set to %s", value)
+}
+
+func (im *Importer) reloadTenant(name string, config TenantConfig) {
+	p, ok := tenants[name]
+	if !ok {
+		logInfo(Fields{"tenant": name}, "tenant %s is new, it is only taken into account by the next run", name)
+		return
+	}
+	p.rate.setRate(config.Rate)
+	limit, ok := im.tenantWorkers[name]
+	switch {
+	case ok && config.Concurrency > 0:
+		go func() {
+			n := limit.set(config.Concurrency)
+			logInfo(Fields{"tenant": name, "concurrency": n, "rate": config.Rate}, "concurrency of tenant %s set to %d", name, n)
+		}()
+		return
+	case ok || config.Concurrency > 0:
+		logInfo(Fields{"tenant": name}, "tenant %s can only get or lose workers of its own in the next run", name)
+	}
+	logInfo(Fields{"tenant": name, "rate": config.Rate}, "rate of tenant %s set to %g", name, config.Rate)
+}
@@ -0,0 +1,234 @@
+package importer
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequeueFilter selects the entries set back to pending by requeue.
+type RequeueFilter struct {
+	State    string
+	Statuses [][2]int
+	Classes  []string
+	Before   string
+	After    string
+	RunID    string
+	Where    string
+}
+
+// parseStatusRanges parses a comma-separated list of HTTP statuses and
+// ranges of statuses, e.g. 201,500-599.
+func parseStatusRanges(list string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, value := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(value), "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", value)
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil || high < low {
+				return nil, fmt.Errorf("invalid status range %q", value)
+			}
+		}
+		ranges = append(ranges, [2]int{low, high})
+	}
+	return ranges, nil
+}
+
+// parseTimestamp accepts a date or an RFC 3339 time, and returns it in the
+// format of imported_at.
+func parseTimestamp(value string) (string, error) {
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		if t, err = time.Parse(time.RFC3339, value); err != nil {
+			return "", fmt.Errorf("invalid time %q, expected a date like 2024-01-01 or an RFC 3339 time", value)
+		}
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+// condition returns the SQL condition selecting the entries of f in the
+// database of s, and its arguments. The columns s lacks are NULL, those
+// entries being left out by the filters on them.
+func (f *RequeueFilter) condition(s *sqlStore) (string, []interface{}, error) {
+	var conditions []string
+	var args []interface{}
+	switch f.State {
+	case "imported":
+		conditions = append(conditions, "imported_at IS NOT NULL AND payload <> ''")
+	case "errored":
+		conditions = append(conditions, "imported_at IS NULL AND error IS NOT NULL AND "+s.col("dead_lettered_at")+" IS NULL")
+	case "all":
+		conditions = append(conditions, "(imported_at IS NOT NULL OR error IS NOT NULL) AND "+s.col("dead_lettered_at")+" IS NULL AND payload <> ''")
+	default:
+		return "", nil, fmt.Errorf("invalid state %q, expected imported, errored or all", f.State)
+	}
+	if len(f.Statuses) > 0 {
+		var ranges []string
+		for _, r := range f.Statuses {
+			ranges = append(ranges, s.col("http_status")+" BETWEEN ? AND ?")
+			args = append(args, r[0], r[1])
+		}
+		conditions = append(conditions, "("+strings.Join(ranges, " OR ")+")")
+	}
+	if len(f.Classes) > 0 {
+		conditions = append(conditions, s.col("error_class")+" IN ("+placeholders(len(f.Classes))+")")
+		for _, class := range f.Classes {
+			args = append(args, class)
+		}
+	}
+	if f.Before != "" {
+		conditions = append(conditions, s.processedAt()+" < ?")
+		args = append(args, f.Before)
+	}
+	if f.After != "" {
+		conditions = append(conditions, s.processedAt()+" >= ?")
+		args = append(args, f.After)
+	}
+	if f.RunID != "" {
+		conditions = append(conditions, s.col("run_id")+" = ?")
+		args = append(args, f.RunID)
+	}
+	if f.Where != "" {
+		conditions = append(conditions, "("+f.Where+")")
+	}
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// processedAt returns the time an entry was imported or errored at, the start
+// of its run for the errors saved before errored_at was recorded.
+func (s *sqlStore) processedAt() string {
+	at := "COALESCE(imported_at, " + s.col("errored_at")
+	if s.has("runs", "") && s.has("imports", "run_id") {
+		at += ", (SELECT started_at FROM runs WHERE runs.id = imports.run_id)"
+	}
+	return at + ")"
+}
+
+// requeueColumns are the optional columns of the outcome of an entry, cleared
+// by requeue if the database has them.
+var requeueColumns = []string{"error_class", "http_status", "duplicate_of", "verified_at", "verify_error", "claimed_by", "error_hash", "response_conflict", "errored_at"}
+
+// requeueSet returns the assignments setting entries back to pending, keeping
+// the response_id updates and deletions apply to. idempotency_key comes first,
+// as MySQL evaluates assignments in order.
+func (s *sqlStore) requeueSet() string {
+	var set []string
+	if s.has("imports", "idempotency_key") {
+		set = append(set, "idempotency_key = CASE WHEN imported_at IS NOT NULL THEN NULL ELSE idempotency_key END")
+	}
+	set = append(set, "imported_at = NULL")
+	if s.has("imports", "operation") {
+		set = append(set, "response_id = CASE WHEN operation IN ('update', 'delete') THEN response_id END")
+	} else {
+		set = append(set, "response_id = NULL")
+	}
+	set = append(set, "error = NULL")
+	for _, column := range requeueColumns {
+		if s.has("imports", column) {
+			set = append(set, column+" = NULL")
+		}
+	}
+	return strings.Join(set, ", ")
+}
+
+// Requeue sets the entries matching filter back to pending, or only counts
+// them if dryRun. Imported entries lose their idempotency key, so that they
+// are created anew instead of replayed by the API.
+func (s *sqlStore) Requeue(filter *RequeueFilter, dryRun bool) (int64, error) {
+	condition, args, err := filter.condition(s)
+	if err != nil {
+		return 0, err
+	}
+	if dryRun {
+		var n int64
+		err := s.db.QueryRow(s.dialect.rebind("SELECT COUNT(*) FROM imports WHERE "+condition), args...).Scan(&n)
+		return n, err
+	}
+	uids, err := s.uidsWhere(condition, args...)
+	if err != nil {
+		return 0, err
+	}
+	result, err := s.exec("UPDATE imports SET "+s.requeueSet()+" WHERE "+condition, args...)
+	if err != nil {
+		return 0, err
+	}
+	auditTrail.requeued(uids)
+	return result.RowsAffected()
+}
+
+func runRequeue(args []string) error {
+	fs := flag.NewFlagSet("requeue", flag.ExitOnError)
+	commonFlags(fs)
+	inheritFlags(fs, "audit-file")
+	state := fs.String("state", "all", "entries to requeue: imported, errored or all")
+	statuses := fs.String("status", "", "comma-separated HTTP statuses or ranges of statuses, e.g. 201,500-599")
+	classes := fs.String("class", "", "comma-separated error classes ("+strings.Join(errorClasses, ",")+")")
+	before := fs.String("before", "", "only entries imported or errored before this date or RFC 3339 time")
+	after := fs.String("after", "", "only entries imported or errored at or after this date or RFC 3339 time")
+	runID := fs.String("run", "", "only entries processed by this run id")
+	where := fs.String("where", "", "only entries matching this SQL condition on the imports table")
+	all := fs.Bool("all", false, "requeue all the entries of -state when no other filter is given")
+	dryRun := fs.Bool("dry-run", false, "only count the entries that would be requeued")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s requeue [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := setupAudit("requeue"); err != nil {
+		return err
+	}
+	defer closeAudit()
+
+	filter := &RequeueFilter{State: *state, RunID: *runID, Where: *where}
+	var err error
+	if *statuses != "" {
+		if filter.Statuses, err = parseStatusRanges(*statuses); err != nil {
+			return err
+		}
+	}
+	if *classes != "" {
+		if filter.Classes, err = parseErrorClasses(*classes); err != nil {
+			return err
+		}
+	}
+	if *before != "" {
+		if filter.Before, err = parseTimestamp(*before); err != nil {
+			return err
+		}
+	}
+	if *after != "" {
+		if filter.After, err = parseTimestamp(*after); err != nil {
+			return err
+		}
+	}
+	if !*all && *statuses == "" && *classes == "" && *before == "" && *after == "" && *runID == "" && *where == "" {
+		return errors.New("a filter is needed, or -all to requeue every entry of -state")
+	}
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+
+	n, err := store.Requeue(filter, *dryRun)
+	if err != nil {
+		return fmt.Errorf("failed to requeue entries: %s", err)
+	}
+	if *dryRun {
+		logInfo(Fields{"matching": n}, "%d entries would be set back to pending", n)
+		return nil
+	}
+	logInfo(Fields{"requeued": n}, "%d entries set back to pending", n)
+	return nil
+}
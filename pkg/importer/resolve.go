@@ -0,0 +1,284 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var argResolveCache = Flags.String("resolve-cache", "", "JSON `file` keeping the -resolve references found in the API across runs")
+
+// referenceList is a repeatable flag of "path=/api/path/{}" references.
+type referenceList []reference
+
+// reference is a payload field referencing an API resource, e.g. a place by
+// its external ID, checked by requesting the API path with {} replaced by
+// the field value.
+type reference struct {
+	field string
+	path  string
+}
+
+func (r *referenceList) String() string {
+	refs := make([]string, len(*r))
+	for i, ref := range *r {
+		refs[i] = ref.field + "=" + ref.path
+	}
+	return strings.Join(refs, ", ")
+}
+
+func (r *referenceList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || !strings.Contains(parts[1], "{}") {
+		return fmt.Errorf("invalid reference %q, expected field=/api/path/{}", value)
+	}
+	*r = append(*r, reference{parts[0], parts[1]})
+	return nil
+}
+
+func (r *referenceList) reset() {
+	*r = nil
+}
+
+var argResolve referenceList
+
+func init() {
+	Flags.Var(&argResolve, "resolve", "`field=/api/path/{}` reference of the payloads checked in the API before sending them, {} being the field value, repeatable; entries referencing missing resources are blocked")
+}
+
+// ReferenceError lists the references of an entry missing in the API, along
+// with the failure to create them with -resolve-create if any.
+type ReferenceError struct {
+	Missing []string
+	Err     error
+}
+
+func (e *ReferenceError) Error() string {
+	msg := "missing references: " + strings.Join(e.Missing, ", ")
+	if e.Err != nil {
+		msg += " (" + e.Err.Error() + ")"
+	}
+	return msg
+}
+
+// referenceCache remembers which resources exist in the API, for the run and,
+// for those found, in -resolve-cache. A resource being requested is only
+// requested once, the other entries referencing it waiting for the answer.
+type referenceCache struct {
+	mu       sync.Mutex
+	found    map[string]bool
+	inFlight map[string]chan struct{}
+}
+
+var references *referenceCache
+
+func setupResolve(store Store) error {
+	references = nil
+	if len(argResolve) == 0 {
+		return nil
+	}
+	references = &referenceCache{found: make(map[string]bool), inFlight: make(map[string]chan struct{})}
+	if *argResolveCache != "" {
+		content, err := ioutil.ReadFile(*argResolveCache)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return fmt.Errorf("failed to read resolve cache: %s", err)
+		default:
+			var found []string
+			if err := json.Unmarshal(content, &found); err != nil {
+				return fmt.Errorf("invalid resolve cache %s: %s", *argResolveCache, err)
+			}
+			for _, key := range found {
+				references.found[key] = true
+			}
+			logInfo(Fields{"references": len(found)}, "%d references known to exist loaded from %s", len(found), *argResolveCache)
+		}
+	}
+	n, err := store.ResetErrors([]string{errorClassBlocked})
+	if err != nil {
+		return fmt.Errorf("failed to unblock entries: %s", err)
+	}
+	if n > 0 {
+		logInfo(Fields{"unblocked": n}, "%d blocked entries set back to pending to resolve their references again", n)
+	}
+	return nil
+}
+
+// save writes the references found to -resolve-cache.
+func (c *referenceCache) save() error {
+	if c == nil || *argResolveCache == "" {
+		return nil
+	}
+	c.mu.Lock()
+	found := make([]string, 0, len(c.found))
+	for key, exists := range c.found {
+		if exists {
+			found = append(found, key)
+		}
+	}
+	c.mu.Unlock()
+	sort.Strings(found)
+	content, err := json.MarshalIndent(found, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*argResolveCache, append(content, '\n'), 0644)
+}
+
+// lookup returns whether the resource at key exists if known. Otherwise, it
+// returns a channel closed once the resource requested by another entry is
+// known, or nil if the caller has to request it and call done.
+func (c *referenceCache) lookup(key string) (exists, ok bool, wait chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if exists, ok = c.found[key]; ok {
+		return exists, true, nil
+	}
+	if wait = c.inFlight[key]; wait == nil {
+		c.inFlight[key] = make(chan struct{})
+	}
+	return false, false, wait
+}
+
+// known reports whether the resource at key is known to exist.
+func (c *referenceCache) known(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.found[key]
+}
+
+func (c *referenceCache) set(key string, exists bool) {
+	c.mu.Lock()
+	c.found[key] = exists
+	c.mu.Unlock()
+}
+
+// done records whether the resource at key exists, unless it could not be
+// requested.
+func (c *referenceCache) done(key string, exists bool, err error) {
+	c.mu.Lock()
+	if err == nil {
+		c.found[key] = exists
+	}
+	close(c.inFlight[key])
+	delete(c.inFlight, key)
+	c.mu.Unlock()
+}
+
+// resolve checks that the resources referenced by the payload of e exist,
+// failing with a ReferenceError otherwise. It is a no-op without -resolve.
+func (e *Entry) resolve(ctx context.Context) error {
+	if references == nil {
+		return nil
+	}
+	doc, err := decodeJSON([]byte(e.Payload))
+	if err != nil {
+		return &ParseError{e.Payload}
+	}
+	api, err := e.endpoint()
+	if err != nil {
+		return err
+	}
+	var missing []missingReference
+	for _, ref := range argResolve {
+		value, found := valueAt(doc, ref.field)
+		id, scalar := lintString(value)
+		if !found || value == nil || !scalar || id == "" {
+			continue
+		}
+		path := strings.Replace(ref.path, "{}", url.PathEscape(id), -1)
+		exists, err := referenceExists(ctx, api, path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s %s: %w", ref.field, id, err)
+		}
+		if !exists {
+			missing = append(missing, missingReference{ref.field, id, api.url + path})
+		}
+	}
+	var createErr error
+	if len(missing) > 0 && resourceCreator != nil {
+		missing, createErr = resourceCreator.create(ctx, api, missing)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	refs := make([]string, len(missing))
+	for i, m := range missing {
+		refs[i] = m.field + "=" + m.id
+	}
+	return &ReferenceError{refs, createErr}
+}
+
+// referenceExists tells whether the resource at path exists, from the cache
+// or else the API.
+func referenceExists(ctx context.Context, api *endpoint, path string) (bool, error) {
+	key := api.url + path
+	for {
+		exists, ok, wait := references.lookup(key)
+		if ok {
+			return exists, nil
+		}
+		if wait == nil {
+			break
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	exists, err := requestReference(ctx, api, key)
+	references.done(key, exists, err)
+	return exists, err
+}
+
+// requestReference requests the resource at key, which exists when the API
+// answers with a 200 whose body is not an empty list.
+func requestReference(ctx context.Context, api *endpoint, key string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", key, nil)
+	if err != nil {
+		return false, err
+	}
+	if err := api.authorize(req); err != nil {
+		return false, err
+	}
+	resp, _, err := api.send(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	var exists bool
+	switch resp.StatusCode {
+	case http.StatusOK:
+		exists = !bytes.Equal(bytes.TrimSpace(body), []byte("[]"))
+	case http.StatusNotFound:
+	default:
+		return false, &APIError{resp.StatusCode, string(body)}
+	}
+	return exists, nil
+}
+
+// block finishes e, whose references are missing in the API, leaving it
+// blocked until a later run resolves them.
+func (im *Importer) block(e *Entry, err error) {
+	e.Err = err
+	logInfo(e.fields("blocked"), "entry %s blocked: %s", e.UID, err)
+	importMetrics.entryDone("blocked")
+	im.progress.record(e, "blocked")
+	im.writer.markErrored(e)
+	im.groups.fail(e)
+	auditTrail.entry("blocked", e)
+	payloadDeduper.finished(e, false)
+	e.span.set("outcome", "blocked")
+	e.span.finish(err)
+}
@@ -0,0 +1,118 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// responseFieldList is a repeatable flag of "column=path" fields of the API
+// responses stored in columns of the imports table.
+type responseFieldList []responseField
+
+// responseField is a field of the API responses, at a dot-separated path,
+// stored in a column of the imports table.
+type responseField struct {
+	column string
+	path   string
+}
+
+func (r *responseFieldList) String() string {
+	fields := make([]string, len(*r))
+	for i, f := range *r {
+		fields[i] = f.column + "=" + f.path
+	}
+	return strings.Join(fields, ", ")
+}
+
+func (r *responseFieldList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[1] == "" || !identifier.MatchString(parts[0]) {
+		return fmt.Errorf("invalid response field %q, expected column=path", value)
+	}
+	column := strings.ToLower(parts[0])
+	for _, c := range columns {
+		if c.name == column {
+			return fmt.Errorf("invalid response field %q, %s is a column of the importer", value, column)
+		}
+	}
+	for _, f := range *r {
+		if f.column == column {
+			return fmt.Errorf("invalid response field %q, column %s is given twice", value, column)
+		}
+	}
+	*r = append(*r, responseField{column, parts[1]})
+	return nil
+}
+
+func (r *responseFieldList) reset() {
+	*r = nil
+}
+
+// columns returns the names of the columns of the fields.
+func (r responseFieldList) columns() []string {
+	names := make([]string, len(r))
+	for i, f := range r {
+		names[i] = f.column
+	}
+	return names
+}
+
+var argResponseFields responseFieldList
+
+func init() {
+	Flags.Var(&argResponseFields, "response-field", "`column=path` field of the API responses, at a dot-separated path, stored in this column of the imports table when the entry is imported, e.g. conversation_id=data.conversation.id, repeatable; migrate adds the columns")
+}
+
+// importColumns returns the columns of the imports table, those of the
+// -response-field fields included.
+func importColumns() []column {
+	all := make([]column, 0, len(columns)+len(argResponseFields))
+	all = append(all, columns...)
+	for _, f := range argResponseFields {
+		all = append(all, column{f.column, "TEXT"})
+	}
+	return all
+}
+
+// extractFields sets the -response-field fields of e from the response
+// body: strings as they are, other values as JSON, missing ones as NULL.
+func (e *Entry) extractFields(body []byte) {
+	if len(argResponseFields) == 0 {
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return
+	}
+	e.responseFields = make(map[string]*string, len(argResponseFields))
+	for _, f := range argResponseFields {
+		value, found := valueAt(doc, f.path)
+		if !found || value == nil {
+			e.responseFields[f.column] = nil
+			continue
+		}
+		text, ok := value.(string)
+		if !ok {
+			encoded, _ := json.Marshal(value)
+			text = string(encoded)
+		}
+		e.responseFields[f.column] = &text
+	}
+}
+
+// fieldAssignments returns the assignments of the -response-field columns of
+// e, none if its response was not decoded.
+func (e *Entry) fieldAssignments() []assignment {
+	if e.responseFields == nil {
+		return nil
+	}
+	assignments := make([]assignment, 0, len(argResponseFields))
+	for _, f := range argResponseFields {
+		assignments = append(assignments, assignment{f.column, e.responseFields[f.column]})
+	}
+	return assignments
+}
@@ -0,0 +1,186 @@
+package importer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	argRetryBudget    = Flags.String("retry-budget", "", "cap the requests sent again, after a 429 or a retryable batch item, at this fraction of the requests sent once, e.g. 10%, failing the others instead of retrying them")
+	argAttemptHistory = Flags.Bool("attempt-history", false, "record every request sent for an entry, with its time, status, latency and error, in the attempt_history table")
+)
+
+// retryBudgetFloor is the number of retries always allowed, so that the
+// first throttled requests of a run are retried.
+const retryBudgetFloor = 10
+
+var attemptHistoryColumns = []column{
+	{"uid", "%s NOT NULL"},
+	{"run_id", "TEXT"},
+	{"attempt", "INTEGER"},
+	{"sent_at", "TEXT"},
+	{"http_status", "INTEGER"},
+	{"latency_ms", "INTEGER"},
+	{"error", "TEXT"},
+}
+
+// retryBudget caps the retries at a fraction of the requests, so that a
+// struggling API is not hit by a retry storm.
+type retryBudget struct {
+	ratio    float64
+	requests int64
+	retries  int64
+	refused  int64
+	once     sync.Once
+}
+
+// apiRetries is the retry budget of the run, nil without -retry-budget.
+var apiRetries *retryBudget
+
+func setupRetryBudget() error {
+	apiRetries = nil
+	if *argRetryBudget == "" {
+		return nil
+	}
+	ratio, err := parseRate(*argRetryBudget)
+	if err != nil {
+		return fmt.Errorf("invalid -retry-budget: %s", err)
+	}
+	apiRetries = &retryBudget{ratio: ratio}
+	return nil
+}
+
+// sent counts a request sent for the first time. It is a no-op on a nil
+// budget.
+func (b *retryBudget) sent() {
+	if b != nil {
+		atomic.AddInt64(&b.requests, 1)
+	}
+}
+
+// allow reports whether a request may be sent again, counting it if so. It
+// always does on a nil budget.
+func (b *retryBudget) allow() bool {
+	if b == nil {
+		return true
+	}
+	retries := atomic.AddInt64(&b.retries, 1)
+	if float64(retries) <= b.ratio*float64(atomic.LoadInt64(&b.requests))+retryBudgetFloor {
+		return true
+	}
+	atomic.AddInt64(&b.retries, -1)
+	atomic.AddInt64(&b.refused, 1)
+	b.once.Do(func() {
+		logError(Fields{"retries": retries - 1, "requests": atomic.LoadInt64(&b.requests), "retry_budget": *argRetryBudget},
+			"retry budget of %s exhausted after %d retries, failing requests instead of retrying them", *argRetryBudget, retries-1)
+	})
+	return false
+}
+
+// report logs the retries refused during the run, if any. It is a no-op on a
+// nil budget.
+func (b *retryBudget) report() {
+	if b == nil || atomic.LoadInt64(&b.refused) == 0 {
+		return
+	}
+	refused, retries, requests := atomic.LoadInt64(&b.refused), atomic.LoadInt64(&b.retries), atomic.LoadInt64(&b.requests)
+	logInfo(Fields{"refused": refused, "retries": retries, "requests": requests},
+		"%d retries refused by the retry budget, %d retries for %d requests", refused, retries, requests)
+}
+
+// checkAttemptHistory checks that the database was migrated for
+// -attempt-history.
+func checkAttemptHistory(store Store) error {
+	if !*argAttemptHistory {
+		return nil
+	}
+	s := schemaStore(store)
+	if s == nil {
+		return errors.New("-attempt-history needs a -db database, it cannot be used with -pipe")
+	}
+	if !s.has("attempt_history", "") {
+		return errors.New("-attempt-history needs the attempt_history table, run migrate first")
+	}
+	return nil
+}
+
+// RequestAttempt is a request sent for an entry, recorded with
+// -attempt-history.
+type RequestAttempt struct {
+	Attempt    int
+	SentAt     string
+	HTTPStatus int
+	LatencyMs  int64
+	Error      string
+}
+
+type attemptLogKey struct{}
+
+// withAttemptLog returns ctx recording the requests sent with it into log
+// with -attempt-history.
+func withAttemptLog(ctx context.Context, log *[]RequestAttempt) context.Context {
+	if !*argAttemptHistory {
+		return ctx
+	}
+	return context.WithValue(ctx, attemptLogKey{}, log)
+}
+
+// logAttempt records a request sent by sendRequest into the log of its
+// context, if any.
+func logAttempt(req *http.Request, resp *http.Response, elapsed time.Duration, err error) {
+	log, _ := req.Context().Value(attemptLogKey{}).(*[]RequestAttempt)
+	if log == nil {
+		return
+	}
+	a := RequestAttempt{
+		Attempt:   len(*log) + 1,
+		SentAt:    time.Now().Add(-elapsed).UTC().Format(time.RFC3339Nano),
+		LatencyMs: elapsed.Milliseconds(),
+	}
+	switch {
+	case err != nil:
+		a.Error = err.Error()
+	case resp.StatusCode >= 400:
+		a.HTTPStatus = resp.StatusCode
+		a.Error = http.StatusText(resp.StatusCode)
+	default:
+		a.HTTPStatus = resp.StatusCode
+	}
+	*log = append(*log, a)
+}
+
+// recordHistory inserts the requests sent for the entry of u within tx.
+func (s *sqlStore) recordHistory(tx *sql.Tx, u *StatusUpdate) error {
+	var runID interface{}
+	if u.RunID != "" {
+		runID = u.RunID
+	}
+	for _, a := range u.Entry.history {
+		var status, failure interface{}
+		if a.HTTPStatus != 0 {
+			status = a.HTTPStatus
+		}
+		if a.Error != "" {
+			failure = a.Error
+		}
+		query, args := s.insertQuery("attempt_history", []assignment{
+			{"uid", u.Entry.UID},
+			{"run_id", runID},
+			{"attempt", a.Attempt},
+			{"sent_at", a.SentAt},
+			{"http_status", status},
+			{"latency_ms", a.LatencyMs},
+			{"error", failure},
+		})
+		if _, err := tx.Exec(s.dialect.rebind(query), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package importer
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+func (s *sqlStore) FetchToRollback(filter *RequeueFilter, after string, limit int) ([]Entry, error) {
+	condition, args, err := filter.condition(s)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.query("SELECT uid, response_id, "+s.col("target")+", "+s.col("tenant")+" FROM imports WHERE "+condition+" AND "+s.createsOnly()+" AND uid > ? ORDER BY uid LIMIT ?",
+		append(args, after, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		var entry Entry
+		var target, tenant sql.NullString
+		if err := rows.Scan(&entry.UID, &entry.ResponseId, &target, &tenant); err != nil {
+			return nil, err
+		}
+		entry.Target = target.String
+		entry.Tenant = tenant.String
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// MarkRolledBack sets e back to pending once its response is deleted.
+func (s *sqlStore) MarkRolledBack(e *Entry) error {
+	if _, err := s.exec("UPDATE imports SET "+s.requeueSet()+" WHERE uid = ?", e.UID); err != nil {
+		return err
+	}
+	if err := s.unmapResponse(e.UID); err != nil {
+		return err
+	}
+	auditTrail.entry("rolled_back", e)
+	auditTrail.requeued([]string{e.UID})
+	return nil
+}
+
+// rollback deletes the response created for e, if any. A response already
+// gone counts as deleted.
+func (e *Entry) rollback() error {
+	if e.ResponseId == nil || *e.ResponseId == "" {
+		return nil
+	}
+	api, err := e.endpoint()
+	if err != nil {
+		return err
+	}
+	return deleteResource(api, e.target().Path+"/"+url.PathEscape(*e.ResponseId))
+}
+
+// deleteResource sends a DELETE on path. A resource already gone counts as
+// deleted.
+func deleteResource(api *endpoint, path string) error {
+	req, err := http.NewRequest("DELETE", api.url+path, nil)
+	if err != nil {
+		return err
+	}
+	if err := api.authorize(req); err != nil {
+		return err
+	}
+	resp, _, err := api.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == 404 || resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return &APIError{resp.StatusCode, string(body)}
+}
+
+func runRollback(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	commonFlags(fs)
+	apiFlags(fs)
+	inheritFlags(fs, "j", "page-size", "audit-file")
+	before := fs.String("before", "", "only entries imported before this date or RFC 3339 time")
+	after := fs.String("after", "", "only entries imported at or after this date or RFC 3339 time")
+	runID := fs.String("run", "", "only entries imported by this run id")
+	where := fs.String("where", "", "only entries matching this SQL condition on the imports table")
+	all := fs.Bool("all", false, "roll back every imported entry when no other filter is given")
+	dryRun := fs.Bool("dry-run", false, "only count the entries that would be rolled back")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rollback [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := setupAudit("rollback"); err != nil {
+		return err
+	}
+	defer closeAudit()
+
+	filter := &RequeueFilter{State: "imported", RunID: *runID, Where: *where}
+	var err error
+	if *before != "" {
+		if filter.Before, err = parseTimestamp(*before); err != nil {
+			return err
+		}
+	}
+	if *after != "" {
+		if filter.After, err = parseTimestamp(*after); err != nil {
+			return err
+		}
+	}
+	if !*all && *before == "" && *after == "" && *runID == "" && *where == "" {
+		return errors.New("a filter is needed, or -all to roll back every imported entry")
+	}
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+
+	if *dryRun {
+		n, err := store.Requeue(filter, true)
+		if err != nil {
+			return fmt.Errorf("failed to count entries: %s", err)
+		}
+		logInfo(Fields{"matching": n}, "%d entries would be rolled back", n)
+		return nil
+	}
+
+	if err := setupTenants(); err != nil {
+		return err
+	}
+	if err := setupAPI(*argConcurrency); err != nil {
+		return err
+	}
+	defer spans.Close()
+
+	rolledBack, failed, err := rollbackEntries(store, filter, *argConcurrency, *argPageSize)
+	if err != nil {
+		return err
+	}
+	logInfo(Fields{"rolled_back": rolledBack, "failed": failed}, "%d entries rolled back and set back to pending, %d failed", rolledBack, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d entries could not be rolled back", failed)
+	}
+	return nil
+}
+
+// rollbackEntries deletes the responses of the entries matching filter with
+// concurrency workers, setting them back to pending, and returns the number
+// of entries rolled back and of those that failed.
+func rollbackEntries(store Store, filter *RequeueFilter, concurrency, pageSize int) (rolledBack, failed int, err error) {
+	queue := make(chan Entry, pageSize)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range queue {
+				err := entry.rollback()
+				if err != nil {
+					logError(Fields{"uid": entry.UID, "error": err}, "failed to delete the response of entry %s: %s", entry.UID, err)
+				} else if err = store.MarkRolledBack(&entry); err != nil {
+					logError(Fields{"uid": entry.UID, "error": err}, "failed to mark entry %s rolled back: %s", entry.UID, err)
+				}
+				mu.Lock()
+				if err != nil {
+					failed++
+				} else {
+					rolledBack++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	last := ""
+	for {
+		page, err := store.FetchToRollback(filter, last, pageSize)
+		if err != nil {
+			close(queue)
+			wg.Wait()
+			return rolledBack, failed, fmt.Errorf("failed to fetch data: %s", err)
+		}
+		for _, entry := range page {
+			queue <- entry
+		}
+		if len(page) < pageSize {
+			break
+		}
+		last = page[len(page)-1].UID
+	}
+	close(queue)
+	wg.Wait()
+	return rolledBack, failed, nil
+}
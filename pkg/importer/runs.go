@@ -0,0 +1,252 @@
+package importer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var argRunTag = Flags.String("run-tag", "", "free-form label recorded with the run in the runs table")
+
+// secretFlags are left out of the flags recorded with a run, the webhook URLs
+// included as their path or query holds their secret.
+var secretFlags = map[string]bool{
+	"token":               true,
+	"oauth-client-secret": true,
+	"header":              true,
+	"hmac-key":            true,
+	"payload-key":         true,
+	"notify-url":          true,
+	"notify-slack":        true,
+}
+
+// dsnFlags are recorded with a run with their password redacted.
+var dsnFlags = map[string]bool{
+	"db":           true,
+	"source":       true,
+	"on-import-db": true,
+	"proxy":        true,
+}
+
+// Run is an invocation of the importer, as recorded in the runs table.
+type Run struct {
+	ID         string
+	Tag        string
+	Instance   string
+	Flags      string
+	StartedAt  string
+	FinishedAt sql.NullString
+	Imported   int
+	Errored    int
+	Duplicate  int
+	Skipped    int
+	Aborted    int
+	BatchSize  int
+	// Checksum is the checksum of the imported entries at the end of the
+	// run, with -checksum.
+	Checksum        sql.NullString
+	ChecksumEntries int
+}
+
+func newRun(instance string) (*Run, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(setFlags())
+	if err != nil {
+		return nil, err
+	}
+	return &Run{
+		ID:        id,
+		Tag:       *argRunTag,
+		Instance:  instance,
+		Flags:     string(data),
+		StartedAt: time.Now().UTC().Format(time.RFC3339),
+		BatchSize: batchSize(),
+	}, nil
+}
+
+// setFlags returns the flags given to the run, secrets redacted.
+func setFlags() map[string]string {
+	flags := map[string]string{}
+	Flags.Visit(func(f *flag.Flag) {
+		switch {
+		case secretFlags[f.Name]:
+			flags[f.Name] = "redacted"
+		case dsnFlags[f.Name]:
+			flags[f.Name] = redactDSN(f.Value.String())
+		default:
+			flags[f.Name] = f.Value.String()
+		}
+	})
+	return flags
+}
+
+// redactedDSN replaces a DSN whose password cannot be located, so that it
+// is never shown as given.
+const redactedDSN = "redacted"
+
+// redactDSN hides the password of a database DSN: that of the user of a
+// PostgreSQL URL or of a MySQL DSN, and a password parameter. SQLite paths
+// are returned as they are.
+func redactDSN(dsn string) string {
+	d, source := parseDSN(dsn)
+	switch {
+	case d.driver == "mysql":
+		cfg, err := mysql.ParseDSN(source)
+		if err != nil {
+			return "mysql://" + redactedDSN
+		}
+		if cfg.Passwd != "" {
+			cfg.Passwd = "redacted"
+		}
+		return "mysql://" + cfg.FormatDSN()
+	case d.driver == "sqlite3" && !strings.Contains(dsn, "://"):
+		return dsn
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return redactedDSN
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+		}
+	}
+	if query := u.Query(); query.Get("password") != "" {
+		query.Set("password", "redacted")
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// finish sets the end time and counts of r from the progress of the run.
+func (r *Run) finish(p *progress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r.FinishedAt = sql.NullString{String: time.Now().UTC().Format(time.RFC3339), Valid: true}
+	r.Imported = p.imported
+	r.Errored = p.errored()
+	r.Duplicate = p.duplicate
+	r.Skipped = p.skipped
+	r.Aborted = p.aborted
+	r.BatchSize = batchSize()
+}
+
+func (s *sqlStore) StartRun(r *Run) error {
+	if !s.has("runs", "") {
+		return nil
+	}
+	query, args := s.insertQuery("runs", []assignment{
+		{"id", r.ID}, {"tag", r.Tag}, {"instance", r.Instance}, {"flags", r.Flags}, {"started_at", r.StartedAt}, {"batch_size", r.BatchSize},
+	})
+	_, err := s.exec(query, args...)
+	return err
+}
+
+func (s *sqlStore) FinishRun(r *Run) error {
+	if !s.has("runs", "") {
+		return nil
+	}
+	query, args := s.updateQuery("runs", []assignment{
+		{"finished_at", r.FinishedAt}, {"imported", r.Imported}, {"errored", r.Errored}, {"duplicate", r.Duplicate},
+		{"skipped", r.Skipped}, {"aborted", r.Aborted}, {"batch_size", r.BatchSize},
+		{"checksum", r.Checksum}, {"checksum_entries", r.ChecksumEntries},
+	}, "id = ?", r.ID)
+	_, err := s.exec(query, args...)
+	return err
+}
+
+// Runs returns the recorded runs, the latest first.
+func (s *sqlStore) Runs(limit int) ([]Run, error) {
+	checksum, checksumEntries := "NULL", "0"
+	if s.has("runs", "checksum") {
+		checksum, checksumEntries = "checksum", "COALESCE(checksum_entries, 0)"
+	}
+	rows, err := s.query(`SELECT id, tag, instance, flags, started_at, finished_at,
+COALESCE(imported, 0), COALESCE(errored, 0), COALESCE(duplicate, 0), COALESCE(skipped, 0), COALESCE(aborted, 0),
+COALESCE(batch_size, 1), `+checksum+`, `+checksumEntries+`
+FROM runs ORDER BY started_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []Run
+	for rows.Next() {
+		var r Run
+		var tag sql.NullString
+		if err := rows.Scan(&r.ID, &tag, &r.Instance, &r.Flags, &r.StartedAt, &r.FinishedAt,
+			&r.Imported, &r.Errored, &r.Duplicate, &r.Skipped, &r.Aborted, &r.BatchSize, &r.Checksum, &r.ChecksumEntries); err != nil {
+			return nil, err
+		}
+		r.Tag = tag.String
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func runRuns(args []string) error {
+	fs := flag.NewFlagSet("runs", flag.ExitOnError)
+	commonFlags(fs)
+	limit := fs.Int("n", 20, "number of runs to list")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s runs [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+
+	runs, err := store.Runs(*limit)
+	if err != nil {
+		return fmt.Errorf("failed to query runs: %s", err)
+	}
+	if jsonLogs {
+		for _, r := range runs {
+			logInfo(Fields{
+				"run_id":           r.ID,
+				"tag":              r.Tag,
+				"instance":         r.Instance,
+				"flags":            json.RawMessage(r.Flags),
+				"started_at":       r.StartedAt,
+				"finished_at":      r.FinishedAt.String,
+				"imported":         r.Imported,
+				"errored":          r.Errored,
+				"duplicate":        r.Duplicate,
+				"skipped":          r.Skipped,
+				"aborted":          r.Aborted,
+				"batch_size":       r.BatchSize,
+				"checksum":         r.Checksum.String,
+				"checksum_entries": r.ChecksumEntries,
+			}, "run %s", r.ID)
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTAG\tSTARTED\tFINISHED\tIMPORTED\tERRORED\tDUPLICATE\tSKIPPED\tABORTED\tBATCH")
+	for _, r := range runs {
+		finished := r.FinishedAt.String
+		if !r.FinishedAt.Valid {
+			finished = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n", r.ID, r.Tag, r.StartedAt, finished,
+			r.Imported, r.Errored, r.Duplicate, r.Skipped, r.Aborted, r.BatchSize)
+	}
+	return w.Flush()
+}
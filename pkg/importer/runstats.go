@@ -0,0 +1,166 @@
+package importer
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var argRunStats = Flags.Bool("run-stats", false, "aggregate the throughput, error rate and latency percentiles of the run per minute, and write them to the run_stats table as each minute ends")
+
+var runStatsColumns = []column{
+	{"run_id", "TEXT"},
+	{"minute", "TEXT"},
+	{"imported", "INTEGER"},
+	{"duplicate", "INTEGER"},
+	{"errored", "INTEGER"},
+	{"error_rate", "REAL"},
+	{"latency_p50_ms", "INTEGER"},
+	{"latency_p95_ms", "INTEGER"},
+	{"latency_p99_ms", "INTEGER"},
+	{"latency_max_ms", "INTEGER"},
+}
+
+// checkRunStats checks that the database was migrated for -run-stats.
+func checkRunStats(store Store) error {
+	if !*argRunStats {
+		return nil
+	}
+	s := schemaStore(store)
+	if s == nil {
+		return errors.New("-run-stats needs a -db database, it cannot be used with -pipe")
+	}
+	if !s.has("run_stats", "") {
+		return errors.New("-run-stats needs the run_stats table, run migrate first")
+	}
+	return nil
+}
+
+// minuteStats are the outcomes of the entries processed within a minute.
+type minuteStats struct {
+	imported  int
+	duplicate int
+	errored   int
+	latency   histogram
+}
+
+// runStats aggregates the outcomes of a run per minute, and writes each
+// minute to the run_stats table once it is over. Its methods are no-ops on a
+// nil runStats.
+type runStats struct {
+	mu      sync.Mutex
+	store   *sqlStore
+	runID   string
+	minutes map[time.Time]*minuteStats
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// startRunStats aggregates the stats of run runID into store, flushing the
+// minutes over every minute.
+func startRunStats(store *sqlStore, runID string) *runStats {
+	r := &runStats{
+		store:   store,
+		runID:   runID,
+		minutes: make(map[time.Time]*minuteStats),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.flush(time.Now().UTC().Truncate(time.Minute))
+			}
+		}
+	}()
+	return r
+}
+
+// record counts the outcome of e in the current minute.
+func (r *runStats) record(e *Entry, outcome string) {
+	if r == nil || outcome != "imported" && outcome != "duplicate" && outcome != "errored" {
+		return
+	}
+	minute := time.Now().UTC().Truncate(time.Minute)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := r.minutes[minute]
+	if m == nil {
+		m = &minuteStats{}
+		r.minutes[minute] = m
+	}
+	switch outcome {
+	case "imported":
+		m.imported++
+	case "duplicate":
+		m.duplicate++
+	default:
+		m.errored++
+	}
+	if e.Attempts > 0 {
+		m.latency.record(e.ImportTime)
+	}
+}
+
+// flush writes the minutes before until to the run_stats table, in order.
+// Those failing to be written are logged and dropped.
+func (r *runStats) flush(until time.Time) {
+	r.mu.Lock()
+	var over []time.Time
+	for minute := range r.minutes {
+		if minute.Before(until) {
+			over = append(over, minute)
+		}
+	}
+	sort.Slice(over, func(i, j int) bool { return over[i].Before(over[j]) })
+	stats := make([]*minuteStats, len(over))
+	for i, minute := range over {
+		stats[i] = r.minutes[minute]
+		delete(r.minutes, minute)
+	}
+	r.mu.Unlock()
+
+	var runID interface{}
+	if r.runID != "" {
+		runID = r.runID
+	}
+	for i, m := range stats {
+		latency := m.latency.latency()
+		query, args := r.store.insertQuery("run_stats", []assignment{
+			{"run_id", runID},
+			{"minute", over[i].Format(time.RFC3339)},
+			{"imported", m.imported},
+			{"duplicate", m.duplicate},
+			{"errored", m.errored},
+			{"error_rate", float64(m.errored) / float64(m.imported+m.duplicate+m.errored)},
+			{"latency_p50_ms", latency.P50},
+			{"latency_p95_ms", latency.P95},
+			{"latency_p99_ms", latency.P99},
+			{"latency_max_ms", latency.Max},
+		})
+		if _, err := r.store.exec(query, args...); err != nil {
+			logError(Fields{"minute": over[i].Format(time.RFC3339), "error": err}, "failed to write run stats: %s", err)
+		}
+	}
+}
+
+// close stops the periodic flushes and writes the minutes left, the current
+// one included.
+func (r *runStats) close() {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		close(r.stop)
+		<-r.done
+		r.flush(time.Now().UTC().Add(time.Minute))
+	})
+}
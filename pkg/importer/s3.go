@@ -0,0 +1,285 @@
+package importer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hash of an empty request body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Client lists and reads objects of an S3-compatible storage, signing its
+// requests with AWS Signature Version 4. GCS is used through its S3
+// compatible XML API, with HMAC keys.
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	client    *http.Client
+}
+
+// objectInfo is an object listed by s3Client.
+type objectInfo struct {
+	Key  string
+	ETag string
+	Size int64
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// newObjectClient returns a client for the s3 or gs scheme, configured from
+// the environment.
+func newObjectClient(scheme string) (*s3Client, error) {
+	c := &s3Client{client: &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}}}
+	endpoint := ""
+	switch scheme {
+	case "s3":
+		c.region = firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+		if c.region == "" {
+			c.region = "us-east-1"
+		}
+		c.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.token = os.Getenv("AWS_SESSION_TOKEN")
+		endpoint = firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL")
+		if c.accessKey == "" || c.secretKey == "" {
+			return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are needed to read from S3")
+		}
+	case "gs":
+		c.region = "auto"
+		c.accessKey = os.Getenv("GCS_ACCESS_KEY_ID")
+		c.secretKey = os.Getenv("GCS_SECRET_ACCESS_KEY")
+		endpoint = firstEnv("GCS_ENDPOINT_URL")
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+		if c.accessKey == "" || c.secretKey == "" {
+			return nil, errors.New("GCS_ACCESS_KEY_ID and GCS_SECRET_ACCESS_KEY (HMAC keys) are needed to read from GCS")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported object storage %q, expected s3 or gs", scheme)
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint URL %q", endpoint)
+		}
+		c.endpoint = u
+	}
+	return c, nil
+}
+
+// uriEncode percent-encodes s as expected by Signature Version 4, leaving
+// slashes as is unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// objectURL returns the URL of key in bucket, path-style with a custom
+// endpoint and virtual-hosted-style on AWS.
+func (c *s3Client) objectURL(bucket, key string, query url.Values) *url.URL {
+	u := &url.URL{Scheme: "https", RawQuery: canonicalQuery(query)}
+	path := "/" + key
+	if c.endpoint != nil {
+		u.Scheme, u.Host = c.endpoint.Scheme, c.endpoint.Host
+		path = strings.TrimSuffix(c.endpoint.Path, "/") + "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + ".s3." + c.region + ".amazonaws.com"
+	}
+	u.Path, u.RawPath = path, uriEncode(path, false)
+	return u
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the Signature Version 4 headers to req, of the empty body.
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	c.signService(req, now, "s3", emptySHA256)
+}
+
+// signService adds the Signature Version 4 headers to req for service, whose
+// body has the hex SHA-256 bodyHash.
+func (c *s3Client) signService(req *http.Request, now time.Time, service, bodyHash string) {
+	date := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", bodyHash)
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, bodyHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	scope := date[:8] + "/" + c.region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date[:8])
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func (c *s3Client) get(ctx context.Context, u *url.URL, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	c.sign(req, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		var s3Err struct {
+			Code    string
+			Message string
+		}
+		if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("HTTP %d: %s: %s", resp.StatusCode, s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// list returns the objects of bucket whose key starts with prefix, sorted by
+// key.
+func (c *s3Client) list(ctx context.Context, bucket, prefix string) ([]objectInfo, error) {
+	var objects []objectInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.get(ctx, c.objectURL(bucket, "", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key  string
+				ETag string
+				Size int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid listing: %s", err)
+		}
+		for _, o := range result.Contents {
+			objects = append(objects, objectInfo{Key: o.Key, ETag: strings.Trim(o.ETag, `"`), Size: o.Size})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// open reads key in bucket from the given byte offset.
+func (c *s3Client) open(ctx context.Context, bucket, key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.get(ctx, c.objectURL(bucket, key, nil), header)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && resp.StatusCode == http.StatusOK {
+		// The range was ignored, skip to the offset.
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return resp.Body, nil
+}
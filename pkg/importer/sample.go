@@ -0,0 +1,194 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	argSample     = Flags.String("sample", "", "only import a reproducible random sample of the pending entries, as a percentage such as 1% or a count such as 500, e.g. for a pilot, recorded in the samples table")
+	argSampleSeed = Flags.String("sample-seed", "", "seed of the -sample selection, the same seed selecting the same entries (default: the run id)")
+	argSampled    = Flags.String("sampled", "", "only import the entries of a past -sample (only), or all but them (exclude)")
+	argSampledRun = Flags.String("sampled-run", "", "restrict -sampled to the sample of this run id")
+)
+
+// sampleColumns are the columns of the samples table, recording the entries
+// selected by each -sample run.
+var sampleColumns = []column{
+	{"uid", "%s NOT NULL"},
+	{"run_id", "TEXT"},
+	{"seed", "TEXT"},
+	{"sampled_at", "TEXT"},
+}
+
+// parseSample reads a -sample value, returning either a fraction of the
+// pending entries or a count of them.
+func parseSample(value string) (float64, int, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64)
+		if err != nil || math.IsNaN(percent) || percent <= 0 || percent > 100 {
+			return 0, 0, fmt.Errorf("invalid -sample %q, expected a percentage above 0%% and up to 100%%", value)
+		}
+		return percent / 100, 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("invalid -sample %q, expected a percentage such as 1%% or a count such as 500", value)
+	}
+	return 0, n, nil
+}
+
+// sampledFilter returns the SQL condition of -sampled, empty without it.
+func sampledFilter() (string, error) {
+	if *argSampledRun != "" && *argSampled == "" {
+		return "", errors.New("-sampled-run needs -sampled")
+	}
+	samples := "SELECT uid FROM samples"
+	if *argSampledRun != "" {
+		samples += " WHERE run_id = '" + strings.Replace(*argSampledRun, "'", "''", -1) + "'"
+	}
+	switch *argSampled {
+	case "":
+		return "", nil
+	case "only":
+		return "uid IN (" + samples + ")", nil
+	case "exclude":
+		return "uid NOT IN (" + samples + ")", nil
+	}
+	return "", fmt.Errorf("invalid -sampled %q, expected only or exclude", *argSampled)
+}
+
+func checkSampleFlags(store Store) error {
+	if *argSample == "" && *argSampled == "" {
+		return nil
+	}
+	if *argSample != "" {
+		if _, _, err := parseSample(*argSample); err != nil {
+			return err
+		}
+		if *argUIDFile != "" {
+			return errors.New("-sample and -uid-file cannot be combined")
+		}
+	}
+	s, ok := store.(*sqlStore)
+	if !ok {
+		return errors.New("-sample and -sampled need a -db database, they cannot be used with -pipe, -kafka-brokers or -checkpoint")
+	}
+	if !s.has("samples", "") {
+		return errors.New("-sample and -sampled need the samples table, run migrate first")
+	}
+	return nil
+}
+
+// sampleRank orders the pending entries for a sample by the hash of the seed
+// and their uid, the first ones being sampled.
+func sampleRank(seed, uid string) uint64 {
+	h := sha256.Sum256([]byte(seed + "\x00" + uid))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// setupSample restricts the selection of the run to the -sample of the
+// pending entries drawn with seed, and records it in the samples table
+// unless dryRun is set.
+func (im *Importer) setupSample(seed, runID string, dryRun bool) error {
+	if *argSample == "" {
+		return nil
+	}
+	if *argSampleSeed != "" {
+		seed = *argSampleSeed
+	}
+	if seed == "" {
+		var err error
+		if seed, err = newUUID(); err != nil {
+			return err
+		}
+	}
+	fraction, count, _ := parseSample(*argSample)
+	s := im.store.(*sqlStore)
+	condition, args := s.pendingCondition()
+	rows, err := s.query("SELECT uid FROM imports WHERE "+condition, args...)
+	if err != nil {
+		return fmt.Errorf("failed to read pending entries: %s", err)
+	}
+	type ranked struct {
+		uid  string
+		rank uint64
+	}
+	var pending []ranked
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			rows.Close()
+			return err
+		}
+		if pendingSelection.inShard(uid) {
+			pending = append(pending, ranked{uid, sampleRank(seed, uid)})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read pending entries: %s", err)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].rank != pending[j].rank {
+			return pending[i].rank < pending[j].rank
+		}
+		return pending[i].uid < pending[j].uid
+	})
+	if count == 0 {
+		// An entry is in a percentage sample by its rank alone, whatever the
+		// other pending entries.
+		for count < len(pending) && (fraction >= 1 || float64(pending[count].rank) < fraction*math.Pow(2, 64)) {
+			count++
+		}
+	}
+	if count > len(pending) {
+		count = len(pending)
+	}
+	uids := make([]string, count)
+	set := make(map[string]bool, count)
+	for i, p := range pending[:count] {
+		uids[i] = p.uid
+		set[p.uid] = true
+	}
+	sort.Strings(uids)
+	pendingSelection.uids, pendingSelection.set = uids, set
+	logInfo(Fields{"sample": *argSample, "seed": seed, "sampled": count, "pending": len(pending)},
+		"sampling %d of %d pending entries with seed %s", count, len(pending), seed)
+	if dryRun {
+		return nil
+	}
+	if err := s.recordSample(uids, runID, seed); err != nil {
+		return fmt.Errorf("failed to record sample: %s", err)
+	}
+	return nil
+}
+
+// recordSample inserts the uids of a sample into the samples table.
+func (s *sqlStore) recordSample(uids []string, runID, seed string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	var run interface{}
+	if runID != "" {
+		run = runID
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	query := s.dialect.rebind("INSERT INTO samples (uid, run_id, seed, sampled_at) VALUES (?, ?, ?, ?)")
+	for _, uid := range uids {
+		if _, err := tx.Exec(query, uid, run, seed, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
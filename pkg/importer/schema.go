@@ -0,0 +1,256 @@
+package importer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// column is a column of the imports table, its type being %s for the uid
+// key type of the dialect.
+type column struct {
+	name       string
+	definition string
+}
+
+var columns = []column{
+	{"uid", "%s NOT NULL UNIQUE"},
+	{"payload", "TEXT NOT NULL"},
+	{"response_id", "TEXT"},
+	{"imported_at", "TEXT"},
+	{"error", "TEXT"},
+	{"error_class", "TEXT"},
+	{"http_status", "INTEGER"},
+	{"import_time_ms", "INTEGER"},
+	{"claimed_by", "TEXT"},
+	{"claimed_at", "TEXT"},
+	{"idempotency_key", "TEXT"},
+	{"response_body", "TEXT"},
+	{"request_id", "TEXT"},
+	{"verified_at", "TEXT"},
+	{"verify_error", "TEXT"},
+	{"target", "TEXT"},
+	{"priority", "INTEGER"},
+	{"duplicate_of", "TEXT"},
+	{"run_id", "TEXT"},
+	{"tenant", "TEXT"},
+	{"group_key", "TEXT"},
+	{"headers", "TEXT"},
+	{"dead_lettered_at", "TEXT"},
+	{"not_before", "TEXT"},
+	{"error_hash", "TEXT"},
+	{"response_conflict", "TEXT"},
+	{"correlation_id", "TEXT"},
+	{"operation", "TEXT"},
+	{"auth_token", "TEXT"},
+	{"query_params", "TEXT"},
+	{"errored_at", "TEXT"},
+}
+
+var runColumns = []column{
+	{"id", "%s NOT NULL UNIQUE"},
+	{"tag", "TEXT"},
+	{"instance", "TEXT"},
+	{"flags", "TEXT"},
+	{"started_at", "TEXT"},
+	{"finished_at", "TEXT"},
+	{"imported", "INTEGER"},
+	{"errored", "INTEGER"},
+	{"duplicate", "INTEGER"},
+	{"skipped", "INTEGER"},
+	{"aborted", "INTEGER"},
+	{"batch_size", "INTEGER"},
+	{"checksum", "TEXT"},
+	{"checksum_entries", "INTEGER"},
+}
+
+func (d dialect) columnDefinition(c column) string {
+	if strings.Contains(c.definition, "%s") {
+		return c.name + " " + fmt.Sprintf(c.definition, d.textKey)
+	}
+	return c.name + " " + c.definition
+}
+
+func (d dialect) createTableQuery(table string, columns []column) string {
+	definitions := make([]string, len(columns))
+	for i, c := range columns {
+		definitions[i] = "    " + d.columnDefinition(c)
+	}
+	return "CREATE TABLE IF NOT EXISTS " + table + " (\n" + strings.Join(definitions, ",\n") + "\n)"
+}
+
+// table is a table created besides imports, fill being run when Migrate
+// creates it.
+type table struct {
+	name    string
+	columns []column
+	fill    string
+}
+
+var tables = []table{
+	{"runs", runColumns, ""},
+	{"sources", sourceColumns, ""},
+	{"attempts", attemptColumns, ""},
+	{"attempt_history", attemptHistoryColumns, ""},
+	{"dead_letters", deadLetterColumns, ""},
+	{"quarantine_reviews", quarantineReviewColumns, ""},
+	{"samples", sampleColumns, ""},
+	{"response_map", responseMapColumns, fillResponseMap},
+	{"errors", errorBodyColumns, ""},
+	{"jobs", jobColumns, ""},
+	{"run_stats", runStatsColumns, ""},
+	{"attachments", attachmentColumns, ""},
+}
+
+// InitSchema creates the imports table and the other tables if they do not
+// exist.
+func (s *sqlStore) InitSchema() error {
+	if _, err := s.exec(s.dialect.createTableQuery("imports", importColumns())); err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if _, err := s.exec(s.dialect.createTableQuery(t.name, t.columns)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrate adds the columns missing from an imports table created by an
+// older version, and the other tables if missing, and returns their names.
+func (s *sqlStore) Migrate() ([]string, error) {
+	added, err := s.addMissingColumns("imports", importColumns())
+	if err != nil {
+		return added, err
+	}
+	for _, t := range tables {
+		if rows, err := s.query("SELECT * FROM " + t.name + " WHERE 1 = 0"); err == nil {
+			rows.Close()
+			columns, err := s.addMissingColumns(t.name, t.columns)
+			for _, c := range columns {
+				added = append(added, t.name+"."+c)
+			}
+			if err != nil {
+				return added, err
+			}
+			continue
+		}
+		if _, err := s.exec(s.dialect.createTableQuery(t.name, t.columns)); err != nil {
+			return added, fmt.Errorf("failed to create table %s: %s", t.name, err)
+		}
+		if t.fill != "" {
+			if _, err := s.exec(t.fill); err != nil {
+				return added, fmt.Errorf("failed to fill table %s: %s", t.name, err)
+			}
+		}
+		added = append(added, t.name)
+	}
+	return added, nil
+}
+
+// addMissingColumns adds to table the columns it lacks among cols.
+func (s *sqlStore) addMissingColumns(table string, cols []column) ([]string, error) {
+	rows, err := s.query("SELECT * FROM " + table + " WHERE 1 = 0")
+	if err != nil {
+		return nil, err
+	}
+	names, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool, len(names))
+	for _, name := range names {
+		existing[strings.ToLower(name)] = true
+	}
+	var added []string
+	for _, c := range cols {
+		if existing[c.name] {
+			continue
+		}
+		if strings.Contains(c.definition, "NOT NULL") {
+			return added, fmt.Errorf("required column %s is missing", c.name)
+		}
+		if _, err := s.exec("ALTER TABLE " + table + " ADD COLUMN " + s.dialect.columnDefinition(c)); err != nil {
+			return added, fmt.Errorf("failed to add column %s: %s", c.name, err)
+		}
+		added = append(added, c.name)
+	}
+	return added, nil
+}
+
+func runInitDB(args []string) error {
+	fs := flag.NewFlagSet("init-db", flag.ExitOnError)
+	commonFlags(fs)
+	inheritFlags(fs, "response-field")
+	print := fs.Bool("print", false, "print the CREATE TABLE statements for the database instead of running them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s init-db [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *print {
+		d, _ := parseDSN(*argDb)
+		fmt.Println(d.createTableQuery("imports", importColumns()) + ";")
+		for _, t := range tables {
+			fmt.Println(d.createTableQuery(t.name, t.columns) + ";")
+		}
+		return nil
+	}
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.InitSchema(); err != nil {
+		return fmt.Errorf("failed to create table: %s", err)
+	}
+	added, err := store.Migrate()
+	if err != nil {
+		return fmt.Errorf("failed to migrate table: %s", err)
+	}
+	if len(added) > 0 {
+		logInfo(Fields{"added": added}, "imports table exists, added missing %s", strings.Join(added, ", "))
+		return nil
+	}
+	logInfo(nil, "tables ready in %s", *argDb)
+	return nil
+}
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	commonFlags(fs)
+	inheritFlags(fs, "response-field")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s migrate [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+
+	added, err := store.Migrate()
+	if err != nil {
+		if len(added) > 0 {
+			logInfo(Fields{"added": added}, "added %s", strings.Join(added, ", "))
+		}
+		return fmt.Errorf("failed to migrate table: %s", err)
+	}
+	if len(added) == 0 {
+		logInfo(nil, "tables are up to date")
+		return nil
+	}
+	logInfo(Fields{"added": added}, "added %s", strings.Join(added, ", "))
+	return nil
+}
@@ -0,0 +1,273 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var argTokenSource = Flags.String("token-source", "", "fetch the API token at start, and again when the API answers 401, from file:PATH, vault:PATH[#field] or aws-secrets:SECRET_ID[#field], instead of -token")
+
+// secretsTimeout bounds the fetch of a token from its source.
+const secretsTimeout = 30 * time.Second
+
+// tokenSource fetches the current API token from where it is rotated.
+type tokenSource interface {
+	fetch(ctx context.Context) (string, error)
+	String() string
+}
+
+// parseTokenSource parses the file:, vault: and aws-secrets: sources of
+// -token-source.
+func parseTokenSource(value string) (tokenSource, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid token source %q, expected file:PATH, vault:PATH[#field] or aws-secrets:SECRET_ID[#field]", value)
+	}
+	location, field := parts[1], ""
+	if i := strings.LastIndex(location, "#"); i >= 0 {
+		location, field = location[:i], location[i+1:]
+	}
+	switch parts[0] {
+	case "file":
+		return fileTokenSource(parts[1]), nil
+	case "vault":
+		if field == "" {
+			field = "token"
+		}
+		return newVaultTokenSource(location, field)
+	case "aws-secrets":
+		return newAWSTokenSource(location, field)
+	}
+	return nil, fmt.Errorf("unknown token source %q, expected file, vault or aws-secrets", parts[0])
+}
+
+// fileTokenSource reads the token from a file, e.g. one a sidecar rotates.
+type fileTokenSource string
+
+func (s fileTokenSource) fetch(ctx context.Context) (string, error) {
+	content, err := ioutil.ReadFile(string(s))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func (s fileTokenSource) String() string {
+	return "file " + string(s)
+}
+
+// vaultTokenSource reads the token from a field of a Vault secret, of the KV
+// version 1 or 2 engine, with VAULT_ADDR, VAULT_TOKEN and VAULT_NAMESPACE.
+type vaultTokenSource struct {
+	addr      string
+	token     string
+	namespace string
+	path      string
+	field     string
+	client    *http.Client
+}
+
+func newVaultTokenSource(path, field string) (*vaultTokenSource, error) {
+	s := &vaultTokenSource{
+		addr:      strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+		token:     os.Getenv("VAULT_TOKEN"),
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		path:      strings.Trim(path, "/"),
+		field:     field,
+		client:    &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}, Timeout: secretsTimeout},
+	}
+	if s.addr == "" || s.token == "" {
+		return nil, errors.New("VAULT_ADDR and VAULT_TOKEN are needed to read the token from Vault")
+	}
+	return s, nil
+}
+
+func (s *vaultTokenSource) fetch(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.addr+"/v1/"+s.path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	if s.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.namespace)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("invalid Vault response: %s", err)
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	token, ok := data[s.field].(string)
+	if !ok || token == "" {
+		return "", fmt.Errorf("no %q field in Vault secret %s", s.field, s.path)
+	}
+	return token, nil
+}
+
+func (s *vaultTokenSource) String() string {
+	return "Vault secret " + s.path
+}
+
+// awsTokenSource reads the token from AWS Secrets Manager: the secret string,
+// or a field of it if it is a JSON object.
+type awsTokenSource struct {
+	aws      *s3Client
+	url      string
+	secretID string
+	field    string
+}
+
+func newAWSTokenSource(secretID, field string) (*awsTokenSource, error) {
+	c := &s3Client{
+		region:    firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}, Timeout: secretsTimeout},
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are needed to read the token from AWS Secrets Manager")
+	}
+	endpoint := firstEnv("AWS_ENDPOINT_URL_SECRETS_MANAGER", "AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + c.region + ".amazonaws.com"
+	}
+	return &awsTokenSource{aws: c, url: strings.TrimSuffix(endpoint, "/") + "/", secretID: secretID, field: field}, nil
+}
+
+func (s *awsTokenSource) fetch(ctx context.Context) (string, error) {
+	body, err := json.Marshal(map[string]string{"SecretId": s.secretID})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	hash := sha256.Sum256(body)
+	s.aws.signService(req, time.Now(), "secretsmanager", hex.EncodeToString(hash[:]))
+	resp, err := s.aws.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(content)))
+	}
+	var secret struct {
+		SecretString string
+	}
+	if err := json.Unmarshal(content, &secret); err != nil || secret.SecretString == "" {
+		return "", fmt.Errorf("no secret string in AWS Secrets Manager secret %s", s.secretID)
+	}
+	if s.field == "" {
+		return strings.TrimSpace(secret.SecretString), nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("AWS Secrets Manager secret %s is not a JSON object: %s", s.secretID, err)
+	}
+	token, ok := fields[s.field].(string)
+	if !ok || token == "" {
+		return "", fmt.Errorf("no %q field in AWS Secrets Manager secret %s", s.field, s.secretID)
+	}
+	return token, nil
+}
+
+func (s *awsTokenSource) String() string {
+	return "AWS Secrets Manager secret " + s.secretID
+}
+
+// tokenRefresher is an Authenticator whose credentials can be fetched again
+// after the API rejected those of req.
+type tokenRefresher interface {
+	Refresh(ctx context.Context, req *http.Request) error
+}
+
+// rotatingAuth sends the token of a source in header, prefixed with prefix,
+// fetching it again when the API answers 401.
+type rotatingAuth struct {
+	source tokenSource
+	header string
+	prefix string
+
+	mu    sync.Mutex
+	token string
+}
+
+func newRotatingAuth(source tokenSource, header, prefix string) (*rotatingAuth, error) {
+	a := &rotatingAuth{source: source, header: header, prefix: prefix}
+	ctx, cancel := context.WithTimeout(context.Background(), secretsTimeout)
+	defer cancel()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *rotatingAuth) Authorize(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	req.Header.Set(a.header, a.prefix+a.token)
+	return nil
+}
+
+// Refresh fetches the token again, unless the one req was sent with was
+// already replaced after another request was rejected.
+func (a *rotatingAuth) Refresh(ctx context.Context, req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if req.Header.Get(a.header) != a.prefix+a.token {
+		return nil
+	}
+	return a.refresh(ctx)
+}
+
+// refresh fetches the token, with a.mu held.
+func (a *rotatingAuth) refresh(ctx context.Context) error {
+	token, err := a.source.fetch(ctx)
+	if err == nil && token == "" {
+		err = errors.New("empty token")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch the API token from %s: %s", a.source, err)
+	}
+	if a.token != "" && token != a.token {
+		logInfo(Fields{"source": a.source.String()}, "API token rotated, fetched a new one from %s", a.source)
+	}
+	a.token = token
+	return nil
+}
@@ -0,0 +1,669 @@
+package importer
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// jobColumns are the columns of the jobs table, holding the import jobs
+// submitted to serve.
+var jobColumns = []column{
+	{"id", "%s NOT NULL UNIQUE"},
+	{"flags", "TEXT"},
+	{"state", "TEXT"},
+	{"created_at", "TEXT"},
+	{"started_at", "TEXT"},
+	{"finished_at", "TEXT"},
+	{"exit_code", "INTEGER"},
+	{"run_id", "TEXT"},
+	{"summary", "TEXT"},
+	{"error", "TEXT"},
+	{"output", "TEXT"},
+}
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// jobOutputLines is the number of last log lines of a job kept in its
+// output column.
+const jobOutputLines = 20
+
+// jobFlagsAllowed are the flags jobs can set: the selection, pacing and
+// retry settings of the import. The others run commands, open files,
+// databases or listeners on the host, or send the requests elsewhere, and
+// must come from the environment or the configuration of the service; -db is
+// always the database of the service.
+var jobFlagsAllowed = map[string]bool{}
+
+func init() {
+	for _, name := range []string{
+		"db", "j", "where", "limit", "shard", "sample", "sample-seed", "sampled", "sampled-run",
+		"priority", "priority-reserve", "reimport-since", "reimport-until", "window",
+		"dry-run", "max-attempts", "page-size", "readers", "prepare-workers", "prepare-queue",
+		"batch-size", "batch-retries", "batch-retry-delay", "fail-fast", "max-error-rate",
+		"error-rate-window", "retry-budget", "adaptive", "adaptive-min", "adaptive-interval",
+		"adaptive-batch", "adaptive-batch-min", "ramp-up", "ramp-steps", "throttle-delay",
+		"throttle-retries", "max-throttle-delay", "max-bandwidth", "max-inflight-bytes",
+		"http-timeout", "request-timeout", "stop-timeout", "slow-request", "slow-request-retry",
+		"fetch-retries", "fetch-retry-delay", "breaker-threshold", "breaker-cooldown",
+		"breaker-max-cooldown", "resolve", "resolve-create", "idempotency", "dedupe", "claim",
+		"claim-ttl", "run-tag", "archive-responses", "attempt-history", "run-stats", "checksum",
+		"compact-after", "compact-payloads", "max-payload-size", "require-columns", "v", "q",
+	} {
+		jobFlagsAllowed[name] = true
+	}
+}
+
+// Job is an import submitted to serve, run by a child process with its flags.
+type Job struct {
+	ID         string                 `json:"id"`
+	Flags      map[string]interface{} `json:"flags"`
+	State      string                 `json:"state"`
+	CreatedAt  string                 `json:"created_at"`
+	StartedAt  string                 `json:"started_at,omitempty"`
+	FinishedAt string                 `json:"finished_at,omitempty"`
+	ExitCode   *int                   `json:"exit_code,omitempty"`
+	RunID      string                 `json:"run_id,omitempty"`
+	Summary    json.RawMessage        `json:"summary,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	Output     string                 `json:"output,omitempty"`
+}
+
+// jobArgs returns the command-line arguments of the import of flags, once
+// checked.
+func jobArgs(flags map[string]interface{}) ([]string, error) {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := []string{"-log-format=json", "-progress=false"}
+	for _, name := range names {
+		switch {
+		case Flags.Lookup(name) == nil:
+			return nil, fmt.Errorf("unknown flag %q", name)
+		case secretFlags[name]:
+			return nil, fmt.Errorf("flag %q is a secret, set it in the environment of the service instead", name)
+		case !jobFlagsAllowed[name]:
+			return nil, fmt.Errorf("flag %q cannot be set by jobs, set it in the environment or configuration of the service instead", name)
+		case name == "db" && flags[name] != *argDb:
+			return nil, errors.New("jobs run against the database of the service, -db cannot be changed")
+		}
+		values, ok := flags[name].([]interface{})
+		if !ok {
+			values = []interface{}{flags[name]}
+		}
+		for _, value := range values {
+			switch v := value.(type) {
+			case string:
+				args = append(args, "-"+name+"="+v)
+			case float64, bool:
+				args = append(args, fmt.Sprintf("-%s=%v", name, v))
+			default:
+				return nil, fmt.Errorf("invalid value of flag %q, expected a string, number, boolean or array of them", name)
+			}
+		}
+	}
+	return args, nil
+}
+
+// redactedFlags returns flags with the passwords of their DSNs redacted.
+func redactedFlags(flags map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(flags))
+	for name, value := range flags {
+		if dsn, ok := value.(string); ok && dsnFlags[name] {
+			value = redactDSN(dsn)
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
+
+var jobSelect = "SELECT id, flags, state, created_at, started_at, finished_at, exit_code, run_id, summary, error, output FROM jobs"
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var job Job
+	var flags string
+	var startedAt, finishedAt, runID, summary, jobErr, output sql.NullString
+	var exitCode sql.NullInt64
+	if err := row.Scan(&job.ID, &flags, &job.State, &job.CreatedAt, &startedAt, &finishedAt, &exitCode, &runID, &summary, &jobErr, &output); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(flags), &job.Flags); err != nil {
+		return nil, fmt.Errorf("invalid flags of job %s: %s", job.ID, err)
+	}
+	job.StartedAt, job.FinishedAt, job.RunID = startedAt.String, finishedAt.String, runID.String
+	job.Error, job.Output = jobErr.String, output.String
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		job.ExitCode = &code
+	}
+	if summary.Valid {
+		job.Summary = json.RawMessage(summary.String)
+	}
+	return &job, nil
+}
+
+func (s *sqlStore) insertJob(job *Job) error {
+	flags, err := json.Marshal(job.Flags)
+	if err != nil {
+		return err
+	}
+	query, args := s.insertQuery("jobs", []assignment{
+		{"id", job.ID},
+		{"flags", string(flags)},
+		{"state", job.State},
+		{"created_at", job.CreatedAt},
+	})
+	_, err = s.exec(query, args...)
+	return err
+}
+
+func (s *sqlStore) updateJob(id string, assignments ...assignment) error {
+	query, args := s.updateQuery("jobs", assignments, "id = ?", id)
+	_, err := s.exec(query, args...)
+	return err
+}
+
+func (s *sqlStore) job(id string) (*Job, error) {
+	return scanJob(s.db.QueryRow(s.dialect.rebind(jobSelect+" WHERE id = ?"), id))
+}
+
+// jobs returns the latest limit jobs, only those in state if not empty.
+func (s *sqlStore) jobs(state string, limit int) ([]*Job, error) {
+	query, args := jobSelect, []interface{}{}
+	if state != "" {
+		query += " WHERE state = ?"
+		args = append(args, state)
+	}
+	rows, err := s.query(query+" ORDER BY created_at DESC, id LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []*Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// nextJob returns the oldest queued job, nil if none.
+func (s *sqlStore) nextJob() (*Job, error) {
+	job, err := scanJob(s.db.QueryRow(s.dialect.rebind(jobSelect+" WHERE state = ? ORDER BY created_at, id LIMIT 1"), jobQueued))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// jobProcess is the child process running a job.
+type jobProcess struct {
+	cmd       *exec.Cmd
+	cancelled bool
+}
+
+// jobService runs the queued jobs of its database, up to maxJobs at once,
+// each as a child process running the importer.
+type jobService struct {
+	store      *sqlStore
+	executable string
+	maxJobs    int
+	token      string
+	// config is the -config of the service, given to its jobs, and env the
+	// environment of their processes, passing them the other settings of
+	// the service without showing secrets in their command line.
+	config string
+	env    []string
+
+	mu      sync.Mutex
+	running map[string]*jobProcess
+	wake    chan struct{}
+}
+
+// recover queues again the jobs left running by an earlier instance of the
+// service, their imports resuming where they stopped.
+func (js *jobService) recover() error {
+	jobs, err := js.store.jobs(jobRunning, 1<<30)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if err := js.store.updateJob(job.ID, assignment{"state", jobQueued}); err != nil {
+			return err
+		}
+		logInfo(Fields{"job": job.ID}, "job %s was interrupted, queued again", job.ID)
+	}
+	return nil
+}
+
+// schedule starts queued jobs whenever a slot is free, until stop is closed.
+func (js *jobService) schedule(stop <-chan struct{}) {
+	for {
+		js.startQueued()
+		select {
+		case <-stop:
+			return
+		case <-js.wake:
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (js *jobService) notify() {
+	select {
+	case js.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (js *jobService) startQueued() {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	for len(js.running) < js.maxJobs {
+		job, err := js.store.nextJob()
+		if err != nil {
+			logError(Fields{"error": err}, "failed to fetch queued jobs: %s", err)
+			return
+		}
+		if job == nil {
+			return
+		}
+		if err := js.start(job); err != nil {
+			logError(Fields{"job": job.ID, "error": err}, "failed to start job %s: %s", job.ID, err)
+			now := time.Now().UTC().Format(time.RFC3339)
+			if err := js.store.updateJob(job.ID, assignment{"state", jobFailed}, assignment{"finished_at", now}, assignment{"error", err.Error()}); err != nil {
+				logError(Fields{"job": job.ID, "error": err}, "failed to record job %s: %s", job.ID, err)
+				return
+			}
+		}
+	}
+}
+
+// command returns the child process running job, with the config file and
+// settings of the service.
+func (js *jobService) command(job *Job) (*exec.Cmd, error) {
+	args, err := jobArgs(job.Flags)
+	if err != nil {
+		return nil, err
+	}
+	if js.config != "" {
+		args = append([]string{"-config=" + js.config}, args...)
+	}
+	cmd := jobCommand(js.executable, args...)
+	cmd.Env = js.env
+	return cmd, nil
+}
+
+// start runs job in a child process, with mu held.
+func (js *jobService) start(job *Job) error {
+	cmd, err := js.command(job)
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p := &jobProcess{cmd: cmd}
+	js.running[job.ID] = p
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := js.store.updateJob(job.ID, assignment{"state", jobRunning}, assignment{"started_at", now}); err != nil {
+		logError(Fields{"job": job.ID, "error": err}, "failed to record job %s: %s", job.ID, err)
+	}
+	logInfo(Fields{"job": job.ID, "pid": cmd.Process.Pid}, "job %s started", job.ID)
+	go js.watch(job.ID, p, stderr)
+	return nil
+}
+
+// watch follows the logs of the process of job id until it exits, then
+// records its outcome.
+func (js *jobService) watch(id string, p *jobProcess, logs io.Reader) {
+	var output []string
+	var summary, lastError string
+	scanner := bufio.NewScanner(logs)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if output = append(output, line); len(output) > jobOutputLines {
+			output = output[1:]
+		}
+		var record map[string]interface{}
+		if json.Unmarshal([]byte(line), &record) != nil {
+			continue
+		}
+		msg, _ := record["msg"].(string)
+		switch {
+		case record["level"] == "error" || record["level"] == "fatal":
+			lastError = msg
+		case msg == "run finished":
+			for _, key := range []string{"time", "level", "msg"} {
+				delete(record, key)
+			}
+			if data, err := json.Marshal(record); err == nil {
+				summary = string(data)
+			}
+		}
+		if runID, ok := record["run_id"].(string); ok && strings.HasPrefix(msg, "starting run") {
+			if err := js.store.updateJob(id, assignment{"run_id", runID}); err != nil {
+				logError(Fields{"job": id, "error": err}, "failed to record job %s: %s", id, err)
+			}
+		}
+	}
+	err := p.cmd.Wait()
+	code := p.cmd.ProcessState.ExitCode()
+
+	js.mu.Lock()
+	delete(js.running, id)
+	state := jobSucceeded
+	switch {
+	case p.cancelled:
+		state = jobCancelled
+	case code == ExitErrors:
+		// The run completed, the summary counts its errored entries.
+	case err != nil:
+		state = jobFailed
+		if lastError == "" {
+			lastError = err.Error()
+		}
+	}
+	js.mu.Unlock()
+
+	assignments := []assignment{
+		{"state", state},
+		{"finished_at", time.Now().UTC().Format(time.RFC3339)},
+		{"exit_code", code},
+		{"error", nullString(lastError)},
+		{"output", strings.Join(output, "\n")},
+	}
+	if summary != "" {
+		assignments = append(assignments, assignment{"summary", summary})
+	}
+	if err := js.store.updateJob(id, assignments...); err != nil {
+		logError(Fields{"job": id, "error": err}, "failed to record job %s: %s", id, err)
+	}
+	logInfo(Fields{"job": id, "state": state, "exit_code": code}, "job %s %s", id, state)
+	js.notify()
+}
+
+// cancel stops job id: a queued job is cancelled at once, a running one is
+// sent a stop signal, a second one aborting its in-flight requests. A process
+// that cannot be signalled, e.g. on Windows without a console, is killed.
+func (js *jobService) cancel(id string) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if p, ok := js.running[id]; ok {
+		p.cancelled = true
+		if err := interruptJob(p.cmd.Process); err != nil {
+			return p.cmd.Process.Kill()
+		}
+		return nil
+	}
+	job, err := js.store.job(id)
+	if err != nil {
+		return err
+	}
+	if job.State != jobQueued {
+		return fmt.Errorf("job %s is already %s", id, job.State)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	return js.store.updateJob(id, assignment{"state", jobCancelled}, assignment{"finished_at", now})
+}
+
+// stopAll asks the running jobs to stop and waits for them, up to timeout.
+func (js *jobService) stopAll(timeout time.Duration) {
+	js.mu.Lock()
+	for _, p := range js.running {
+		if err := interruptJob(p.cmd.Process); err != nil {
+			p.cmd.Process.Kill()
+		}
+	}
+	js.mu.Unlock()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		js.mu.Lock()
+		left := len(js.running)
+		js.mu.Unlock()
+		if left == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// jobRequest is the body of a job submission.
+type jobRequest struct {
+	Flags map[string]interface{} `json:"flags"`
+}
+
+// healthChecks are the readiness conditions of the service: its database
+// answering.
+func (js *jobService) healthChecks() []healthCheck {
+	return []healthCheck{databaseCheck(0, js.store)}
+}
+
+func (js *jobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+		healthHandler(js.healthChecks).ServeHTTP(w, r)
+		return
+	}
+	if js.token != "" && r.Header.Get("Authorization") != "Bearer "+js.token {
+		writeJSONError(w, http.StatusUnauthorized, errors.New("invalid token"))
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "jobs" && r.Method == http.MethodPost:
+		js.submit(w, r)
+	case path == "jobs" && r.Method == http.MethodGet:
+		limit := 100
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", value))
+				return
+			}
+			limit = n
+		}
+		jobs, err := js.store.jobs(r.URL.Query().Get("state"), limit)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, job := range jobs {
+			job.Flags = redactedFlags(job.Flags)
+		}
+		if jobs == nil {
+			jobs = []*Job{}
+		}
+		writeJSON(w, http.StatusOK, jobs)
+	case len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodGet:
+		js.get(w, parts[1], http.StatusOK)
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "cancel" && r.Method == http.MethodPost,
+		len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodDelete:
+		if err := js.cancel(parts[1]); err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("no job %s", parts[1]))
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusConflict, err)
+			return
+		}
+		js.get(w, parts[1], http.StatusAccepted)
+	case path == "health":
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no route for %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (js *jobService) get(w http.ResponseWriter, id string, status int) {
+	job, err := js.store.job(id)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no job %s", id))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	job.Flags = redactedFlags(job.Flags)
+	writeJSON(w, status, job)
+}
+
+func (js *jobService) submit(w http.ResponseWriter, r *http.Request) {
+	var request jobRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid job: %s", err))
+		return
+	}
+	if request.Flags == nil {
+		request.Flags = map[string]interface{}{}
+	}
+	if _, ok := request.Flags["db"]; !ok {
+		request.Flags["db"] = *argDb
+	}
+	if _, err := jobArgs(request.Flags); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	id, err := newUUID()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	job := &Job{ID: id, Flags: request.Flags, State: jobQueued, CreatedAt: time.Now().UTC().Format(time.RFC3339Nano)}
+	if err := js.store.insertJob(job); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logInfo(Fields{"job": id}, "job %s queued", id)
+	js.notify()
+	js.get(w, id, http.StatusCreated)
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	commonFlags(fs)
+	apiFlags(fs)
+	addr := fs.String("addr", "127.0.0.1:8090", "address the job API listens on, a loopback one unless -service-token is set")
+	maxJobs := fs.Int("max-jobs", 1, "number of jobs run at once")
+	token := fs.String("service-token", "", "bearer token clients of the job API must send (GAIA_SERVICE_TOKEN)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *maxJobs < 1 {
+		return errors.New("-max-jobs must be at least 1")
+	}
+	if *token == "" {
+		*token = os.Getenv("GAIA_SERVICE_TOKEN")
+	}
+	if *token == "" && !loopbackAddr(*addr) {
+		return fmt.Errorf("serving the job API on %s needs a -service-token, or a loopback address such as 127.0.0.1:8090", *addr)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the importer executable: %s", err)
+	}
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+	s := schemaStore(store)
+	if s == nil || !s.has("jobs", "") {
+		return errors.New("the database has no jobs table, run migrate to add it")
+	}
+	js := &jobService{store: s, executable: executable, maxJobs: *maxJobs, token: *token, config: *argConfig, env: serviceEnv(fs),
+		running: map[string]*jobProcess{}, wake: make(chan struct{}, 1)}
+	if err := js.recover(); err != nil {
+		return fmt.Errorf("failed to recover jobs: %s", err)
+	}
+
+	stop := make(chan struct{})
+	go js.schedule(stop)
+	server := &http.Server{Addr: *addr, Handler: js}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		logInfo(nil, "stop signal received, stopping the running jobs...")
+		close(stop)
+		js.stopAll(time.Minute)
+		server.Close()
+	}()
+	logInfo(Fields{"addr": *addr, "max_jobs": *maxJobs}, "serving the job API on %s", *addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// serviceEnv returns the environment of the jobs of the service: its own,
+// with the import flags of fs it was given but -config as GAIA_* variables,
+// which the jobs read for the flags they do not set.
+func serviceEnv(fs *flag.FlagSet) []string {
+	env := os.Environ()
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && Flags.Lookup(f.Name) != nil {
+			env = append(env, envName(f.Name)+"="+f.Value.String())
+		}
+	})
+	return env
+}
+
+// loopbackAddr reports whether addr only listens on the loopback interface.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,35 @@
+package importer
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestJobCommand(t *testing.T) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	apiFlags(fs)
+	fs.String("service-token", "", "")
+	if err := fs.Parse([]string{"-token", "secret", "-service-token", "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	js := &jobService{executable: "gaia-responses-importer", config: "gaia.yaml", env: serviceEnv(fs)}
+	cmd, err := js.command(&Job{Flags: map[string]interface{}{"j": 4.0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"gaia-responses-importer", "-config=gaia.yaml", "-log-format=json", "-progress=false", "-j=4"}
+	if !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("got command %q, want %q", cmd.Args, want)
+	}
+	env := map[string]bool{}
+	for _, v := range cmd.Env {
+		env[v] = true
+	}
+	if !env["GAIA_TOKEN=secret"] {
+		t.Error("the -token of the service is not in the environment of its jobs")
+	}
+	if env["GAIA_SERVICE_TOKEN=s3cret"] {
+		t.Error("the -service-token of the service is in the environment of its jobs")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package importer
+
+import "os/exec"
+
+const defaultEditor = "vi"
+
+// shellCommand runs command with sh, args being its positional parameters
+// $1, $2...
+func shellCommand(command string, args ...string) *exec.Cmd {
+	return exec.Command("sh", append([]string{"-c", command, "sh"}, args...)...)
+}
+
+// editorCommand opens file in editor, which may include arguments.
+func editorCommand(editor, file string) *exec.Cmd {
+	return shellCommand(editor+` "$1"`, file)
+}
@@ -0,0 +1,23 @@
+package importer
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+const defaultEditor = "notepad"
+
+// shellCommand runs command with cmd.exe. It has no positional parameters,
+// so args are not passed: callers also set them in the environment.
+func shellCommand(command string, args ...string) *exec.Cmd {
+	cmd := exec.Command("cmd.exe")
+	// cmd.exe does not follow the usual quoting rules, its command line is
+	// passed as is.
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: `cmd.exe /S /C "` + command + `"`}
+	return cmd
+}
+
+// editorCommand opens file in editor, which may include arguments.
+func editorCommand(editor, file string) *exec.Cmd {
+	return shellCommand(editor + ` "` + file + `"`)
+}
@@ -0,0 +1,79 @@
+package importer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	argHMACKey             = Flags.String("hmac-key", "", "secret key signing every API request with HMAC-SHA256, for gateways requiring it")
+	argHMACHeader          = Flags.String("hmac-header", "X-Signature", "header holding the hex HMAC-SHA256 signature of the requests, with -hmac-key")
+	argHMACTimestampHeader = Flags.String("hmac-timestamp-header", "X-Signature-Timestamp", "header holding the Unix time the requests were signed at, with -hmac-key")
+)
+
+// RequestSigner signs API requests. Sign is called before each attempt, once
+// the body is final, e.g. compressed.
+type RequestSigner interface {
+	Sign(req *http.Request) error
+}
+
+var requestSigner RequestSigner
+
+// hmacSigner signs the method, path, body hash and time of the requests with
+// HMAC-SHA256.
+type hmacSigner struct {
+	key             []byte
+	header          string
+	timestampHeader string
+}
+
+// stringToSign returns the newline-separated method, escaped path, hex SHA-256
+// of the body and Unix timestamp the signature is computed over.
+func stringToSign(req *http.Request, timestamp string) (string, error) {
+	hash := sha256.New()
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return "", errors.New("request body cannot be signed")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(hash, body)
+		body.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%s\n%s\n%x\n%s", req.Method, req.URL.EscapedPath(), hash.Sum(nil), timestamp), nil
+}
+
+func (s *hmacSigner) Sign(req *http.Request) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	message, err := stringToSign(req, timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %s", err)
+	}
+	mac := hmac.New(sha256.New, s.key)
+	io.WriteString(mac, message)
+	req.Header.Set(s.timestampHeader, timestamp)
+	req.Header.Set(s.header, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+func newSigner() (RequestSigner, error) {
+	if *argHMACKey == "" {
+		return nil, nil
+	}
+	if *argHMACHeader == "" || *argHMACTimestampHeader == "" {
+		return nil, errors.New("-hmac-header and -hmac-timestamp-header cannot be empty")
+	}
+	return &hmacSigner{[]byte(*argHMACKey), *argHMACHeader, *argHMACTimestampHeader}, nil
+}
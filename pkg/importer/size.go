@@ -0,0 +1,79 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	argMaxPayloadSize = Flags.Int("max-payload-size", 0, "maximum size in `bytes` of a payload, larger entries failing with the oversized error class without being sent (0 means no limit)")
+	argOversizedFile  = Flags.String("oversized-file", "", "append oversized entries, including those refused by the API with a 413, to this NDJSON `file`")
+)
+
+type OversizedError struct {
+	Size  int
+	Limit int
+}
+
+func (e *OversizedError) Error() string {
+	return fmt.Sprintf("payload of %d bytes exceeds the limit of %d bytes", e.Size, e.Limit)
+}
+
+// checkPayloadSize fails if e, once transformed, is over -max-payload-size.
+func checkPayloadSize(e *Entry) error {
+	if *argMaxPayloadSize > 0 && len(e.Payload) > *argMaxPayloadSize {
+		return &OversizedError{len(e.Payload), *argMaxPayloadSize}
+	}
+	return nil
+}
+
+// spillFile receives the oversized entries, one JSON object per line.
+type spillFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+var oversizedSpill *spillFile
+
+func setupOversizedFile() error {
+	if *argOversizedFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*argOversizedFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open oversized file: %s", err)
+	}
+	oversizedSpill = &spillFile{f: f}
+	return nil
+}
+
+// write appends e to the file. It is a no-op on a nil spill file.
+func (s *spillFile) write(e *Entry) {
+	if s == nil {
+		return
+	}
+	line, err := json.Marshal(map[string]interface{}{
+		"uid":     e.UID,
+		"size":    len(e.Payload),
+		"error":   e.Err.Error(),
+		"payload": json.RawMessage(e.Payload),
+	})
+	if err != nil {
+		logError(Fields{"uid": e.UID, "error": err}, "failed to write entry %s to the oversized file: %s", e.UID, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		logError(Fields{"uid": e.UID, "error": err}, "failed to write entry %s to the oversized file: %s", e.UID, err)
+	}
+}
+
+func (s *spillFile) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,146 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	argSlowRequest      = Flags.Duration("slow-request", 0, "log the API requests still running after this long, with their entries, headers and timing (0 disables it)")
+	argSlowRequestRetry = Flags.Bool("slow-request-retry", false, "cancel the requests running longer than -slow-request and send them again once, with the same Idempotency-Key, rather than waiting for them")
+)
+
+type entryUIDsKey struct{}
+
+// withEntryUIDs returns ctx naming the entries of the requests sent with it,
+// for the slow request logs.
+func withEntryUIDs(ctx context.Context, uids ...string) context.Context {
+	if *argSlowRequest <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, entryUIDsKey{}, uids)
+}
+
+// slowWatchdog counts the requests running longer than -slow-request.
+type slowWatchdog struct {
+	slow    int64
+	retried int64
+}
+
+var slowRequests = &slowWatchdog{}
+
+// cancelOnClose is a response body releasing the context of its request
+// once closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// send sends req with sendOnce, logging it once it runs longer than
+// -slow-request and, with -slow-request-retry, cancelling it then to send it
+// again, once.
+func (w *slowWatchdog) send(req *http.Request) (*http.Response, time.Duration, error) {
+	if *argSlowRequest <= 0 {
+		return sendOnce(req)
+	}
+	return w.watch(req, *argSlowRequestRetry && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil))
+}
+
+func (w *slowWatchdog) watch(req *http.Request, retry bool) (*http.Response, time.Duration, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	var mu sync.Mutex
+	done, cancelled := false, false
+	start := time.Now()
+	timer := time.AfterFunc(*argSlowRequest, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if done {
+			return
+		}
+		atomic.AddInt64(&w.slow, 1)
+		retrying := retry && apiRetries.allow()
+		w.log(req, time.Since(start), retrying)
+		if retrying {
+			cancelled = true
+			cancel()
+		}
+	})
+	resp, elapsed, err := sendOnce(req.WithContext(ctx))
+	mu.Lock()
+	done = true
+	mu.Unlock()
+	timer.Stop()
+	if !cancelled || req.Context().Err() != nil {
+		if err != nil {
+			cancel()
+			return resp, elapsed, err
+		}
+		resp.Body = &cancelOnClose{resp.Body, cancel}
+		return resp, elapsed, nil
+	}
+	cancel()
+	if resp != nil {
+		drain(resp)
+	}
+	if err := rewind(req); err != nil {
+		return nil, elapsed, fmt.Errorf("failed to send slow request again: %s", err)
+	}
+	atomic.AddInt64(&w.retried, 1)
+	resp, retryElapsed, err := w.watch(req, false)
+	return resp, elapsed + retryElapsed, err
+}
+
+// log logs req, running for elapsed, with the entries it sends.
+func (w *slowWatchdog) log(req *http.Request, elapsed time.Duration, retrying bool) {
+	uids, _ := req.Context().Value(entryUIDsKey{}).([]string)
+	inflight, _ := apiRequests.snapshot()
+	fields := Fields{
+		"method":       req.Method,
+		"url":          req.URL.String(),
+		"elapsed_ms":   elapsed.Milliseconds(),
+		"slow_request": argSlowRequest.String(),
+		"uids":         uids,
+		"in_flight":    len(inflight),
+		"retrying":     retrying,
+	}
+	if key := req.Header.Get("Idempotency-Key"); key != "" {
+		fields["idempotency_key"] = key
+	}
+	if *argCorrelationHeader != "" {
+		fields["correlation_id"] = req.Header.Get(*argCorrelationHeader)
+	}
+	action := "still waiting for it"
+	if retrying {
+		action = "cancelling it to send it again"
+	}
+	logError(fields, "slow request %s %s for %v still running after %s, %s", req.Method, requestPath(req), uids, elapsed.Round(time.Millisecond), action)
+}
+
+// report logs the number of slow requests of the run, if any.
+func (w *slowWatchdog) report() {
+	slow, retried := atomic.LoadInt64(&w.slow), atomic.LoadInt64(&w.retried)
+	if slow == 0 {
+		return
+	}
+	logInfo(Fields{"slow_requests": slow, "retried": retried, "slow_request": argSlowRequest.String()},
+		"%d requests ran longer than -slow-request %s, %d sent again", slow, *argSlowRequest, retried)
+}
+
+func writeSlowMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP gaia_importer_slow_requests_total API requests running longer than -slow-request, by action taken.")
+	fmt.Fprintln(w, "# TYPE gaia_importer_slow_requests_total counter")
+	slow, retried := atomic.LoadInt64(&slowRequests.slow), atomic.LoadInt64(&slowRequests.retried)
+	fmt.Fprintf(w, "gaia_importer_slow_requests_total{action=\"retried\"} %d\n", retried)
+	fmt.Fprintf(w, "gaia_importer_slow_requests_total{action=\"waited\"} %d\n", slow-retried)
+}
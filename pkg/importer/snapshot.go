@@ -0,0 +1,104 @@
+package importer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"time"
+)
+
+var (
+	argSnapshotFile     = Flags.String("snapshot-file", "", "`file` the state of the run is written to every -snapshot-interval, counters, in-flight uids, last errors and memory use, to tell what a killed process was doing")
+	argSnapshotInterval = Flags.Duration("snapshot-interval", 5*time.Second, "interval between two writes of -snapshot-file")
+)
+
+// InFlightEntry is an entry being processed when a snapshot was taken.
+type InFlightEntry struct {
+	UID   string `json:"uid"`
+	Since string `json:"since"`
+}
+
+// Snapshot is the state of a run written to -snapshot-file.
+type Snapshot struct {
+	Time       string           `json:"time"`
+	PID        int              `json:"pid"`
+	Finished   bool             `json:"finished"`
+	Status     *DashboardStatus `json:"status"`
+	InFlight   []InFlightEntry  `json:"in_flight"`
+	Goroutines int              `json:"goroutines"`
+	HeapBytes  uint64           `json:"heap_bytes"`
+	SysBytes   uint64           `json:"sys_bytes"`
+	GCs        uint32           `json:"gcs"`
+}
+
+// snapshotter writes the snapshots of a run.
+type snapshotter struct {
+	path string
+	im   *Importer
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startSnapshots(im *Importer, path string, interval time.Duration) *snapshotter {
+	s := &snapshotter{path: path, im: im, stop: make(chan struct{}), done: make(chan struct{})}
+	s.write(false)
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			s.write(false)
+		}
+	}()
+	logInfo(Fields{"snapshot_file": path, "interval": interval.String()}, "writing run snapshots to %s every %s", path, interval)
+	return s
+}
+
+func (s *snapshotter) snapshot(finished bool) *Snapshot {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	snap := &Snapshot{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		PID:        os.Getpid(),
+		Finished:   finished,
+		Status:     s.im.Status(),
+		InFlight:   s.im.flights.entries(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  mem.HeapAlloc,
+		SysBytes:   mem.Sys,
+		GCs:        mem.NumGC,
+	}
+	return snap
+}
+
+// write replaces the snapshot file, through a temporary file so that a crash
+// never leaves it half written.
+func (s *snapshotter) write(finished bool) {
+	data, err := json.MarshalIndent(s.snapshot(finished), "", "  ")
+	if err != nil {
+		logError(Fields{"error": err}, "failed to encode snapshot: %s", err)
+		return
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		logError(Fields{"snapshot_file": s.path, "error": err}, "failed to write snapshot: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		logError(Fields{"snapshot_file": s.path, "error": err}, "failed to write snapshot: %s", err)
+	}
+}
+
+// Close stops the snapshots and writes a last one, marked finished.
+func (s *snapshotter) Close() {
+	close(s.stop)
+	<-s.done
+	s.write(true)
+}
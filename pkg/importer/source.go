@@ -0,0 +1,406 @@
+package importer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	argSource        = Flags.String("source", "", "s3://bucket/prefix or gs://bucket/prefix of NDJSON files loaded into -db before importing, resuming where the last run stopped, or DSN of a database queried with -source-query")
+	argSourceUID     = Flags.String("source-uid", "uid", "field of the -source lines, or column of the -source-query rows, holding the entry uid")
+	argSourcePayload = Flags.String("source-payload", "", "field of the -source lines holding their payload (default: the whole line)")
+)
+
+// sourceChunkLines is the number of lines of an object loaded per
+// transaction, along with the offset to resume from.
+const sourceChunkLines = 1000
+
+var sourceColumns = []column{
+	{"object_url", "%s NOT NULL UNIQUE"},
+	{"etag", "TEXT"},
+	{"byte_offset", "INTEGER"},
+	{"line_offset", "INTEGER"},
+	{"loaded_at", "TEXT"},
+	{"cursor_value", "TEXT"},
+}
+
+// entrySource loads entries into the imports table before importing them.
+type entrySource interface {
+	sync(ctx context.Context, s *sqlStore) (int, error)
+	// preview returns the number of entries sync would read, without
+	// writing to s.
+	preview(ctx context.Context, s *sqlStore) (int, error)
+	String() string
+}
+
+// sourceState is how much of an object has been loaded.
+type sourceState struct {
+	etag   string
+	bytes  int64
+	lines  int
+	loaded bool
+}
+
+// objectSource loads the NDJSON objects under a prefix of a bucket into the
+// imports table.
+type objectSource struct {
+	scheme       string
+	bucket       string
+	prefix       string
+	client       *s3Client
+	uidField     string
+	payloadField string
+	compress     bool
+}
+
+func isSourceURL(s string) bool {
+	return strings.HasPrefix(s, "s3://") || strings.HasPrefix(s, "gs://")
+}
+
+func openSource(raw, uidField, payloadField string) (*objectSource, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "s3" && u.Scheme != "gs") {
+		return nil, fmt.Errorf("invalid source %q, expected s3://bucket/prefix or gs://bucket/prefix", raw)
+	}
+	client, err := newObjectClient(u.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	return &objectSource{
+		scheme:       u.Scheme,
+		bucket:       u.Host,
+		prefix:       strings.TrimPrefix(u.Path, "/"),
+		client:       client,
+		uidField:     uidField,
+		payloadField: payloadField,
+	}, nil
+}
+
+func (src *objectSource) String() string {
+	return src.scheme + "://" + src.bucket + "/" + src.prefix
+}
+
+// sync loads the objects, or the parts of them, that were not loaded yet,
+// and returns the number of lines loaded.
+func (src *objectSource) sync(ctx context.Context, s *sqlStore) (int, error) {
+	if err := s.InitSchema(); err != nil {
+		return 0, err
+	}
+	objects, err := src.client.list(ctx, src.bucket, src.prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %s", src, err)
+	}
+	total := 0
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+		name := src.scheme + "://" + src.bucket + "/" + object.Key
+		state, err := s.sourceState(name)
+		if err != nil {
+			return total, err
+		}
+		if state.etag != "" && state.etag != object.ETag {
+			logInfo(Fields{"object": name}, "%s changed since it was loaded, loading it again", name)
+			state = sourceState{}
+		}
+		if state.loaded {
+			continue
+		}
+		n, err := src.load(ctx, s, name, object, state)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to load %s: %s", name, err)
+		}
+		logInfo(Fields{"object": name, "loaded": n}, "%d entries loaded from %s", n, name)
+	}
+	return total, nil
+}
+
+// preview counts the lines of the objects, or the parts of them, that were
+// not loaded yet.
+func (src *objectSource) preview(ctx context.Context, s *sqlStore) (int, error) {
+	objects, err := src.client.list(ctx, src.bucket, src.prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %s", src, err)
+	}
+	total := 0
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+		name := src.scheme + "://" + src.bucket + "/" + object.Key
+		var state sourceState
+		if s.has("sources", "") {
+			if state, err = s.sourceState(name); err != nil {
+				return total, err
+			}
+		}
+		if state.etag != "" && state.etag != object.ETag {
+			state = sourceState{}
+		}
+		if state.loaded {
+			continue
+		}
+		n, err := src.count(ctx, object, state)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to read %s: %s", name, err)
+		}
+		logInfo(Fields{"object": name, "lines": n}, "%d lines to load from %s", n, name)
+	}
+	return total, nil
+}
+
+// count returns the number of non-empty lines of object after state.
+func (src *objectSource) count(ctx context.Context, object objectInfo, state sourceState) (int, error) {
+	compressed := strings.HasSuffix(object.Key, ".gz")
+	offset := state.bytes
+	if compressed {
+		offset = 0
+	}
+	body, err := src.client.open(ctx, src.bucket, object.Key, offset)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	var r io.Reader = body
+	if compressed {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	reader := bufio.NewReaderSize(r, 64*1024)
+	skip := 0
+	if compressed {
+		skip = state.lines
+	}
+	n := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if skip > 0 && line != "" {
+			skip--
+		} else if strings.TrimSpace(line) != "" {
+			n++
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+	}
+}
+
+// load loads object from state on, committing the offset reached with each
+// chunk of lines. Compressed objects (.gz) cannot be read from an offset and
+// have their loaded lines skipped instead.
+func (src *objectSource) load(ctx context.Context, s *sqlStore, name string, object objectInfo, state sourceState) (int, error) {
+	compressed := strings.HasSuffix(object.Key, ".gz")
+	offset := state.bytes
+	if compressed {
+		offset = 0
+	}
+	body, err := src.client.open(ctx, src.bucket, object.Key, offset)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	var r io.Reader = body
+	if compressed {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	skip := 0
+	if compressed {
+		skip = state.lines
+	}
+	loaded := 0
+	var records []loadRecord
+	uncommitted := 0
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return loaded, readErr
+		}
+		if line != "" {
+			if !compressed {
+				state.bytes += int64(len(line))
+			}
+			if skip > 0 {
+				skip--
+			} else {
+				state.lines++
+				uncommitted++
+				if raw := strings.TrimSpace(line); raw != "" {
+					record, err := parseNDJSONLine(raw, src.uidField, src.payloadField)
+					if err != nil {
+						return loaded, fmt.Errorf("line %d: %s", state.lines, err)
+					}
+					if src.compress {
+						if record.Payload, err = compressPayload(record.Payload); err != nil {
+							return loaded, fmt.Errorf("line %d: %s", state.lines, err)
+						}
+					}
+					records = append(records, record)
+				}
+			}
+		}
+		done := readErr == io.EOF
+		if done || uncommitted >= sourceChunkLines {
+			state.etag, state.loaded = object.ETag, done
+			if err := s.loadSourceChunk(name, records, state); err != nil {
+				return loaded, err
+			}
+			loaded += len(records)
+			records, uncommitted = records[:0], 0
+		}
+		if done {
+			return loaded, nil
+		}
+	}
+}
+
+func (s *sqlStore) sourceState(name string) (sourceState, error) {
+	var state sourceState
+	var etag, loadedAt sql.NullString
+	var bytes sql.NullInt64
+	var lines sql.NullInt64
+	err := s.db.QueryRow(s.dialect.rebind("SELECT etag, byte_offset, line_offset, loaded_at FROM sources WHERE object_url = ?"), name).
+		Scan(&etag, &bytes, &lines, &loadedAt)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	state.etag, state.bytes, state.lines, state.loaded = etag.String, bytes.Int64, int(lines.Int64), loadedAt.Valid
+	return state, nil
+}
+
+// loadSourceChunk upserts records and records state for the object in the
+// same transaction, so that a restart resumes right after them.
+func (s *sqlStore) loadSourceChunk(name string, records []loadRecord, state sourceState) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.upsertTx(tx, records); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var loadedAt interface{}
+	if state.loaded {
+		loadedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	if _, err := tx.Exec(s.dialect.rebind("DELETE FROM sources WHERE object_url = ?"), name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(s.dialect.rebind("INSERT INTO sources (object_url, etag, byte_offset, line_offset, loaded_at) VALUES (?, ?, ?, ?, ?)"),
+		name, state.etag, state.bytes, state.lines, loadedAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadSource loads the objects under a bucket prefix, as the load
+// subcommand.
+func loadSource(raw, uidField, payloadField string, compress bool) error {
+	src, err := openSource(raw, uidField, payloadField)
+	if err != nil {
+		return err
+	}
+	src.compress = compress
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+	n, err := src.sync(context.Background(), store.(*sqlStore))
+	if err != nil {
+		return err
+	}
+	logInfo(Fields{"loaded": n}, "%d entries loaded into %s", n, *argDb)
+	return nil
+}
+
+// setupSource checks that -source can be loaded into store.
+func setupSource(store Store) (entrySource, *sqlStore, error) {
+	if *argSource == "" {
+		return nil, nil, nil
+	}
+	s, ok := store.(*sqlStore)
+	if !ok {
+		return nil, nil, fmt.Errorf("-source needs a -db database, it cannot be used with -pipe, -checkpoint or another store")
+	}
+	var src entrySource
+	var err error
+	switch {
+	case isSourceURL(*argSource) && *argSourceQuery != "":
+		return nil, nil, fmt.Errorf("-source-query needs a database -source, not a bucket")
+	case isSourceURL(*argSource) || *argSourceQuery == "":
+		src, err = openSource(*argSource, *argSourceUID, *argSourcePayload)
+	default:
+		src, err = openQuerySource(*argSource)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if *argDryRun {
+		return src, s, nil
+	}
+	if err := s.InitSchema(); err != nil {
+		return nil, nil, fmt.Errorf("failed to create tables: %s", err)
+	}
+	if _, err := s.addMissingColumns("sources", sourceColumns); err != nil {
+		return nil, nil, fmt.Errorf("failed to migrate the sources table: %s", err)
+	}
+	return src, s, nil
+}
+
+// syncSource loads the new lines of -source, if any, before importing.
+func (im *Importer) syncSource(ctx context.Context) {
+	if im.source == nil {
+		return
+	}
+	n, err := im.source.sync(ctx, im.sourceStore)
+	if err != nil {
+		logError(Fields{"source": im.source.String(), "error": err}, "failed to sync %s: %s", im.source, err)
+		return
+	}
+	if n > 0 {
+		logInfo(Fields{"source": im.source.String(), "loaded": n}, "%d new entries loaded from %s", n, im.source)
+	}
+}
+
+// previewSource counts the new entries of -source, if any, for -dry-run,
+// which leaves them out of the database.
+func (im *Importer) previewSource(ctx context.Context) {
+	if im.source == nil {
+		return
+	}
+	n, err := im.source.preview(ctx, im.sourceStore)
+	if err != nil {
+		logError(Fields{"source": im.source.String(), "error": err}, "failed to read %s: %s", im.source, err)
+		return
+	}
+	logInfo(Fields{"source": im.source.String(), "pending": n}, "%d new entries of %s would be loaded, not loading them in a dry run", n, im.source)
+}
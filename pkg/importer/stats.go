@@ -0,0 +1,188 @@
+package importer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+var argStats = Flags.String("stats", "", "write latency and throughput statistics of the run as JSON to this `file`")
+
+// slowestCount is the number of slowest entries kept in the statistics.
+const slowestCount = 10
+
+// SlowEntry is one of the slowest entries of a run.
+type SlowEntry struct {
+	UID       string `json:"uid"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// Latency holds request latency percentiles in milliseconds.
+type Latency struct {
+	Count int   `json:"count"`
+	P50   int64 `json:"p50"`
+	P95   int64 `json:"p95"`
+	P99   int64 `json:"p99"`
+	Max   int64 `json:"max"`
+}
+
+// Stats is the content of the -stats file.
+type Stats struct {
+	Latency     Latency            `json:"latency_ms"`
+	ByTarget    map[string]Latency `json:"latency_ms_by_target"`
+	Slowest     []SlowEntry        `json:"slowest"`
+	Throughput  []int              `json:"entries_per_minute"`
+	Rate        float64            `json:"entries_per_second"`
+	ElapsedMS   int64              `json:"elapsed_ms"`
+	Connections ConnStats          `json:"connections"`
+}
+
+// latencyStats collects the request latency of imported and errored entries,
+// under the lock of its progress.
+type latencyStats struct {
+	all      histogram
+	byTarget map[string]*histogram
+	slowest  []SlowEntry
+	minutes  []int
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{byTarget: make(map[string]*histogram)}
+}
+
+// histogramExact is the number of latencies below which a histogram counts
+// each millisecond apart; above it, buckets hold 64 values per power of two,
+// for percentiles within 1.6%.
+const histogramExact = 128
+
+// histogram counts latencies in fixed buckets, so that runs of any length
+// keep their percentiles in bounded memory.
+type histogram struct {
+	counts []int
+	count  int
+	max    int64
+}
+
+// bucket returns the bucket of latency v, and the lowest latency it holds.
+func bucket(v int64) (int, int64) {
+	if v < histogramExact {
+		if v < 0 {
+			v = 0
+		}
+		return int(v), v
+	}
+	shift := uint(bits.Len64(uint64(v)) - 7)
+	mantissa := v >> shift
+	return histogramExact + int(shift-1)*64 + int(mantissa-64), mantissa << shift
+}
+
+// bucketLow returns the lowest latency of bucket i.
+func bucketLow(i int) int64 {
+	if i < histogramExact {
+		return int64(i)
+	}
+	shift := uint((i-histogramExact)/64 + 1)
+	return int64((i-histogramExact)%64+64) << shift
+}
+
+func (h *histogram) record(v int64) {
+	i, _ := bucket(v)
+	for len(h.counts) <= i {
+		h.counts = append(h.counts, 0)
+	}
+	h.counts[i]++
+	h.count++
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// latency returns the percentiles of the latencies recorded, each the lowest
+// latency of its bucket.
+func (h *histogram) latency() Latency {
+	if h.count == 0 {
+		return Latency{}
+	}
+	at := func(p float64) int64 {
+		rank, seen := int(p*float64(h.count-1)), 0
+		for i, n := range h.counts {
+			if seen += n; seen > rank {
+				return bucketLow(i)
+			}
+		}
+		return h.max
+	}
+	return Latency{Count: h.count, P50: at(0.5), P95: at(0.95), P99: at(0.99), Max: h.max}
+}
+
+func (s *latencyStats) record(e *Entry, since time.Duration) {
+	minute := int(since / time.Minute)
+	for len(s.minutes) <= minute {
+		s.minutes = append(s.minutes, 0)
+	}
+	s.minutes[minute]++
+	if e.Attempts == 0 {
+		return
+	}
+	s.all.record(e.ImportTime)
+	target := e.target().String()
+	h := s.byTarget[target]
+	if h == nil {
+		h = &histogram{}
+		s.byTarget[target] = h
+	}
+	h.record(e.ImportTime)
+	if len(s.slowest) == slowestCount && e.ImportTime <= s.slowest[slowestCount-1].LatencyMS {
+		return
+	}
+	i := sort.Search(len(s.slowest), func(i int) bool { return s.slowest[i].LatencyMS < e.ImportTime })
+	s.slowest = append(s.slowest, SlowEntry{})
+	copy(s.slowest[i+1:], s.slowest[i:])
+	s.slowest[i] = SlowEntry{e.UID, e.ImportTime}
+	if len(s.slowest) > slowestCount {
+		s.slowest = s.slowest[:slowestCount]
+	}
+}
+
+// percentiles sorts latencies in place.
+func percentiles(latencies []int64) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	at := func(p float64) int64 {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	return Latency{Count: len(latencies), P50: at(0.5), P95: at(0.95), P99: at(0.99), Max: latencies[len(latencies)-1]}
+}
+
+func (p *progress) stats() *Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elapsed := time.Since(p.start)
+	s := &Stats{
+		Latency:     p.latency.all.latency(),
+		ByTarget:    make(map[string]Latency, len(p.latency.byTarget)),
+		Slowest:     append([]SlowEntry{}, p.latency.slowest...),
+		Throughput:  append([]int{}, p.latency.minutes...),
+		ElapsedMS:   elapsed.Milliseconds(),
+		Connections: apiConns.snapshot(),
+	}
+	for target, h := range p.latency.byTarget {
+		s.ByTarget[target] = h.latency()
+	}
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		s.Rate = float64(p.imported+p.duplicate+p.errored()) / seconds
+	}
+	return s
+}
+
+func writeStatsFile(path string, s *Stats) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
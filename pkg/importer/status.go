@@ -0,0 +1,157 @@
+package importer
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// ImportStatus summarizes the state of the imports table.
+type ImportStatus struct {
+	Pending       int64
+	Scheduled     int64
+	NextScheduled sql.NullString
+	Imported      int64
+	Errored       int64
+	DeadLettered  int64
+	Blocked       int64
+	Quarantined   int64
+	Discarded     int64
+	Conflicts     int64
+	ErrorsByHTTP  map[string]int64
+	AvgImportTime sql.NullFloat64
+	FirstImported sql.NullString
+	LastImported  sql.NullString
+}
+
+func (s *sqlStore) Status() (*ImportStatus, error) {
+	status := &ImportStatus{ErrorsByHTTP: make(map[string]int64)}
+	now := time.Now().UTC().Format(time.RFC3339)
+	notBefore, errorClass, deadLettered := s.col("not_before"), s.col("error_class"), s.col("dead_lettered_at")
+	avgImportTime := "NULL"
+	if s.has("imports", "import_time_ms") {
+		avgImportTime = "AVG(import_time_ms)"
+	}
+	errored := "imported_at IS NULL AND error IS NOT NULL AND " + deadLettered + " IS NULL AND COALESCE(" + errorClass + ", '') NOT IN ('blocked', 'quarantined', 'discarded')"
+	row := s.db.QueryRow(s.dialect.rebind(`SELECT
+    COALESCE(SUM(CASE WHEN imported_at IS NULL AND error IS NULL AND (`+notBefore+` IS NULL OR `+notBefore+` <= ?) THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN imported_at IS NULL AND error IS NULL AND `+notBefore+` > ? THEN 1 ELSE 0 END), 0),
+    MIN(CASE WHEN imported_at IS NULL AND error IS NULL AND `+notBefore+` > ? THEN `+notBefore+` END),
+    COALESCE(SUM(CASE WHEN imported_at IS NOT NULL THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN `+errored+` THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN `+deadLettered+` IS NOT NULL THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN imported_at IS NULL AND `+errorClass+` = 'blocked' AND `+deadLettered+` IS NULL THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN imported_at IS NULL AND `+errorClass+` = 'quarantined' AND `+deadLettered+` IS NULL THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN imported_at IS NULL AND `+errorClass+` = 'discarded' AND `+deadLettered+` IS NULL THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN imported_at IS NOT NULL AND `+s.col("response_conflict")+` IS NOT NULL THEN 1 ELSE 0 END), 0),
+    `+avgImportTime+`,
+    MIN(imported_at),
+    MAX(imported_at)
+FROM imports`), now, now, now)
+	err := row.Scan(&status.Pending, &status.Scheduled, &status.NextScheduled, &status.Imported, &status.Errored, &status.DeadLettered, &status.Blocked,
+		&status.Quarantined, &status.Discarded, &status.Conflicts,
+		&status.AvgImportTime, &status.FirstImported, &status.LastImported)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.query(`SELECT COALESCE(` + errorClass + `, 'unknown'), ` + s.col("http_status") + `, COUNT(*) FROM imports
+WHERE ` + errored + ` GROUP BY 1, 2 ORDER BY 1, 2`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var class string
+		var httpStatus sql.NullInt64
+		var count int64
+		if err := rows.Scan(&class, &httpStatus, &count); err != nil {
+			return nil, err
+		}
+		key := class
+		if httpStatus.Valid {
+			key = fmt.Sprintf("%s (HTTP %d)", class, httpStatus.Int64)
+		}
+		status.ErrorsByHTTP[key] = count
+	}
+	return status, rows.Err()
+}
+
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	commonFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s status [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+
+	status, err := store.Status()
+	if err != nil {
+		return fmt.Errorf("failed to query status: %s", err)
+	}
+	if jsonLogs {
+		logInfo(Fields{
+			"pending":           status.Pending,
+			"scheduled":         status.Scheduled,
+			"next_scheduled_at": status.NextScheduled.String,
+			"imported":          status.Imported,
+			"errored":           status.Errored,
+			"errors":            status.ErrorsByHTTP,
+			"dead_lettered":     status.DeadLettered,
+			"blocked":           status.Blocked,
+			"quarantined":       status.Quarantined,
+			"discarded":         status.Discarded,
+			"conflicts":         status.Conflicts,
+			"avg_import_ms":     status.AvgImportTime.Float64,
+			"first_imported_at": status.FirstImported.String,
+			"last_imported_at":  status.LastImported.String,
+		}, "import status")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "pending\t%d\n", status.Pending)
+	if status.Scheduled > 0 {
+		fmt.Fprintf(w, "scheduled\t%d (next at %s)\n", status.Scheduled, status.NextScheduled.String)
+	}
+	fmt.Fprintf(w, "imported\t%d\n", status.Imported)
+	if status.Conflicts > 0 {
+		fmt.Fprintf(w, "  conflicts\t%d\n", status.Conflicts)
+	}
+	fmt.Fprintf(w, "errored\t%d\n", status.Errored)
+	for _, key := range sortedKeys(status.ErrorsByHTTP) {
+		fmt.Fprintf(w, "  %s\t%d\n", key, status.ErrorsByHTTP[key])
+	}
+	if status.DeadLettered > 0 {
+		fmt.Fprintf(w, "dead-lettered\t%d\n", status.DeadLettered)
+	}
+	if status.Blocked > 0 {
+		fmt.Fprintf(w, "blocked\t%d\n", status.Blocked)
+	}
+	if status.Quarantined > 0 {
+		fmt.Fprintf(w, "quarantined\t%d\n", status.Quarantined)
+	}
+	if status.Discarded > 0 {
+		fmt.Fprintf(w, "discarded\t%d\n", status.Discarded)
+	}
+	if status.AvgImportTime.Valid {
+		fmt.Fprintf(w, "average import time\t%.0fms\n", status.AvgImportTime.Float64)
+	}
+	if status.FirstImported.Valid {
+		fmt.Fprintf(w, "first imported at\t%s\n", status.FirstImported.String)
+		fmt.Fprintf(w, "last imported at\t%s\n", status.LastImported.String)
+	}
+	return w.Flush()
+}
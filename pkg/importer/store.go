@@ -0,0 +1,581 @@
+package importer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type Store interface {
+	SetPendingFilter(where string)
+	SetPendingAfter(uid string)
+	CountPending(uids []string) (int, error)
+	FetchPending(scope pendingScope, after string, limit int) ([]Entry, error)
+	PendingPriorities() ([]int, error)
+	PendingBoundaries(parts int) ([]string, error)
+	WriteStatus(updates []StatusUpdate) error
+	SetIdempotencyKey(e *Entry, key string) error
+	ResetErrors(classes []string) (int64, error)
+	Requeue(filter *RequeueFilter, dryRun bool) (int64, error)
+	Claim(e *Entry, instance string, expiry time.Duration) (bool, error)
+	Upsert(records []loadRecord) error
+	ForEachImported(fn func(uid, payload string, responseID *string) error) error
+	InitSchema() error
+	StartRun(r *Run) error
+	FinishRun(r *Run) error
+	Runs(limit int) ([]Run, error)
+	Migrate() ([]string, error)
+	Status() (*ImportStatus, error)
+	Export(fn func(row ExportRow) error) error
+	FetchToVerify(after string, limit int, all bool) ([]Entry, error)
+	MarkVerified(e *Entry, verifyErr error) error
+	FetchToRollback(filter *RequeueFilter, after string, limit int) ([]Entry, error)
+	MarkRolledBack(e *Entry) error
+	Close() error
+}
+
+type dialect struct {
+	driver      string
+	numbered    bool
+	textKey     string
+	upsertQuery string
+	// insertNewQuery inserts an entry unless its uid is already there.
+	insertNewQuery string
+	// insertErrorBodyQuery inserts an error body unless its hash is already
+	// there.
+	insertErrorBodyQuery string
+}
+
+var (
+	sqliteDialect = dialect{
+		driver:               "sqlite3",
+		textKey:              "TEXT",
+		upsertQuery:          "INSERT INTO imports (uid, payload) VALUES (?, ?) ON CONFLICT (uid) DO UPDATE SET payload = excluded.payload",
+		insertNewQuery:       "INSERT INTO imports (uid, payload) VALUES (?, ?) ON CONFLICT (uid) DO NOTHING",
+		insertErrorBodyQuery: "INSERT INTO errors (hash, body, http_status, first_seen_at) VALUES (?, ?, ?, ?) ON CONFLICT (hash) DO NOTHING",
+	}
+	postgresDialect = dialect{
+		driver:               "postgres",
+		numbered:             true,
+		textKey:              "TEXT",
+		upsertQuery:          "INSERT INTO imports (uid, payload) VALUES (?, ?) ON CONFLICT (uid) DO UPDATE SET payload = excluded.payload",
+		insertNewQuery:       "INSERT INTO imports (uid, payload) VALUES (?, ?) ON CONFLICT (uid) DO NOTHING",
+		insertErrorBodyQuery: "INSERT INTO errors (hash, body, http_status, first_seen_at) VALUES (?, ?, ?, ?) ON CONFLICT (hash) DO NOTHING",
+	}
+	mysqlDialect = dialect{
+		driver:               "mysql",
+		textKey:              "VARCHAR(255)",
+		upsertQuery:          "INSERT INTO imports (uid, payload) VALUES (?, ?) ON DUPLICATE KEY UPDATE payload = VALUES(payload)",
+		insertNewQuery:       "INSERT IGNORE INTO imports (uid, payload) VALUES (?, ?)",
+		insertErrorBodyQuery: "INSERT IGNORE INTO errors (hash, body, http_status, first_seen_at) VALUES (?, ?, ?, ?)",
+	}
+)
+
+// rebind rewrites the ? placeholders of query for drivers expecting $1, $2...
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+	filter  string
+	after   string
+	// missing are the tables and columns found missing by detectSchema.
+	missing map[string]bool
+}
+
+// openStore opens the store designated by dsn: postgres:// and mysql:// URLs
+// select the matching driver, anything else is a path to a SQLite database.
+// It fails if the schema of the database cannot be read, unless it has no
+// imports table yet, as before init-db.
+func openStore(dsn string) (Store, error) {
+	db, d, err := openDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{db: db, dialect: d}
+	if err := s.detectSchema(); err != nil && !errors.Is(err, errNoImportsTable) {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func openDB(dsn string) (*sql.DB, dialect, error) {
+	d, source := parseDSN(dsn)
+	switch d.driver {
+	case "sqlite3":
+		source = withDefaults(source, "_journal_mode=WAL", "_busy_timeout=5000")
+	case "mysql":
+		source = withDefaults(source, "clientFoundRows=true")
+	}
+	db, err := sql.Open(d.driver, source)
+	if err != nil {
+		return nil, d, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, d, err
+	}
+	return db, d, nil
+}
+
+// parseDSN returns the dialect of dsn and the data source to open with its
+// driver.
+func parseDSN(dsn string) (dialect, string) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return postgresDialect, dsn
+	case strings.HasPrefix(dsn, "mysql://"):
+		return mysqlDialect, strings.TrimPrefix(dsn, "mysql://")
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return sqliteDialect, strings.TrimPrefix(dsn, "sqlite://")
+	}
+	return sqliteDialect, dsn
+}
+
+// withDefaults adds the params the DSN does not set already to source. SQLite
+// databases get WAL journaling and a busy timeout, so that concurrent readers
+// and writers wait for each other instead of failing with SQLITE_BUSY. MySQL
+// ones get clientFoundRows, so that the rows affected by an UPDATE are those
+// it matched, changed or not, as with the other databases, which Claim
+// relies on.
+func withDefaults(source string, params ...string) string {
+	for _, param := range params {
+		name := param[:strings.Index(param, "=")]
+		if strings.Contains(source, name+"=") {
+			continue
+		}
+		separator := "?"
+		if strings.Contains(source, "?") {
+			separator = "&"
+		}
+		source += separator + param
+	}
+	return source
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// SetPendingFilter restricts pending entries to those matching the SQL
+// condition where.
+func (s *sqlStore) SetPendingFilter(where string) {
+	s.filter = where
+}
+
+// SetPendingAfter restricts pending entries to those whose uid sorts after
+// the given one.
+func (s *sqlStore) SetPendingAfter(uid string) {
+	s.after = uid
+}
+
+func (s *sqlStore) pendingCondition() (string, []interface{}) {
+	condition := "imported_at IS NULL AND " + s.col("error") + " IS NULL AND (" + s.col("not_before") + " IS NULL OR " + s.col("not_before") + " <= ?)"
+	args := []interface{}{time.Now().UTC().Format(time.RFC3339)}
+	if s.filter != "" {
+		condition += " AND (" + s.filter + ")"
+	}
+	if s.after != "" {
+		condition += " AND uid > ?"
+		args = append(args, s.after)
+	}
+	return condition, args
+}
+
+// NextScheduled returns the earliest not_before time of the entries not yet
+// eligible, if any.
+func (s *sqlStore) NextScheduled() (time.Time, bool, error) {
+	if !s.has("imports", "not_before") {
+		return time.Time{}, false, nil
+	}
+	var next sql.NullString
+	err := s.db.QueryRow(s.dialect.rebind("SELECT MIN(not_before) FROM imports WHERE imported_at IS NULL AND error IS NULL AND not_before > ?"),
+		time.Now().UTC().Format(time.RFC3339)).Scan(&next)
+	if err != nil || !next.Valid {
+		return time.Time{}, false, err
+	}
+	t, err := time.Parse(time.RFC3339, next.String)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid not_before %q, expected an RFC 3339 time: %s", next.String, err)
+	}
+	return t, true, nil
+}
+
+// maxUIDsPerQuery keeps IN lists below the SQLite limit on variables.
+const maxUIDsPerQuery = 500
+
+// CountPending counts pending entries, only among uids if not nil.
+func (s *sqlStore) CountPending(uids []string) (int, error) {
+	condition, conditionArgs := s.pendingCondition()
+	if uids == nil {
+		var n int
+		err := s.db.QueryRow(s.dialect.rebind("SELECT COUNT(*) FROM imports WHERE "+condition), conditionArgs...).Scan(&n)
+		return n, err
+	}
+	total := 0
+	for start := 0; start < len(uids); start += maxUIDsPerQuery {
+		end := start + maxUIDsPerQuery
+		if end > len(uids) {
+			end = len(uids)
+		}
+		args := append([]interface{}{}, conditionArgs...)
+		for _, uid := range uids[start:end] {
+			args = append(args, uid)
+		}
+		var n int
+		query := "SELECT COUNT(*) FROM imports WHERE " + condition + " AND uid IN (" + placeholders(end-start) + ")"
+		if err := s.db.QueryRow(s.dialect.rebind(query), args...).Scan(&n); err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// PendingPriorities returns the distinct priorities of pending entries, the
+// highest first. Entries without priority count as priority 0.
+func (s *sqlStore) PendingPriorities() ([]int, error) {
+	condition, args := s.pendingCondition()
+	rows, err := s.query("SELECT DISTINCT COALESCE("+s.col("priority")+", 0) FROM imports WHERE "+condition+" ORDER BY 1 DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var priorities []int
+	for rows.Next() {
+		var priority int
+		if err := rows.Scan(&priority); err != nil {
+			return nil, err
+		}
+		priorities = append(priorities, priority)
+	}
+	return priorities, rows.Err()
+}
+
+// PendingBoundaries returns the uids splitting pending entries in parts of
+// about the same size, each being the last uid of its part. There are fewer
+// of them when there are not enough pending entries.
+func (s *sqlStore) PendingBoundaries(parts int) ([]string, error) {
+	n, err := s.CountPending(nil)
+	if err != nil {
+		return nil, err
+	}
+	condition, args := s.pendingCondition()
+	var boundaries []string
+	for i := 1; i < parts; i++ {
+		offset := i*n/parts - 1
+		if offset < 0 {
+			continue
+		}
+		var uid string
+		err := s.db.QueryRow(s.dialect.rebind("SELECT uid FROM imports WHERE "+condition+" ORDER BY uid LIMIT 1 OFFSET ?"), append(args, offset)...).Scan(&uid)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(boundaries) == 0 || uid > boundaries[len(boundaries)-1] {
+			boundaries = append(boundaries, uid)
+		}
+	}
+	return boundaries, nil
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// pendingScope restricts the pending entries fetched to those of priority if
+// not nil, and to those of tenant if set, or else not of the excluded tenants.
+type pendingScope struct {
+	priority *int
+	tenant   string
+	excluded []string
+}
+
+// FetchPending returns at most limit pending entries of scope whose uid
+// sorts after the given one.
+func (s *sqlStore) FetchPending(scope pendingScope, after string, limit int) ([]Entry, error) {
+	var entries []Entry
+	condition, args := s.pendingCondition()
+	if scope.priority != nil {
+		condition += " AND COALESCE(" + s.col("priority") + ", 0) = ?"
+		args = append(args, *scope.priority)
+	}
+	switch {
+	case scope.tenant != "":
+		condition += " AND " + s.col("tenant") + " = ?"
+		args = append(args, scope.tenant)
+	case len(scope.excluded) > 0:
+		condition += " AND (" + s.col("tenant") + " IS NULL OR " + s.col("tenant") + " NOT IN (" + placeholders(len(scope.excluded)) + "))"
+		for _, tenant := range scope.excluded {
+			args = append(args, tenant)
+		}
+	}
+	selected := []string{"uid", "payload", "imported_at", s.col("idempotency_key"), s.col("target"), s.col("tenant"), s.col("group_key"), s.col("headers"), s.col("query_params"), s.col("operation"), "response_id", s.col("auth_token")}
+	rows, err := s.query("SELECT "+strings.Join(selected, ", ")+" FROM imports WHERE "+condition+" AND uid > ? ORDER BY uid LIMIT ?", append(args, after, limit)...)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry, err := makeEntry(rows)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// StatusUpdate is the outcome of an import to persist.
+type StatusUpdate struct {
+	Entry    Entry
+	Imported bool
+	RunID    string
+}
+
+func (s *sqlStore) statusQuery(u *StatusUpdate) (string, []interface{}) {
+	e := &u.Entry
+	var runID *string
+	if u.RunID != "" {
+		runID = &u.RunID
+	}
+	var status *int
+	if e.Status != 0 {
+		status = &e.Status
+	}
+	if u.Imported {
+		now := time.Now().UTC()
+		return s.updateQuery("imports", append([]assignment{
+			{"response_id", e.ResponseId},
+			{"imported_at", now.Format(time.RFC3339)},
+			{"import_time_ms", e.ImportTime},
+			{"http_status", status},
+			{"response_body", e.archivedBody(true)},
+			{"request_id", e.archivedRequestID()},
+			{"correlation_id", nullString(e.CorrelationID)},
+			{"duplicate_of", e.DuplicateOf},
+			{"response_conflict", e.ConflictsWith},
+			{"run_id", runID},
+			{"claimed_by", nil},
+		}, e.fieldAssignments()...), "uid = ?", e.UID)
+	}
+	failure := s.errorRecord(e)
+	body := e.archivedBody(false)
+	if failure.hash != "" && body != nil && *body == failure.body {
+		body = nil
+	}
+	return s.updateQuery("imports", []assignment{
+		{"error", failure.text},
+		{"errored_at", time.Now().UTC().Format(time.RFC3339)},
+		{"error_class", classifyError(e.Err)},
+		{"error_hash", failure.hashArg()},
+		{"http_status", status},
+		{"response_body", body},
+		{"request_id", e.archivedRequestID()},
+		{"correlation_id", nullString(e.CorrelationID)},
+		{"run_id", runID},
+		{"claimed_by", nil},
+	}, "uid = ?", e.UID)
+}
+
+// nullString returns s, or NULL if it is empty.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// WriteStatus persists updates in a single transaction, preparing each
+// distinct status query once.
+func (s *sqlStore) WriteStatus(updates []StatusUpdate) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	var dead []StatusUpdate
+	statements := make(map[string]*sql.Stmt)
+	defer func() {
+		for _, statement := range statements {
+			statement.Close()
+		}
+	}()
+	for i := range updates {
+		query, args := s.statusQuery(&updates[i])
+		statement, ok := statements[query]
+		if !ok {
+			if statement, err = tx.Prepare(s.dialect.rebind(query)); err != nil {
+				tx.Rollback()
+				return err
+			}
+			statements[query] = statement
+		}
+		if _, err := statement.Exec(args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if updates[i].Imported {
+			if err := s.mapResponse(tx, &updates[i].Entry, now); err != nil {
+				tx.Rollback()
+				return err
+			}
+		} else if err := s.saveErrorBody(tx, s.errorRecord(&updates[i].Entry), now); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if *argAttemptHistory && s.has("attempt_history", "") {
+			if err := s.recordHistory(tx, &updates[i]); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if class := classifyError(updates[i].Entry.Err); *argMaxAttempts > 0 && (updates[i].Imported || class != errorClassBlocked && class != errorClassQuarantined) {
+			moved, err := s.recordAttempt(tx, &updates[i], now)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if moved {
+				dead = append(dead, updates[i])
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, u := range dead {
+		logInfo(u.Entry.fields("dead-lettered"), "entry %s errored %d times, moved to the dead letters", u.Entry.UID, *argMaxAttempts)
+		auditTrail.record("dead_lettered", u.Entry.UID, nil)
+	}
+	return nil
+}
+
+func (s *sqlStore) SetIdempotencyKey(e *Entry, key string) error {
+	if !s.has("imports", "idempotency_key") {
+		return nil
+	}
+	_, err := s.exec("UPDATE imports SET idempotency_key = ? WHERE uid = ?", key, e.UID)
+	return err
+}
+
+// ResetErrors sets errored entries of the given classes back to pending.
+func (s *sqlStore) ResetErrors(classes []string) (int64, error) {
+	if len(classes) == 0 {
+		return 0, nil
+	}
+	args := make([]interface{}, len(classes))
+	for i, class := range classes {
+		args[i] = class
+	}
+	list := placeholders(len(classes))
+	condition := "imported_at IS NULL AND error IS NOT NULL AND " + s.col("dead_lettered_at") + " IS NULL AND "
+	if len(classes) == len(errorClasses) {
+		// also requeue errors recorded before classes were persisted
+		condition += "(" + s.col("error_class") + " IS NULL OR " + s.col("error_class") + " IN (" + list + "))"
+	} else {
+		condition += s.col("error_class") + " IN (" + list + ")"
+	}
+	uids, err := s.uidsWhere(condition, args...)
+	if err != nil {
+		return 0, err
+	}
+	set := "error = NULL"
+	for _, column := range []string{"error_class", "http_status", "error_hash", "errored_at"} {
+		if s.has("imports", column) {
+			set += ", " + column + " = NULL"
+		}
+	}
+	result, err := s.exec("UPDATE imports SET "+set+" WHERE "+condition, args...)
+	if err != nil {
+		return 0, err
+	}
+	auditTrail.requeued(uids)
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) Upsert(records []loadRecord) error {
+	if err := s.InitSchema(); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.upsertTx(tx, records); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) upsertTx(tx *sql.Tx, records []loadRecord) error {
+	statement, err := tx.Prepare(s.dialect.rebind(s.dialect.upsertQuery))
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+	for _, record := range records {
+		if record.UID == "" {
+			return errors.New("empty uid")
+		}
+		payload, err := sealPayload(record.Payload)
+		if err != nil {
+			return err
+		}
+		if _, err := statement.Exec(record.UID, payloadArg(payload)); err != nil {
+			return fmt.Errorf("uid %s: %s", record.UID, err)
+		}
+	}
+	return nil
+}
+
+// Claim marks e as being processed by instance, unless another instance holds
+// a claim on it that is more recent than the given expiry. Entries saved with
+// an error are not claimed: saving the error releases their claim, and they
+// wait for retry-errors to reset them.
+func (s *sqlStore) Claim(e *Entry, instance string, expiry time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	result, err := s.exec(`UPDATE imports SET claimed_by = ?, claimed_at = ?
+WHERE uid = ? AND imported_at IS NULL AND error IS NULL AND (claimed_by IS NULL OR claimed_by = ? OR claimed_at < ?)`,
+		instance, now.Format(time.RFC3339), e.UID, instance, now.Add(-expiry).Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
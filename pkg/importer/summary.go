@@ -0,0 +1,130 @@
+package importer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var argSummaryJSON = Flags.String("summary-json", "", "write the outcome of the run as JSON to this `file` once it ends: run id, counts, duration, errors by status and class, and exit status, for orchestrators deciding whether to retry")
+
+// RunSummary is the content of the -summary-json file.
+type RunSummary struct {
+	RunID       string         `json:"run_id,omitempty"`
+	Tag         string         `json:"tag,omitempty"`
+	Instance    string         `json:"instance,omitempty"`
+	DB          string         `json:"db,omitempty"`
+	StartedAt   string         `json:"started_at"`
+	FinishedAt  string         `json:"finished_at"`
+	DurationMS  int64          `json:"duration_ms"`
+	Outcome     string         `json:"outcome"`
+	ExitStatus  int            `json:"exit_status"`
+	Error       string         `json:"error,omitempty"`
+	Imported    int            `json:"imported"`
+	Conflicts   int            `json:"conflicts"`
+	Duplicate   int            `json:"duplicate"`
+	Skipped     int            `json:"skipped"`
+	Errored     int            `json:"errored"`
+	Retryable   int            `json:"retryable"`
+	Aborted     int            `json:"aborted"`
+	Blocked     int            `json:"blocked"`
+	Quarantined int            `json:"quarantined"`
+	Remaining   int            `json:"remaining"`
+	Errors      map[string]int `json:"errors"`
+	ErrorClass  map[string]int `json:"errors_by_class"`
+	Databases   []RunSummary   `json:"databases,omitempty"`
+}
+
+// retryableClasses are the error classes of the entries a retry-errors run
+// is likely to import.
+var retryableClasses = []string{errorClassNetwork, errorClass5xx}
+
+// exitOutcome names the exit status code in the summary.
+func exitOutcome(code int) string {
+	switch code {
+	case ExitOK:
+		return "ok"
+	case ExitErrors:
+		return "errors"
+	case ExitAborted:
+		return "stopped"
+	case ExitInterrupted:
+		return "interrupted"
+	case ExitConfig:
+		return "invalid"
+	}
+	return "failed"
+}
+
+// runSummary returns the summary of the run of im, ended with err.
+func (im *Importer) runSummary(started time.Time, err error) RunSummary {
+	code := im.ExitCode(err)
+	s := RunSummary{
+		DB:         *argDb,
+		StartedAt:  started.UTC().Format(time.RFC3339),
+		FinishedAt: time.Now().UTC().Format(time.RFC3339),
+		DurationMS: time.Since(started).Milliseconds(),
+		Outcome:    exitOutcome(code),
+		ExitStatus: code,
+		Errors:     map[string]int{},
+		ErrorClass: map[string]int{},
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if im.run != nil {
+		s.RunID, s.Tag, s.Instance = im.run.ID, im.run.Tag, im.run.Instance
+	}
+	if p := im.progress; p != nil {
+		p.mu.Lock()
+		s.Imported, s.Conflicts, s.Duplicate, s.Skipped = p.imported, p.conflicts, p.duplicate, p.skipped
+		s.Errored, s.Aborted, s.Blocked, s.Quarantined = p.errored(), p.aborted, p.blocked, p.quarantined
+		s.Remaining = p.remaining()
+		for status, n := range p.errors {
+			s.Errors[status] = n
+		}
+		for class, n := range p.classes {
+			s.ErrorClass[class] = n
+		}
+		p.mu.Unlock()
+		for _, class := range retryableClasses {
+			s.Retryable += s.ErrorClass[class]
+		}
+	}
+	return s
+}
+
+// add adds the counts of d, the summary of one of several databases, to s.
+func (s *RunSummary) add(d RunSummary) {
+	s.Imported += d.Imported
+	s.Conflicts += d.Conflicts
+	s.Duplicate += d.Duplicate
+	s.Skipped += d.Skipped
+	s.Errored += d.Errored
+	s.Retryable += d.Retryable
+	s.Aborted += d.Aborted
+	s.Blocked += d.Blocked
+	s.Quarantined += d.Quarantined
+	s.Remaining += d.Remaining
+	for status, n := range d.Errors {
+		s.Errors[status] += n
+	}
+	for class, n := range d.ErrorClass {
+		s.ErrorClass[class] += n
+	}
+	s.Databases = append(s.Databases, d)
+}
+
+// writeJSONFile writes v as indented JSON to path, replacing it at once.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,151 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	argTarget        = Flags.String("target", "/responses", "API path entries are sent to, unless overridden by their target column")
+	argMethod        = Flags.String("method", "POST", "HTTP method used to send entries")
+	argSuccessStatus = Flags.String("success-status", "201", "comma-separated HTTP statuses or ranges (e.g. 200-299) denoting a successful import")
+	argResponseID    = Flags.String("response-id-path", "ID", "dot-separated path of the response identifier in the JSON body of successful responses, e.g. data.id")
+)
+
+var successStatuses = map[int]bool{201: true}
+
+// Target is where an entry is sent to.
+type Target struct {
+	Method string
+	Path   string
+}
+
+func (t Target) String() string {
+	return t.Method + " " + t.Path
+}
+
+// parseTarget reads a target column value, either a path or a method and a
+// path separated by a space (e.g. "PUT /places").
+func parseTarget(value string) Target {
+	target := Target{Method: *argMethod, Path: *argTarget}
+	fields := strings.Fields(value)
+	switch len(fields) {
+	case 1:
+		target.Path = fields[0]
+	case 2:
+		target.Method, target.Path = strings.ToUpper(fields[0]), fields[1]
+	}
+	return target
+}
+
+func (e *Entry) target() Target {
+	return parseTarget(e.Target)
+}
+
+// request returns the method and URL of the request sending e alone to api,
+// depending on its operation.
+func (e *Entry) request(api *endpoint) (string, string) {
+	target := e.target()
+	switch e.operation() {
+	case operationUpdate:
+		return *argUpdateMethod, api.url + target.Path + "/" + url.PathEscape(*e.ResponseId)
+	case operationDelete:
+		return http.MethodDelete, api.url + target.Path + "/" + url.PathEscape(*e.ResponseId)
+	}
+	return target.Method, api.url + target.Path
+}
+
+func parseSuccessStatuses(list string) (map[int]bool, error) {
+	ranges, err := parseStatusRanges(list)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[int]bool)
+	for _, r := range ranges {
+		if r[0] < 100 || r[1] > 599 {
+			return nil, fmt.Errorf("invalid success status %d-%d", r[0], r[1])
+		}
+		for status := r[0]; status <= r[1]; status++ {
+			statuses[status] = true
+		}
+	}
+	return statuses, nil
+}
+
+// extractResponseID returns the string or number found at -response-id-path
+// in body, and false if there is none.
+func extractResponseID(body []byte) (string, bool, error) {
+	return extractID(body, *argResponseID)
+}
+
+// extractID returns the string or number found at the dot-separated path in
+// body, numbers in the path indexing arrays, and false if there is none.
+func extractID(body []byte, path string) (string, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", false, err
+	}
+	value, _ = valueAt(value, path)
+	switch id := value.(type) {
+	case string:
+		return id, true, nil
+	case json.Number:
+		return id.String(), true, nil
+	}
+	return "", false, nil
+}
+
+// valueAt returns the value found at the dot-separated path in a decoded
+// JSON document, numbers in the path indexing arrays.
+func valueAt(value interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = node[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			value = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// groupByTarget splits entries into groups sharing the same target, tenant,
+// headers, query parameters and auth token, in order of first appearance.
+func groupByTarget(entries []Entry) [][]Entry {
+	type key struct {
+		target  Target
+		tenant  string
+		headers string
+		query   string
+		token   string
+	}
+	var groups [][]Entry
+	index := make(map[key]int)
+	for _, entry := range entries {
+		k := key{entry.target(), entry.Tenant, entry.Headers, entry.QueryParams, entry.AuthToken}
+		i, ok := index[k]
+		if !ok {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], entry)
+	}
+	return groups
+}
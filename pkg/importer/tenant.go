@@ -0,0 +1,243 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TenantConfig holds the settings of a tenant in the tenants section of the
+// config file. Empty settings default to the matching flags, credentials
+// only if none is set; $VAR references in credentials are expanded from the
+// environment. Concurrency gives the tenant its own workers instead of
+// sharing -j, and Rate caps its requests per second.
+type TenantConfig struct {
+	URL               string  `yaml:"url"`
+	Auth              string  `yaml:"auth"`
+	AuthHeader        string  `yaml:"auth-header"`
+	AuthPrefix        string  `yaml:"auth-prefix"`
+	Token             string  `yaml:"token"`
+	TokenSource       string  `yaml:"token-source"`
+	OAuthTokenURL     string  `yaml:"oauth-token-url"`
+	OAuthClientID     string  `yaml:"oauth-client-id"`
+	OAuthClientSecret string  `yaml:"oauth-client-secret"`
+	OAuthScope        string  `yaml:"oauth-scope"`
+	Concurrency       int     `yaml:"concurrency"`
+	Rate              float64 `yaml:"rate"`
+}
+
+// endpoint is where and how the entries of a tenant are sent.
+type endpoint struct {
+	url  string
+	auth Authenticator
+	rate *rateLimiter
+}
+
+// send sends req with sendRequest once the rate of the tenant allows it,
+// once more with a fresh token if it is rejected with 401 and the token can
+// be fetched again.
+func (p *endpoint) send(req *http.Request) (*http.Response, time.Duration, error) {
+	if err := p.rate.wait(req.Context()); err != nil {
+		return nil, 0, err
+	}
+	resp, elapsed, err := sendRequest(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, elapsed, err
+	}
+	auth := p.auth
+	if auth == nil {
+		auth = authenticator
+	}
+	refresher, ok := auth.(tokenRefresher)
+	if !ok || rewind(req) != nil {
+		return resp, elapsed, err
+	}
+	if err := refresher.Refresh(req.Context(), req); err != nil {
+		logError(Fields{"error": err}, "%s", err)
+		return resp, elapsed, nil
+	}
+	drain(resp)
+	if err := auth.Authorize(req); err != nil {
+		return nil, elapsed, err
+	}
+	logInfo(Fields{"url": req.URL.String()}, "API answered 401, retrying with a fresh token")
+	return sendRequest(req)
+}
+
+// rateLimiter spaces requests by interval, 0 letting them through.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// setRate sets the maximum number of requests per second, 0 for no limit.
+func (r *rateLimiter) setRate(rate float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interval = 0
+	if rate > 0 {
+		r.interval = time.Duration(float64(time.Second) / rate)
+	}
+}
+
+// wait blocks until the next request is allowed, reserving its slot. It is a
+// no-op on a nil limiter.
+func (r *rateLimiter) wait(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	at := r.next
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	r.next = at.Add(r.interval)
+	r.mu.Unlock()
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// authorize adds the credentials of p to req, those of the flags if p has
+// none of its own.
+func (p *endpoint) authorize(req *http.Request) error {
+	if p.auth == nil {
+		return authenticator.Authorize(req)
+	}
+	return p.auth.Authorize(req)
+}
+
+var tenants = map[string]*endpoint{}
+
+// tenantLanes maps the tenants with their own concurrency to the semaphore
+// of their workers.
+var tenantLanes = map[string]chan bool{}
+
+type TenantError struct {
+	Tenant string
+}
+
+func (e *TenantError) Error() string {
+	if e.Tenant == "" {
+		return "no credentials for entries without tenant"
+	}
+	return fmt.Sprintf("unknown tenant %q", e.Tenant)
+}
+
+// tenantConfigs returns the tenants section of a config file.
+func tenantConfigs(file map[string]interface{}) (map[string]TenantConfig, error) {
+	section, ok := file["tenants"]
+	if !ok {
+		return nil, nil
+	}
+	content, err := yaml.Marshal(section)
+	if err != nil {
+		return nil, err
+	}
+	var configs map[string]TenantConfig
+	if err := yaml.UnmarshalStrict(content, &configs); err != nil {
+		return nil, fmt.Errorf("invalid tenants in %s: %s", *argConfig, err)
+	}
+	for name, config := range configs {
+		if config.Concurrency < 0 || config.Rate < 0 {
+			return nil, fmt.Errorf("tenant %s: negative concurrency or rate", name)
+		}
+	}
+	return configs, nil
+}
+
+// setupTenants reads the tenants section of the config file, replacing the
+// tenants of the previous database of a run.
+func setupTenants() error {
+	tenants = map[string]*endpoint{}
+	tenantLanes = map[string]chan bool{}
+	if *argConfig == "" {
+		return nil
+	}
+	file, err := loadConfigFile(*argConfig)
+	if err != nil {
+		return err
+	}
+	configs, err := tenantConfigs(file)
+	if err != nil {
+		return err
+	}
+	for name, config := range configs {
+		p := &endpoint{url: config.URL}
+		if p.url == "" {
+			p.url = *argURL
+		}
+		if config.Auth != "" || config.AuthHeader != "" || config.AuthPrefix != "" || config.Token != "" || config.TokenSource != "" || config.OAuthClientID != "" {
+			settings := flagAuthSettings()
+			overrideAuth(&settings.scheme, config.Auth)
+			overrideAuth(&settings.header, config.AuthHeader)
+			overrideAuth(&settings.prefix, config.AuthPrefix)
+			overrideAuth(&settings.token, os.ExpandEnv(config.Token))
+			if config.Token != "" {
+				settings.tokenSource = ""
+			}
+			overrideAuth(&settings.tokenSource, os.ExpandEnv(config.TokenSource))
+			overrideAuth(&settings.tokenURL, config.OAuthTokenURL)
+			overrideAuth(&settings.clientID, config.OAuthClientID)
+			overrideAuth(&settings.clientSecret, os.ExpandEnv(config.OAuthClientSecret))
+			overrideAuth(&settings.scope, config.OAuthScope)
+			if p.auth, err = settings.authenticator(); err != nil {
+				return fmt.Errorf("tenant %s: %s", name, err)
+			}
+		}
+		p.rate = &rateLimiter{}
+		p.rate.setRate(config.Rate)
+		if config.Concurrency > 0 {
+			sem := make(chan bool, config.Concurrency)
+			for i := 0; i < config.Concurrency; i++ {
+				sem <- true
+			}
+			tenantLanes[name] = sem
+		}
+		tenants[name] = p
+	}
+	return nil
+}
+
+// tenantWorkers returns the number of workers of the tenants with their own
+// concurrency.
+func tenantWorkers() int {
+	n := 0
+	for _, sem := range tenantLanes {
+		n += cap(sem)
+	}
+	return n
+}
+
+func overrideAuth(setting *string, value string) {
+	if value != "" {
+		*setting = value
+	}
+}
+
+// endpoint returns where e is sent, according to its tenant.
+func (e *Entry) endpoint() (*endpoint, error) {
+	if e.Tenant == "" {
+		return &endpoint{url: *argURL}, nil
+	}
+	p, ok := tenants[e.Tenant]
+	if !ok {
+		return nil, &TenantError{e.Tenant}
+	}
+	return p, nil
+}
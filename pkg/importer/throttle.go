@@ -0,0 +1,100 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	argThrottleRetries  = Flags.Int("throttle-retries", 10, "number of times a request answered with 429 Too Many Requests is retried before failing")
+	argThrottleDelay    = Flags.Duration("throttle-delay", 30*time.Second, "pause after a 429 response without Retry-After header")
+	argMaxThrottleDelay = Flags.Duration("max-throttle-delay", 10*time.Minute, "maximum pause after a 429 response, whatever its Retry-After header")
+)
+
+// throttle pauses all requests to the API while it asks to slow down.
+type throttle struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+var apiThrottle = &throttle{}
+
+// wait blocks until the current pause, if any, is over.
+func (t *throttle) wait(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		delay := time.Until(t.until)
+		t.mu.Unlock()
+		if delay <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// pause holds all requests for delay, unless a longer pause is in progress.
+func (t *throttle) pause(delay time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until := time.Now().Add(delay)
+	if !until.After(t.until) {
+		return
+	}
+	if time.Now().After(t.until) {
+		logInfo(Fields{"delay_ms": delay.Milliseconds()}, "API is throttling requests, pausing for %s", delay)
+	}
+	t.until = until
+}
+
+// retryAfter returns the delay asked by the Retry-After header of resp,
+// given in seconds or as a date, capped to -max-throttle-delay.
+func retryAfter(resp *http.Response) time.Duration {
+	delay := *argThrottleDelay
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			delay = time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(value); err == nil {
+			delay = time.Until(date)
+		}
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > *argMaxThrottleDelay {
+		delay = *argMaxThrottleDelay
+	}
+	return delay
+}
+
+// rewind gives req a fresh copy of its body, to send it again.
+func rewind(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if req.GetBody == nil {
+		return errors.New("request body cannot be sent again")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+func drain(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
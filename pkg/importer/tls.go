@@ -0,0 +1,78 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	argTLSCert = Flags.String("tls-cert", "", "PEM client certificate `file` presented to the API for mutual TLS (requires -tls-key)")
+	argTLSKey  = Flags.String("tls-key", "", "PEM private key `file` of -tls-cert")
+	argTLSCA   = Flags.String("tls-ca", "", "PEM `file` of the CA certificates trusted for the API instead of the system ones")
+	argTLSPin  = Flags.String("tls-pin", "", "comma-separated base64 SHA-256 hashes of public keys, one of which the API certificate chain must hold")
+)
+
+// newTLSConfig returns the TLS settings of the flags, or nil if none is set.
+func newTLSConfig() (*tls.Config, error) {
+	if *argTLSCert == "" && *argTLSKey == "" && *argTLSCA == "" && *argTLSPin == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if *argTLSCert != "" || *argTLSKey != "" {
+		if *argTLSCert == "" || *argTLSKey == "" {
+			return nil, errors.New("-tls-cert and -tls-key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(*argTLSCert, *argTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if *argTLSCA != "" {
+		pem, err := ioutil.ReadFile(*argTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificates: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", *argTLSCA)
+		}
+		config.RootCAs = pool
+	}
+	if *argTLSPin != "" {
+		pins := make(map[string]bool)
+		for _, pin := range strings.Split(*argTLSPin, ",") {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+			if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid public key pin %q", pin)
+			}
+			pins[pin] = true
+		}
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			return checkPins(pins, rawCerts)
+		}
+	}
+	return config, nil
+}
+
+// checkPins fails unless one of the certificates presented by the server has
+// a pinned public key.
+func checkPins(pins map[string]bool, rawCerts [][]byte) error {
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(hash[:])] {
+			return nil
+		}
+	}
+	return errors.New("no pinned public key in the server certificate chain")
+}
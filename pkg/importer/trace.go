@@ -0,0 +1,134 @@
+package importer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	argTrace     = Flags.Bool("trace", false, "log every API request and response with their headers and bodies, credentials redacted")
+	argTraceFile = Flags.String("trace-file", "", "write traces to this `file` instead of the log (implies -trace)")
+)
+
+// redactedHeaders have their value hidden in traces.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+}
+
+// tracer writes the requests and responses of sendRequest, to the log or to
+// its own file.
+type tracer struct {
+	mu  sync.Mutex
+	out *log.Logger
+}
+
+var apiTracer *tracer
+
+func setupTrace() error {
+	if *argTraceFile == "" {
+		if *argTrace {
+			apiTracer = &tracer{}
+		}
+		return nil
+	}
+	f, err := os.OpenFile(*argTraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open trace file: %s", err)
+	}
+	apiTracer = &tracer{out: log.New(f, "", log.LstdFlags|log.Lmicroseconds)}
+	return nil
+}
+
+func traceHeaders(h http.Header) map[string]string {
+	headers := make(map[string]string, len(h))
+	for name, values := range h {
+		if redactedHeaders[name] {
+			headers[name] = "redacted"
+			continue
+		}
+		headers[name] = strings.Join(values, ", ")
+	}
+	return headers
+}
+
+func (t *tracer) write(fields Fields, title string, headers map[string]string, body []byte) {
+	if t.out == nil && jsonLogs {
+		fields["headers"] = headers
+		fields["body"] = string(body)
+		logInfo(fields, "%s", title)
+		return
+	}
+	var b strings.Builder
+	b.WriteString(title + "\n")
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s\n", name, headers[name])
+	}
+	if len(body) > 0 {
+		b.WriteString("\n")
+		b.Write(body)
+		b.WriteString("\n")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.out != nil {
+		t.out.Print(b.String())
+	} else {
+		log.Print(b.String())
+	}
+}
+
+// request traces req, whose body is read from GetBody so that it can still
+// be sent. It is a no-op on a nil tracer.
+func (t *tracer) request(req *http.Request) {
+	if t == nil {
+		return
+	}
+	var body []byte
+	if req.GetBody != nil {
+		if r, err := req.GetBody(); err == nil {
+			body, _ = ioutil.ReadAll(r)
+			r.Close()
+		}
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			body = gunzip(body)
+		}
+	}
+	fields := Fields{"trace": "request", "method": req.Method, "url": req.URL.String()}
+	t.write(fields, fmt.Sprintf("> %s %s", req.Method, req.URL), traceHeaders(req.Header), body)
+}
+
+// response traces the outcome of req, replacing the body of resp by a copy.
+// It is a no-op on a nil tracer.
+func (t *tracer) response(req *http.Request, resp *http.Response, elapsed time.Duration, err error) {
+	if t == nil {
+		return
+	}
+	fields := Fields{"trace": "response", "method": req.Method, "url": req.URL.String(), "latency_ms": elapsed.Milliseconds()}
+	if err != nil {
+		fields["error"] = err
+		t.write(fields, fmt.Sprintf("< %s %s failed after %s: %s", req.Method, req.URL, elapsed, err), nil, nil)
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	fields["status"] = resp.StatusCode
+	t.write(fields, fmt.Sprintf("< %s %s %s in %s", req.Method, req.URL, resp.Status, elapsed), traceHeaders(resp.Header), body)
+}
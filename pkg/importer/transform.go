@@ -0,0 +1,77 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+)
+
+var argTransform = Flags.String("transform", "", "path to a Go text/template rendering the payload actually sent")
+
+var transformTemplate *template.Template
+
+// TransformData is the value the transformation template is executed with.
+type TransformData struct {
+	UID     string
+	Raw     string
+	Payload map[string]interface{}
+}
+
+type TransformError struct {
+	Err error
+}
+
+func (e *TransformError) Error() string {
+	return fmt.Sprintf("failed to transform payload: %s", e.Err)
+}
+
+var transformFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"set": func(m map[string]interface{}, key string, value interface{}) map[string]interface{} {
+		m[key] = value
+		return m
+	},
+	"now": func() string {
+		return time.Now().UTC().Format(time.RFC3339)
+	},
+	"env": os.Getenv,
+}
+
+func loadTransform(path string) error {
+	t, err := template.New(path).Funcs(transformFuncs).Option("missingkey=error").ParseFiles(path)
+	if err != nil {
+		return err
+	}
+	transformTemplate = t.Lookup(t.Name())
+	if transformTemplate == nil {
+		return fmt.Errorf("no template found in %s", path)
+	}
+	return nil
+}
+
+// transform replaces the in-memory payload of e by the output of the
+// transformation template, if any. The stored payload is left untouched.
+func (e *Entry) transform() error {
+	if transformTemplate == nil {
+		return nil
+	}
+	data := TransformData{UID: e.UID, Raw: e.Payload}
+	if err := json.Unmarshal([]byte(e.Payload), &data.Payload); err != nil {
+		return &TransformError{err}
+	}
+	var out bytes.Buffer
+	if err := transformTemplate.Execute(&out, data); err != nil {
+		return &TransformError{err}
+	}
+	if !json.Valid(out.Bytes()) {
+		return &TransformError{fmt.Errorf("template output is not valid JSON: %s", out.String())}
+	}
+	e.Payload = out.String()
+	return nil
+}
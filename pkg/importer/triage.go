@@ -0,0 +1,398 @@
+package importer
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// triagePageSize is the number of errored rows loaded at once.
+const triagePageSize = 100
+
+// triageRow is an errored entry shown by triage, along with what the
+// operator decided for it.
+type triageRow struct {
+	uid          string
+	payload      string
+	err          string
+	class        string
+	status       int
+	responseBody string
+	decision     string
+}
+
+func (s *sqlStore) fetchErrored(condition string, args []interface{}, after string, limit int) ([]triageRow, error) {
+	args = append(append([]interface{}{}, args...), after, limit)
+	rows, err := s.query("SELECT uid, payload, error, error_class, http_status, "+s.responseBodyColumn()+" FROM imports WHERE "+condition+
+		" AND uid > ? ORDER BY uid LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var page []triageRow
+	for rows.Next() {
+		var r triageRow
+		var class, body sql.NullString
+		var status sql.NullInt64
+		if err := rows.Scan(&r.uid, &r.payload, &r.err, &class, &status, &body); err != nil {
+			return nil, err
+		}
+		if r.payload, err = decodePayload(r.payload); err != nil {
+			return nil, fmt.Errorf("failed to decode payload of entry %s: %s", r.uid, err)
+		}
+		r.class, r.status, r.responseBody = class.String, int(status.Int64), body.String
+		page = append(page, r)
+	}
+	return page, rows.Err()
+}
+
+// requeueEntry sets an errored entry back to pending, with a new payload if
+// not empty.
+func (s *sqlStore) requeueEntry(uid, payload string) error {
+	if payload != "" {
+		sealed, err := sealPayload(payload)
+		if err != nil {
+			return err
+		}
+		if _, err := s.exec("UPDATE imports SET payload = ? WHERE uid = ?", sealed, uid); err != nil {
+			return err
+		}
+	}
+	if _, err := s.exec("UPDATE imports SET "+s.requeueSet()+" WHERE uid = ?", uid); err != nil {
+		return err
+	}
+	auditTrail.requeued([]string{uid})
+	return nil
+}
+
+// skipEntry moves an errored entry to the dead letters, so that it is not
+// retried anymore.
+func (s *sqlStore) skipEntry(uid string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	attempts, err := s.attemptErrors(tx, uid)
+	if err == nil {
+		err = s.moveToDeadLetters(tx, uid, attempts, time.Now().UTC().Format(time.RFC3339))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	auditTrail.record("dead_lettered", uid, nil)
+	return nil
+}
+
+// triage pages through errored rows on a terminal in raw mode.
+type triage struct {
+	store     *sqlStore
+	condition string
+	args      []interface{}
+	total     int
+	rows      []triageRow
+	current   int
+	exhausted bool
+	message   string
+	fd        int
+	state     *term.State
+	out       *bufio.Writer
+}
+
+// load makes sure the row at index i is loaded, and reports whether it
+// exists.
+func (t *triage) load(i int) (bool, error) {
+	for i >= len(t.rows) && !t.exhausted {
+		after := ""
+		if len(t.rows) > 0 {
+			after = t.rows[len(t.rows)-1].uid
+		}
+		page, err := t.store.fetchErrored(t.condition, t.args, after, triagePageSize)
+		if err != nil {
+			return false, err
+		}
+		t.rows = append(t.rows, page...)
+		t.exhausted = len(page) < triagePageSize
+	}
+	return i < len(t.rows), nil
+}
+
+// wrap splits text in lines of at most width runes.
+func wrap(text string, width int) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.Replace(text, "\t", "    ", -1), "\n") {
+		for utf8.RuneCountInString(line) > width {
+			runes := []rune(line)
+			lines = append(lines, string(runes[:width]))
+			line = string(runes[width:])
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func pad(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+func (t *triage) draw() {
+	width, height, err := term.GetSize(t.fd)
+	if err != nil || width < 40 || height < 8 {
+		width, height = 80, 24
+	}
+	r := &t.rows[t.current]
+	fmt.Fprint(t.out, "\x1b[H\x1b[2J")
+	status := ""
+	if r.status != 0 {
+		status = fmt.Sprintf(", HTTP %d", r.status)
+	}
+	header := fmt.Sprintf("entry %d/%d  %s  (%s%s)", t.current+1, t.total, r.uid, r.class, status)
+	if r.decision != "" {
+		header += "  [" + r.decision + "]"
+	}
+	fmt.Fprintf(t.out, "\x1b[7m%s\x1b[0m\r\n", pad(header, width))
+
+	column := (width - 3) / 2
+	payload := r.payload
+	if indented, err := indentJSON(payload); err == nil {
+		payload = indented
+	}
+	left := append([]string{"Payload", ""}, wrap(payload, column)...)
+	details := r.err
+	if r.responseBody != "" {
+		if indented, err := indentJSON(r.responseBody); err == nil {
+			details += "\n\nResponse:\n" + indented
+		} else {
+			details += "\n\nResponse:\n" + r.responseBody
+		}
+	}
+	right := append([]string{"Error", ""}, wrap(details, column)...)
+	for i := 0; i < height-3; i++ {
+		var l, rt string
+		if i < len(left) {
+			l = left[i]
+		}
+		if i < len(right) {
+			rt = right[i]
+		}
+		fmt.Fprintf(t.out, "%s | %s\r\n", pad(l, column), rt)
+	}
+	footer := "[r]equeue  [s]kip  [e]dit  [n]ext  [p]revious  [q]uit"
+	if t.message != "" {
+		footer = t.message + "  " + footer
+	}
+	fmt.Fprintf(t.out, "\x1b[7m%s\x1b[0m", pad(footer, width))
+	t.out.Flush()
+}
+
+// readKey returns the next key pressed, arrows as n and p.
+func (t *triage) readKey(in *bufio.Reader) (byte, error) {
+	b, err := in.ReadByte()
+	if err != nil || b != 0x1b {
+		return b, err
+	}
+	if in.Buffered() < 2 {
+		return 'q', nil
+	}
+	in.ReadByte()
+	switch arrow, _ := in.ReadByte(); arrow {
+	case 'C', 'B':
+		return 'n', nil
+	case 'D', 'A':
+		return 'p', nil
+	}
+	return 0, nil
+}
+
+// edit lets the operator edit the payload of the current row out of raw
+// mode, and returns it.
+func (t *triage) edit(r *triageRow) (string, error) {
+	fmt.Fprint(t.out, "\x1b[?1049l")
+	t.out.Flush()
+	term.Restore(t.fd, t.state)
+	defer func() {
+		t.state, _ = term.MakeRaw(t.fd)
+		fmt.Fprint(t.out, "\x1b[?1049h")
+	}()
+	payload, err := editPayload(r.uid, r.payload)
+	if err != nil {
+		return "", err
+	}
+	return normalizePayload(payload)
+}
+
+func (t *triage) decide(key byte) error {
+	r := &t.rows[t.current]
+	if r.decision != "" {
+		t.message = fmt.Sprintf("%s already %s", r.uid, r.decision)
+		return nil
+	}
+	var err error
+	switch key {
+	case 'r':
+		if err = t.store.requeueEntry(r.uid, ""); err == nil {
+			r.decision = "requeued"
+		}
+	case 's':
+		if err = t.store.skipEntry(r.uid); err == nil {
+			r.decision = "skipped"
+		}
+	case 'e':
+		var payload string
+		if payload, err = t.edit(r); err == nil {
+			if err = t.store.requeueEntry(r.uid, payload); err == nil {
+				r.payload, r.decision = payload, "edited"
+			}
+		}
+	}
+	if err != nil {
+		t.message = fmt.Sprintf("failed: %s", err)
+		return nil
+	}
+	t.message = fmt.Sprintf("%s %s", r.uid, r.decision)
+	return t.move(1)
+}
+
+func (t *triage) move(delta int) error {
+	next := t.current + delta
+	if next < 0 {
+		return nil
+	}
+	ok, err := t.load(next)
+	if err != nil {
+		return err
+	}
+	if ok {
+		t.current = next
+	} else if t.message == "" {
+		t.message = "last entry"
+	}
+	return nil
+}
+
+func (t *triage) run() error {
+	var err error
+	if t.state, err = term.MakeRaw(t.fd); err != nil {
+		return fmt.Errorf("failed to set up terminal: %s", err)
+	}
+	fmt.Fprint(t.out, "\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+		t.out.Flush()
+		term.Restore(t.fd, t.state)
+	}()
+	in := bufio.NewReader(os.Stdin)
+	for {
+		t.draw()
+		t.message = ""
+		key, err := t.readKey(in)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case 'q', 3:
+			return nil
+		case 'n', ' ', 'j':
+			err = t.move(1)
+		case 'p', 'k':
+			err = t.move(-1)
+		case 'r', 's', 'e':
+			err = t.decide(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (t *triage) summary() map[string]int {
+	counts := make(map[string]int)
+	for _, r := range t.rows {
+		if r.decision != "" {
+			counts[r.decision]++
+		}
+	}
+	return counts
+}
+
+func runTriage(args []string) error {
+	fs := flag.NewFlagSet("triage", flag.ExitOnError)
+	commonFlags(fs)
+	inheritFlags(fs, "audit-file")
+	statuses := fs.String("status", "", "comma-separated HTTP statuses or ranges of statuses, e.g. 400-499")
+	classes := fs.String("class", "", "comma-separated error classes ("+strings.Join(errorClasses, ",")+")")
+	runID := fs.String("run", "", "only entries errored in this run id")
+	where := fs.String("where", "", "only entries matching this SQL condition on the imports table")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s triage [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := setupAudit("triage"); err != nil {
+		return err
+	}
+	defer closeAudit()
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("triage needs a terminal")
+	}
+
+	filter := &RequeueFilter{State: "errored", RunID: *runID, Where: *where}
+	var err error
+	if *statuses != "" {
+		if filter.Statuses, err = parseStatusRanges(*statuses); err != nil {
+			return err
+		}
+	}
+	if *classes != "" {
+		if filter.Classes, err = parseErrorClasses(*classes); err != nil {
+			return err
+		}
+	}
+
+	db, d, err := openDB(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	s := &sqlStore{db: db, dialect: d}
+	s.detectSchema()
+	defer s.Close()
+	condition, conditionArgs, err := filter.condition(s)
+	if err != nil {
+		return err
+	}
+
+	t := &triage{store: s, condition: condition, args: conditionArgs, fd: fd, out: bufio.NewWriter(os.Stdout)}
+	if err := s.db.QueryRow(d.rebind("SELECT COUNT(*) FROM imports WHERE "+condition), conditionArgs...).Scan(&t.total); err != nil {
+		return fmt.Errorf("failed to count errored entries: %s", err)
+	}
+	if ok, err := t.load(0); err != nil {
+		return fmt.Errorf("failed to fetch errored entries: %s", err)
+	} else if !ok {
+		logInfo(nil, "no errored entries to triage")
+		return nil
+	}
+	if err := t.run(); err != nil {
+		return err
+	}
+	counts := t.summary()
+	logInfo(Fields{"requeued": counts["requeued"], "edited": counts["edited"], "skipped": counts["skipped"]},
+		"%d entries requeued, %d edited and requeued, %d skipped", counts["requeued"], counts["edited"], counts["skipped"])
+	return nil
+}
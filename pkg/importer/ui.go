@@ -0,0 +1,262 @@
+package importer
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+var argUI = Flags.String("ui", "", "address to serve a web dashboard of the run on, with pause, resume and reload buttons (e.g. :8080)")
+
+const (
+	// recentErrorCount is the number of errors kept for the dashboard feed.
+	recentErrorCount = 50
+	// throughputMinutes is the number of minutes shown by the dashboard
+	// throughput graph.
+	throughputMinutes = 60
+)
+
+// ErrorEvent is an errored entry, as shown in the dashboard error feed.
+type ErrorEvent struct {
+	Time   string `json:"time"`
+	UID    string `json:"uid"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// DashboardStatus is the state of a run served by the dashboard.
+type DashboardStatus struct {
+	RunID      string           `json:"run_id,omitempty"`
+	Instance   string           `json:"instance"`
+	Paused     bool             `json:"paused"`
+	Total      int              `json:"total"`
+	Imported   int              `json:"imported"`
+	Skipped    int              `json:"skipped"`
+	Duplicate  int              `json:"duplicate"`
+	Aborted    int              `json:"aborted"`
+	Errored    int              `json:"errored"`
+	Remaining  int              `json:"remaining"`
+	Errors     map[string]int   `json:"errors"`
+	Statuses   map[string]int64 `json:"http_statuses"`
+	Rate       float64          `json:"entries_per_second"`
+	ElapsedMS  int64            `json:"elapsed_ms"`
+	Throughput []int            `json:"entries_per_minute"`
+	Recent     []ErrorEvent     `json:"recent_errors"`
+	Stages     []StageStatus    `json:"stages"`
+}
+
+// recordError adds e to the error feed, under the lock of p.
+func (p *progress) recordError(e *Entry, status string) {
+	message := ""
+	if e.Err != nil {
+		message = e.Err.Error()
+	}
+	if len(message) > 500 {
+		message = message[:500] + "..."
+	}
+	p.recent = append(p.recent, ErrorEvent{
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		UID:    e.UID,
+		Status: status,
+		Error:  message,
+	})
+	if len(p.recent) > recentErrorCount {
+		p.recent = p.recent[len(p.recent)-recentErrorCount:]
+	}
+}
+
+func (p *progress) dashboard() *DashboardStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elapsed := time.Since(p.start)
+	s := &DashboardStatus{
+		Total:     p.total,
+		Imported:  p.imported,
+		Skipped:   p.skipped,
+		Duplicate: p.duplicate,
+		Aborted:   p.aborted,
+		Errored:   p.errored(),
+		Remaining: p.remaining(),
+		Errors:    make(map[string]int, len(p.errors)),
+		ElapsedMS: elapsed.Milliseconds(),
+	}
+	for status, count := range p.errors {
+		s.Errors[status] = count
+	}
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		s.Rate = float64(p.imported+p.duplicate+s.Errored) / seconds
+	}
+	minutes := append([]int{}, p.latency.minutes...)
+	for len(minutes) <= int(elapsed/time.Minute) {
+		minutes = append(minutes, 0)
+	}
+	if len(minutes) > throughputMinutes {
+		minutes = minutes[len(minutes)-throughputMinutes:]
+	}
+	s.Throughput = minutes
+	// The feed is served latest first.
+	s.Recent = make([]ErrorEvent, len(p.recent))
+	for i, event := range p.recent {
+		s.Recent[len(p.recent)-1-i] = event
+	}
+	return s
+}
+
+func (m *metrics) statusCounts() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]int64, len(m.statuses))
+	for status, count := range m.statuses {
+		counts[status] = count
+	}
+	return counts
+}
+
+// Status returns the state of the run, as served by the dashboard.
+func (im *Importer) Status() *DashboardStatus {
+	s := &DashboardStatus{}
+	if im.progress != nil {
+		s = im.progress.dashboard()
+	}
+	if im.run != nil {
+		s.RunID = im.run.ID
+	}
+	s.Instance = im.instance
+	s.Paused = im.Paused()
+	s.Statuses = importMetrics.statusCounts()
+	s.Stages = stageStatuses()
+	return s
+}
+
+// serveUI serves the dashboard of im on addr until the returned server is
+// closed.
+func serveUI(im *Importer, addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(dashboardHTML))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(im.Status())
+	})
+	mux.HandleFunc("/pause", uiAction(im.Pause))
+	mux.HandleFunc("/resume", uiAction(im.Resume))
+	mux.HandleFunc("/reload", uiAction(im.Reload))
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logError(Fields{"error": err}, "dashboard server stopped: %s", err)
+		}
+	}()
+	return server, nil
+}
+
+// uiAction wraps a dashboard button action, which must be POSTed.
+func uiAction(action func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		action()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Gaia responses importer</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+.counters { display: flex; flex-wrap: wrap; gap: 1em; margin: 1em 0; }
+.counter { border: 1px solid #ddd; border-radius: 4px; padding: .6em 1em; min-width: 7em; }
+.counter b { display: block; font-size: 1.6em; }
+.bar { background: #eee; height: 1em; border-radius: 4px; overflow: hidden; }
+.bar div { background: #4a8; height: 100%; }
+table { border-collapse: collapse; font-size: .9em; }
+td, th { border-bottom: 1px solid #eee; padding: .3em .8em; text-align: left; vertical-align: top; }
+#paused { color: #c60; font-weight: bold; }
+svg rect { fill: #48c; }
+</style>
+</head>
+<body>
+<h1>Gaia responses importer <span id="paused"></span></h1>
+<p id="run"></p>
+<div class="bar"><div id="bar" style="width: 0"></div></div>
+<p id="line"></p>
+<p><button id="pause">Pause</button> <button id="resume">Resume</button> <button id="reload">Reload settings</button></p>
+<div class="counters" id="counters"></div>
+<h2>Throughput (entries per minute)</h2>
+<svg id="graph" width="600" height="120"></svg>
+<h2>Errors by status</h2>
+<table id="errors"></table>
+<h2>HTTP statuses</h2>
+<table id="statuses"></table>
+<h2>Recent errors</h2>
+<table id="recent"></table>
+<script>
+function text(s) {
+  var d = document.createElement("div");
+  d.textContent = s;
+  return d.innerHTML;
+}
+function rows(counts) {
+  return Object.keys(counts).sort().map(function (k) {
+    return "<tr><td>" + text(k) + "</td><td>" + counts[k] + "</td></tr>";
+  }).join("");
+}
+function render(s) {
+  var processed = s.imported + s.skipped + s.duplicate + s.aborted + s.errored;
+  var percent = s.total > 0 ? Math.min(100, processed * 100 / s.total) : 0;
+  document.getElementById("paused").textContent = s.paused ? "(paused)" : "";
+  document.getElementById("run").textContent = (s.run_id ? "run " + s.run_id + " on " : "") + s.instance +
+    ", running for " + Math.round(s.elapsed_ms / 1000) + "s";
+  document.getElementById("bar").style.width = percent + "%";
+  document.getElementById("line").textContent = processed + "/" + s.total + " (" + percent.toFixed(1) + "%), " +
+    s.entries_per_second.toFixed(1) + "/s";
+  document.getElementById("counters").innerHTML = ["imported", "errored", "duplicate", "skipped", "aborted", "remaining"].map(function (k) {
+    return "<div class=\"counter\">" + k + "<b>" + s[k] + "</b></div>";
+  }).join("");
+  var graph = document.getElementById("graph"), minutes = s.entries_per_minute;
+  var max = Math.max.apply(null, minutes.concat([1])), width = 600 / Math.max(minutes.length, 1);
+  graph.innerHTML = minutes.map(function (n, i) {
+    var h = n * 110 / max;
+    return "<rect x=\"" + i * width + "\" y=\"" + (120 - h) + "\" width=\"" + Math.max(width - 1, 1) + "\" height=\"" + h + "\"><title>" + n + "</title></rect>";
+  }).join("");
+  document.getElementById("errors").innerHTML = rows(s.errors);
+  document.getElementById("statuses").innerHTML = rows(s.http_statuses);
+  document.getElementById("recent").innerHTML = s.recent_errors.map(function (e) {
+    return "<tr><td>" + text(e.time) + "</td><td>" + text(e.uid) + "</td><td>" + text(e.status) + "</td><td>" + text(e.error) + "</td></tr>";
+  }).join("");
+}
+function refresh() {
+  fetch("status").then(function (r) { return r.json(); }).then(render).catch(function () {
+    document.getElementById("paused").textContent = "(disconnected)";
+  });
+}
+function post(action) {
+  fetch(action, {method: "POST"}).then(refresh);
+}
+document.getElementById("pause").onclick = function () { post("pause"); };
+document.getElementById("resume").onclick = function () { post("resume"); };
+document.getElementById("reload").onclick = function () { post("reload"); };
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
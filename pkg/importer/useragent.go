@@ -0,0 +1,44 @@
+package importer
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Version is the version of the importer, set at build time with
+// -ldflags "-X github.com/critizr/gaia-responses-importer/pkg/importer.Version=1.2.0".
+var Version = "dev"
+
+var (
+	argUserAgent         = Flags.String("user-agent", "", "User-Agent header of API requests, where {version} and {run_id} are replaced (default gaia-responses-importer/{version} (run {run_id}))")
+	argCorrelationHeader = Flags.String("correlation-header", "X-Correlation-Id", "header carrying a random identifier of each import request, stored in the correlation_id column (empty disables)")
+)
+
+var userAgent = "gaia-responses-importer/" + Version
+
+// setupUserAgent sets the User-Agent of API requests for the run runID, if
+// any.
+func setupUserAgent(runID string) {
+	template := *argUserAgent
+	if template == "" {
+		template = "gaia-responses-importer/{version}"
+		if runID != "" {
+			template += " (run {run_id})"
+		}
+	}
+	userAgent = strings.NewReplacer("{version}", Version, "{run_id}", runID).Replace(template)
+}
+
+// setCorrelationID sets a new correlation identifier on req and returns it,
+// empty without -correlation-header.
+func setCorrelationID(req *http.Request) (string, error) {
+	if *argCorrelationHeader == "" {
+		return "", nil
+	}
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(*argCorrelationHeader, id)
+	return id, nil
+}
@@ -0,0 +1,33 @@
+package importer
+
+import (
+	"net/http"
+)
+
+var argAuthTokenHeader = Flags.String("auth-token-header", "", "`header` the auth_token column of an entry is sent in: the -auth-header replaces the credentials of the run, with their prefix, another header, e.g. an impersonation one, is sent as is along with them (default: the -auth-header)")
+
+// setAuthToken sends the request of e as the user of its auth_token column,
+// if it has one.
+func (e *Entry) setAuthToken(req *http.Request) {
+	if e.AuthToken == "" {
+		return
+	}
+	header := authTokenHeader()
+	if header != http.CanonicalHeaderKey(*argAuthHeader) {
+		req.Header.Set(header, e.AuthToken)
+		return
+	}
+	req.Header.Set(header, flagAuthSettings().tokenPrefix()+e.AuthToken)
+}
+
+// authTokenHeader returns the header of the auth_token column.
+func authTokenHeader() string {
+	if *argAuthTokenHeader == "" {
+		return http.CanonicalHeaderKey(*argAuthHeader)
+	}
+	return http.CanonicalHeaderKey(*argAuthTokenHeader)
+}
+
+func setupAuthTokenHeader() {
+	redactedHeaders[authTokenHeader()] = true
+}
@@ -0,0 +1,164 @@
+package importer
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+func (s *sqlStore) FetchToVerify(after string, limit int, all bool) ([]Entry, error) {
+	query := "SELECT uid, response_id, tenant FROM imports WHERE response_id IS NOT NULL AND COALESCE(" + s.col("operation") + ", 'create') <> 'delete' AND uid > ?"
+	if !all {
+		query += " AND verified_at IS NULL"
+	}
+	rows, err := s.query(query+" ORDER BY uid LIMIT ?", after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		var entry Entry
+		var tenant sql.NullString
+		if err := rows.Scan(&entry.UID, &entry.ResponseId, &tenant); err != nil {
+			return nil, err
+		}
+		entry.Tenant = tenant.String
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqlStore) MarkVerified(e *Entry, verifyErr error) error {
+	var message *string
+	if verifyErr != nil {
+		m := verifyErr.Error()
+		message = &m
+	}
+	_, err := s.exec("UPDATE imports SET verified_at = ?, verify_error = ? WHERE uid = ?",
+		time.Now().UTC().Format(time.RFC3339), message, e.UID)
+	return err
+}
+
+// verify checks that the response created for e exists in Gaia.
+func (e *Entry) verify() error {
+	api, err := e.endpoint()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", api.url+"/responses/"+url.PathEscape(*e.ResponseId), nil)
+	if err != nil {
+		return err
+	}
+	if err := api.authorize(req); err != nil {
+		return err
+	}
+	resp, _, err := api.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case 200:
+	case 404:
+		return errors.New("response not found")
+	default:
+		return &APIError{resp.StatusCode, string(body)}
+	}
+	id, ok, err := extractResponseID(body)
+	if err != nil {
+		return &ParseError{string(body)}
+	}
+	if ok && id != *e.ResponseId {
+		return fmt.Errorf("response ID mismatch: got %s", id)
+	}
+	return nil
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	commonFlags(fs)
+	apiFlags(fs)
+	inheritFlags(fs, "j", "page-size", "response-id-path")
+	all := fs.Bool("all", false, "verify again entries that were already verified")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := setupTenants(); err != nil {
+		return err
+	}
+	if err := setupAPI(*argConcurrency); err != nil {
+		return err
+	}
+	defer spans.Close()
+
+	store, err := openStore(*argDb)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	defer store.Close()
+
+	queue := make(chan Entry, *argPageSize)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	verified, failed := 0, 0
+	for i := 0; i < *argConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range queue {
+				verifyErr := entry.verify()
+				if verifyErr != nil {
+					logError(Fields{"uid": entry.UID, "response_id": *entry.ResponseId, "error": verifyErr}, "entry %s failed verification: %s", entry.UID, verifyErr)
+				}
+				if err := store.MarkVerified(&entry, verifyErr); err != nil {
+					logError(Fields{"uid": entry.UID, "error": err}, "failed to mark verification for entry %s: %s", entry.UID, err)
+				}
+				mu.Lock()
+				if verifyErr != nil {
+					failed++
+				} else {
+					verified++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	after := ""
+	for {
+		page, err := store.FetchToVerify(after, *argPageSize, *all)
+		if err != nil {
+			close(queue)
+			wg.Wait()
+			return fmt.Errorf("failed to fetch data: %s", err)
+		}
+		for _, entry := range page {
+			queue <- entry
+		}
+		if len(page) < *argPageSize {
+			break
+		}
+		after = page[len(page)-1].UID
+	}
+	close(queue)
+	wg.Wait()
+
+	logInfo(Fields{"verified": verified, "failed": failed}, "%d responses verified, %d failed verification", verified, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d responses failed verification", failed)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package importer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var argWindow = Flags.String("window", "", "only schedule entries between these local times, e.g. 22:00-06:00 (waits outside of it)")
+
+// timeWindow is a daily window of local time, from start to end minutes
+// after midnight; it spans midnight when end is before start.
+type timeWindow struct {
+	start, end int
+
+	mu      sync.Mutex
+	waiting bool
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseWindow(s string) (*timeWindow, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", s)
+	}
+	start, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("invalid window %q, start and end are the same", s)
+	}
+	return &timeWindow{start: start, end: end}, nil
+}
+
+func (w *timeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+// untilOpen returns how long to wait from now for the window to open, 0 if
+// it is open.
+func (w *timeWindow) untilOpen(now time.Time) time.Duration {
+	minute := now.Hour()*60 + now.Minute()
+	open := minute >= w.start && minute < w.end
+	if w.end < w.start {
+		open = minute >= w.start || minute < w.end
+	}
+	if open {
+		return 0
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	start := midnight.Add(time.Duration(w.start) * time.Minute)
+	if !start.After(now) {
+		start = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()).Add(time.Duration(w.start) * time.Minute)
+	}
+	return start.Sub(now)
+}
+
+// wait blocks while outside of the window, and reports false if stop is
+// closed first.
+func (w *timeWindow) wait(stop <-chan struct{}) bool {
+	if w == nil {
+		return true
+	}
+	for {
+		delay := w.untilOpen(time.Now())
+		w.mu.Lock()
+		switch {
+		case delay == 0 && w.waiting:
+			w.waiting = false
+			logInfo(Fields{"window": w.String()}, "import window %s opened, resuming", w)
+		case delay > 0 && !w.waiting:
+			w.waiting = true
+			opens := time.Now().Add(delay)
+			logInfo(Fields{"window": w.String(), "opens_at": opens.Format(time.RFC3339)},
+				"outside of the import window %s, waiting until %s", w, opens.Format("2006-01-02 15:04"))
+		}
+		w.mu.Unlock()
+		if delay == 0 {
+			return true
+		}
+		// Wake up at least every minute, in case of clock or DST changes.
+		if delay > time.Minute {
+			delay = time.Minute
+		}
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return false
+		}
+	}
+}
+
+func setupWindow() (*timeWindow, error) {
+	if *argWindow == "" {
+		return nil, nil
+	}
+	return parseWindow(*argWindow)
+}
@@ -0,0 +1,135 @@
+package importer
+
+import (
+	"time"
+)
+
+const (
+	statusRetries    = 5
+	statusRetryDelay = 200 * time.Millisecond
+)
+
+var (
+	argStatusBatch    = Flags.Int("status-batch", 100, "maximum number of status updates written in one transaction")
+	argStatusInterval = Flags.Duration("status-interval", 0, "time status updates are held for to be written together, up to -status-batch of them (0 writes whatever has queued up at once)")
+)
+
+// statusWriter funnels the status updates of all workers through a single
+// goroutine, writing whatever has queued up in one transaction, or with
+// -status-interval what queued up during that time.
+type statusWriter struct {
+	store    Store
+	runID    string
+	batch    int
+	interval time.Duration
+	updates  chan StatusUpdate
+	flushes  chan chan struct{}
+	done     chan struct{}
+}
+
+func newStatusWriter(store Store, runID string) *statusWriter {
+	batch := *argStatusBatch
+	if batch < 1 {
+		batch = 1
+	}
+	queue := *argStatusQueue
+	if queue < 1 {
+		queue = batch
+	}
+	w := &statusWriter{
+		store:    store,
+		runID:    runID,
+		batch:    batch,
+		interval: *argStatusInterval,
+		updates:  make(chan StatusUpdate, queue),
+		flushes:  make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *statusWriter) markImported(e *Entry) {
+	persistStage.queue(1)
+	w.updates <- StatusUpdate{Entry: *e, Imported: true, RunID: w.runID}
+}
+
+func (w *statusWriter) markErrored(e *Entry) {
+	persistStage.queue(1)
+	w.updates <- StatusUpdate{Entry: *e, RunID: w.runID}
+}
+
+func (w *statusWriter) run() {
+	defer close(w.done)
+	var pending []StatusUpdate
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case update, ok := <-w.updates:
+			if !ok {
+				w.write(pending)
+				return
+			}
+			pending = append(pending, update)
+			for len(pending) < w.batch && len(w.updates) > 0 {
+				pending = append(pending, <-w.updates)
+			}
+			if tick == nil || len(pending) >= w.batch {
+				w.write(pending)
+				pending = pending[:0]
+			}
+		case <-tick:
+			w.write(pending)
+			pending = pending[:0]
+		case ack := <-w.flushes:
+			for len(w.updates) > 0 {
+				pending = append(pending, <-w.updates)
+			}
+			w.write(pending)
+			pending = pending[:0]
+			close(ack)
+		}
+	}
+}
+
+// write persists updates, retrying the transaction on failure and falling
+// back to one transaction per update as a last resort.
+func (w *statusWriter) write(updates []StatusUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+	persistStage.queue(-len(updates))
+	start := persistStage.begin()
+	defer persistStage.end(start, len(updates))
+	var err error
+	for attempt := 0; attempt < statusRetries; attempt++ {
+		if err = w.store.WriteStatus(updates); err == nil {
+			return
+		}
+		time.Sleep(statusRetryDelay << uint(attempt))
+	}
+	logError(Fields{"count": len(updates), "error": err}, "failed to write %d status updates, retrying one by one: %s", len(updates), err)
+	for _, update := range updates {
+		if err := w.store.WriteStatus([]StatusUpdate{update}); err != nil {
+			logError(Fields{"uid": update.Entry.UID, "error": err}, "failed to mark status of entry %s: %s", update.Entry.UID, err)
+		}
+	}
+}
+
+// Flush returns once every update queued before the call is persisted.
+func (w *statusWriter) Flush() {
+	ack := make(chan struct{})
+	w.flushes <- ack
+	<-ack
+}
+
+// Close persists the remaining updates and stops the writer.
+func (w *statusWriter) Close() {
+	close(w.updates)
+	<-w.done
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/critizr/gaia-responses-importer/pkg/importer"
+)
+
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// handleControls pauses the run on SIGUSR1, resumes it on SIGUSR2, reloads
+// its settings on SIGHUP and dumps its state to stderr on SIGQUIT.
+func handleControls(im *importer.Importer) {
+	controls := make(chan os.Signal, 1)
+	signal.Notify(controls, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGQUIT)
+	go func() {
+		for sig := range controls {
+			switch sig {
+			case syscall.SIGUSR1:
+				im.Pause()
+			case syscall.SIGUSR2:
+				im.Resume()
+			case syscall.SIGQUIT:
+				im.DumpState(os.Stderr)
+			default:
+				im.Reload()
+			}
+		}
+	}()
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/critizr/gaia-responses-importer/pkg/importer"
+)
+
+// SIGTERM is delivered when the console is closed, or on logoff and
+// shutdown, which leave a few seconds to stop.
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// handleControls does nothing, Windows has no user signals: runs are
+// paused and their settings reloaded from the -ui dashboard instead.
+func handleControls(im *importer.Importer) {}